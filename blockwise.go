@@ -0,0 +1,489 @@
+package coap
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrInvalidBlockSize is returned for block sizes other than the
+// powers of two from 16 to 1024.
+var ErrInvalidBlockSize = errors.New("invalid block size")
+
+// ErrBlockMismatch is returned when the blocks of a response don't
+// fit together, such as when the representation changed midway.
+var ErrBlockMismatch = errors.New("blocks of the response don't match")
+
+// BlockOption is the value of a Block1 or Block2 option (RFC 7959
+// section 2.2).
+type BlockOption struct {
+	// Num is the number of the block within the transfer.
+	Num uint32
+	// More is set if more blocks follow.
+	More bool
+	// Size is the block size, a power of two from 16 to 1024.
+	Size int
+}
+
+// szx returns the size exponent encoding b.Size.
+func (b BlockOption) szx() (uint32, error) {
+	for szx := uint32(0); szx < 7; szx++ {
+		if 16<<szx == b.Size {
+			return szx, nil
+		}
+	}
+	return 0, ErrInvalidBlockSize
+}
+
+// Offset returns the position of the block's first byte in the
+// whole body.
+func (b BlockOption) Offset() int {
+	return int(b.Num) * b.Size
+}
+
+// Value returns the option value encoding b.
+func (b BlockOption) Value() (uint32, error) {
+	szx, err := b.szx()
+	if err != nil {
+		return 0, err
+	}
+	v := b.Num<<4 | szx
+	if b.More {
+		v |= 1 << 3
+	}
+	return v, nil
+}
+
+// ParseBlock decodes a Block1 or Block2 option value.
+func ParseBlock(v uint32) (BlockOption, error) {
+	szx := v & 0x7
+	if szx == 7 {
+		return BlockOption{}, ErrInvalidBlockSize
+	}
+	return BlockOption{
+		Num:  v >> 4,
+		More: v&(1<<3) != 0,
+		Size: 16 << szx,
+	}, nil
+}
+
+func (m Message) block(o OptionID) (BlockOption, bool) {
+	v, ok := m.Option(o).(uint32)
+	if !ok {
+		return BlockOption{}, false
+	}
+	b, err := ParseBlock(v)
+	return b, err == nil
+}
+
+func (m *Message) setBlock(o OptionID, b BlockOption) error {
+	v, err := b.Value()
+	if err != nil {
+		return err
+	}
+	m.SetOption(o, v)
+	return nil
+}
+
+// Block1 returns the message's Block1 option, if it has a valid one.
+func (m Message) Block1() (BlockOption, bool) {
+	return m.block(Block1)
+}
+
+// SetBlock1 sets the message's Block1 option.
+func (m *Message) SetBlock1(b BlockOption) error {
+	return m.setBlock(Block1, b)
+}
+
+// Block2 returns the message's Block2 option, if it has a valid one.
+func (m Message) Block2() (BlockOption, bool) {
+	return m.block(Block2)
+}
+
+// SetBlock2 sets the message's Block2 option.
+func (m *Message) SetBlock2(b BlockOption) error {
+	return m.setBlock(Block2, b)
+}
+
+// DefaultBlockwiseTimeout is how long a server keeps the state of a
+// blockwise transfer after its last block, EXCHANGE_LIFETIME (RFC
+// 7252 section 4.8.2).
+const DefaultBlockwiseTimeout = ExchangeLifetime
+
+// DefaultMaxBodySize is the largest request body a server receives
+// in blocks unless configured otherwise.
+const DefaultMaxBodySize = 1 << 20
+
+// DefaultMaxBlockwiseTransfers and DefaultMaxBlockwiseTransfersPerPeer
+// are how many blockwise transfers a server keeps at once, in total
+// and for each client, unless configured otherwise.
+const (
+	DefaultMaxBlockwiseTransfers        = 1024
+	DefaultMaxBlockwiseTransfersPerPeer = 16
+)
+
+// maxBlockSize is the largest block size, and the default one.
+const maxBlockSize = 1024
+
+// A transfer is the state of a blockwise transfer in progress on a
+// server: the request body received so far, or the response being
+// sent.
+type transfer struct {
+	peer  string
+	body  []byte
+	resp  Message
+	timer *time.Timer
+}
+
+// transferKey names the transfer of the body of r's request (Block1)
+// or response (Block2): the client and the request URI.
+func transferKey(opt OptionID, r *Request) string {
+	return fmt.Sprintf("%d|%v|%v|%v?%v", opt, r.Addr, r.Msg.Code,
+		r.Msg.EscapedPath(), r.Msg.EscapedQuery())
+}
+
+// blockSize is the block size of responses the client didn't ask
+// for a size for.
+func (s *Server) blockSize() int {
+	if s.BlockSize > 0 {
+		return s.BlockSize
+	}
+	return maxBlockSize
+}
+
+func (s *Server) maxBodySize() int {
+	if s.MaxBodySize > 0 {
+		return s.MaxBodySize
+	}
+	return DefaultMaxBodySize
+}
+
+func (s *Server) blockwiseTimeout() time.Duration {
+	if s.BlockwiseTimeout > 0 {
+		return s.BlockwiseTimeout
+	}
+	return DefaultBlockwiseTimeout
+}
+
+// transfer returns the transfer named by key and postpones its
+// expiry, or returns nil.
+func (s *Server) transfer(key string) *transfer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t := s.transfers[key]
+	if t != nil {
+		t.timer.Reset(s.blockwiseTimeout())
+	}
+	return t
+}
+
+// startTransfer records t as the transfer named by key, replacing
+// any other, until it ends or expires.  It tells whether it did: one
+// that replaces none isn't recorded beyond the server's limits.
+func (s *Server) startTransfer(key string, t *transfer) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.transfers == nil {
+		s.transfers = map[string]*transfer{}
+		s.peerTransfers = map[string]int{}
+	}
+	if old := s.transfers[key]; old != nil {
+		s.dropTransfer(key, old)
+	} else if len(s.transfers) >= s.maxBlockwiseTransfers() ||
+		s.peerTransfers[t.peer] >= s.maxBlockwiseTransfersPerPeer() {
+		return false
+	}
+	t.timer = time.AfterFunc(s.blockwiseTimeout(), func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.transfers[key] == t {
+			s.dropTransfer(key, t)
+		}
+	})
+	s.transfers[key] = t
+	s.peerTransfers[t.peer]++
+	return true
+}
+
+func (s *Server) endTransfer(key string, t *transfer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.transfers[key] == t {
+		s.dropTransfer(key, t)
+	}
+}
+
+// dropTransfer forgets t, the transfer named by key.  s.mu must be
+// held.
+func (s *Server) dropTransfer(key string, t *transfer) {
+	t.timer.Stop()
+	delete(s.transfers, key)
+	if s.peerTransfers[t.peer]--; s.peerTransfers[t.peer] <= 0 {
+		delete(s.peerTransfers, t.peer)
+	}
+}
+
+func (s *Server) maxBlockwiseTransfers() int {
+	if s.MaxBlockwiseTransfers > 0 {
+		return s.MaxBlockwiseTransfers
+	}
+	return DefaultMaxBlockwiseTransfers
+}
+
+func (s *Server) maxBlockwiseTransfersPerPeer() int {
+	if s.MaxBlockwiseTransfersPerPeer > 0 {
+		return s.MaxBlockwiseTransfersPerPeer
+	}
+	return DefaultMaxBlockwiseTransfersPerPeer
+}
+
+// BlockwiseTransfers returns the number of blockwise transfers in
+// progress.
+func (s *Server) BlockwiseTransfers() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.transfers)
+}
+
+// receiveBlock handles the Block1 and Block2 options of the request
+// r.  It returns false when it responded to r itself: to ask for the
+// next Block1, with a later Block2 of a response it kept, with 4.08
+// Request Entity Incomplete for a Block1 that doesn't continue a
+// transfer, because it's out of sequence or the transfer expired,
+// with 4.13 Request Entity Too Large for a body larger than the
+// server takes, or with 5.03 Service Unavailable for a Block1 that
+// would start more transfers than it keeps.  Otherwise r carries the
+// whole request body.
+func (s *Server) receiveBlock(r *Request) bool {
+	if b, ok := r.Msg.Block2(); ok && b.Num > 0 {
+		key := transferKey(Block2, r)
+		if t := s.transfer(key); t != nil && b.Offset() < len(t.body) {
+			m := t.resp
+			if !sliceBlock2(&m, b.Num, b.Size) {
+				s.endTransfer(key, t)
+			}
+			r.Respond(m)
+			return false
+		}
+		// Not kept, so the handler makes the response again.
+		return true
+	}
+
+	b, ok := r.Msg.Block1()
+	if !ok {
+		return true
+	}
+	limit := s.maxBodySize()
+	if size, ok := r.Msg.Option(Size1).(uint32); ok && b.Num == 0 && uint64(size) > uint64(limit) {
+		r.Respond(tooLarge(limit))
+		return false
+	}
+	body, err := s.addBlock1(transferKey(Block1, r), r.Addr.String(), b, r.Msg.Payload, limit)
+	switch {
+	case err == errBodyTooLarge:
+		r.Respond(tooLarge(limit))
+		return false
+	case err == errTooManyTransfers:
+		r.Respond(Message{Code: ServiceUnavailable})
+		return false
+	case err != nil:
+		r.Respond(Message{Code: RequestEntityIncomplete})
+		return false
+	case b.More:
+		rv := Message{Code: Continue}
+		rv.SetBlock1(b)
+		r.Respond(rv)
+		return false
+	}
+	r.Msg.Payload = body
+	r.Msg.RemoveOption(Block1)
+	r.block1 = &b
+	return true
+}
+
+// tooLarge is the 4.13 Request Entity Too Large response to a request
+// body larger than limit bytes, telling the client the limit.
+func tooLarge(limit int) Message {
+	m := Message{Code: RequestEntityTooLarge}
+	m.SetOption(Size1, uint32(limit))
+	return m
+}
+
+var (
+	errBlockOutOfSequence = errors.New("block out of sequence")
+	errBodyTooLarge       = errors.New("request body too large")
+	errTooManyTransfers   = errors.New("too many blockwise transfers")
+)
+
+// addBlock1 adds the block b with payload p to the request body of
+// the transfer named by key with the client at peer, starting it with
+// block zero.  Once the last block arrived, it ends the transfer and
+// returns the body.  It fails for a block that doesn't continue where
+// the previous one ended, for a first one the server has no room for,
+// and ends the transfer once the body grows past limit bytes.
+func (s *Server) addBlock1(key, peer string, b BlockOption, p []byte, limit int) ([]byte, error) {
+	var t *transfer
+	if b.Num == 0 {
+		t = &transfer{peer: peer}
+		if !s.startTransfer(key, t) && b.More {
+			return nil, errTooManyTransfers
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if t == nil {
+		t = s.transfers[key]
+		if t == nil || b.Offset() != len(t.body) {
+			return nil, errBlockOutOfSequence
+		}
+		t.timer.Reset(s.blockwiseTimeout())
+	}
+	over := len(t.body)+len(p) > limit
+	if !over {
+		t.body = append(t.body, p...)
+	}
+	if (over || !b.More) && s.transfers[key] == t {
+		s.dropTransfer(key, t)
+	}
+	if over {
+		return nil, errBodyTooLarge
+	}
+	return t.body, nil
+}
+
+// sendBlock2 cuts the block of the response m to r that the client
+// asked for, or the first one if m is too large for one block.  The
+// response is kept for the client's requests for the following
+// blocks.
+func (s *Server) sendBlock2(r *Request, m *Message) {
+	if m.Option(Block2) != nil {
+		return
+	}
+	b, ok := r.Msg.Block2()
+	if !ok || b.Num == 0 && b.Size > s.blockSize() {
+		b.Size = s.blockSize()
+	}
+	if b.Num == 0 && len(m.Payload) <= b.Size {
+		return
+	}
+	if b.Offset() >= len(m.Payload) {
+		*m = Message{Type: m.Type, Code: BadOption, MessageID: m.MessageID, Token: m.Token}
+		return
+	}
+	if b.Num == 0 {
+		s.startTransfer(transferKey(Block2, r), &transfer{
+			peer: r.Addr.String(),
+			body: m.Payload,
+			resp: *m,
+		})
+	}
+	sliceBlock2(m, b.Num, b.Size)
+}
+
+// sliceBlock2 cuts block num of size bytes out of m's payload, and
+// tells whether more follow.
+func sliceBlock2(m *Message, num uint32, size int) bool {
+	b := BlockOption{Num: num, Size: size}
+	body := m.Payload
+	end := b.Offset() + size
+	if end < len(body) {
+		b.More = true
+	} else {
+		end = len(body)
+	}
+	m.Payload = body[b.Offset():end]
+	m.SetBlock2(b)
+	return b.More
+}
+
+// sendBlock1 sends the request req with its payload in blocks,
+// moving on to the next block on each 2.31 Continue and switching to
+// smaller blocks if the server asks for them.  Any other response
+// ends the transfer and is returned.
+func (c *Conn) sendBlock1(ctx context.Context, req Message) (*Message, error) {
+	body := req.Payload
+	b := BlockOption{Size: c.blockSize}
+	for {
+		m := req
+		m.opts = append(options(nil), req.opts...)
+		if b.Num > 0 {
+			m.MessageID = c.nextMessageID()
+		}
+		end := b.Offset() + b.Size
+		b.More = end < len(body)
+		if !b.More {
+			end = len(body)
+		}
+		m.Payload = body[b.Offset():end]
+		if err := m.SetBlock1(b); err != nil {
+			return nil, err
+		}
+
+		rv, err := c.exchange(ctx, m)
+		if err != nil || !b.More || rv.Code != Continue {
+			return rv, err
+		}
+		if rb, ok := rv.Block1(); ok && rb.Size < b.Size {
+			b.Num = uint32(end / rb.Size)
+			b.Size = rb.Size
+		} else {
+			b.Num++
+		}
+	}
+}
+
+// fetchBlock2 gets the rest of the response rv to req, if it's the
+// first of several blocks, and returns it with the whole body.  The
+// requests for the following blocks repeat req without its Observe
+// option, and without its payload unless it's a FETCH, whose payload
+// is part of what selects the response (RFC 8132 section 2.3.2).
+func (c *Conn) fetchBlock2(ctx context.Context, req Message, rv *Message) (*Message, error) {
+	b, ok := rv.Block2()
+	if !ok || !b.More || b.Num != 0 {
+		return rv, nil
+	}
+	etag, _ := rv.Option(ETag).([]byte)
+	body := append([]byte(nil), rv.Payload...)
+
+	for b.More {
+		m := req
+		m.opts = append(options(nil), req.opts...)
+		m.RemoveOption(Observe)
+		m.RemoveOption(Block1)
+		m.MessageID = c.nextMessageID()
+		if req.Code != FETCH {
+			m.Payload = nil
+		}
+		m.SetBlock2(BlockOption{Num: uint32(len(body) / b.Size), Size: b.Size})
+
+		var next *Message
+		var err error
+		if len(m.Payload) > c.blockSize {
+			next, err = c.sendBlock1(ctx, m)
+		} else {
+			next, err = c.exchange(ctx, m)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if next.Code != rv.Code {
+			return next, nil
+		}
+		tag, _ := next.Option(ETag).([]byte)
+		nb, ok := next.Block2()
+		if !ok || nb.Offset() != len(body) || !bytes.Equal(tag, etag) {
+			return nil, ErrBlockMismatch
+		}
+		body = append(body, next.Payload...)
+		b = nb
+	}
+
+	whole := *rv
+	whole.opts = append(options(nil), rv.opts...)
+	whole.RemoveOption(Block2)
+	whole.Payload = body
+	return &whole, nil
+}
@@ -0,0 +1,394 @@
+package coap
+
+import (
+	"bytes"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBlockValue(t *testing.T) {
+	tests := []struct {
+		b BlockOption
+		v uint32
+	}{
+		{BlockOption{Num: 0, More: false, Size: 16}, 0x00},
+		{BlockOption{Num: 0, More: true, Size: 1024}, 0x0e},
+		{BlockOption{Num: 3, More: true, Size: 64}, 0x3a},
+		{BlockOption{Num: 1 << 19, More: false, Size: 512}, 1<<23 | 0x05},
+	}
+
+	for _, test := range tests {
+		v, err := test.b.Value()
+		if err != nil || v != test.v {
+			t.Errorf("Expected %+v to encode as %#x, got %#x, %v", test.b, test.v, v, err)
+		}
+		b, err := ParseBlock(test.v)
+		if err != nil || b != test.b {
+			t.Errorf("Expected %#x to decode as %+v, got %+v, %v", test.v, test.b, b, err)
+		}
+	}
+
+	if _, err := (BlockOption{Size: 100}).Value(); err != ErrInvalidBlockSize {
+		t.Errorf("Expected ErrInvalidBlockSize for size 100, got %v", err)
+	}
+	if _, err := ParseBlock(0x7); err != ErrInvalidBlockSize {
+		t.Errorf("Expected ErrInvalidBlockSize for SZX 7, got %v", err)
+	}
+}
+
+func TestMessageBlockOptions(t *testing.T) {
+	m := Message{Type: Confirmable, Code: GET, MessageID: 1}
+	if err := m.SetBlock2(BlockOption{Num: 2, Size: 256}); err != nil {
+		t.Fatalf("Error setting Block2: %v", err)
+	}
+	if err := m.SetBlock1(BlockOption{Num: 5, More: true, Size: 32}); err != nil {
+		t.Fatalf("Error setting Block1: %v", err)
+	}
+	m.SetOption(Size2, uint32(4096))
+
+	data, err := m.MarshalBinary()
+	if err != nil {
+		t.Fatalf("Error encoding: %v", err)
+	}
+	got, err := ParseMessage(data)
+	if err != nil {
+		t.Fatalf("Error parsing: %v", err)
+	}
+
+	if b, ok := got.Block2(); !ok || b != (BlockOption{Num: 2, Size: 256}) {
+		t.Errorf("Unexpected Block2: %+v, %v", b, ok)
+	}
+	if b, ok := got.Block1(); !ok || b != (BlockOption{Num: 5, More: true, Size: 32}) || b.Offset() != 160 {
+		t.Errorf("Unexpected Block1: %+v, %v", b, ok)
+	}
+	if got.Option(Size2) != uint32(4096) {
+		t.Errorf("Expected Size2 4096, got %v", got.Option(Size2))
+	}
+}
+
+func TestServeBlockwise(t *testing.T) {
+	l, addr := startUDPLisenter(t)
+	defer l.Close()
+	s := &Server{
+		Handler: FuncHandler(func(l *net.UDPConn, a *net.UDPAddr, m *Message) *Message {
+			return &Message{
+				Type:      Acknowledgement,
+				Code:      Changed,
+				MessageID: m.MessageID,
+				Token:     m.Token,
+				Payload:   bytes.Repeat(m.Payload, 2),
+			}
+		}),
+		BlockwiseTimeout: 50 * time.Millisecond,
+	}
+	go s.Serve(l)
+
+	c, err := Dial("udp", addr)
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	defer c.Close()
+
+	body := bytes.Repeat([]byte("0123456789abcdef"), 80) // 1280 bytes
+	send := func(b BlockOption, opt OptionID) *Message {
+		req := Message{
+			Type:      Confirmable,
+			Code:      PUT,
+			MessageID: c.nextMessageID(),
+			Token:     c.session.NextToken(),
+		}
+		req.SetPathString("/upload")
+		if opt == Block1 {
+			end := b.Offset() + b.Size
+			if end > len(body) {
+				end = len(body)
+			}
+			req.Payload = body[b.Offset():end]
+			req.SetBlock1(b)
+		} else {
+			req.SetBlock2(b)
+		}
+		rv, err := c.Send(req)
+		if err != nil {
+			t.Fatalf("Error sending block %+v: %v", b, err)
+		}
+		return rv
+	}
+
+	// An upload in 512 byte blocks, whose response comes back in
+	// 1024 byte blocks, put together by Send.
+	for num := uint32(0); num < 3; num++ {
+		rv := send(BlockOption{Num: num, More: num < 2, Size: 512}, Block1)
+		if num < 2 {
+			if rv.Code != Continue {
+				t.Fatalf("Block %v: expected Continue, got %v", num, rv.Code)
+			}
+			continue
+		}
+		if rv.Code != Changed {
+			t.Fatalf("Expected Changed, got %v", rv.Code)
+		}
+		if b, ok := rv.Block1(); !ok || b.Num != 2 {
+			t.Errorf("Expected Block1 echoed, got %v, %v", b, ok)
+		}
+		if _, ok := rv.Block2(); ok || !bytes.Equal(rv.Payload, bytes.Repeat(body, 2)) {
+			t.Errorf("Expected the whole response body, got %v bytes", len(rv.Payload))
+		}
+	}
+	// The response's blocks are forgotten once all were sent.
+	if n := s.BlockwiseTransfers(); n != 0 {
+		t.Errorf("Expected no transfers left, got %v", n)
+	}
+
+	// Out of sequence, and after the transfer expired.
+	if rv := send(BlockOption{Num: 0, More: true, Size: 512}, Block1); rv.Code != Continue {
+		t.Fatalf("Expected Continue, got %v", rv.Code)
+	}
+	if rv := send(BlockOption{Num: 2, More: false, Size: 512}, Block1); rv.Code != RequestEntityIncomplete {
+		t.Errorf("Expected RequestEntityIncomplete out of sequence, got %v", rv.Code)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := s.BlockwiseTransfers(); n != 0 {
+		t.Errorf("Expected the transfer to expire, %v left", n)
+	}
+	if rv := send(BlockOption{Num: 1, More: true, Size: 512}, Block1); rv.Code != RequestEntityIncomplete {
+		t.Errorf("Expected RequestEntityIncomplete after expiry, got %v", rv.Code)
+	}
+}
+
+func TestServeBlockwiseMaxBodySize(t *testing.T) {
+	l, addr := startUDPLisenter(t)
+	defer l.Close()
+	s := &Server{Handler: FuncHandler(contentHandler), MaxBodySize: 1000}
+	go s.Serve(l)
+
+	d := Dialer{BlockSize: 256}
+	c, err := d.Dial("udp", addr)
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	defer c.Close()
+
+	body := bytes.Repeat([]byte("0123456789abcdef"), 80) // 1280 bytes
+	rv, err := c.Send(Message{Type: Confirmable, Code: PUT, MessageID: 1, Payload: body})
+	if err != nil {
+		t.Fatalf("Error sending: %v", err)
+	}
+	if rv.Code != RequestEntityTooLarge || rv.Option(Size1) != uint32(1000) {
+		t.Errorf("Expected 4.13 with Size1 1000, got %v", rv)
+	}
+	if n := s.BlockwiseTransfers(); n != 0 {
+		t.Errorf("Expected the transfer dropped, %v left", n)
+	}
+
+	// Announced up front.
+	req := Message{Type: Confirmable, Code: PUT, MessageID: 2, Payload: body[:256]}
+	req.SetBlock1(BlockOption{Num: 0, More: true, Size: 256})
+	req.SetOption(Size1, uint32(len(body)))
+	if rv, err = c.Send(req); err != nil {
+		t.Fatalf("Error sending: %v", err)
+	}
+	if rv.Code != RequestEntityTooLarge || rv.Option(Size1) != uint32(1000) {
+		t.Errorf("Expected 4.13 with Size1 1000 for the announced size, got %v", rv)
+	}
+	if n := s.BlockwiseTransfers(); n != 0 {
+		t.Errorf("Expected no transfer started, %v left", n)
+	}
+}
+
+func TestServeBlockwiseTransferLimit(t *testing.T) {
+	l, addr := startUDPLisenter(t)
+	defer l.Close()
+	s := &Server{Handler: FuncHandler(contentHandler), MaxBlockwiseTransfersPerPeer: 1}
+	go s.Serve(l)
+
+	c, err := Dial("udp", addr)
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	defer c.Close()
+
+	first := func(mid uint16, path string) *Message {
+		req := Message{Type: Confirmable, Code: PUT, MessageID: mid, Payload: make([]byte, 16)}
+		req.SetPathString(path)
+		req.SetBlock1(BlockOption{Num: 0, More: true, Size: 16})
+		rv, err := c.Send(req)
+		if err != nil {
+			t.Fatalf("Error sending: %v", err)
+		}
+		return rv
+	}
+	if rv := first(1, "/a"); rv.Code != Continue {
+		t.Fatalf("Expected 2.31 Continue, got %v", rv)
+	}
+	if rv := first(2, "/b"); rv.Code != ServiceUnavailable {
+		t.Errorf("Expected 5.03 beyond the limit, got %v", rv)
+	}
+	// Restarting the same transfer replaces it.
+	if rv := first(3, "/a"); rv.Code != Continue {
+		t.Errorf("Expected 2.31 Continue restarting, got %v", rv)
+	}
+	if n := s.BlockwiseTransfers(); n != 1 {
+		t.Errorf("Expected 1 transfer, got %v", n)
+	}
+}
+
+func TestSendBlock1(t *testing.T) {
+	l, addr := startUDPLisenter(t)
+	defer l.Close()
+	var requests int32
+	go Serve(l, FuncHandler(func(l *net.UDPConn, a *net.UDPAddr, m *Message) *Message {
+		atomic.AddInt32(&requests, 1)
+		return &Message{
+			Type:      Acknowledgement,
+			Code:      Changed,
+			MessageID: m.MessageID,
+			Token:     m.Token,
+			Payload:   m.Payload,
+		}
+	}))
+
+	if _, err := (&Dialer{BlockSize: 100}).Dial("udp", addr); err != ErrInvalidBlockSize {
+		t.Errorf("Expected ErrInvalidBlockSize, got %v", err)
+	}
+	d := Dialer{BlockSize: 64}
+	c, err := d.Dial("udp", addr)
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	defer c.Close()
+
+	body := bytes.Repeat([]byte("x"), 300)
+	req := Message{
+		Type:      Confirmable,
+		Code:      POST,
+		MessageID: 1,
+		Token:     []byte("b1"),
+		Payload:   body,
+	}
+	req.SetPathString("/upload")
+	rv, err := c.Send(req)
+	if err != nil {
+		t.Fatalf("Error sending: %v", err)
+	}
+	if rv.Code != Changed || !bytes.Equal(rv.Payload, body) {
+		t.Errorf("Expected the whole body echoed, got %v with %v bytes", rv.Code, len(rv.Payload))
+	}
+	if b, ok := rv.Block1(); !ok || b.Num != 4 || b.More {
+		t.Errorf("Expected the last Block1 echoed, got %+v, %v", b, ok)
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("Expected the handler called once, got %v", n)
+	}
+}
+
+func TestSendBlock2(t *testing.T) {
+	body := bytes.Repeat([]byte("0123456789"), 50)
+	var version int32
+	l, addr := startUDPLisenter(t)
+	defer l.Close()
+	go Serve(l, FuncHandler(func(l *net.UDPConn, a *net.UDPAddr, m *Message) *Message {
+		rv := &Message{
+			Type:      Acknowledgement,
+			Code:      Content,
+			MessageID: m.MessageID,
+			Token:     m.Token,
+		}
+		b, _ := m.Block2()
+		if b.Size == 0 {
+			b.Size = 128
+		}
+		rv.Payload = body
+		sliceBlock2(rv, b.Num, b.Size)
+		rv.SetOption(ETag, []byte{byte(atomic.LoadInt32(&version))})
+		return rv
+	}))
+
+	c, err := Dial("udp", addr)
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	defer c.Close()
+
+	req := Message{Type: Confirmable, Code: GET, MessageID: 1, Token: []byte("b2")}
+	req.SetPathString("/big")
+	rv, err := c.Send(req)
+	if err != nil {
+		t.Fatalf("Error sending: %v", err)
+	}
+	if _, ok := rv.Block2(); ok || !bytes.Equal(rv.Payload, body) {
+		t.Errorf("Expected the whole body, got %v bytes", len(rv.Payload))
+	}
+
+	// Asking for a particular block gets just that.
+	req.MessageID++
+	req.SetBlock2(BlockOption{Num: 1, Size: 64})
+	if rv, err = c.Send(req); err != nil {
+		t.Fatalf("Error sending: %v", err)
+	}
+	if !bytes.Equal(rv.Payload, body[64:128]) {
+		t.Errorf("Expected block 1 only, got %q", rv.Payload)
+	}
+
+	// Stamping every block with a new ETag.
+	req.RemoveOption(Block2)
+	l2, addr2 := startUDPLisenter(t)
+	defer l2.Close()
+	go Serve(l2, FuncHandler(func(l *net.UDPConn, a *net.UDPAddr, m *Message) *Message {
+		atomic.AddInt32(&version, 1)
+		rv := &Message{Type: Acknowledgement, Code: Content, MessageID: m.MessageID, Token: m.Token}
+		b, _ := m.Block2()
+		rv.Payload = body
+		sliceBlock2(rv, b.Num, 128)
+		rv.SetOption(ETag, []byte{byte(atomic.LoadInt32(&version))})
+		return rv
+	}))
+	c2, err := Dial("udp", addr2)
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	defer c2.Close()
+	if _, err := c2.Send(req); err != ErrBlockMismatch {
+		t.Errorf("Expected ErrBlockMismatch, got %v", err)
+	}
+}
+
+func TestSendBlock2Fetch(t *testing.T) {
+	body := bytes.Repeat([]byte("0123456789"), 50)
+	var queries int32
+	l, addr := startUDPLisenter(t)
+	defer l.Close()
+	go Serve(l, FuncHandler(func(l *net.UDPConn, a *net.UDPAddr, m *Message) *Message {
+		rv := &Message{Type: Acknowledgement, Code: Content, MessageID: m.MessageID, Token: m.Token}
+		if string(m.Payload) != "query" {
+			rv.Code = BadRequest
+			return rv
+		}
+		atomic.AddInt32(&queries, 1)
+		b, _ := m.Block2()
+		rv.Payload = body
+		sliceBlock2(rv, b.Num, 128)
+		return rv
+	}))
+
+	c, err := Dial("udp", addr)
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	defer c.Close()
+
+	req := Message{Type: Confirmable, Code: FETCH, MessageID: 1, Token: []byte("f"), Payload: []byte("query")}
+	req.SetPathString("/big")
+	rv, err := c.Send(req)
+	if err != nil {
+		t.Fatalf("Error sending: %v", err)
+	}
+	if rv.Code != Content || !bytes.Equal(rv.Payload, body) {
+		t.Errorf("Expected the whole body, got %v with %v bytes", rv.Code, len(rv.Payload))
+	}
+	if n := atomic.LoadInt32(&queries); n != 4 {
+		t.Errorf("Expected the payload in all 4 block requests, got %v", n)
+	}
+}
@@ -0,0 +1,118 @@
+package coap
+
+import (
+	"fmt"
+	"net/url"
+)
+
+// A RequestBuilder puts a request message together step by step:
+//
+//	req, err := coap.NewRequest(coap.GET, "coap://host/path").
+//		Accept(coap.AppJSON).
+//		Token(tok).
+//		Confirmable().
+//		Build()
+//
+// The first error met is kept and returned by Build.
+type RequestBuilder struct {
+	m   Message
+	err error
+}
+
+// NewRequest starts building a confirmable request with the given
+// method for the resource at rawurl.  A CoAP URL sets the options
+// NewRequestFromURL does; a reference with just a path and query
+// sets the Uri-Path and Uri-Query options, leaving the host and port
+// to the connection the request is sent on (see DialURL).
+func NewRequest(code COAPCode, rawurl string) *RequestBuilder {
+	b := &RequestBuilder{}
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		b.err = err
+		return b
+	}
+	if u.IsAbs() || u.Host != "" {
+		b.m, b.err = NewRequestFromURL(code, rawurl)
+		return b
+	}
+
+	b.m = Message{Type: Confirmable, Code: code}
+	if !isRequest(code) {
+		b.err = fmt.Errorf("coap: %v is not a request method", code)
+		return b
+	}
+	if u.Fragment != "" {
+		b.err = fmt.Errorf("coap: invalid request URL %q", rawurl)
+		return b
+	}
+	if err := b.m.SetEscapedPath(u.EscapedPath()); err != nil {
+		b.err = err
+		return b
+	}
+	b.err = b.m.SetEscapedQuery(u.RawQuery)
+	return b
+}
+
+// Confirmable makes the request confirmable, which it is by default.
+func (b *RequestBuilder) Confirmable() *RequestBuilder {
+	b.m.Type = Confirmable
+	return b
+}
+
+// NonConfirmable makes the request non-confirmable.
+func (b *RequestBuilder) NonConfirmable() *RequestBuilder {
+	b.m.Type = NonConfirmable
+	return b
+}
+
+// MessageID sets the request's Message ID.
+func (b *RequestBuilder) MessageID(id uint16) *RequestBuilder {
+	b.m.MessageID = id
+	return b
+}
+
+// Token sets the request's token.
+func (b *RequestBuilder) Token(t []byte) *RequestBuilder {
+	b.m.Token = append([]byte(nil), t...)
+	return b
+}
+
+// Accept asks for a response in content format mt.
+func (b *RequestBuilder) Accept(mt MediaType) *RequestBuilder {
+	b.m.SetOption(Accept, mt)
+	return b
+}
+
+// Payload sets the request's payload and its content format.
+func (b *RequestBuilder) Payload(mt MediaType, p []byte) *RequestBuilder {
+	b.m.SetOption(ContentFormat, mt)
+	b.m.Payload = p
+	return b
+}
+
+// Observe adds the Observe option, 0 to register and 1 to
+// deregister.
+func (b *RequestBuilder) Observe(v uint32) *RequestBuilder {
+	b.m.SetOption(Observe, v)
+	return b
+}
+
+// Option adds an option.
+func (b *RequestBuilder) Option(id OptionID, v interface{}) *RequestBuilder {
+	b.m.AddOption(id, v)
+	return b
+}
+
+// Build returns the request, or the first error found while building
+// it, including anything that would keep it from being encoded.
+func (b *RequestBuilder) Build() (Message, error) {
+	if b.err != nil {
+		return Message{}, b.err
+	}
+	if _, err := b.m.MarshalBinary(); err != nil {
+		return Message{}, err
+	}
+	m := b.m
+	m.opts = append(options(nil), b.m.opts...)
+	return m, nil
+}
@@ -0,0 +1,62 @@
+package coap
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRequestBuilder(t *testing.T) {
+	m, err := NewRequest(GET, "coap://example.net/a%2Fb/c?x=1&y").
+		Accept(AppJSON).
+		Token([]byte("tok")).
+		MessageID(9).
+		NonConfirmable().
+		Build()
+	if err != nil {
+		t.Fatalf("Error building: %v", err)
+	}
+
+	if m.Type != NonConfirmable || m.Code != GET || m.MessageID != 9 || string(m.Token) != "tok" {
+		t.Errorf("Unexpected header: %v", m)
+	}
+	if !reflect.DeepEqual(m.Path(), []string{"a/b", "c"}) {
+		t.Errorf("Unexpected path: %q", m.Path())
+	}
+	if q := m.optionStrings(URIQuery); !reflect.DeepEqual(q, []string{"x=1", "y"}) {
+		t.Errorf("Unexpected query: %q", q)
+	}
+	if m.Option(Accept) != AppJSON {
+		t.Errorf("Expected Accept %v, got %v", AppJSON, m.Option(Accept))
+	}
+	if m.Option(URIHost) != "example.net" {
+		t.Errorf("Expected the URL's Uri-Host, got %v", m.Option(URIHost))
+	}
+
+	m, err = NewRequest(GET, "/a?b").Build()
+	if err != nil {
+		t.Fatalf("Error building: %v", err)
+	}
+	if m.Option(URIHost) != nil || m.PathString() != "a" || m.EscapedQuery() != "b" {
+		t.Errorf("Expected just the path and query, got %v", m)
+	}
+}
+
+func TestRequestBuilderErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		b    *RequestBuilder
+	}{
+		{"response code", NewRequest(Content, "/x")},
+		{"bad url", NewRequest(GET, "coap://%zz")},
+		{"other scheme", NewRequest(GET, "http://example.net/x")},
+		{"fragment", NewRequest(GET, "/x#y")},
+		{"long token", NewRequest(GET, "/x").Token([]byte("123456789"))},
+		{"bad option value", NewRequest(GET, "/x").Option(MaxAge, 1.5)},
+	}
+
+	for _, test := range tests {
+		if _, err := test.b.Build(); err == nil {
+			t.Errorf("%v: expected an error", test.name)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package coap
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// CaptureFormat is the format a Capture writes datagrams in.
+type CaptureFormat int
+
+const (
+	// HexDump writes a line with the time, direction and peer of
+	// each datagram, followed by a hex dump of it.
+	HexDump CaptureFormat = iota
+	// PCAP writes a pcap file, with each datagram in IP and UDP
+	// headers, for Wireshark or tcpdump -r.
+	PCAP
+)
+
+// pcap link type of packets starting with their IP header.
+const linkTypeRaw = 101
+
+// A Capture writes the datagrams a Server or client connection sends
+// and receives to W, for debugging interoperability problems where
+// tcpdump isn't available.  It's safe for concurrent use, so several
+// servers and clients may share one.  Writing stops at the first
+// error, which Err returns.
+type Capture struct {
+	// W is where the datagrams are written.
+	W io.Writer
+	// Format is the format they're written in.
+	Format CaptureFormat
+
+	mu      sync.Mutex
+	started bool
+	err     error
+}
+
+// NewCapture returns a Capture writing the datagrams to w in format f.
+func NewCapture(w io.Writer, f CaptureFormat) *Capture {
+	return &Capture{W: w, Format: f}
+}
+
+// Err returns the error that stopped the capture, if any.
+func (c *Capture) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// datagram writes data, sent from local to peer or received by local
+// from peer.
+func (c *Capture) datagram(sent bool, local, peer net.Addr, data []byte) {
+	if c == nil {
+		return
+	}
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return
+	}
+	switch c.Format {
+	case PCAP:
+		if !c.started {
+			c.started = true
+			c.err = writePCAPHeader(c.W)
+			if c.err != nil {
+				return
+			}
+		}
+		src, dst := local, peer
+		if !sent {
+			src, dst = peer, local
+		}
+		c.err = writePCAPRecord(c.W, now, src, dst, data)
+	default:
+		dir := "<-"
+		if sent {
+			dir = "->"
+		}
+		_, c.err = fmt.Fprintf(c.W, "%v %v %v (%d bytes)\n%s",
+			now.Format(time.RFC3339Nano), dir, peer, len(data), hex.Dump(data))
+	}
+}
+
+func writePCAPHeader(w io.Writer) error {
+	var h [24]byte
+	binary.LittleEndian.PutUint32(h[0:], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(h[4:], 2)
+	binary.LittleEndian.PutUint16(h[6:], 4)
+	binary.LittleEndian.PutUint32(h[16:], 65535)
+	binary.LittleEndian.PutUint32(h[20:], linkTypeRaw)
+	_, err := w.Write(h[:])
+	return err
+}
+
+// udpEndpoint returns the IP and port of a, zero for addresses that
+// aren't UDP ones.
+func udpEndpoint(a net.Addr) (net.IP, int) {
+	if u, ok := a.(*net.UDPAddr); ok {
+		return u.IP, u.Port
+	}
+	return nil, 0
+}
+
+// ipv4 tells whether ip can be written in an IPv4 header: it's an
+// IPv4 address, or none in particular.
+func ipv4(ip net.IP) bool {
+	return ip == nil || ip.IsUnspecified() || ip.To4() != nil
+}
+
+// writePCAPRecord writes data as a UDP datagram from src to dst.
+func writePCAPRecord(w io.Writer, t time.Time, src, dst net.Addr, data []byte) error {
+	sip, sport := udpEndpoint(src)
+	dip, dport := udpEndpoint(dst)
+
+	udp := make([]byte, 8+len(data))
+	binary.BigEndian.PutUint16(udp[0:], uint16(sport))
+	binary.BigEndian.PutUint16(udp[2:], uint16(dport))
+	binary.BigEndian.PutUint16(udp[4:], uint16(len(udp)))
+	copy(udp[8:], data)
+
+	var ip []byte
+	if ipv4(sip) && ipv4(dip) {
+		s4, d4 := sip.To4(), dip.To4()
+		if s4 == nil {
+			s4 = net.IPv4zero.To4()
+		}
+		if d4 == nil {
+			d4 = net.IPv4zero.To4()
+		}
+		ip = make([]byte, 20)
+		ip[0] = 0x45
+		binary.BigEndian.PutUint16(ip[2:], uint16(20+len(udp)))
+		ip[8] = 64
+		ip[9] = 17
+		copy(ip[12:], s4)
+		copy(ip[16:], d4)
+		binary.BigEndian.PutUint16(ip[10:], ^checksum(0, ip))
+		binary.BigEndian.PutUint16(udp[6:], udpChecksum(s4, d4, udp))
+	} else {
+		s16, d16 := sip.To16(), dip.To16()
+		if s16 == nil {
+			s16 = net.IPv6unspecified
+		}
+		if d16 == nil {
+			d16 = net.IPv6unspecified
+		}
+		ip = make([]byte, 40)
+		ip[0] = 0x60
+		binary.BigEndian.PutUint16(ip[4:], uint16(len(udp)))
+		ip[6] = 17
+		ip[7] = 64
+		copy(ip[8:], s16)
+		copy(ip[24:], d16)
+		binary.BigEndian.PutUint16(udp[6:], udpChecksum(s16, d16, udp))
+	}
+
+	var h [16]byte
+	n := len(ip) + len(udp)
+	binary.LittleEndian.PutUint32(h[0:], uint32(t.Unix()))
+	binary.LittleEndian.PutUint32(h[4:], uint32(t.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(h[8:], uint32(n))
+	binary.LittleEndian.PutUint32(h[12:], uint32(n))
+	for _, b := range [][]byte{h[:], ip, udp} {
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checksum adds b to the ones' complement sum sum.
+func checksum(sum uint32, b []byte) uint16 {
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum&0xffff + sum>>16
+	}
+	return uint16(sum)
+}
+
+// udpChecksum returns the checksum of the UDP datagram udp from src
+// to dst, with its checksum field zero.
+func udpChecksum(src, dst net.IP, udp []byte) uint16 {
+	pseudo := append(append([]byte(nil), src...), dst...)
+	pseudo = append(pseudo, 0, 17, byte(len(udp)>>8), byte(len(udp)))
+	sum := ^checksum(uint32(checksum(0, pseudo)), udp)
+	if sum == 0 {
+		return 0xffff
+	}
+	return sum
+}
@@ -0,0 +1,106 @@
+package coap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// pcapRecords splits a pcap file into its packets.
+func pcapRecords(t *testing.T, data []byte) [][]byte {
+	if len(data) < 24 || binary.LittleEndian.Uint32(data) != 0xa1b2c3d4 ||
+		binary.LittleEndian.Uint32(data[20:]) != linkTypeRaw {
+		t.Fatalf("Invalid pcap header: %x", data)
+	}
+	var rv [][]byte
+	for data = data[24:]; len(data) > 0; {
+		n := int(binary.LittleEndian.Uint32(data[8:]))
+		rv = append(rv, data[16:16+n])
+		data = data[16+n:]
+	}
+	return rv
+}
+
+// checkUDP checks the IP and UDP headers of the packet p, and returns
+// its ports and payload.
+func checkUDP(t *testing.T, p []byte) (int, int, []byte) {
+	var udp, pseudo []byte
+	switch p[0] >> 4 {
+	case 4:
+		if checksum(0, p[:20]) != 0xffff || p[9] != 17 {
+			t.Errorf("Invalid IPv4 header: %x", p[:20])
+		}
+		udp = p[20:]
+		pseudo = append(append([]byte(nil), p[12:20]...), 0, 17, byte(len(udp)>>8), byte(len(udp)))
+	case 6:
+		if p[6] != 17 {
+			t.Errorf("Invalid IPv6 header: %x", p[:40])
+		}
+		udp = p[40:]
+		pseudo = append(append([]byte(nil), p[8:40]...), 0, 17, byte(len(udp)>>8), byte(len(udp)))
+	default:
+		t.Fatalf("Invalid IP version: %x", p)
+	}
+	if checksum(uint32(checksum(0, pseudo)), udp) != 0xffff {
+		t.Errorf("Invalid UDP checksum: %x", p)
+	}
+	return int(binary.BigEndian.Uint16(udp)), int(binary.BigEndian.Uint16(udp[2:])), udp[8:]
+}
+
+func TestCapture(t *testing.T) {
+	var hexBuf, pcapBuf bytes.Buffer
+	serverCapture := NewCapture(&hexBuf, HexDump)
+	l, addr := startUDPLisenter(t)
+	defer l.Close()
+	go (&Server{Handler: FuncHandler(contentHandler), Capture: serverCapture}).Serve(l)
+
+	d := Dialer{Capture: NewCapture(&pcapBuf, PCAP)}
+	c, err := d.Dial("udp", addr)
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	req := Message{Type: Confirmable, Code: GET, MessageID: 7, Token: []byte("cap")}
+	req.SetPathString("/x")
+	rv, err := c.Send(req)
+	if err != nil {
+		t.Fatalf("Error sending: %v", err)
+	}
+	c.Close()
+
+	records := pcapRecords(t, pcapBuf.Bytes())
+	if len(records) != 2 {
+		t.Fatalf("Expected 2 packets, got %v", len(records))
+	}
+	port := l.LocalAddr().(*net.UDPAddr).Port
+	for i, exp := range []*Message{&req, rv} {
+		src, dst, payload := checkUDP(t, records[i])
+		if (i == 0 && dst != port) || (i == 1 && src != port) {
+			t.Errorf("Packet %v: unexpected ports %v -> %v", i, src, dst)
+		}
+		if data, _ := exp.MarshalBinary(); !bytes.Equal(payload, data) {
+			t.Errorf("Packet %v: expected %x, got %x", i, data, payload)
+		}
+	}
+
+	serverCapture.mu.Lock()
+	dump := hexBuf.String()
+	serverCapture.mu.Unlock()
+	lines := strings.Split(dump, "\n")
+	if !strings.Contains(lines[0], " <- 127.0.0.1:") || !strings.Contains(dump, " -> 127.0.0.1:") ||
+		!strings.Contains(dump, "|C...cap.x|") {
+		t.Errorf("Unexpected hex dump:\n%s", dump)
+	}
+
+	var v6 bytes.Buffer
+	src := &net.UDPAddr{IP: net.IPv6loopback, Port: 5683}
+	dst := &net.UDPAddr{IP: net.ParseIP("fe80::1"), Port: 40000}
+	if err := writePCAPRecord(&v6, time.Now(), src, dst, []byte("odd")); err != nil {
+		t.Fatalf("Error writing: %v", err)
+	}
+	if sport, dport, payload := checkUDP(t, v6.Bytes()[16:]); sport != 5683 || dport != 40000 || string(payload) != "odd" {
+		t.Errorf("Unexpected IPv6 packet %v -> %v %q", sport, dport, payload)
+	}
+}
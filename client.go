@@ -1,7 +1,13 @@
 package coap
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"net"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -9,6 +15,10 @@ const (
 	// ResponseTimeout is the amount of time to wait for a
 	// response.
 	ResponseTimeout = time.Second * 2
+	// SeparateResponseTimeout is how long to wait for the
+	// response once the request was acknowledged with an empty
+	// ACK (MAX_TRANSMIT_WAIT in RFC 7252 section 4.8.2).
+	SeparateResponseTimeout = time.Second * 93
 	// ResponseRandomFactor is a multiplier for response backoff.
 	ResponseRandomFactor = 1.5
 	// MaxRetransmit is the maximum number of times a message will
@@ -16,51 +26,922 @@ const (
 	MaxRetransmit = 4
 )
 
+// ErrKeepAliveTimeout is reported to a KeepAlive failure handler
+// when the peer stopped answering keepalive pings.
+var ErrKeepAliveTimeout = errors.New("keepalive timeout")
+
+// KeepAlive configures periodic pings on an otherwise idle
+// connection, keeping NAT and firewall bindings open during
+// long-lived observations.
+type KeepAlive struct {
+	// Interval is how long the connection may be idle before a
+	// ping is sent.  Zero disables keepalives.
+	Interval time.Duration
+	// MaxMissed is the number of consecutive unanswered pings
+	// after which the peer is considered gone.  Zero never gives
+	// up.
+	MaxMissed int
+	// NonConfirmable sends empty NON messages instead of CoAP
+	// pings.  These are never answered, so failures can't be
+	// detected.
+	NonConfirmable bool
+	// OnFailure, if not nil, is called with ErrKeepAliveTimeout
+	// once MaxMissed pings went unanswered.  Keepalives stop
+	// afterwards.
+	OnFailure func(error)
+}
+
 // Conn is a CoAP client connection.
+//
+// A goroutine reads everything arriving on the connection and routes
+// responses to the Send waiting for them by token (or by Message ID
+// for empty ACKs and Resets).  Anything else, such as notifications
+// for an observation, is handed out by Receive.
+//
+// A Conn is safe for concurrent use by multiple goroutines.  Requests
+// sent at once are answered independently, as their tokens differ,
+// though only as many confirmable ones are outstanding as its Limits
+// allow.  Each message for Receive goes to one of its callers.
 type Conn struct {
-	conn *net.UDPConn
-	buf  []byte
+	conn net.Conn
+
+	// host and port as given to Dial, used for Uri-Host and
+	// Uri-Port.
+	host string
+	port int
+
+	// What to dial again when the host name resolves elsewhere.
+	network   string
+	addr      string
+	localAddr *net.UDPAddr
+
+	session   *Session
+	telemetry telemetry
+	blockSize int
+	readSize  int
+	tokenLen  int
+	params    TransmissionParams
+	cocoa     *CoCoA
+
+	incoming chan Message
+	done     chan struct{}
+
+	mu        sync.Mutex
+	waiters   map[exchangeKey]chan Message
+	readErr   error
+	lastSend  time.Time
+	lastRecv  time.Time
+	pingMID   uint16
+	pingSent  time.Time
+	stopAlive chan struct{}
+	migrating bool
+	stopDNS   chan struct{}
+
+	// answered has the Message IDs of the confirmable responses
+	// acknowledged, and when, to acknowledge retransmissions of
+	// them again.
+	answered map[uint16]time.Time
+
+	// slots holds a token for every confirmable request
+	// outstanding, up to NSTART.
+	slots       chan struct{}
+	probingRate float64
+	nextNon     time.Time
+
+	// observations are the subscriptions, by token.
+	observations map[string]*Observation
+	observeGrace time.Duration
+	// orders track the notifications of the observations
+	// registered with Send, by token.
+	orders map[string]*observeOrder
+}
+
+// exchangeKey identifies what a waiting Send is matched on.
+type exchangeKey struct {
+	mid   bool
+	id    uint16
+	token string
+}
+
+func tokenKey(tok []byte) exchangeKey {
+	return exchangeKey{token: string(tok)}
+}
+
+func midKey(mid uint16) exchangeKey {
+	return exchangeKey{mid: true, id: mid}
+}
+
+// A Dialer contains options for connecting a CoAP client.
+//
+// The zero value is a valid Dialer that lets the system pick the
+// local address.
+type Dialer struct {
+	// LocalAddr is the local address (IP, port and zone) to send
+	// from.  Nil, an unspecified IP, or a zero port leave the
+	// corresponding choice to the system.
+	LocalAddr *net.UDPAddr
+	// ResolveInterval, if positive, is how often to resolve the
+	// peer's host name again.  When the address changed, the
+	// connection moves to the new one and repeats the Observe
+	// registrations made with Send there.  It's ignored with DTLS.
+	ResolveInterval time.Duration
+	// DTLS, if not nil, secures the connection with DTLS, making
+	// the peer's verified identity available through the
+	// Session.  LocalAddr is then ignored.
+	DTLS DTLSTransport
+	// TLSConfig configures DTLS.  Nil means the default
+	// configuration; either way, the ServerName defaults to the
+	// host dialed.
+	TLSConfig *tls.Config
+	// Tracer, if not nil, records the messages sent and
+	// received.
+	Tracer *Tracer
+	// Hooks, if not nil, are called with the requests sent, the
+	// responses received, and the retransmissions and timeouts.
+	Hooks *Hooks
+	// Metrics, if not nil, counts the messages, retransmissions,
+	// timeouts and Observe registrations, and records latencies.
+	Metrics MetricsRecorder
+	// Capture, if not nil, gets a copy of every datagram sent
+	// and received.
+	Capture *Capture
+	// BlockSize is the size of the blocks that request payloads
+	// too large for one datagram are split in, a power of two
+	// from 16 to 1024.  Zero means 1024.
+	BlockSize int
+	// ReadBufferSize is the largest datagram read; longer ones are
+	// truncated, and so dropped as malformed.  Zero means
+	// DefaultReadBufferSize.
+	ReadBufferSize int
+	// Params are the transmission parameters of the connection.
+	// Its Limits start out as their NStart and ProbingRate.
+	Params TransmissionParams
+	// CoCoA, if not nil, adapts the retransmission timeouts of
+	// confirmable requests to the round-trip times measured.  It
+	// may be shared by connections, to carry what's known about a
+	// server over to the next one.
+	CoCoA *CoCoA
+	// ObserveGrace is how long past the Max-Age of its last
+	// notification an observation waits for the next one before
+	// registering again.  Zero means DefaultObserveGrace.
+	ObserveGrace time.Duration
+	// TokenLength is the length of the random tokens given to
+	// requests sent without one, from 1 to 8 bytes.  Zero means
+	// DefaultTokenLength; a negative value leaves them without.
+	TokenLength int
+}
+
+// resolveUDPAddr is replaced in tests.
+var resolveUDPAddr = net.ResolveUDPAddr
+
+// redialUDP is replaced in tests.
+var redialUDP = net.DialUDP
+
+// resolveUDPAddrContext resolves addr with resolveUDPAddr, unless ctx
+// is done first.
+func resolveUDPAddrContext(ctx context.Context, n, addr string) (*net.UDPAddr, error) {
+	type result struct {
+		a   *net.UDPAddr
+		err error
+	}
+	resolve := resolveUDPAddr
+	ch := make(chan result, 1)
+	go func() {
+		a, err := resolve(n, addr)
+		ch <- result{a, err}
+	}()
+	select {
+	case r := <-ch:
+		return r.a, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
 }
 
 // Dial connects a CoAP client.
 func Dial(n, addr string) (*Conn, error) {
-	uaddr, err := net.ResolveUDPAddr(n, addr)
-	if err != nil {
+	var d Dialer
+	return d.Dial(n, addr)
+}
+
+// DialContext connects a CoAP client, giving up on resolving the
+// address once ctx is done.
+func DialContext(ctx context.Context, n, addr string) (*Conn, error) {
+	var d Dialer
+	return d.DialContext(ctx, n, addr)
+}
+
+// Dial connects a CoAP client using the dialer's options.
+func (d *Dialer) Dial(n, addr string) (*Conn, error) {
+	return d.DialContext(context.Background(), n, addr)
+}
+
+// DialContext connects a CoAP client using the dialer's options,
+// giving up on resolving the address once ctx is done.  The context
+// only covers connecting; use SendContext for requests.
+func (d *Dialer) DialContext(ctx context.Context, n, addr string) (*Conn, error) {
+	blockSize := d.BlockSize
+	if blockSize == 0 {
+		blockSize = maxBlockSize
+	}
+	if _, err := (BlockOption{Size: blockSize}).szx(); err != nil {
 		return nil, err
 	}
 
-	s, err := net.DialUDP("udp", nil, uaddr)
+	tokenLen := d.TokenLength
+	if tokenLen == 0 {
+		tokenLen = DefaultTokenLength
+	}
+	if tokenLen > 8 {
+		return nil, ErrInvalidTokenLen
+	}
+
+	params := d.Params.withDefaults()
+
+	var s net.Conn
+	if d.DTLS != nil {
+		dc, err := d.dialDTLS(ctx, n, addr)
+		if err != nil {
+			return nil, err
+		}
+		s = dc
+	} else {
+		uaddr, err := resolveUDPAddrContext(ctx, n, addr)
+		if err != nil {
+			return nil, err
+		}
+		if s, err = net.DialUDP(n, d.LocalAddr, uaddr); err != nil {
+			return nil, err
+		}
+	}
+
+	c := &Conn{
+		conn:      s,
+		session:   NewSession(s.LocalAddr(), s.RemoteAddr()),
+		network:   n,
+		addr:      addr,
+		localAddr: d.LocalAddr,
+		telemetry: telemetry{d.Tracer, d.Hooks, d.Metrics, d.Capture},
+		blockSize: blockSize,
+		readSize:  d.ReadBufferSize,
+		tokenLen:  tokenLen,
+		incoming:  make(chan Message, incomingQueueLen),
+		done:      make(chan struct{}),
+		waiters:   map[exchangeKey]chan Message{},
+		params:    params,
+		cocoa:     d.CoCoA,
+		slots:     make(chan struct{}, params.NStart),
+
+		probingRate: params.ProbingRate,
+
+		observations: map[string]*Observation{},
+		observeGrace: d.ObserveGrace,
+		orders:       map[string]*observeOrder{},
+	}
+	if c.observeGrace == 0 {
+		c.observeGrace = DefaultObserveGrace
+	}
+	if c.readSize <= 0 {
+		c.readSize = DefaultReadBufferSize
+	}
+	if dc, ok := s.(DTLSConn); ok {
+		c.session.SetIdentity(peerIdentity(dc.ConnectionState()))
+	}
+	if ua, ok := s.RemoteAddr().(*net.UDPAddr); ok {
+		c.port = ua.Port
+	}
+	if host, port, err := net.SplitHostPort(addr); err == nil {
+		c.host = host
+		if p, err := strconv.Atoi(port); err == nil {
+			c.port = p
+		}
+	}
+	go c.readLoop(s)
+	if d.ResolveInterval > 0 && d.DTLS == nil && net.ParseIP(c.host) == nil {
+		c.stopDNS = make(chan struct{})
+		go c.resolveLoop(d.ResolveInterval, c.stopDNS)
+	}
+	return c, nil
+}
+
+// Number of unmatched messages held for Receive before dropping more.
+const incomingQueueLen = 64
+
+func isRequest(c COAPCode) bool {
+	return c >= GET && c < Created
+}
+
+// setURIHost adds the Uri-Host and Uri-Port options for a request
+// meant for host:port that is sent to dst, leaving out whichever
+// would just repeat the destination (RFC 7252 section 6.4).  Options
+// already present on the message are left alone.
+func setURIHost(m *Message, host string, port int, dst *net.UDPAddr) {
+	if host == "" || m.Option(URIHost) != nil || m.Option(URIPort) != nil {
+		return
+	}
+
+	ip := net.ParseIP(strings.SplitN(host, "%", 2)[0])
+	setHost := ip == nil || dst == nil || !ip.Equal(dst.IP)
+	setPort := dst == nil || port != dst.Port
+	if !setHost && !setPort {
+		return
+	}
+
+	// Don't append into the caller's backing array.
+	m.opts = append(options(nil), m.opts...)
+	if setHost {
+		if ip == nil {
+			host = strings.ToLower(host)
+		}
+		m.AddOption(URIHost, host)
+	}
+	if setPort {
+		m.AddOption(URIPort, uint32(port))
+	}
+}
+
+// Close stops any keepalives and closes the underlying socket.
+func (c *Conn) Close() error {
+	c.SetKeepAlive(KeepAlive{})
+	c.mu.Lock()
+	if c.stopDNS != nil {
+		close(c.stopDNS)
+		c.stopDNS = nil
+	}
+	c.mu.Unlock()
+	return c.socket().Close()
+}
+
+func (c *Conn) socket() net.Conn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn
+}
+
+func (c *Conn) resolveLoop(interval time.Duration, stop chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+
+		uaddr, err := resolveUDPAddr(c.network, c.addr)
+		if err != nil || uaddr.String() == c.socket().RemoteAddr().String() {
+			continue
+		}
+		if c.migrate(uaddr) == nil {
+			c.reobserve()
+		}
+	}
+}
+
+// migrate moves the connection to a new peer address.
+func (c *Conn) migrate(to *net.UDPAddr) error {
+	old := c.socket()
+	s, err := redialUDP(c.network, c.localAddr, to)
 	if err != nil {
-		return nil, err
+		if c.localAddr == nil || c.localAddr.Port == 0 {
+			return err
+		}
+		// The fixed local port is still taken by the old socket.
+		c.mu.Lock()
+		c.migrating = true
+		c.mu.Unlock()
+		old.Close()
+		s, err = redialUDP(c.network, c.localAddr, to)
+		if err != nil {
+			s, err = redialUDP(c.network, c.localAddr, old.RemoteAddr().(*net.UDPAddr))
+			if err != nil {
+				// Neither socket is left, so the connection is
+				// closed.
+				c.mu.Lock()
+				c.migrating = false
+				c.failLocked(err)
+				c.mu.Unlock()
+				return err
+			}
+		}
+	}
+
+	c.mu.Lock()
+	c.conn = s
+	c.migrating = false
+	c.mu.Unlock()
+	c.session.moved(s.LocalAddr(), s.RemoteAddr())
+	old.Close()
+	go c.readLoop(s)
+	return nil
+}
+
+// resetOrder forgets the notifications of the observation with tok
+// received so far, so the next one is fresh whatever its Observe
+// value.
+func (c *Conn) resetOrder(tok []byte) {
+	c.mu.Lock()
+	delete(c.orders, string(tok))
+	o := c.observations[string(tok)]
+	c.mu.Unlock()
+	if o != nil {
+		o.mu.Lock()
+		o.order = observeOrder{}
+		o.mu.Unlock()
+	}
+}
+
+// reobserve repeats the Observe registrations in progress, handing
+// the responses on as the first notifications from the new address.
+func (c *Conn) reobserve() {
+	for _, tok := range c.session.ObservationTokens() {
+		req, ok := c.session.Observation(tok).(Message)
+		if !ok {
+			continue
+		}
+		req.MessageID = c.nextMessageID()
+		go func() {
+			rv, err := c.Send(req)
+			if err != nil || rv == nil {
+				return
+			}
+			// The new peer counts its notifications anew.
+			c.resetOrder(req.Token)
+			c.deliver(*rv)
+		}()
+	}
+}
+
+// Session returns the state shared with the peer.
+func (c *Conn) Session() *Session {
+	return c.session
+}
+
+func (c *Conn) nextMessageID() uint16 {
+	return c.session.NextMessageID()
+}
+
+func (c *Conn) transmit(m Message) error {
+	return c.transmitContext(context.Background(), m)
+}
+
+// transmitContext sends m, pacing non-confirmable messages to the
+// probing rate unless ctx is done first.
+func (c *Conn) transmitContext(ctx context.Context, m Message) error {
+	if m.Type == NonConfirmable {
+		d, err := m.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		if err := c.pace(ctx, len(d)); err != nil {
+			return err
+		}
+	}
+	return c.write(m, false)
+}
+
+// write sends m as it is, recording whether it's a retransmission.
+func (c *Conn) write(m Message, retransmission bool) error {
+	s := c.socket()
+	d, err := m.MarshalBinary()
+	if err == nil {
+		_, err = s.Write(d)
+	}
+	if err == nil {
+		c.telemetry.sent(s.LocalAddr(), s.RemoteAddr(), m, retransmission)
+		c.mu.Lock()
+		c.lastSend = time.Now()
+		c.mu.Unlock()
+	}
+	return err
+}
+
+func (c *Conn) readLoop(s net.Conn) {
+	_, udp := s.(*net.UDPConn)
+	// One byte more tells truncated datagrams apart.
+	buf := make([]byte, c.readSize+1)
+	for {
+		nr, err := s.Read(buf)
+		if err != nil {
+			if udp && !errors.Is(err, net.ErrClosed) {
+				// Typically ICMP errors bubbling up on a
+				// connected socket.  Keep listening.
+				time.Sleep(5 * time.Millisecond)
+				continue
+			}
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			if udp && (c.conn != s || c.migrating) {
+				// Moved to another socket.
+				return
+			}
+			c.failLocked(err)
+			return
+		}
+
+		c.telemetry.capture.datagram(false, s.LocalAddr(), s.RemoteAddr(), buf[:nr])
+		if nr > c.readSize {
+			continue
+		}
+		msg, err := ParseMessage(append([]byte(nil), buf[:nr]...))
+		if err != nil {
+			continue
+		}
+		c.telemetry.received(s.RemoteAddr(), msg)
+		c.dispatch(msg)
+	}
+}
+
+// dispatch hands a received message to the Send waiting for it, or
+// queues it for Receive.
+func (c *Conn) dispatch(msg Message) {
+	c.mu.Lock()
+	c.lastRecv = time.Now()
+	empty := msg.Code == 0 &&
+		(msg.Type == Reset || msg.Type == Acknowledgement)
+	if empty && !c.pingSent.IsZero() && msg.MessageID == c.pingMID {
+		c.mu.Unlock()
+		return
+	}
+
+	if _, dup := c.answered[msg.MessageID]; dup && msg.IsConfirmable() {
+		c.mu.Unlock()
+		c.transmit(Message{Type: Acknowledgement, MessageID: msg.MessageID})
+		return
+	}
+
+	ch, ok := c.waiters[midKey(msg.MessageID)]
+	if !ok || !(empty || msg.Type == Acknowledgement) {
+		ch, ok = c.waiters[tokenKey(msg.Token)]
+		if ok && empty {
+			ok = false
+		}
+	}
+	c.mu.Unlock()
+
+	if ok {
+		select {
+		case ch <- msg:
+		default:
+		}
+		return
+	}
+	c.deliver(msg)
+}
+
+// deliver hands a message that isn't a response to a Send to the
+// observation it belongs to, or else to Receive.
+func (c *Conn) deliver(msg Message) {
+	c.mu.Lock()
+	o := c.observations[string(msg.Token)]
+	c.mu.Unlock()
+
+	if o != nil && msg.Type != Reset && msg.Type != Acknowledgement {
+		if msg.IsConfirmable() {
+			c.transmit(Message{Type: Acknowledgement, MessageID: msg.MessageID})
+		}
+		o.notify(msg)
+		return
+	}
+	if !c.fresh(msg) {
+		// Acknowledged all the same, so it's not sent again.
+		if msg.IsConfirmable() {
+			c.transmit(Message{Type: Acknowledgement, MessageID: msg.MessageID})
+		}
+		return
 	}
 
-	return &Conn{s, make([]byte, maxPktLen)}, nil
+	select {
+	case c.incoming <- msg:
+	default:
+	}
+}
+
+// fresh tells whether msg, if it's a notification for an observation
+// registered with Send, isn't stale.
+func (c *Conn) fresh(msg Message) bool {
+	if msg.Option(Observe) == nil || c.session.Observation(msg.Token) == nil {
+		return true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	o := c.orders[string(msg.Token)]
+	if o == nil {
+		o = &observeOrder{}
+		c.orders[string(msg.Token)] = o
+	}
+	return o.accept(msg, time.Now())
+}
+
+// failLocked closes the connection with err, unless it's closed
+// already.  c.mu must be held.
+func (c *Conn) failLocked(err error) {
+	select {
+	case <-c.done:
+	default:
+		c.readErr = err
+		close(c.done)
+	}
+}
+
+func (c *Conn) err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.readErr
 }
 
 // Send a message.  Get a response if there is one.
+//
+// Requests to a peer dialed by host name get a Uri-Host option
+// naming it, so virtual-hosted servers can route them.  Requests
+// without a token get a random one, as the Dialer's TokenLength says.
+//
+// Send only returns a message carrying the request's token, or an
+// ACK for the request's Message ID; other messages arriving meanwhile
+// are left for Receive.  A Reset makes it return a *ResetError.
+//
+// A confirmable message is retransmitted until it's acknowledged or
+// answered, first after a random timeout between ACK_TIMEOUT and
+// ACK_TIMEOUT * ACK_RANDOM_FACTOR, then after twice the previous one,
+// at most MAX_RETRANSMIT times (RFC 7252 section 4.2), all as the
+// Dialer's Params say.  If the last
+// timeout passes as well, Send returns ErrTimeout.
+//
+// When a request is acknowledged with an empty ACK, Send waits up
+// to SeparateResponseTimeout for the separate response, and
+// acknowledges it, as well as any retransmission of it.
+//
+// Send waits while the connection has as many confirmable requests
+// outstanding as its Limits allow, and paces non-confirmable ones to
+// their probing rate.
+//
+// A confirmable request with a payload larger than the connection's
+// block size is sent in blocks (RFC 7959 Block1), and the response
+// to the last one returned.  A response that comes in blocks (Block2)
+// is returned with the whole body, unless the request asked for a
+// particular block.
 func (c *Conn) Send(req Message) (*Message, error) {
-	err := Transmit(c.conn, nil, req)
-	if err != nil {
+	return c.SendContext(context.Background(), req)
+}
+
+// SendContext is like Send, but gives up once ctx is done, returning
+// its error.  That includes waiting for a turn to send, the
+// response, and any further blocks.
+func (c *Conn) SendContext(ctx context.Context, req Message) (*Message, error) {
+	if err := assignToken(&req, c.tokenLen); err != nil {
 		return nil, err
 	}
+	if !isRequest(req.Code) || !req.IsConfirmable() {
+		return c.exchange(ctx, req)
+	}
 
+	var rv *Message
+	var err error
+	if len(req.Payload) > c.blockSize && req.Option(Block1) == nil {
+		rv, err = c.sendBlock1(ctx, req)
+	} else {
+		rv, err = c.exchange(ctx, req)
+	}
+	if err != nil || req.Option(Block2) != nil {
+		return rv, err
+	}
+	return c.fetchBlock2(ctx, req, rv)
+}
+
+// exchange sends req as it is and waits for the response, if any.
+func (c *Conn) exchange(ctx context.Context, req Message) (*Message, error) {
+	peer := c.socket().RemoteAddr()
+	if isRequest(req.Code) {
+		raddr, _ := peer.(*net.UDPAddr)
+		setURIHost(&req, c.host, c.port, raddr)
+	}
+	if v, ok := observeValue(req); ok {
+		switch v {
+		case 0:
+			c.session.SetObservation(req.Token, req)
+		case 1:
+			c.session.RemoveObservation(req.Token)
+		}
+		c.mu.Lock()
+		delete(c.orders, string(req.Token))
+		c.mu.Unlock()
+	}
+
+	if isRequest(req.Code) {
+		c.telemetry.request(req, peer)
+	}
 	if !req.IsConfirmable() {
-		return nil, nil
+		return nil, c.transmitContext(ctx, req)
 	}
 
-	rv, err := Receive(c.conn, c.buf)
+	end, err := c.startExchange(ctx)
 	if err != nil {
 		return nil, err
 	}
+	defer end()
 
-	return &rv, nil
+	ch := make(chan Message, 1)
+	keys := []exchangeKey{midKey(req.MessageID)}
+	if req.Code != 0 {
+		keys = append(keys, tokenKey(req.Token))
+	}
+	c.mu.Lock()
+	for _, k := range keys {
+		c.waiters[k] = ch
+	}
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		for _, k := range keys {
+			if c.waiters[k] == ch {
+				delete(c.waiters, k)
+			}
+		}
+		c.mu.Unlock()
+	}()
+
+	policy := c.params.retryPolicy()
+	if c.params.Retry == nil && c.cocoa != nil {
+		timeout, backoff := c.cocoa.timeouts(peer, c.params)
+		policy = ExponentialBackoff{Initial: timeout, Factor: backoff, MaxAttempts: c.params.MaxRetransmit + 1}
+	}
+	timeout, ok := policy.NextTimeout(0, 0)
+	if !ok {
+		return nil, ErrTimeout
+	}
+	start := time.Now()
+	if err := c.transmit(req); err != nil {
+		return nil, err
+	}
+
+	retransmissions := 0
+	separate := false
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	for {
+		select {
+		case rv := <-ch:
+			// Acknowledged or answered, so no longer
+			// outstanding.
+			end()
+			if !separate {
+				c.cocoa.measured(peer, time.Since(start), retransmissions+1)
+			}
+			switch {
+			case rv.Type == Reset:
+				return nil, &ResetError{MessageID: rv.MessageID}
+			case rv.Type == Acknowledgement && rv.Code == 0 && req.Code != 0:
+				separate = true
+				t.Reset(SeparateResponseTimeout)
+				continue
+			case rv.IsConfirmable():
+				c.ackResponse(rv.MessageID)
+			}
+			if rv.Code != 0 {
+				c.telemetry.response(rv, peer, start)
+			}
+			return &rv, nil
+		case <-c.done:
+			return nil, c.err()
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-t.C:
+			next, ok := policy.NextTimeout(retransmissions+1, timeout)
+			if separate || !ok {
+				c.telemetry.timeout(req, peer, start)
+				return nil, ErrTimeout
+			}
+			retransmissions++
+			c.telemetry.retransmit(req, peer, retransmissions, start)
+			if err := c.write(req, true); err != nil {
+				return nil, err
+			}
+			timeout = next
+			t.Reset(timeout)
+		}
+	}
+}
+
+// ackResponse acknowledges the confirmable response with Message ID
+// mid, remembering it for EXCHANGE_LIFETIME in case the ACK is lost
+// and the response retransmitted.
+func (c *Conn) ackResponse(mid uint16) {
+	now := time.Now()
+	c.mu.Lock()
+	if c.answered == nil {
+		c.answered = map[uint16]time.Time{}
+	}
+	for id, at := range c.answered {
+		if now.Sub(at) > ExchangeLifetime {
+			delete(c.answered, id)
+		}
+	}
+	c.answered[mid] = now
+	c.mu.Unlock()
+
+	c.transmit(Message{Type: Acknowledgement, MessageID: mid})
 }
 
-// Receive a message.
+// Receive a message that isn't the response to a Send, such as an
+// Observe notification.
 func (c *Conn) Receive() (*Message, error) {
-	rv, err := Receive(c.conn, c.buf)
-	if err != nil {
-		return nil, err
+	t := time.NewTimer(ResponseTimeout)
+	defer t.Stop()
+	select {
+	case rv := <-c.incoming:
+		return &rv, nil
+	case <-c.done:
+		select {
+		case rv := <-c.incoming:
+			return &rv, nil
+		default:
+		}
+		return nil, c.err()
+	case <-t.C:
+		return nil, ErrTimeout
+	}
+}
+
+// Ping checks that the peer is alive by sending it an empty
+// confirmable message, retransmitted as Send would, and waiting for
+// the Reset it answers with (RFC 7252 section 4.3).  An empty ACK
+// will do as well.
+func (c *Conn) Ping(ctx context.Context) error {
+	_, err := c.exchange(ctx, Message{Type: Confirmable, MessageID: c.nextMessageID()})
+	if errors.Is(err, ErrReset) {
+		return nil
+	}
+	return err
+}
+
+// SetKeepAlive replaces the keepalive configuration of this
+// connection.
+func (c *Conn) SetKeepAlive(k KeepAlive) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.stopAlive != nil {
+		close(c.stopAlive)
+		c.stopAlive = nil
+	}
+	c.pingSent = time.Time{}
+
+	if k.Interval > 0 {
+		c.stopAlive = make(chan struct{})
+		go c.keepAlive(k, c.stopAlive)
+	}
+}
+
+func (c *Conn) keepAlive(k KeepAlive, stop chan struct{}) {
+	t := time.NewTicker(k.Interval)
+	defer t.Stop()
+
+	missed := 0
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+
+		c.mu.Lock()
+		if !c.pingSent.IsZero() {
+			if c.lastRecv.Before(c.pingSent) {
+				missed++
+			} else {
+				missed = 0
+			}
+			c.pingSent = time.Time{}
+		}
+		idle := c.lastSend
+		if c.lastRecv.After(idle) {
+			idle = c.lastRecv
+		}
+		c.mu.Unlock()
+
+		if k.MaxMissed > 0 && missed >= k.MaxMissed {
+			if k.OnFailure != nil {
+				k.OnFailure(ErrKeepAliveTimeout)
+			}
+			return
+		}
+
+		if time.Since(idle) < k.Interval {
+			continue
+		}
+
+		ping := Message{Type: Confirmable, MessageID: c.nextMessageID()}
+		if k.NonConfirmable {
+			ping.Type = NonConfirmable
+		}
+
+		c.mu.Lock()
+		if !k.NonConfirmable {
+			c.pingMID = ping.MessageID
+			c.pingSent = time.Now()
+		}
+		c.mu.Unlock()
+
+		c.transmit(ping)
 	}
-	return &rv, nil
 }
@@ -0,0 +1,762 @@
+package coap
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// pingServer answers CoAP pings with a Reset unless silent is set,
+// counting the pings it sees.  It reads the socket itself, since a
+// Server answers pings before its handler sees them.
+func pingServer(t *testing.T, silent bool) (*net.UDPConn, string, *int32) {
+	l, addr := startUDPLisenter(t)
+	var pings int32
+	go func() {
+		buf := make([]byte, DefaultReadBufferSize)
+		for {
+			n, a, err := l.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			m, err := ParseMessage(buf[:n])
+			if err != nil || m.Code != 0 {
+				continue
+			}
+			atomic.AddInt32(&pings, 1)
+			if !silent && m.Type == Confirmable {
+				Transmit(l, a, Message{Type: Reset, MessageID: m.MessageID})
+			}
+		}
+	}()
+	return l, addr, &pings
+}
+
+func readForever(c *Conn) {
+	for {
+		if _, err := c.Receive(); err != nil {
+			if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
+				continue
+			}
+			return
+		}
+	}
+}
+
+func TestKeepAliveAnswered(t *testing.T) {
+	l, addr, pings := pingServer(t, false)
+	defer l.Close()
+
+	c, err := Dial("udp", addr)
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	defer c.Close()
+	go readForever(c)
+
+	failed := make(chan error, 1)
+	c.SetKeepAlive(KeepAlive{
+		Interval:  10 * time.Millisecond,
+		MaxMissed: 2,
+		OnFailure: func(err error) { failed <- err },
+	})
+
+	select {
+	case err := <-failed:
+		t.Fatalf("Unexpected keepalive failure: %v", err)
+	case <-time.After(150 * time.Millisecond):
+	}
+
+	if atomic.LoadInt32(pings) < 2 {
+		t.Errorf("Expected several pings, got %v", atomic.LoadInt32(pings))
+	}
+}
+
+func TestKeepAliveUnanswered(t *testing.T) {
+	l, addr, _ := pingServer(t, true)
+	defer l.Close()
+
+	c, err := Dial("udp", addr)
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	defer c.Close()
+	go readForever(c)
+
+	failed := make(chan error, 1)
+	c.SetKeepAlive(KeepAlive{
+		Interval:  10 * time.Millisecond,
+		MaxMissed: 2,
+		OnFailure: func(err error) { failed <- err },
+	})
+
+	select {
+	case err := <-failed:
+		if err != ErrKeepAliveTimeout {
+			t.Errorf("Expected ErrKeepAliveTimeout, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Keepalive failure wasn't reported")
+	}
+}
+
+func TestKeepAliveNonConfirmable(t *testing.T) {
+	l, addr, pings := pingServer(t, false)
+	defer l.Close()
+
+	c, err := Dial("udp", addr)
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	defer c.Close()
+
+	c.SetKeepAlive(KeepAlive{
+		Interval:       10 * time.Millisecond,
+		MaxMissed:      1,
+		NonConfirmable: true,
+		OnFailure:      func(err error) { t.Errorf("Unexpected failure: %v", err) },
+	})
+	time.Sleep(100 * time.Millisecond)
+
+	if atomic.LoadInt32(pings) == 0 {
+		t.Errorf("Expected pings, got none")
+	}
+}
+
+func TestPing(t *testing.T) {
+	l, addr := startUDPLisenter(t)
+	defer l.Close()
+	var served int32
+	go Serve(l, FuncHandler(func(l *net.UDPConn, a *net.UDPAddr, m *Message) *Message {
+		atomic.AddInt32(&served, 1)
+		return nil
+	}))
+
+	c, err := Dial("udp", addr)
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	defer c.Close()
+	for i := 0; i < 2; i++ {
+		if err := c.Ping(context.Background()); err != nil {
+			t.Fatalf("Error pinging: %v", err)
+		}
+	}
+	if n := atomic.LoadInt32(&served); n != 0 {
+		t.Errorf("Expected the server to answer pings itself, its handler saw %v", n)
+	}
+
+	sl, saddr, pings := pingServer(t, true)
+	defer sl.Close()
+	sc, err := Dial("udp", saddr)
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	defer sc.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := sc.Ping(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected the deadline to pass pinging a silent peer, got %v", err)
+	}
+	if atomic.LoadInt32(pings) != 1 {
+		t.Errorf("Expected one ping, got %v", atomic.LoadInt32(pings))
+	}
+}
+
+func TestSendAssignsToken(t *testing.T) {
+	l, addr := startUDPLisenter(t)
+	defer l.Close()
+	go Serve(l, FuncHandler(contentHandler))
+
+	tests := []struct {
+		length int
+		token  []byte
+		exp    int
+	}{
+		{0, nil, DefaultTokenLength},
+		{2, nil, 2},
+		{-1, nil, 0},
+		{0, []byte("x"), 1},
+	}
+	for i, test := range tests {
+		d := Dialer{TokenLength: test.length}
+		c, err := d.Dial("udp", addr)
+		if err != nil {
+			t.Fatalf("Error dialing: %v", err)
+		}
+		defer c.Close()
+		rv, err := c.Send(Message{Type: Confirmable, Code: GET, MessageID: uint16(i), Token: test.token})
+		if err != nil {
+			t.Fatalf("%+v: error sending: %v", test, err)
+		}
+		if len(rv.Token) != test.exp || test.token != nil && !bytes.Equal(rv.Token, test.token) {
+			t.Errorf("%+v: unexpected token %x", test, rv.Token)
+		}
+	}
+
+	d := Dialer{TokenLength: 9}
+	if _, err := d.Dial("udp", addr); err != ErrInvalidTokenLen {
+		t.Errorf("Expected ErrInvalidTokenLen for 9 byte tokens, got %v", err)
+	}
+}
+
+func TestDialerReadBufferSize(t *testing.T) {
+	l, addr := startUDPLisenter(t)
+	defer l.Close()
+	go func() {
+		buf := make([]byte, DefaultReadBufferSize)
+		for {
+			n, a, err := l.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			m, err := ParseMessage(buf[:n])
+			if err != nil {
+				continue
+			}
+			Transmit(l, a, Message{Type: Acknowledgement, Code: Content, MessageID: m.MessageID,
+				Token: m.Token, Payload: bytes.Repeat([]byte("x"), 3000)})
+		}
+	}()
+
+	for _, size := range []int{0, 4096} {
+		d := Dialer{ReadBufferSize: size}
+		c, err := d.Dial("udp", addr)
+		if err != nil {
+			t.Fatalf("Error dialing: %v", err)
+		}
+		defer c.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		rv, err := c.SendContext(ctx, Message{Type: Confirmable, Code: GET, MessageID: 1})
+		switch {
+		case size == 0 && err != context.DeadlineExceeded:
+			t.Errorf("Expected the truncated response to be dropped, got %v, %v", rv, err)
+		case size > 0 && (err != nil || len(rv.Payload) != 3000):
+			t.Errorf("Expected a 3000 byte response, got %v, %v", rv, err)
+		}
+	}
+}
+
+func TestSetURIHost(t *testing.T) {
+	dst := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5683}
+	tests := []struct {
+		host string
+		port int
+		exp  []OptionID
+		val  interface{}
+	}{
+		{"192.0.2.1", 5683, nil, nil},
+		{"192.0.2.7", 5683, []OptionID{URIHost}, "192.0.2.7"},
+		{"Example.COM", 5683, []OptionID{URIHost}, "example.com"},
+		{"192.0.2.1", 61616, []OptionID{URIPort}, uint32(61616)},
+		{"", 5683, nil, nil},
+	}
+
+	for _, test := range tests {
+		m := Message{Code: GET}
+		setURIHost(&m, test.host, test.port, dst)
+		if len(m.opts) != len(test.exp) {
+			t.Errorf("%v:%v: expected options %v, got %v",
+				test.host, test.port, test.exp, m.opts)
+			continue
+		}
+		for i, id := range test.exp {
+			if m.opts[i].ID != id || m.opts[i].Value != test.val {
+				t.Errorf("%v:%v: expected %v=%v, got %v",
+					test.host, test.port, id, test.val, m.opts[i])
+			}
+		}
+	}
+}
+
+func TestSetURIHostKeepsExisting(t *testing.T) {
+	m := Message{Code: GET}
+	m.SetOption(URIHost, "other.example")
+	setURIHost(&m, "example.com", 5683, nil)
+	if got := m.Options(URIHost); len(got) != 1 || got[0] != "other.example" {
+		t.Errorf("Expected Uri-Host to be left alone, got %v", got)
+	}
+}
+
+func TestSendByHostNameSetsURIHost(t *testing.T) {
+	l, addr := startUDPLisenter(t)
+	defer l.Close()
+
+	hosts := make(chan interface{}, 1)
+	go Serve(l, FuncHandler(func(l *net.UDPConn, a *net.UDPAddr, m *Message) *Message {
+		hosts <- m.Option(URIHost)
+		return &Message{Type: Acknowledgement, Code: Content, MessageID: m.MessageID}
+	}))
+
+	_, port, _ := net.SplitHostPort(addr)
+	req := Message{Type: Confirmable, Code: GET, MessageID: 1}
+	req.SetPathString("/a")
+	dialAndSend(t, net.JoinHostPort("localhost", port), req)
+
+	if got := <-hosts; got != "localhost" {
+		t.Errorf("Expected Uri-Host localhost, got %v", got)
+	}
+	if len(req.opts) != 1 {
+		t.Errorf("Send modified the caller's message: %v", req.opts)
+	}
+}
+
+func TestDialerLocalAddr(t *testing.T) {
+	l, addr := startUDPLisenter(t)
+	defer l.Close()
+
+	// Grab a free port to source from.
+	tmp, _ := startUDPLisenter(t)
+	local := tmp.LocalAddr().(*net.UDPAddr)
+	tmp.Close()
+
+	froms := make(chan *net.UDPAddr, 1)
+	go Serve(l, FuncHandler(func(l *net.UDPConn, a *net.UDPAddr, m *Message) *Message {
+		froms <- a
+		return nil
+	}))
+
+	d := Dialer{LocalAddr: local}
+	c, err := d.Dial("udp", addr)
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	defer c.Close()
+
+	if _, err := c.Send(Message{Type: NonConfirmable, Code: GET}); err != nil {
+		t.Fatalf("Error sending: %v", err)
+	}
+	if from := <-froms; from.Port != local.Port || !from.IP.Equal(local.IP) {
+		t.Errorf("Expected request from %v, got %v", local, from)
+	}
+}
+
+func TestSendSkipsInterleavedNotifications(t *testing.T) {
+	l, addr := startUDPLisenter(t)
+	defer l.Close()
+
+	go Serve(l, FuncHandler(func(l *net.UDPConn, a *net.UDPAddr, m *Message) *Message {
+		// An unrelated notification and a stray ACK arrive first.
+		note := Message{
+			Type:      NonConfirmable,
+			Code:      Content,
+			MessageID: 1,
+			Token:     []byte("obs"),
+			Payload:   []byte("notification"),
+		}
+		note.SetOption(Observe, 7)
+		Transmit(l, a, note)
+		Transmit(l, a, Message{Type: Acknowledgement, MessageID: m.MessageID + 1})
+
+		return &Message{
+			Type:      Acknowledgement,
+			Code:      Content,
+			MessageID: m.MessageID,
+			Token:     m.Token,
+			Payload:   []byte("response"),
+		}
+	}))
+
+	c, err := Dial("udp", addr)
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	defer c.Close()
+
+	rv, err := c.Send(Message{
+		Type:      Confirmable,
+		Code:      GET,
+		MessageID: 100,
+		Token:     []byte("req"),
+	})
+	if err != nil {
+		t.Fatalf("Error sending: %v", err)
+	}
+	if string(rv.Payload) != "response" {
+		t.Errorf("Expected the response, got %v (%s)", rv, rv.Payload)
+	}
+
+	note, err := c.Receive()
+	if err != nil {
+		t.Fatalf("Error receiving: %v", err)
+	}
+	if string(note.Payload) != "notification" {
+		t.Errorf("Expected the notification, got %v (%s)", note, note.Payload)
+	}
+}
+
+func TestDialURL(t *testing.T) {
+	l, addr := startUDPLisenter(t)
+	defer l.Close()
+	go Serve(l, FuncHandler(func(l *net.UDPConn, a *net.UDPAddr, m *Message) *Message {
+		return &Message{
+			Type:      Acknowledgement,
+			Code:      Content,
+			MessageID: m.MessageID,
+			Token:     m.Token,
+		}
+	}))
+
+	c, err := DialURL("coap://" + addr + "/a")
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	defer c.Close()
+	rv, err := c.Send(Message{Type: Confirmable, Code: GET, MessageID: 1, Token: []byte("u")})
+	if err != nil || rv.Code != Content {
+		t.Fatalf("Expected Content, got %v, %v", rv, err)
+	}
+
+	if _, err := DialURL("gopher://" + addr); err == nil {
+		t.Errorf("Expected an error for an unsupported scheme")
+	}
+}
+
+func TestDialerResolveMigrates(t *testing.T) {
+	// Two servers answering registrations, telling which one they are.
+	var addrs []*net.UDPAddr
+	regs := make(chan string, 4)
+	for _, name := range []string{"old", "new"} {
+		name := name
+		l, _ := startUDPLisenter(t)
+		defer l.Close()
+		addrs = append(addrs, l.LocalAddr().(*net.UDPAddr))
+		go Serve(l, FuncHandler(func(l *net.UDPConn, a *net.UDPAddr, m *Message) *Message {
+			if m.Option(Observe) != uint32(0) {
+				return nil
+			}
+			regs <- name
+			rv := &Message{
+				Type:      Acknowledgement,
+				Code:      Content,
+				MessageID: m.MessageID,
+				Token:     m.Token,
+				Payload:   []byte(name),
+			}
+			rv.SetOption(Observe, 2)
+			return rv
+		}))
+	}
+
+	var mu sync.Mutex
+	current := addrs[0]
+	resolveUDPAddr = func(n, addr string) (*net.UDPAddr, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return current, nil
+	}
+	defer func() { resolveUDPAddr = net.ResolveUDPAddr }()
+
+	d := Dialer{ResolveInterval: 10 * time.Millisecond}
+	c, err := d.Dial("udp", "coap.example.com:5683")
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	defer c.Close()
+
+	req := Message{Type: Confirmable, Code: GET, MessageID: 1, Token: []byte("obs")}
+	req.SetOption(Observe, 0)
+	req.SetPathString("/temp")
+	if _, err := c.Send(req); err != nil {
+		t.Fatalf("Error registering: %v", err)
+	}
+	next := func() string {
+		select {
+		case name := <-regs:
+			return name
+		case <-time.After(time.Second):
+			return "nobody"
+		}
+	}
+	if got := next(); got != "old" {
+		t.Fatalf("Expected registration at the old address, got %v", got)
+	}
+
+	mu.Lock()
+	current = addrs[1]
+	mu.Unlock()
+
+	if got := next(); got != "new" {
+		t.Fatalf("Expected registration repeated at the new address, got %v", got)
+	}
+	rv, err := c.Receive()
+	if err != nil {
+		t.Fatalf("Error receiving: %v", err)
+	}
+	if string(rv.Token) != "obs" || string(rv.Payload) != "new" {
+		t.Errorf("Expected the new registration's response, got %v", rv)
+	}
+	if c.Session().RemoteAddr().String() != addrs[1].String() {
+		t.Errorf("Expected the session moved to %v, got %v", addrs[1],
+			c.Session().RemoteAddr())
+	}
+}
+
+func TestMigrateFailure(t *testing.T) {
+	l, addr := startUDPLisenter(t)
+	defer l.Close()
+
+	tmp, _ := startUDPLisenter(t)
+	d := Dialer{LocalAddr: tmp.LocalAddr().(*net.UDPAddr)}
+	tmp.Close()
+	c, err := d.Dial("udp", addr)
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	defer c.Close()
+
+	failed := errors.New("no route")
+	redialUDP = func(n string, laddr, raddr *net.UDPAddr) (*net.UDPConn, error) {
+		return nil, failed
+	}
+	defer func() { redialUDP = net.DialUDP }()
+
+	if err := c.migrate(l.LocalAddr().(*net.UDPAddr)); err != failed {
+		t.Fatalf("Expected the redial error, got %v", err)
+	}
+	select {
+	case <-c.done:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the connection closed")
+	}
+	if _, err := c.Receive(); err != failed {
+		t.Errorf("Expected the redial error from Receive, got %v", err)
+	}
+}
+
+func TestSendContext(t *testing.T) {
+	// Nothing answers on l.
+	l, addr := startUDPLisenter(t)
+	defer l.Close()
+
+	c, err := Dial("udp", addr)
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 2)
+	go func() {
+		_, err := c.SendContext(ctx, Message{Type: Confirmable, Code: GET, MessageID: 1})
+		errs <- err
+	}()
+	// This one waits for its turn, the first taking up NSTART.
+	go func() {
+		_, err := c.SendContext(ctx, Message{Type: Confirmable, Code: GET, MessageID: 2})
+		errs <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	start := time.Now()
+	cancel()
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != context.Canceled {
+			t.Errorf("Expected context.Canceled, got %v", err)
+		}
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Expected cancellation to return promptly, took %v", d)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := c.SendContext(ctx, Message{Type: Confirmable, Code: GET, MessageID: 3}); err != context.DeadlineExceeded {
+		t.Errorf("Expected context.DeadlineExceeded, got %v", err)
+	}
+
+	// The connection is still usable.
+	c.SetLimits(Limits{ProbingRate: 1})
+	if _, err := c.SendContext(context.Background(), Message{Type: NonConfirmable, MessageID: 4}); err != nil {
+		t.Errorf("Error sending: %v", err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := c.SendContext(ctx, Message{Type: NonConfirmable, MessageID: 5}); err != context.DeadlineExceeded {
+		t.Errorf("Expected pacing to give up at the deadline, got %v", err)
+	}
+}
+
+func TestDialContext(t *testing.T) {
+	block := make(chan struct{})
+	defer close(block)
+	resolveUDPAddr = func(n, addr string) (*net.UDPAddr, error) {
+		<-block
+		return nil, errors.New("unreachable")
+	}
+	defer func() { resolveUDPAddr = net.ResolveUDPAddr }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := DialContext(ctx, "udp", "slow.example:5683"); err != context.DeadlineExceeded {
+		t.Errorf("Expected context.DeadlineExceeded, got %v", err)
+	}
+}
+
+func TestConcurrentSends(t *testing.T) {
+	l, addr := startUDPLisenter(t)
+	defer l.Close()
+
+	// Answer four requests at once, in reverse order.
+	reqs := make(chan *Request, 4)
+	go Serve(l, RequestFunc(func(r *Request) { reqs <- r }))
+	go func() {
+		var held []*Request
+		for len(held) < 4 {
+			held = append(held, <-reqs)
+		}
+		for i := len(held) - 1; i >= 0; i-- {
+			r := held[i]
+			r.Respond(Message{Code: Content, Payload: r.Msg.Token})
+		}
+	}()
+
+	c, err := Dial("udp", addr)
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	defer c.Close()
+	c.SetLimits(Limits{NStart: 4})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			tok := []byte{'t', byte('0' + i)}
+			rv, err := c.Send(Message{
+				Type:      Confirmable,
+				Code:      GET,
+				MessageID: c.nextMessageID(),
+				Token:     tok,
+			})
+			if err != nil {
+				t.Errorf("Error sending %s: %v", tok, err)
+				return
+			}
+			if string(rv.Payload) != string(tok) {
+				t.Errorf("Expected the response to %s, got %s", tok, rv.Payload)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestSendSeparateResponseRetransmitted(t *testing.T) {
+	l, addr := startUDPLisenter(t)
+	defer l.Close()
+
+	c, err := Dial("udp", addr)
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	defer c.Close()
+
+	acks := make(chan Message, 2)
+	go func() {
+		buf := make([]byte, DefaultReadBufferSize)
+		nr, a, err := l.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		req, _ := ParseMessage(buf[:nr])
+		Transmit(l, a, Message{Type: Acknowledgement, MessageID: req.MessageID})
+		rv := Message{
+			Type:      Confirmable,
+			Code:      Content,
+			MessageID: 77,
+			Token:     req.Token,
+			Payload:   []byte("late"),
+		}
+		// As if the first ACK got lost.
+		for i := 0; i < 2; i++ {
+			Transmit(l, a, rv)
+			ack, err := Receive(l, buf)
+			if err != nil {
+				return
+			}
+			acks <- ack
+		}
+	}()
+
+	rv, err := c.Send(Message{Type: Confirmable, Code: GET, MessageID: 5, Token: []byte("sep")})
+	if err != nil {
+		t.Fatalf("Error sending: %v", err)
+	}
+	if string(rv.Payload) != "late" {
+		t.Errorf("Expected the separate response, got %v (%s)", rv, rv.Payload)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case ack := <-acks:
+			if ack.Type != Acknowledgement || ack.MessageID != 77 {
+				t.Errorf("Expected an ACK of 77, got %v", ack)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("ACK %v never arrived", i)
+		}
+	}
+	if n := len(c.incoming); n != 0 {
+		t.Errorf("Expected the retransmission not to reach Receive, got %v messages", n)
+	}
+}
+
+func TestSendRetransmits(t *testing.T) {
+	defer func(d time.Duration) { ackTimeout = d }(ackTimeout)
+	ackTimeout = 10 * time.Millisecond
+
+	l, addr := startUDPLisenter(t)
+	defer l.Close()
+	go func() {
+		buf := make([]byte, DefaultReadBufferSize)
+		for i := 0; ; i++ {
+			nr, a, err := l.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			// Only the second retransmission gets through.
+			if i < 2 {
+				continue
+			}
+			req, _ := ParseMessage(buf[:nr])
+			Transmit(l, a, Message{
+				Type:      Acknowledgement,
+				Code:      Content,
+				MessageID: req.MessageID,
+				Token:     req.Token,
+			})
+		}
+	}()
+
+	tr := &Tracer{}
+	d := Dialer{Tracer: tr}
+	c, err := d.Dial("udp", addr)
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	defer c.Close()
+
+	rv, err := c.Send(Message{Type: Confirmable, Code: GET, MessageID: 9, Token: []byte("rt")})
+	if err != nil {
+		t.Fatalf("Error sending: %v", err)
+	}
+	if rv.Code != Content {
+		t.Errorf("Expected Content, got %v", rv)
+	}
+
+	var retransmissions []bool
+	for _, e := range tr.Events() {
+		if e.Sent {
+			retransmissions = append(retransmissions, e.Retransmission)
+		}
+	}
+	if exp := []bool{false, true, true}; !reflect.DeepEqual(retransmissions, exp) {
+		t.Errorf("Expected transmissions %v, got %v", exp, retransmissions)
+	}
+}
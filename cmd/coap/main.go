@@ -0,0 +1,379 @@
+// Command coap sends a request to a CoAP server and prints the
+// response's payload, much like libcoap's coap-client.
+//
+//	coap [flags] URL
+//
+// The URL's scheme may be coap, coap+tcp or coaps+tcp.  The command
+// has no DTLS implementation to plug in as a coap.DTLSTransport, so
+// coaps URLs aren't supported; coaps+tcp is secured with TLS instead.
+//
+// With -s, the resource is observed (RFC 7641), and each notification
+// printed as it arrives until the duration passes or the command is
+// interrupted.
+//
+// The command exits with status 1 on errors, including 4.xx and 5.xx
+// responses, and 2 on invalid flags.
+package main
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-coap"
+)
+
+var methods = map[string]coap.COAPCode{
+	"get":    coap.GET,
+	"post":   coap.POST,
+	"put":    coap.PUT,
+	"delete": coap.DELETE,
+	"fetch":  coap.FETCH,
+	"patch":  coap.PATCH,
+	"ipatch": coap.IPATCH,
+}
+
+var mediaTypes = map[string]coap.MediaType{
+	"text":         coap.TextPlain,
+	"text/plain":   coap.TextPlain,
+	"link":         coap.AppLinkFormat,
+	"link-format":  coap.AppLinkFormat,
+	"xml":          coap.AppXML,
+	"octets":       coap.AppOctets,
+	"octet-stream": coap.AppOctets,
+	"exi":          coap.AppExi,
+	"json":         coap.AppJSON,
+	"cbor":         coap.AppCBOR,
+}
+
+// parseMediaType parses a Content-Format by name, such as "json" or
+// "application/json", or by number.
+func parseMediaType(s string) (coap.MediaType, error) {
+	name := strings.TrimPrefix(strings.ToLower(s), "application/")
+	if mt, ok := mediaTypes[name]; ok {
+		return mt, nil
+	}
+	n, err := strconv.ParseUint(s, 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("unknown content format %q", s)
+	}
+	return coap.MediaType(n), nil
+}
+
+// An option is an option given with -O as number,value.  Decimal
+// values are sent as numbers, values starting with 0x as the bytes
+// they encode, and anything else as a string.
+type option struct {
+	id    coap.OptionID
+	value interface{}
+}
+
+func parseOption(s string) (option, error) {
+	parts := strings.SplitN(s, ",", 2)
+	id, err := strconv.ParseUint(parts[0], 10, 16)
+	if err != nil || len(parts) < 2 {
+		return option{}, fmt.Errorf("invalid option %q, want number,value", s)
+	}
+	o := option{id: coap.OptionID(id)}
+	v := parts[1]
+	if n, err := strconv.ParseUint(v, 10, 32); err == nil {
+		o.value = uint32(n)
+	} else if strings.HasPrefix(v, "0x") {
+		if o.value, err = hex.DecodeString(v[2:]); err != nil {
+			return option{}, fmt.Errorf("invalid option %q: %v", s, err)
+		}
+	} else {
+		o.value = v
+	}
+	return o, nil
+}
+
+type options []option
+
+func (o *options) String() string {
+	return fmt.Sprint(*o)
+}
+
+func (o *options) Set(s string) error {
+	opt, err := parseOption(s)
+	if err != nil {
+		return err
+	}
+	*o = append(*o, opt)
+	return nil
+}
+
+// A request describes the request to make, from the flags.
+type request struct {
+	method   string
+	url      string
+	proxy    string
+	payload  []byte
+	format   string
+	accept   string
+	token    string
+	nonConf  bool
+	observe  bool
+	options  options
+	insecure bool
+}
+
+// build makes the request's message, and returns it with the URL of
+// the endpoint to send it to: the proxy, if there is one.
+func (r request) build() (coap.Message, string, error) {
+	code, ok := methods[strings.ToLower(r.method)]
+	if !ok {
+		return coap.Message{}, "", fmt.Errorf("unknown method %q", r.method)
+	}
+
+	var m coap.Message
+	dest := r.url
+	if r.proxy != "" {
+		u, err := url.Parse(r.url)
+		if err != nil {
+			return coap.Message{}, "", err
+		}
+		m = coap.Message{Type: coap.Confirmable, Code: code}
+		m.SetOption(coap.ProxyURI, u.String())
+		dest = r.proxy
+	} else {
+		var err error
+		if m, err = coap.NewRequestFromURL(code, r.url); err != nil {
+			return coap.Message{}, "", err
+		}
+	}
+	if r.nonConf {
+		m.Type = coap.NonConfirmable
+	}
+
+	m.MessageID = randomMessageID()
+	if r.token != "" {
+		tok, err := hex.DecodeString(r.token)
+		if err != nil || len(tok) > 8 {
+			return coap.Message{}, "", fmt.Errorf("invalid token %q", r.token)
+		}
+		m.Token = tok
+	} else {
+		// Set here rather than by the client, to match the
+		// notifications of an observation.
+		var err error
+		if m.Token, err = coap.NewToken(coap.DefaultTokenLength); err != nil {
+			return coap.Message{}, "", err
+		}
+	}
+
+	if r.observe {
+		m.SetOption(coap.Observe, uint32(0))
+	}
+	if r.accept != "" {
+		mt, err := parseMediaType(r.accept)
+		if err != nil {
+			return coap.Message{}, "", err
+		}
+		m.SetOption(coap.Accept, mt)
+	}
+	if r.payload != nil {
+		m.Payload = r.payload
+		if r.format != "" {
+			mt, err := parseMediaType(r.format)
+			if err != nil {
+				return coap.Message{}, "", err
+			}
+			m.SetOption(coap.ContentFormat, mt)
+		}
+	}
+	for _, o := range r.options {
+		m.AddOption(o.id, o.value)
+	}
+	return m, dest, nil
+}
+
+func randomMessageID() uint16 {
+	var b [2]byte
+	rand.Read(b[:])
+	return uint16(b[0])<<8 | uint16(b[1])
+}
+
+func main() {
+	var r request
+	var file string
+	var observe time.Duration
+	var verbose bool
+	flag.StringVar(&r.method, "m", "get", "request method: get, post, put, delete, fetch, patch or ipatch")
+	flag.StringVar(&file, "f", "", "send the contents of `file` as the payload, - for stdin")
+	payload := flag.String("e", "", "send `text` as the payload")
+	flag.StringVar(&r.format, "t", "", "Content-Format of the payload, by name (json, cbor, text...) or number")
+	flag.StringVar(&r.accept, "A", "", "Accept option, by name or number")
+	flag.DurationVar(&observe, "s", 0, "observe the resource for `duration`")
+	flag.StringVar(&r.token, "T", "", "token, in `hex`")
+	flag.BoolVar(&r.nonConf, "N", false, "send a non-confirmable request")
+	flag.Var(&r.options, "O", "add the option `num,value`, repeatable")
+	flag.StringVar(&r.proxy, "P", "", "send the request through the proxy at `URL`")
+	flag.BoolVar(&r.insecure, "insecure", false, "don't verify the server's TLS certificate for coaps+tcp")
+	flag.BoolVar(&verbose, "v", false, "print the request and responses as JSON on stderr")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s [flags] URL\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	r.url = flag.Arg(0)
+	r.observe = observe > 0
+
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "e" {
+			r.payload = []byte(*payload)
+		}
+	})
+	if file != "" {
+		var err error
+		if r.payload, err = readFile(file); err != nil {
+			fatalf("Error reading payload: %v", err)
+		}
+	}
+
+	req, dest, err := r.build()
+	if err != nil {
+		fatalf("Error building request: %v", err)
+	}
+	if u, err := url.Parse(dest); err == nil && u.Scheme == "coaps" {
+		fatalf("coaps (DTLS) isn't supported, try coaps+tcp")
+	}
+	if r.insecure {
+		d := &coap.StreamDialer{TLSConfig: &tls.Config{InsecureSkipVerify: true}}
+		d.Register()
+	}
+
+	c, err := coap.DialURL(dest)
+	if err != nil {
+		fatalf("Error dialing: %v", err)
+	}
+	defer c.Close()
+
+	if verbose {
+		dump(req)
+	}
+	rv, err := c.Send(req)
+	if err != nil {
+		fatalf("Error sending request: %v", err)
+	}
+	if rv == nil {
+		// The response to a non-confirmable request isn't matched
+		// to it, so it comes through Receive.
+		if rv, err = c.Receive(); err != nil {
+			fatalf("Error receiving response: %v", err)
+		}
+	}
+	show(rv, verbose)
+	if rv.Code >= coap.BadRequest {
+		c.Close()
+		os.Exit(1)
+	}
+	if r.observe && rv.Option(coap.Observe) != nil {
+		watch(c, req, observe, verbose)
+	}
+}
+
+// watch prints the notifications for the observation registered by
+// req until d passes or the command is interrupted, then cancels it.
+func watch(c coap.Client, req coap.Message, d time.Duration, verbose bool) {
+	type result struct {
+		m   *coap.Message
+		err error
+	}
+	ch := make(chan result)
+	go func() {
+		for {
+			m, err := c.Receive()
+			if errors.Is(err, coap.ErrTimeout) {
+				continue
+			}
+			ch <- result{m, err}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	deadline := time.NewTimer(d)
+	defer deadline.Stop()
+	for {
+		select {
+		case res := <-ch:
+			if res.err != nil {
+				fatalf("Error receiving: %v", res.err)
+			}
+			m := res.m
+			if _, ok := c.(*coap.Conn); ok && m.IsConfirmable() {
+				c.Send(coap.Message{Type: coap.Acknowledgement, MessageID: m.MessageID})
+			}
+			if string(m.Token) == string(req.Token) {
+				show(m, verbose)
+			}
+		case <-interrupt:
+			cancel(c, req)
+			return
+		case <-deadline.C:
+			cancel(c, req)
+			return
+		}
+	}
+}
+
+// cancel deregisters the observation registered by req.
+func cancel(c coap.Client, req coap.Message) {
+	req.MessageID = randomMessageID()
+	req.SetOption(coap.Observe, uint32(1))
+	if _, err := c.Send(req); err != nil {
+		fatalf("Error cancelling observation: %v", err)
+	}
+}
+
+func show(m *coap.Message, verbose bool) {
+	if verbose {
+		dump(*m)
+	} else if m.Code >= coap.BadRequest {
+		fmt.Fprintf(os.Stderr, "%d.%02d %v\n", m.Code>>5, m.Code&0x1f, m.Code)
+	}
+	os.Stdout.Write(m.Payload)
+	if len(m.Payload) > 0 && m.Payload[len(m.Payload)-1] != '\n' {
+		fmt.Println()
+	}
+}
+
+func dump(m coap.Message) {
+	b, err := json.Marshal(m)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", m)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "%s\n", b)
+}
+
+func readFile(name string) ([]byte, error) {
+	if name == "-" {
+		return io.ReadAll(os.Stdin)
+	}
+	return os.ReadFile(name)
+}
+
+func fatalf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+	os.Exit(1)
+}
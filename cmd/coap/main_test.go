@@ -0,0 +1,74 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/dustin/go-coap"
+)
+
+func TestParseOption(t *testing.T) {
+	tests := []struct {
+		in  string
+		exp option
+		err bool
+	}{
+		{"14,60", option{coap.MaxAge, uint32(60)}, false},
+		{"4,0xbeef", option{coap.ETag, []byte{0xbe, 0xef}}, false},
+		{"15,a=b,c", option{coap.URIQuery, "a=b,c"}, false},
+		{"65000,", option{65000, ""}, false},
+		{"x,1", option{}, true},
+		{"14", option{}, true},
+		{"4,0xzz", option{}, true},
+	}
+	for _, test := range tests {
+		o, err := parseOption(test.in)
+		if (err != nil) != test.err || !reflect.DeepEqual(o, test.exp) {
+			t.Errorf("parseOption(%q) = %v, %v, wanted %v", test.in, o, err, test.exp)
+		}
+	}
+}
+
+func TestBuildRequest(t *testing.T) {
+	r := request{
+		method:  "put",
+		url:     "coap://example.com/a/b?x=1",
+		payload: []byte("{}"),
+		format:  "application/json",
+		accept:  "60",
+		token:   "0102",
+		options: options{{coap.IfNoneMatch, []byte{}}},
+	}
+	m, dest, err := r.build()
+	if err != nil {
+		t.Fatalf("Error building request: %v", err)
+	}
+	if dest != r.url || m.Code != coap.PUT || m.Type != coap.Confirmable ||
+		m.PathString() != "a/b" || string(m.Token) != "\x01\x02" {
+		t.Errorf("Unexpected request to %v: %v", dest, m)
+	}
+	if m.Option(coap.ContentFormat) != coap.AppJSON || m.Option(coap.Accept) != coap.AppCBOR ||
+		m.Option(coap.IfNoneMatch) == nil || string(m.Payload) != "{}" {
+		t.Errorf("Unexpected options or payload: %v", m)
+	}
+
+	r = request{method: "get", url: "coap://example.com/x", proxy: "coap://proxy", nonConf: true, observe: true}
+	if m, dest, err = r.build(); err != nil {
+		t.Fatalf("Error building proxy request: %v", err)
+	}
+	if dest != "coap://proxy" || m.Type != coap.NonConfirmable || m.Option(coap.ProxyURI) != "coap://example.com/x" ||
+		m.Option(coap.Observe) != uint32(0) || len(m.Token) != coap.DefaultTokenLength {
+		t.Errorf("Unexpected proxy request to %v: %v", dest, m)
+	}
+
+	for _, r := range []request{
+		{method: "brew", url: "coap://example.com/"},
+		{method: "get", url: "http://example.com/"},
+		{method: "get", url: "coap://example.com/", token: "001122334455667788"},
+		{method: "post", url: "coap://example.com/", payload: []byte("x"), format: "yaml"},
+	} {
+		if _, _, err := r.build(); err == nil {
+			t.Errorf("Expected an error building %+v", r)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package coapws
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+
+	"github.com/dustin/go-coap"
+)
+
+// Path is where CoAP over WebSocket endpoints are served (RFC 8323
+// section 8.3).
+const Path = "/.well-known/coap"
+
+// A Dialer contains options for connecting to a CoAP over WebSocket
+// endpoint.  The zero value is a usable Dialer.
+type Dialer struct {
+	// Header holds extra headers for the opening handshake, such
+	// as Authorization.
+	Header http.Header
+	// Proxy picks the proxy to tunnel through for a handshake
+	// request, if any (see coap.DialProxy).  Nil means
+	// http.ProxyFromEnvironment.
+	Proxy func(*http.Request) (*url.URL, error)
+	// TLSConfig is used for coaps+ws URLs.  Nil means the
+	// default configuration.
+	TLSConfig *tls.Config
+}
+
+func init() {
+	var d Dialer
+	d.Register()
+}
+
+// Register makes coap.DialURL use d for coap+ws and coaps+ws URLs.
+func (d *Dialer) Register() {
+	dial := func(u *url.URL) (coap.Client, error) {
+		c, err := d.dialURL(u)
+		if err != nil {
+			return nil, err
+		}
+		return coap.StreamClient(c), nil
+	}
+	coap.RegisterScheme("coap+ws", dial)
+	coap.RegisterScheme("coaps+ws", dial)
+}
+
+// Dial connects to the CoAP over WebSocket endpoint of a coap+ws or
+// coaps+ws URL.
+func Dial(rawurl string) (*coap.StreamConn, error) {
+	var d Dialer
+	return d.Dial(rawurl)
+}
+
+// Dial connects to the CoAP over WebSocket endpoint of a coap+ws or
+// coaps+ws URL using the dialer's options.
+func (d *Dialer) Dial(rawurl string) (*coap.StreamConn, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	return d.dialURL(u)
+}
+
+func (d *Dialer) dialURL(u *url.URL) (*coap.StreamConn, error) {
+	secure := false
+	port := 80
+	switch u.Scheme {
+	case "coap+ws":
+	case "coaps+ws":
+		secure, port = true, 443
+	default:
+		return nil, fmt.Errorf("coapws: unsupported scheme %q", u.Scheme)
+	}
+
+	hu := &url.URL{Scheme: "http", Host: coap.HostPort(u, port), Path: Path}
+	if secure {
+		hu.Scheme = "https"
+	}
+	req, err := http.NewRequest("GET", hu.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, vs := range d.Header {
+		req.Header[k] = vs
+	}
+
+	proxy := d.Proxy
+	if proxy == nil {
+		proxy = http.ProxyFromEnvironment
+	}
+	pu, err := proxy(req)
+	if err != nil {
+		return nil, err
+	}
+
+	var nc net.Conn
+	if pu != nil {
+		nc, err = coap.DialProxy(pu, hu.Host)
+	} else {
+		nc, err = net.Dial("tcp", hu.Host)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if secure {
+		cfg := &tls.Config{}
+		if d.TLSConfig != nil {
+			cfg = d.TLSConfig.Clone()
+		}
+		if cfg.ServerName == "" {
+			cfg.ServerName = u.Hostname()
+		}
+		nc = tls.Client(nc, cfg)
+	}
+
+	c, err := clientHandshake(nc, req)
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	return coap.NewTransportConn(transport{c}), nil
+}
+
+func clientHandshake(nc net.Conn, req *http.Request) (*wsConn, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce)
+
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Protocol", protocol)
+	if err := req.Write(nc); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(nc)
+	res, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		return nil, fmt.Errorf("coapws: handshake failed: %v", res.Status)
+	}
+	if res.Header.Get("Sec-WebSocket-Accept") != acceptKey(key) ||
+		res.Header.Get("Sec-WebSocket-Protocol") != protocol {
+		return nil, errors.New("coapws: invalid handshake response")
+	}
+	return newConn(nc, br, true), nil
+}
+
+// transport carries CoAP messages in WebSocket messages.
+type transport struct {
+	c *wsConn
+}
+
+func (t transport) ReadMessage() (*coap.TcpMessage, error) {
+	data, err := t.c.readMessage()
+	if err != nil {
+		return nil, err
+	}
+	m := &coap.TcpMessage{}
+	return m, m.UnmarshalWebSocket(data)
+}
+
+func (t transport) WriteMessage(m *coap.TcpMessage) error {
+	data, err := m.MarshalWebSocket()
+	if err != nil {
+		return err
+	}
+	return t.c.writeMessage(data)
+}
+
+func (t transport) Close() error {
+	return t.c.close()
+}
+
+func (t transport) LocalAddr() net.Addr  { return t.c.nc.LocalAddr() }
+func (t transport) RemoteAddr() net.Addr { return t.c.nc.RemoteAddr() }
@@ -0,0 +1,107 @@
+package coapws
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/dustin/go-coap"
+)
+
+func TestDialURL(t *testing.T) {
+	h := Handler(coap.FuncHandler(echoHandler))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != Path || r.Header.Get("Authorization") != "Bearer x" {
+			http.Error(w, "no", http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	d := &Dialer{
+		Header: http.Header{"Authorization": {"Bearer x"}},
+		Proxy:  func(*http.Request) (*url.URL, error) { return nil, nil },
+	}
+	d.Register()
+	defer (&Dialer{}).Register()
+
+	c, err := coap.DialURL("coap+ws://" + strings.TrimPrefix(srv.URL, "http://") + "/world")
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	defer c.Close()
+
+	req := coap.Message{Code: coap.GET, Token: []byte("t")}
+	req.SetPathString("/world")
+	rv, err := c.Send(req)
+	if err != nil {
+		t.Fatalf("Error sending: %v", err)
+	}
+	if string(rv.Payload) != "hello world" {
+		t.Errorf("Unexpected response: %q", rv.Payload)
+	}
+}
+
+// connectProxy is an HTTP proxy that only tunnels.
+func connectProxy(tunnels *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "CONNECT" {
+			http.Error(w, "tunnels only", http.StatusMethodNotAllowed)
+			return
+		}
+		up, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		atomic.AddInt32(tunnels, 1)
+		down, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			up.Close()
+			return
+		}
+		io.WriteString(down, "HTTP/1.1 200 Connection established\r\n\r\n")
+		go func() {
+			io.Copy(up, down)
+			up.Close()
+		}()
+		io.Copy(down, up)
+		down.Close()
+	}))
+}
+
+func TestDialThroughProxy(t *testing.T) {
+	srv := httptest.NewServer(Handler(coap.FuncHandler(echoHandler)))
+	defer srv.Close()
+
+	var tunnels int32
+	proxy := connectProxy(&tunnels)
+	defer proxy.Close()
+	pu, _ := url.Parse(proxy.URL)
+
+	d := &Dialer{Proxy: http.ProxyURL(pu)}
+	c, err := d.Dial("coap+ws://" + strings.TrimPrefix(srv.URL, "http://"))
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	defer c.Close()
+
+	req := coap.TcpMessage{Message: coap.Message{Code: coap.GET, Token: []byte("p")}}
+	req.SetPathString("/proxied")
+	rv, err := c.Send(req)
+	if err != nil {
+		t.Fatalf("Error sending: %v", err)
+	}
+	if string(rv.Payload) != "hello proxied" {
+		t.Errorf("Unexpected response: %q", rv.Payload)
+	}
+	if atomic.LoadInt32(&tunnels) != 1 {
+		t.Errorf("Expected one tunnel through the proxy, got %v", tunnels)
+	}
+}
@@ -0,0 +1,129 @@
+// Package coapws carries CoAP over WebSockets (RFC 8323 section 4).
+package coapws
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/dustin/go-coap"
+)
+
+// Handler returns an http.Handler that accepts CoAP over WebSocket
+// connections and serves the requests arriving on them with h.  It
+// can be mounted alongside other handlers, e.g. at /.well-known/coap.
+//
+// h is given a nil *net.UDPConn and the client's address.
+func Handler(h coap.Handler) http.Handler {
+	return wsHandler{h}
+}
+
+// Serve accepts HTTP connections on l and serves CoAP over WebSocket
+// requests at Path with h.
+func Serve(l net.Listener, h coap.Handler) error {
+	return http.Serve(l, mux(h))
+}
+
+// ListenAndServe listens on the TCP address addr and serves CoAP over
+// WebSocket requests (coap+ws URLs) at Path with h.
+func ListenAndServe(addr string, h coap.Handler) error {
+	return http.ListenAndServe(addr, mux(h))
+}
+
+// ListenAndServeTLS is like ListenAndServe for coaps+ws URLs, using
+// the given certificate and key files.
+func ListenAndServeTLS(addr, certFile, keyFile string, h coap.Handler) error {
+	return http.ListenAndServeTLS(addr, certFile, keyFile, mux(h))
+}
+
+func mux(h coap.Handler) http.Handler {
+	m := http.NewServeMux()
+	m.Handle(Path, Handler(h))
+	return m
+}
+
+type wsHandler struct {
+	h coap.Handler
+}
+
+func headerContains(hdr http.Header, name, token string) bool {
+	for _, v := range hdr[http.CanonicalHeaderKey(name)] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (wh wsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != "GET" || key == "" ||
+		!headerContains(r.Header, "Connection", "upgrade") ||
+		!headerContains(r.Header, "Upgrade", "websocket") ||
+		r.Header.Get("Sec-WebSocket-Version") != "13" {
+		http.Error(w, "expected a WebSocket handshake", http.StatusBadRequest)
+		return
+	}
+	if !headerContains(r.Header, "Sec-WebSocket-Protocol", protocol) {
+		http.Error(w, "expected the coap subprotocol", http.StatusBadRequest)
+		return
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "can't take over the connection", http.StatusInternalServerError)
+		return
+	}
+	nc, brw, err := hj.Hijack()
+	if err != nil {
+		return
+	}
+
+	brw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + acceptKey(key) + "\r\n" +
+		"Sec-WebSocket-Protocol: " + protocol + "\r\n\r\n")
+	if err := brw.Flush(); err != nil {
+		nc.Close()
+		return
+	}
+
+	a, _ := net.ResolveUDPAddr("udp", r.RemoteAddr)
+	serve(newConn(nc, brw.Reader, false), a, wh.h)
+}
+
+func serve(c *wsConn, a *net.UDPAddr, h coap.Handler) {
+	t := transport{c}
+	defer t.Close()
+
+	// Each side starts with its capabilities (RFC 8323 section
+	// 5.3); we have nothing to announce.
+	if err := t.WriteMessage(&coap.TcpMessage{Message: coap.Message{Code: coap.CSM}}); err != nil {
+		return
+	}
+
+	for {
+		m, err := t.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		switch m.Code {
+		case coap.Ping:
+			t.WriteMessage(&coap.TcpMessage{Message: coap.Message{Code: coap.Pong, Token: m.Token}})
+		case coap.Release, coap.Abort:
+			return
+		case coap.CSM, coap.Pong:
+		default:
+			go func() {
+				rv := h.ServeCOAP(nil, a, &m.Message)
+				if rv != nil {
+					t.WriteMessage(&coap.TcpMessage{Message: *rv})
+				}
+			}()
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package coapws
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/dustin/go-coap"
+)
+
+func echoHandler(l *net.UDPConn, a *net.UDPAddr, m *coap.Message) *coap.Message {
+	return &coap.Message{
+		Code:    coap.Content,
+		Token:   m.Token,
+		Payload: []byte("hello " + m.PathString()),
+	}
+}
+
+// handshake opens a client WebSocket to srv.
+func handshake(t *testing.T, srv *httptest.Server, path string) *wsConn {
+	nc, err := net.Dial("tcp", strings.TrimPrefix(srv.URL, "http://"))
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	req, _ := http.NewRequest("GET", srv.URL+path, nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	req.Header.Set("Sec-WebSocket-Protocol", "coap")
+	if err := req.Write(nc); err != nil {
+		t.Fatalf("Error writing handshake: %v", err)
+	}
+
+	br := bufio.NewReader(nc)
+	res, err := http.ReadResponse(br, req)
+	if err != nil {
+		t.Fatalf("Error reading handshake: %v", err)
+	}
+	if res.StatusCode != http.StatusSwitchingProtocols ||
+		res.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("Unexpected handshake response: %v %v", res.Status, res.Header)
+	}
+	return newConn(nc, br, true)
+}
+
+func TestHandlerMounted(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.Handle("/.well-known/coap", Handler(coap.FuncHandler(echoHandler)))
+	mux.HandleFunc("/rest", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("rest"))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	c := transport{handshake(t, srv, "/.well-known/coap")}
+	defer c.Close()
+
+	req := coap.TcpMessage{Message: coap.Message{Code: coap.GET, Token: []byte("t")}}
+	req.SetPathString("/world")
+	if err := c.WriteMessage(&req); err != nil {
+		t.Fatalf("Error sending: %v", err)
+	}
+
+	var codes []coap.COAPCode
+	for len(codes) < 2 {
+		m, err := c.ReadMessage()
+		if err != nil {
+			t.Fatalf("Error reading: %v", err)
+		}
+		codes = append(codes, m.Code)
+		if m.Code == coap.Content && string(m.Payload) != "hello world" {
+			t.Errorf("Unexpected response: %q", m.Payload)
+		}
+	}
+	if codes[0] != coap.CSM || codes[1] != coap.Content {
+		t.Errorf("Expected CSM then Content, got %v", codes)
+	}
+
+	res, err := http.Get(srv.URL + "/rest")
+	if err != nil {
+		t.Fatalf("Error getting REST endpoint: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("Expected the REST endpoint alongside, got %v", res.Status)
+	}
+}
+
+func TestHandlerRejectsUnmaskedFrames(t *testing.T) {
+	srv := httptest.NewServer(Handler(coap.FuncHandler(echoHandler)))
+	defer srv.Close()
+
+	c := handshake(t, srv, "/")
+	defer c.nc.Close()
+	c.client = false
+	if err := c.writeMessage([]byte{0x01, 0x01}); err != nil {
+		t.Fatalf("Error sending: %v", err)
+	}
+	c.client = true
+
+	for {
+		_, op, payload, err := c.readFrame()
+		if err != nil {
+			t.Fatalf("Expected a close frame, got %v", err)
+		}
+		if op == opClose {
+			if len(payload) < 2 || payload[0] != 0x03 || payload[1] != 0xea {
+				t.Errorf("Expected status 1002, got %x", payload)
+			}
+			break
+		}
+	}
+}
+
+func TestHandlerRejectsPlainHTTP(t *testing.T) {
+	srv := httptest.NewServer(Handler(coap.FuncHandler(echoHandler)))
+	defer srv.Close()
+
+	res, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("Error getting: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a plain request, got %v", res.Status)
+	}
+}
+
+func TestServe(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	defer l.Close()
+	go Serve(l, coap.FuncHandler(echoHandler))
+
+	d := &Dialer{Proxy: func(*http.Request) (*url.URL, error) { return nil, nil }}
+	c, err := d.Dial("coap+ws://" + l.Addr().String())
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	defer c.Close()
+
+	req := coap.TcpMessage{Message: coap.Message{Code: coap.GET, Token: []byte("t")}}
+	req.SetPathString("/served")
+	rv, err := c.Send(req)
+	if err != nil {
+		t.Fatalf("Error sending: %v", err)
+	}
+	if string(rv.Payload) != "hello served" {
+		t.Errorf("Unexpected response: %q", rv.Payload)
+	}
+}
+
+func TestServeRequestFunc(t *testing.T) {
+	late := make(chan error, 1)
+	mux := coap.NewServeMux()
+	mux.Handle("/now", coap.RequestFunc(func(r *coap.Request) {
+		r.Respond(coap.Message{Code: coap.Content, Payload: []byte("now")})
+	}))
+	mux.Handle("/late", coap.RequestFunc(func(r *coap.Request) {
+		go func() { late <- r.Respond(coap.Message{Code: coap.Content}) }()
+	}))
+	srv := httptest.NewServer(Handler(mux))
+	defer srv.Close()
+
+	c := transport{handshake(t, srv, "/")}
+	defer c.Close()
+	if m, err := c.ReadMessage(); err != nil || m.Code != coap.CSM {
+		t.Fatalf("Expected CSM, got %v, %v", m, err)
+	}
+
+	req := coap.TcpMessage{Message: coap.Message{Code: coap.GET, Token: []byte("t")}}
+	req.SetPathString("/now")
+	if err := c.WriteMessage(&req); err != nil {
+		t.Fatalf("Error sending: %v", err)
+	}
+	m, err := c.ReadMessage()
+	if err != nil {
+		t.Fatalf("Error reading: %v", err)
+	}
+	if m.Code != coap.Content || string(m.Token) != "t" || string(m.Payload) != "now" {
+		t.Errorf("Unexpected response: %v", m)
+	}
+
+	req.SetPathString("/late")
+	if err := c.WriteMessage(&req); err != nil {
+		t.Fatalf("Error sending: %v", err)
+	}
+	if err := <-late; err != coap.ErrNoTransport {
+		t.Errorf("Expected ErrNoTransport responding late, got %v", err)
+	}
+}
@@ -0,0 +1,212 @@
+package coapws
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+// The subset of RFC 6455 CoAP needs: binary messages, plus the
+// control frames.
+
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xa
+)
+
+// maxMessageLen bounds the size of a received message.
+const maxMessageLen = 8 << 20
+
+const handshakeGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// protocol is the WebSocket subprotocol for CoAP (RFC 8323 section
+// 4.1).
+const protocol = "coap"
+
+var errMessageTooLarge = errors.New("websocket message too large")
+
+// errMasking is reported for an unmasked frame from a client, or a
+// masked one from a server (RFC 6455 section 5.1).
+var errMasking = errors.New("websocket frame masked wrongly")
+
+// Close status codes (RFC 6455 section 7.4.1).
+const (
+	closeNormal   = 1000
+	closeProtocol = 1002
+)
+
+func acceptKey(key string) string {
+	h := sha1.Sum([]byte(key + handshakeGUID))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// wsConn is one end of a WebSocket connection.
+type wsConn struct {
+	nc     net.Conn
+	br     *bufio.Reader
+	client bool
+
+	wmu sync.Mutex
+}
+
+func newConn(nc net.Conn, br *bufio.Reader, client bool) *wsConn {
+	if br == nil {
+		br = bufio.NewReader(nc)
+	}
+	return &wsConn{nc: nc, br: br, client: client}
+}
+
+func (c *wsConn) readFrame() (fin bool, op byte, payload []byte, err error) {
+	hdr := make([]byte, 2)
+	if _, err := io.ReadFull(c.br, hdr); err != nil {
+		return false, 0, nil, err
+	}
+	fin = hdr[0]&0x80 != 0
+	op = hdr[0] & 0xf
+	masked := hdr[1]&0x80 != 0
+	if masked == c.client {
+		return false, 0, nil, errMasking
+	}
+
+	n := uint64(hdr[1] & 0x7f)
+	switch n {
+	case 126:
+		ext := make([]byte, 2)
+		if _, err := io.ReadFull(c.br, ext); err != nil {
+			return false, 0, nil, err
+		}
+		n = uint64(binary.BigEndian.Uint16(ext))
+	case 127:
+		ext := make([]byte, 8)
+		if _, err := io.ReadFull(c.br, ext); err != nil {
+			return false, 0, nil, err
+		}
+		n = binary.BigEndian.Uint64(ext)
+	}
+	if n > maxMessageLen {
+		return false, 0, nil, errMessageTooLarge
+	}
+
+	var mask [4]byte
+	if masked {
+		if _, err := io.ReadFull(c.br, mask[:]); err != nil {
+			return false, 0, nil, err
+		}
+	}
+	payload = make([]byte, n)
+	if _, err := io.ReadFull(c.br, payload); err != nil {
+		return false, 0, nil, err
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return fin, op, payload, nil
+}
+
+// readMessage returns the next binary message, answering control
+// frames on the way.  A close frame from the peer yields io.EOF.
+func (c *wsConn) readMessage() ([]byte, error) {
+	var msg []byte
+	var op byte
+	for {
+		fin, fop, payload, err := c.readFrame()
+		if err == errMasking {
+			c.closeWith(closeProtocol)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch fop {
+		case opPing:
+			if err := c.writeFrame(opPong, payload); err != nil {
+				return nil, err
+			}
+			continue
+		case opPong:
+			continue
+		case opClose:
+			c.writeFrame(opClose, payload)
+			return nil, io.EOF
+		case opContinuation:
+		default:
+			op = fop
+			msg = msg[:0]
+		}
+
+		if len(msg)+len(payload) > maxMessageLen {
+			return nil, errMessageTooLarge
+		}
+		msg = append(msg, payload...)
+		if fin && op == opBinary {
+			return msg, nil
+		}
+	}
+}
+
+func (c *wsConn) writeFrame(op byte, payload []byte) error {
+	frame := make([]byte, 0, 14+len(payload))
+	frame = append(frame, 0x80|op)
+
+	var maskBit byte
+	if c.client {
+		maskBit = 0x80
+	}
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, maskBit|byte(n))
+	case n <= 0xffff:
+		frame = append(frame, maskBit|126, byte(n>>8), byte(n))
+	default:
+		ext := make([]byte, 8)
+		binary.BigEndian.PutUint64(ext, uint64(n))
+		frame = append(append(frame, maskBit|127), ext...)
+	}
+
+	if c.client {
+		// Clients must mask everything they send.
+		var mask [4]byte
+		if _, err := rand.Read(mask[:]); err != nil {
+			return err
+		}
+		frame = append(frame, mask[:]...)
+		for i, b := range payload {
+			frame = append(frame, b^mask[i%4])
+		}
+	} else {
+		frame = append(frame, payload...)
+	}
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	_, err := c.nc.Write(frame)
+	return err
+}
+
+func (c *wsConn) writeMessage(data []byte) error {
+	return c.writeFrame(opBinary, data)
+}
+
+// close sends a normal closure and closes the connection.
+func (c *wsConn) close() error {
+	return c.closeWith(closeNormal)
+}
+
+// closeWith sends a close frame with the status code and closes the
+// connection.
+func (c *wsConn) closeWith(code uint16) error {
+	c.writeFrame(opClose, []byte{byte(code >> 8), byte(code)})
+	return c.nc.Close()
+}
@@ -0,0 +1,127 @@
+package coap
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// maxRTO bounds the retransmission timeouts CoCoA picks.
+const maxRTO = 32 * time.Second
+
+// CoCoA adapts the retransmission timeouts of confirmable messages to
+// the round-trip times measured to each peer, following the CoCoA
+// congestion control for CoAP (draft-ietf-core-cocoa).  Without one,
+// the timeouts start at a random point between ACK_TIMEOUT and
+// ACK_TIMEOUT * ACK_RANDOM_FACTOR and double with every
+// retransmission.
+//
+// The zero value is ready to use.  A nil CoCoA uses the fixed
+// timeouts.
+type CoCoA struct {
+	mu    sync.Mutex
+	peers map[string]*cocoaPeer
+}
+
+// cocoaPeer is what's known about the round trips to one peer.
+type cocoaPeer struct {
+	strong, weak rttEstimator
+	rto          time.Duration
+	updated      time.Time
+}
+
+// rttEstimator smooths RTT measurements as RFC 6298 does, with k
+// weighing the variance in the RTO.
+type rttEstimator struct {
+	srtt, rttvar time.Duration
+}
+
+func (e *rttEstimator) measure(rtt time.Duration, k time.Duration) time.Duration {
+	if e.srtt == 0 {
+		e.srtt, e.rttvar = rtt, rtt/2
+	} else {
+		diff := e.srtt - rtt
+		if diff < 0 {
+			diff = -diff
+		}
+		e.rttvar = e.rttvar*3/4 + diff/4
+		e.srtt = e.srtt*7/8 + rtt/8
+	}
+	return e.srtt + k*e.rttvar
+}
+
+// RTO returns the current overall retransmission timeout for a,
+// before dithering.  It starts out as the default ACK_TIMEOUT.
+func (c *CoCoA) RTO(a net.Addr) time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.peer(a.String(), ackTimeout, time.Now()).rto
+}
+
+// peer returns the state for addr, which starts out with the timeout
+// initial, aging a timeout that wasn't updated in a while back
+// towards the initial one.
+func (c *CoCoA) peer(addr string, initial time.Duration, now time.Time) *cocoaPeer {
+	if c.peers == nil {
+		c.peers = map[string]*cocoaPeer{}
+	}
+	p := c.peers[addr]
+	if p == nil {
+		p = &cocoaPeer{rto: initial, updated: now}
+		c.peers[addr] = p
+	}
+	idle := now.Sub(p.updated)
+	switch {
+	case p.rto < time.Second && idle > 16*p.rto:
+		p.rto *= 2
+		p.updated = now
+	case p.rto > 3*time.Second && idle > 4*p.rto:
+		p.rto = time.Second + p.rto/2
+		p.updated = now
+	}
+	return p
+}
+
+// timeouts returns the initial timeout for a message to a and the
+// factor later ones grow by.
+func (c *CoCoA) timeouts(a net.Addr, p TransmissionParams) (time.Duration, float64) {
+	if c == nil {
+		return p.dither(p.AckTimeout), 2
+	}
+	c.mu.Lock()
+	rto := c.peer(a.String(), p.AckTimeout, time.Now()).rto
+	c.mu.Unlock()
+
+	backoff := 2.0
+	switch {
+	case rto < time.Second:
+		backoff = 3
+	case rto > 3*time.Second:
+		backoff = 1.5
+	}
+	return p.dither(rto), backoff
+}
+
+// measured records the round trip of a message to a that was
+// answered after the given number of transmissions, rtt after the
+// first.  Answers to the first transmission feed the strong
+// estimator; those to the second or third the weak one.  Later ones
+// are ambiguous and ignored.
+func (c *CoCoA) measured(a net.Addr, rtt time.Duration, transmissions int) {
+	if c == nil || transmissions > 3 {
+		return
+	}
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p := c.peer(a.String(), ackTimeout, now)
+	if transmissions == 1 {
+		p.rto = p.rto/2 + p.strong.measure(rtt, 4)/2
+	} else {
+		p.rto = p.rto*3/4 + p.weak.measure(rtt, 1)/4
+	}
+	if p.rto > maxRTO {
+		p.rto = maxRTO
+	}
+	p.updated = now
+}
@@ -0,0 +1,106 @@
+package coap
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCoCoAEstimators(t *testing.T) {
+	a := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5683}
+	var cc CoCoA
+	if rto := cc.RTO(a); rto != ackTimeout {
+		t.Fatalf("Expected initial RTO %v, got %v", ackTimeout, rto)
+	}
+
+	tests := []struct {
+		rtt           time.Duration
+		transmissions int
+		exp           time.Duration
+	}{
+		// Strong: 100ms + 4*50ms, weighed half.
+		{100 * time.Millisecond, 1, 1150 * time.Millisecond},
+		// Weak: 100ms + 50ms, weighed a quarter.
+		{100 * time.Millisecond, 2, 900 * time.Millisecond},
+		// Too ambiguous to count.
+		{10 * time.Second, 4, 900 * time.Millisecond},
+	}
+	for _, test := range tests {
+		cc.measured(a, test.rtt, test.transmissions)
+		if rto := cc.RTO(a); rto != test.exp {
+			t.Errorf("After %v in %v transmissions: expected RTO %v, got %v",
+				test.rtt, test.transmissions, test.exp, rto)
+		}
+	}
+
+	timeout, backoff := cc.timeouts(a, TransmissionParams{}.withDefaults())
+	if timeout < 900*time.Millisecond || timeout > 1350*time.Millisecond || backoff != 3 {
+		t.Errorf("Expected a timeout from 900ms to 1.35s backing off by 3, got %v, %v",
+			timeout, backoff)
+	}
+
+	// A short RTO that's not been updated in a while doubles.
+	cc.peers[a.String()].updated = time.Now().Add(-time.Minute)
+	if rto := cc.RTO(a); rto != 1800*time.Millisecond {
+		t.Errorf("Expected the aged RTO to be 1.8s, got %v", rto)
+	}
+}
+
+func TestCoCoATransmit(t *testing.T) {
+	l, addr := startUDPLisenter(t)
+	defer l.Close()
+	go Serve(l, FuncHandler(func(l *net.UDPConn, a *net.UDPAddr, m *Message) *Message {
+		return nil
+	}))
+
+	peer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	defer peer.Close()
+	go func() {
+		buf := make([]byte, DefaultReadBufferSize)
+		for {
+			m, err := Receive(peer, buf)
+			if err != nil {
+				return
+			}
+			Transmit(peer, l.LocalAddr().(*net.UDPAddr),
+				Message{Type: Acknowledgement, MessageID: m.MessageID})
+		}
+	}()
+
+	var cc CoCoA
+	a := peer.LocalAddr().(*net.UDPAddr)
+	for i := 0; i < 3; i++ {
+		m := Message{Type: Confirmable, Code: Content, MessageID: uint16(i)}
+		if _, err := transmitConfirmable(l, a, m, TransmissionParams{}, telemetry{}, &cc); err != nil {
+			t.Fatalf("Error sending to %v: %v", addr, err)
+		}
+	}
+	if rto := cc.RTO(a); rto >= ackTimeout/4 {
+		t.Errorf("Expected the RTO to drop with quick ACKs, got %v", rto)
+	}
+}
+
+func TestCoCoAClient(t *testing.T) {
+	l, addr := startUDPLisenter(t)
+	defer l.Close()
+	go Serve(l, FuncHandler(contentHandler))
+
+	var cc CoCoA
+	d := Dialer{CoCoA: &cc}
+	c, err := d.Dial("udp", addr)
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	defer c.Close()
+	for i := 0; i < 3; i++ {
+		if _, err := c.Send(Message{Type: Confirmable, Code: GET, MessageID: uint16(i)}); err != nil {
+			t.Fatalf("Error sending: %v", err)
+		}
+	}
+	if rto := cc.RTO(l.LocalAddr()); rto >= ackTimeout/4 {
+		t.Errorf("Expected the RTO to drop with quick responses, got %v", rto)
+	}
+}
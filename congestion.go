@@ -0,0 +1,88 @@
+package coap
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// DefaultNStart is NSTART, how many confirmable requests a Conn has
+// outstanding at once unless its Limits say otherwise (RFC 7252
+// section 4.7).
+const DefaultNStart = 1
+
+// Limits are the congestion control limits of a Conn (RFC 7252
+// section 4.7).
+type Limits struct {
+	// NStart is how many confirmable requests may be outstanding
+	// at once, waiting for their ACK or response.  Further ones
+	// wait their turn.  Zero means DefaultNStart.
+	NStart int
+	// ProbingRate, if positive, is the average rate in bytes per
+	// second non-confirmable messages are sent at.  RFC 7252 calls
+	// for 1 with peers that don't respond.  Zero means no limit.
+	ProbingRate float64
+}
+
+// SetLimits replaces the congestion control limits of the
+// connection.  Requests already outstanding don't count against the
+// new NStart.
+func (c *Conn) SetLimits(l Limits) {
+	n := l.NStart
+	if n <= 0 {
+		n = DefaultNStart
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.slots = make(chan struct{}, n)
+	c.probingRate = l.ProbingRate
+}
+
+// startExchange waits until a confirmable request may be sent,
+// returning the function that ends its exchange.  That may be called
+// more than once.
+func (c *Conn) startExchange(ctx context.Context) (func(), error) {
+	c.mu.Lock()
+	slots := c.slots
+	c.mu.Unlock()
+	select {
+	case slots <- struct{}{}:
+	case <-c.done:
+		return nil, c.err()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	var once sync.Once
+	return func() { once.Do(func() { <-slots }) }, nil
+}
+
+// pace waits until a non-confirmable message of n bytes may be sent
+// without exceeding the probing rate, or until ctx is done.
+func (c *Conn) pace(ctx context.Context, n int) error {
+	c.mu.Lock()
+	if c.probingRate <= 0 {
+		c.mu.Unlock()
+		return nil
+	}
+	at := c.nextNon
+	if now := time.Now(); at.Before(now) {
+		at = now
+	}
+	c.nextNon = at.Add(time.Duration(float64(n) / c.probingRate * float64(time.Second)))
+	c.mu.Unlock()
+
+	wait := time.Until(at)
+	if wait <= 0 {
+		return nil
+	}
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-c.done:
+		return c.err()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,91 @@
+package coap
+
+import (
+	"testing"
+	"time"
+)
+
+func TestConnNStart(t *testing.T) {
+	l, addr := startUDPLisenter(t)
+	defer l.Close()
+	arrived := make(chan uint16, 10)
+	release := make(chan struct{})
+	go Serve(l, RequestFunc(func(r *Request) {
+		arrived <- r.Msg.MessageID
+		<-release
+		r.Respond(Message{Code: Content})
+	}))
+
+	c, err := Dial("udp", addr)
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	defer c.Close()
+
+	// count returns how many requests reach the server before it
+	// goes quiet.
+	count := func() int {
+		n := 0
+		for {
+			select {
+			case <-arrived:
+				n++
+			case <-time.After(100 * time.Millisecond):
+				return n
+			}
+		}
+	}
+
+	tests := []struct {
+		limits Limits
+		exp    int
+	}{
+		{Limits{}, DefaultNStart},
+		{Limits{NStart: 3}, 3},
+	}
+	for _, test := range tests {
+		c.SetLimits(test.limits)
+		errs := make(chan error, 4)
+		for i := 0; i < 4; i++ {
+			go func() {
+				_, err := c.Send(Message{Type: Confirmable, Code: GET, MessageID: c.nextMessageID()})
+				errs <- err
+			}()
+		}
+		if n := count(); n != test.exp {
+			t.Errorf("%+v: expected %v requests outstanding, got %v", test.limits, test.exp, n)
+		}
+		for i := 0; i < 4; i++ {
+			release <- struct{}{}
+			count()
+		}
+		for i := 0; i < 4; i++ {
+			if err := <-errs; err != nil {
+				t.Errorf("%+v: error sending: %v", test.limits, err)
+			}
+		}
+	}
+}
+
+func TestConnProbingRate(t *testing.T) {
+	l, addr := startUDPLisenter(t)
+	defer l.Close()
+
+	c, err := Dial("udp", addr)
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	defer c.Close()
+
+	// Each empty NON is 4 bytes, so a second and third take 80ms.
+	c.SetLimits(Limits{ProbingRate: 100})
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if _, err := c.Send(Message{Type: NonConfirmable, MessageID: uint16(i)}); err != nil {
+			t.Fatalf("Error sending: %v", err)
+		}
+	}
+	if d := time.Since(start); d < 80*time.Millisecond || d > time.Second {
+		t.Errorf("Expected sending to take 80ms, took %v", d)
+	}
+}
@@ -0,0 +1,294 @@
+package coap
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// maxCrossProxyBody is the largest HTTP request body a CrossProxy
+// sends on.
+const maxCrossProxyBody = 1 << 20
+
+// httpMethods maps the HTTP methods a CrossProxy forwards to CoAP
+// methods.  HEAD is sent as GET.
+var httpMethods = map[string]COAPCode{
+	http.MethodGet:    GET,
+	http.MethodHead:   GET,
+	http.MethodPost:   POST,
+	http.MethodPut:    PUT,
+	http.MethodDelete: DELETE,
+	"FETCH":           FETCH,
+	http.MethodPatch:  PATCH,
+	"IPATCH":          IPATCH,
+}
+
+// mediaTypes maps Internet media types to CoAP content formats.
+var mediaTypes = map[string]MediaType{
+	"text/plain":               TextPlain,
+	"application/link-format":  AppLinkFormat,
+	"application/xml":          AppXML,
+	"application/octet-stream": AppOctets,
+	"application/exi":          AppExi,
+	"application/json":         AppJSON,
+	"application/cbor":         AppCBOR,
+}
+
+// parseMediaType returns the content format of the Internet media
+// type v.  Text must be UTF-8.
+func parseMediaType(v string) (MediaType, bool) {
+	mt, params, err := mime.ParseMediaType(v)
+	if err != nil {
+		return 0, false
+	}
+	if cs, ok := params["charset"]; ok && !strings.EqualFold(cs, "utf-8") {
+		return 0, false
+	}
+	rv, ok := mediaTypes[mt]
+	return rv, ok
+}
+
+// httpMediaType returns the Internet media type of the content
+// format mt, application/octet-stream for ones it doesn't know.
+func httpMediaType(mt MediaType) string {
+	if mt == TextPlain {
+		return "text/plain; charset=utf-8"
+	}
+	for name, v := range mediaTypes {
+		if v == mt {
+			return name
+		}
+	}
+	return "application/octet-stream"
+}
+
+// httpStatus maps CoAP response codes to HTTP status codes (RFC 8075
+// section 7).  2.02, 2.03 and 2.04 depend on the request.
+var httpStatus = map[COAPCode]int{
+	Created:                 http.StatusCreated,
+	Content:                 http.StatusOK,
+	BadRequest:              http.StatusBadRequest,
+	Unauthorized:            http.StatusForbidden,
+	BadOption:               http.StatusBadRequest,
+	Forbidden:               http.StatusForbidden,
+	NotFound:                http.StatusNotFound,
+	MethodNotAllowed:        http.StatusMethodNotAllowed,
+	NotAcceptable:           http.StatusNotAcceptable,
+	RequestEntityIncomplete: http.StatusBadRequest,
+	Conflict:                http.StatusConflict,
+	PreconditionFailed:      http.StatusPreconditionFailed,
+	RequestEntityTooLarge:   http.StatusRequestEntityTooLarge,
+	UnsupportedMediaType:    http.StatusUnsupportedMediaType,
+	UnprocessableEntity:     http.StatusUnprocessableEntity,
+	InternalServerError:     http.StatusInternalServerError,
+	NotImplemented:          http.StatusNotImplemented,
+	BadGateway:              http.StatusBadGateway,
+	ServiceUnavailable:      http.StatusServiceUnavailable,
+	GatewayTimeout:          http.StatusGatewayTimeout,
+	ProxyingNotSupported:    http.StatusBadGateway,
+	HopLimitReached:         http.StatusLoopDetected,
+}
+
+// formatETag returns the HTTP entity tag for the CoAP ETag b.
+func formatETag(b []byte) string {
+	return `"` + hex.EncodeToString(b) + `"`
+}
+
+// parseETags decodes the entity tags of an If-Match or If-None-Match
+// header made by formatETag.  It returns nil for "*".
+func parseETags(v string) ([][]byte, error) {
+	if strings.TrimSpace(v) == "*" {
+		return nil, nil
+	}
+	var rv [][]byte
+	for _, tag := range strings.Split(v, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if len(tag) < 2 || tag[0] != '"' || tag[len(tag)-1] != '"' {
+			return nil, fmt.Errorf("invalid entity tag %q", tag)
+		}
+		b, err := hex.DecodeString(tag[1 : len(tag)-1])
+		if err != nil || len(b) < 1 || len(b) > 8 {
+			return nil, fmt.Errorf("invalid entity tag %q", tag)
+		}
+		rv = append(rv, b)
+	}
+	return rv, nil
+}
+
+// A CrossProxy is an http.Handler serving HTTP requests from a CoAP
+// backend, so web clients can reach constrained devices (RFC 8075).
+// It maps the method, the Content-Type and Accept headers to and from
+// content formats, and CoAP ETags to entity tags made of their hex:
+// If-Match becomes If-Match options, and the entity tags of a GET's
+// If-None-Match become ETag options, with 2.03 Valid answered by 304
+// Not Modified.
+type CrossProxy struct {
+	// Target is the backend, such as coap://device/api.  The path
+	// of each HTTP request is appended to its path.
+	Target *url.URL
+	// Dial connects to the endpoint of the Target.  Nil means
+	// DialURL.
+	Dial func(rawurl string) (Client, error)
+
+	backend proxyBackend
+}
+
+// NewCrossProxy returns a CrossProxy serving HTTP requests from
+// target.
+func NewCrossProxy(target *url.URL) *CrossProxy {
+	return &CrossProxy{Target: target}
+}
+
+// ServeHTTP sends the request r to the backend and writes its
+// response.
+func (p *CrossProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	code, ok := httpMethods[r.Method]
+	if !ok {
+		http.Error(w, "unsupported method "+r.Method, http.StatusNotImplemented)
+		return
+	}
+	req := Message{Type: Confirmable, Code: code}
+	validating, status, err := p.setHeaders(&req, r)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	if r.Method != http.MethodHead {
+		if req.Payload, err = io.ReadAll(io.LimitReader(r.Body, maxCrossProxyBody+1)); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(req.Payload) > maxCrossProxyBody {
+			http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if len(req.Payload) > 0 && req.Option(ContentFormat) == nil {
+			req.SetOption(ContentFormat, AppOctets)
+		}
+	}
+
+	base := strings.TrimSuffix(p.Target.EscapedPath(), "/")
+	target := *p.Target
+	target.RawPath = base + "/" + strings.TrimPrefix(r.URL.EscapedPath(), "/")
+	if target.Path, err = url.PathUnescape(target.RawPath); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	target.RawQuery = r.URL.RawQuery
+
+	rv := p.backend.forward(p.Dial, &req, &target, RejectUnsafe)
+	p.writeResponse(w, r, rv, validating, base)
+}
+
+// setHeaders sets the options of req for the headers of r.  It tells
+// whether req validates the representations with the ETags r has.
+func (p *CrossProxy) setHeaders(req *Message, r *http.Request) (bool, int, error) {
+	if ct := r.Header.Get("Content-Type"); ct != "" {
+		mt, ok := parseMediaType(ct)
+		if !ok {
+			return false, http.StatusUnsupportedMediaType, fmt.Errorf("unsupported media type %q", ct)
+		}
+		req.SetOption(ContentFormat, mt)
+	}
+	for _, v := range strings.Split(r.Header.Get("Accept"), ",") {
+		if mt, ok := parseMediaType(strings.TrimSpace(v)); ok {
+			req.SetOption(Accept, mt)
+			break
+		}
+	}
+
+	if v := r.Header.Get("If-Match"); v != "" {
+		tags, err := parseETags(v)
+		if err != nil {
+			return false, http.StatusBadRequest, err
+		}
+		if tags == nil {
+			req.AddOption(IfMatch, []byte{})
+		}
+		for _, tag := range tags {
+			req.AddOption(IfMatch, tag)
+		}
+	}
+	validating := false
+	if v := r.Header.Get("If-None-Match"); v != "" {
+		tags, err := parseETags(v)
+		if err != nil {
+			return false, http.StatusBadRequest, err
+		}
+		switch {
+		case tags == nil:
+			req.AddOption(IfNoneMatch, []byte{})
+		case req.Code == GET:
+			for _, tag := range tags {
+				req.AddOption(ETag, tag)
+			}
+			validating = true
+		}
+	}
+	return validating, 0, nil
+}
+
+// writeResponse writes the CoAP response rv as the response to r.
+// Location-Paths under base, the backend's path, are mapped back to
+// the paths of the HTTP requests.
+func (p *CrossProxy) writeResponse(w http.ResponseWriter, r *http.Request, rv *Message, validating bool, base string) {
+	h := w.Header()
+	if mt, ok := rv.Option(ContentFormat).(MediaType); ok {
+		h.Set("Content-Type", httpMediaType(mt))
+	} else if len(rv.Payload) > 0 && rv.Code >= BadRequest {
+		h.Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	if tag, ok := rv.Option(ETag).([]byte); ok {
+		h.Set("ETag", formatETag(tag))
+	}
+	if age, ok := rv.Option(MaxAge).(uint32); ok {
+		h.Set("Cache-Control", "max-age="+strconv.FormatUint(uint64(age), 10))
+		if rv.Code == ServiceUnavailable {
+			h.Set("Retry-After", strconv.FormatUint(uint64(age), 10))
+		}
+	}
+	if rv.Option(LocationPath) != nil || rv.Option(LocationQuery) != nil {
+		loc := Message{}
+		loc.SetPath(rv.optionStrings(LocationPath))
+		path := loc.EscapedPath()
+		if strings.HasPrefix(path, base+"/") {
+			path = path[len(base):]
+		}
+		loc.SetOption(URIQuery, rv.optionStrings(LocationQuery))
+		if q := loc.EscapedQuery(); q != "" {
+			path += "?" + q
+		}
+		h.Set("Location", path)
+	}
+
+	status, ok := httpStatus[rv.Code]
+	switch {
+	case rv.Code == Valid && validating:
+		status = http.StatusNotModified
+	case ok:
+	case rv.Code == Deleted || rv.Code == Valid || rv.Code == Changed:
+		status = http.StatusOK
+		if len(rv.Payload) == 0 {
+			status = http.StatusNoContent
+		}
+	default:
+		status = int(rv.Code>>5)*100 + int(rv.Code&0x1f)
+		if status < 200 || status > 599 {
+			status = http.StatusBadGateway
+		}
+	}
+	w.WriteHeader(status)
+	if r.Method != http.MethodHead && status != http.StatusNotModified && status != http.StatusNoContent {
+		w.Write(rv.Payload)
+	}
+}
+
+// Close closes the connection to the backend.
+func (p *CrossProxy) Close() error {
+	return p.backend.Close()
+}
@@ -0,0 +1,96 @@
+package coap
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestCrossProxy(t *testing.T) {
+	etag := []byte{1, 2}
+	backend := NewServeMux()
+	backend.Handle("/api/doc", RequestFunc(func(r *Request) {
+		rv := Message{Code: Content}
+		switch r.Msg.Code {
+		case GET:
+			rv.SetOption(ETag, etag)
+			if tag, _ := r.Msg.Option(ETag).([]byte); bytes.Equal(tag, etag) {
+				rv.Code = Valid
+				break
+			}
+			rv.SetOption(ContentFormat, AppJSON)
+			rv.SetOption(MaxAge, 30)
+			rv.Payload = []byte(`{"a":1}` + r.Msg.EscapedQuery())
+		case PUT:
+			tag, _ := r.Msg.Option(IfMatch).([]byte)
+			switch {
+			case !bytes.Equal(tag, etag):
+				rv.Code = PreconditionFailed
+			case r.Msg.Option(ContentFormat) != AppJSON:
+				rv.Code = UnsupportedMediaType
+			default:
+				rv.Code = Changed
+			}
+		case POST:
+			rv.Code = Created
+			rv.AddOption(LocationPath, []string{"api", "doc", "2"})
+		}
+		r.Respond(rv)
+	}))
+	bl, baddr := startUDPLisenter(t)
+	defer bl.Close()
+	go Serve(bl, backend)
+
+	target, err := url.Parse("coap://" + baddr + "/api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := NewCrossProxy(target)
+	defer proxy.Close()
+
+	tests := []struct {
+		name, method, path string
+		headers            map[string]string
+		body               string
+		status             int
+		expHeaders         map[string]string
+		exp                string
+	}{
+		{"get", "GET", "/doc?x=1", map[string]string{"Accept": "application/json"}, "", http.StatusOK,
+			map[string]string{"Content-Type": "application/json", "ETag": `"0102"`, "Cache-Control": "max-age=30"},
+			`{"a":1}x=1`},
+		{"head", "HEAD", "/doc", nil, "", http.StatusOK,
+			map[string]string{"Content-Type": "application/json"}, ""},
+		{"not modified", "GET", "/doc", map[string]string{"If-None-Match": `"0102"`}, "", http.StatusNotModified,
+			map[string]string{"ETag": `"0102"`}, ""},
+		{"put", "PUT", "/doc", map[string]string{"If-Match": `"0102"`, "Content-Type": "application/json"}, "{}",
+			http.StatusNoContent, nil, ""},
+		{"precondition", "PUT", "/doc", map[string]string{"If-Match": `"ff"`, "Content-Type": "application/json"}, "{}",
+			http.StatusPreconditionFailed, nil, ""},
+		{"media type", "PUT", "/doc", map[string]string{"Content-Type": "image/png"}, "x",
+			http.StatusUnsupportedMediaType, nil, "unsupported media type \"image/png\"\n"},
+		{"post", "POST", "/doc", nil, "x", http.StatusCreated,
+			map[string]string{"Location": "/doc/2"}, ""},
+		{"not found", "GET", "/other", nil, "", http.StatusNotFound, nil, ""},
+		{"method", "OPTIONS", "/doc", nil, "", http.StatusNotImplemented, nil, "unsupported method OPTIONS\n"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, test.path, strings.NewReader(test.body))
+		for k, v := range test.headers {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+		if w.Code != test.status || w.Body.String() != test.exp {
+			t.Errorf("%v: expected %v %q, got %v %q", test.name, test.status, test.exp, w.Code, w.Body)
+		}
+		for k, v := range test.expHeaders {
+			if got := w.Header().Get(k); got != v {
+				t.Errorf("%v: expected %v %q, got %q", test.name, k, v, got)
+			}
+		}
+	}
+}
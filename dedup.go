@@ -0,0 +1,106 @@
+package coap
+
+import (
+	"net"
+	"time"
+)
+
+// ExchangeLifetime is EXCHANGE_LIFETIME, how long a Message ID may
+// identify a confirmable message and its acknowledgement (RFC 7252
+// section 4.8.2).
+const ExchangeLifetime = 247 * time.Second
+
+// DefaultDuplicateCacheSize is how many requests a server remembers
+// for duplicate detection if its DuplicateCacheSize is zero.
+const DefaultDuplicateCacheSize = 1024
+
+type dupKey struct {
+	l    packetConn
+	addr string
+	mid  uint16
+}
+
+// A dupEntry remembers a request until it expires, along with the
+// ACK or Reset that answered it, if any was sent yet.
+type dupEntry struct {
+	key     dupKey
+	expires time.Time
+	resp    *Message
+}
+
+func (s *Server) duplicateLifetime() time.Duration {
+	if s.DuplicateLifetime > 0 {
+		return s.DuplicateLifetime
+	}
+	return ExchangeLifetime
+}
+
+// duplicate reports whether the request m from u was received on l
+// before (RFC 7252 section 4.5), remembering it otherwise.  A
+// duplicate of a request that was answered gets the same ACK or
+// Reset again; one that wasn't answered yet is ignored, like any
+// duplicate non-confirmable request.
+func (s *Server) duplicate(l packetConn, u *net.UDPAddr, m Message) bool {
+	if s.DuplicateLifetime < 0 || !isRequest(m.Code) {
+		return false
+	}
+	k := dupKey{l, u.String(), m.MessageID}
+	now := time.Now()
+
+	s.mu.Lock()
+	for len(s.dupOrder) > 0 && now.After(s.dupOrder[0].expires) {
+		delete(s.dups, s.dupOrder[0].key)
+		s.dupOrder = s.dupOrder[1:]
+	}
+	e := s.dups[k]
+	if e == nil {
+		size := s.DuplicateCacheSize
+		if size <= 0 {
+			size = DefaultDuplicateCacheSize
+		}
+		if len(s.dupOrder) >= size {
+			delete(s.dups, s.dupOrder[0].key)
+			s.dupOrder = s.dupOrder[1:]
+		}
+		if s.dups == nil {
+			s.dups = map[dupKey]*dupEntry{}
+		}
+		e = &dupEntry{key: k, expires: now.Add(s.duplicateLifetime())}
+		s.dups[k] = e
+		s.dupOrder = append(s.dupOrder, e)
+		s.mu.Unlock()
+		return false
+	}
+	resp := e.resp
+	s.mu.Unlock()
+
+	s.telemetry().duplicate(m)
+	if resp != nil && writeMessage(l, u, *resp) == nil {
+		s.telemetry().sent(l.LocalAddr(), u, *resp, true)
+	}
+	return true
+}
+
+// rememberResponse keeps m, an ACK or Reset sent to u on l, for
+// duplicates of the request it answers.
+func (s *Server) rememberResponse(l packetConn, u *net.UDPAddr, m Message) {
+	if m.Type != Acknowledgement && m.Type != Reset {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e := s.dups[dupKey{l, u.String(), m.MessageID}]; e != nil {
+		// The token may be the request's, which a server reusing
+		// requests recycles.
+		m.Token = append([]byte(nil), m.Token...)
+		e.resp = &m
+	}
+}
+
+// DuplicateCacheLen returns the number of requests remembered for
+// duplicate detection.
+func (s *Server) DuplicateCacheLen() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.dups)
+}
@@ -0,0 +1,86 @@
+package coap
+
+import (
+	"net"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestServerDuplicates(t *testing.T) {
+	l, addr := startUDPLisenter(t)
+	defer l.Close()
+	var calls int32
+	s := &Server{
+		DuplicateCacheSize: 2,
+		DuplicateLifetime:  200 * time.Millisecond,
+		Handler: FuncHandler(func(l *net.UDPConn, a *net.UDPAddr, m *Message) *Message {
+			n := atomic.AddInt32(&calls, 1)
+			if !m.IsConfirmable() {
+				return nil
+			}
+			return &Message{
+				Type:      Acknowledgement,
+				Code:      Content,
+				MessageID: m.MessageID,
+				Token:     m.Token,
+				Payload:   []byte{byte(n)},
+			}
+		}),
+	}
+	go s.Serve(l)
+
+	raddr, _ := net.ResolveUDPAddr("udp", addr)
+	c, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	defer c.Close()
+
+	buf := make([]byte, DefaultReadBufferSize)
+	send := func(typ COAPType, mid uint16) *Message {
+		req := Message{Type: typ, Code: GET, MessageID: mid}
+		if err := Transmit(c, nil, req); err != nil {
+			t.Fatalf("Error sending: %v", err)
+		}
+		if typ != Confirmable {
+			time.Sleep(20 * time.Millisecond)
+			return nil
+		}
+		rv, err := Receive(c, buf)
+		if err != nil {
+			t.Fatalf("Error receiving the response to %v: %v", mid, err)
+		}
+		return &rv
+	}
+
+	first := send(Confirmable, 1)
+	if again := send(Confirmable, 1); !reflect.DeepEqual(first, again) {
+		t.Errorf("Expected the same response again, got %v and %v", first, again)
+	}
+	send(NonConfirmable, 2)
+	send(NonConfirmable, 2)
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Errorf("Expected 2 handler calls, got %v", n)
+	}
+	if n := s.DuplicateCacheLen(); n != 2 {
+		t.Errorf("Expected 2 requests remembered, got %v", n)
+	}
+
+	// The third request pushes the first out of the cache.
+	send(NonConfirmable, 3)
+	if rv := send(Confirmable, 1); rv.Payload[0] != 4 {
+		t.Errorf("Expected the forgotten request handled again, got %v", rv)
+	}
+
+	// As does expiry.
+	time.Sleep(250 * time.Millisecond)
+	send(NonConfirmable, 3)
+	if n := atomic.LoadInt32(&calls); n != 5 {
+		t.Errorf("Expected 5 handler calls, got %v", n)
+	}
+	if n := s.DuplicateCacheLen(); n != 1 {
+		t.Errorf("Expected 1 request remembered after expiry, got %v", n)
+	}
+}
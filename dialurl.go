@@ -0,0 +1,229 @@
+package coap
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"sync"
+)
+
+// Default ports for coap and coaps URLs.
+const (
+	DefaultPort       = 5683
+	DefaultSecurePort = 5684
+)
+
+// Client is a CoAP client on any transport.
+type Client interface {
+	// Send a request and return its response, if any.
+	Send(req Message) (*Message, error)
+	// Receive a message that isn't the response to a Send.
+	Receive() (*Message, error)
+	Close() error
+}
+
+var _ Client = (*Conn)(nil)
+
+// A SchemeDialer connects a Client to the endpoint named by a URL.
+type SchemeDialer func(u *url.URL) (Client, error)
+
+var schemes = struct {
+	sync.Mutex
+	m map[string]SchemeDialer
+}{m: map[string]SchemeDialer{
+	"coap":      dialUDP,
+	"coap+tcp":  dialStream,
+	"coaps+tcp": dialStream,
+}}
+
+func dialStream(u *url.URL) (Client, error) {
+	var d StreamDialer
+	c, err := d.dialURL(u)
+	if err != nil {
+		return nil, err
+	}
+	return StreamClient(c), nil
+}
+
+// RegisterScheme makes DialURL use d for URLs with the given scheme,
+// replacing any previous dialer for it.  Package coapws registers
+// coap+ws and coaps+ws.
+func RegisterScheme(scheme string, d SchemeDialer) {
+	schemes.Lock()
+	defer schemes.Unlock()
+	schemes.m[scheme] = d
+}
+
+// DialURL connects a client to the endpoint of a coap, coap+tcp or
+// coaps+tcp URL, or one of a scheme added with RegisterScheme.  Coaps
+// URLs need a Dialer with a DTLS transport registered.
+// Stream transports go through the proxy configured in the
+// environment, if any.
+func DialURL(rawurl string) (Client, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+
+	schemes.Lock()
+	d := schemes.m[u.Scheme]
+	schemes.Unlock()
+	if d == nil {
+		return nil, fmt.Errorf("coap: unsupported scheme %q", u.Scheme)
+	}
+	return d(u)
+}
+
+// HostPort returns the host and port of u, filling in port if the URL
+// doesn't have one.
+func HostPort(u *url.URL, port int) string {
+	if p := u.Port(); p != "" {
+		return net.JoinHostPort(u.Hostname(), p)
+	}
+	return net.JoinHostPort(u.Hostname(), strconv.Itoa(port))
+}
+
+func dialUDP(u *url.URL) (Client, error) {
+	return Dial("udp", HostPort(u, DefaultPort))
+}
+
+// Register makes DialURL use d for coap URLs, without DTLS, and for
+// coaps URLs if it has a DTLS transport.
+func (d *Dialer) Register() {
+	plain := *d
+	plain.DTLS = nil
+	RegisterScheme("coap", func(u *url.URL) (Client, error) {
+		return plain.Dial("udp", HostPort(u, DefaultPort))
+	})
+	if d.DTLS != nil {
+		RegisterScheme("coaps", func(u *url.URL) (Client, error) {
+			return d.Dial("udp", HostPort(u, DefaultSecurePort))
+		})
+	}
+}
+
+// A StreamDialer contains options for connecting to coap+tcp and
+// coaps+tcp URLs.  The zero value is a usable StreamDialer.
+type StreamDialer struct {
+	// Proxy picks the proxy to go through for a URL, if any (see
+	// DialProxy).  Nil means ProxyFromEnvironment.
+	Proxy func(u *url.URL) (*url.URL, error)
+	// TLSConfig is used for coaps+tcp URLs, offering the "coap"
+	// ALPN protocol unless it sets NextProtos.  Nil means the
+	// default configuration.
+	TLSConfig *tls.Config
+	// TokenLength is the length of the random tokens given to
+	// requests sent without one, from 1 to 8 bytes.  Zero means
+	// DefaultTokenLength; a negative value leaves them without.
+	TokenLength int
+}
+
+// Register makes DialURL use d for coap+tcp and coaps+tcp URLs.
+func (d *StreamDialer) Register() {
+	dial := func(u *url.URL) (Client, error) {
+		c, err := d.dialURL(u)
+		if err != nil {
+			return nil, err
+		}
+		return StreamClient(c), nil
+	}
+	RegisterScheme("coap+tcp", dial)
+	RegisterScheme("coaps+tcp", dial)
+}
+
+// Dial connects to the endpoint of a coap+tcp or coaps+tcp URL.
+func (d *StreamDialer) Dial(rawurl string) (*StreamConn, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	return d.dialURL(u)
+}
+
+func (d *StreamDialer) dialURL(u *url.URL) (*StreamConn, error) {
+	secure := false
+	port := DefaultPort
+	switch u.Scheme {
+	case "coap+tcp":
+	case "coaps+tcp":
+		secure, port = true, DefaultSecurePort
+	default:
+		return nil, fmt.Errorf("coap: unsupported scheme %q", u.Scheme)
+	}
+	addr := HostPort(u, port)
+
+	proxy := d.Proxy
+	if proxy == nil {
+		proxy = ProxyFromEnvironment
+	}
+	pu, err := proxy(u)
+	if err != nil {
+		return nil, err
+	}
+	var nc net.Conn
+	if pu != nil {
+		nc, err = DialProxy(pu, addr)
+	} else {
+		nc, err = net.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if secure {
+		nc = tls.Client(nc, d.tlsConfig(u.Hostname()))
+	}
+	c := NewStreamConn(nc)
+	if d.TokenLength != 0 {
+		c.tokenLen = d.TokenLength
+	}
+	return c, nil
+}
+
+// tlsConfig returns the TLS configuration for connecting to host: the
+// dialer's, with the server name and the "coap" ALPN protocol (RFC
+// 8323 section 4.3) filled in unless it has them.
+func (d *StreamDialer) tlsConfig(host string) *tls.Config {
+	cfg := &tls.Config{}
+	if d.TLSConfig != nil {
+		cfg = d.TLSConfig.Clone()
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName = host
+	}
+	if len(cfg.NextProtos) == 0 {
+		cfg.NextProtos = []string{"coap"}
+	}
+	return cfg
+}
+
+// StreamClient adapts a StreamConn to the Client interface.
+func StreamClient(c *StreamConn) Client {
+	return streamClient{c}
+}
+
+type streamClient struct {
+	c *StreamConn
+}
+
+func (s streamClient) Send(req Message) (*Message, error) {
+	rv, err := s.c.Send(TcpMessage{Message: req})
+	if err != nil {
+		return nil, err
+	}
+	return &rv.Message, nil
+}
+
+func (s streamClient) Receive() (*Message, error) {
+	rv, err := s.c.Receive()
+	if err != nil {
+		return nil, err
+	}
+	return &rv.Message, nil
+}
+
+func (s streamClient) Close() error {
+	return s.c.Close()
+}
@@ -0,0 +1,141 @@
+package coap
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+)
+
+// A DTLSTransport secures CoAP over UDP with DTLS (coaps URLs, RFC
+// 7252 section 9), which the standard library doesn't implement, by
+// wrapping a DTLS implementation.  It's configured with a tls.Config:
+// Certificates to present, RootCAs and ServerName to verify servers
+// by, ClientAuth and ClientCAs to verify clients by, and
+// VerifyPeerCertificate or VerifyConnection for checks of the
+// caller's own.  Implementations must honor those, failing the
+// handshake when verification does.
+type DTLSTransport interface {
+	// DialContext connects to addr on the datagram network
+	// network and completes the handshake, giving up once ctx is
+	// done.
+	DialContext(ctx context.Context, network, addr string, config *tls.Config) (DTLSConn, error)
+	// Listen listens on addr, and returns a listener whose Accept
+	// returns a DTLSConn for each client whose handshake
+	// completed.
+	Listen(network, addr string, config *tls.Config) (net.Listener, error)
+}
+
+// A DTLSConn is a DTLS association with one peer.  Each Write sends
+// one datagram, and each Read returns one.
+type DTLSConn interface {
+	net.Conn
+	// ConnectionState returns the state of the handshake, with
+	// the peer's certificates and the chains they were verified
+	// by.
+	ConnectionState() tls.ConnectionState
+}
+
+// peerIdentity returns the subject of the certificate the peer was
+// verified by in the handshake of cs, or "" if it wasn't.
+func peerIdentity(cs tls.ConnectionState) string {
+	if len(cs.VerifiedChains) == 0 || len(cs.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return cs.VerifiedChains[0][0].Subject.String()
+}
+
+// dialDTLS connects to addr through d's DTLS transport.
+func (d *Dialer) dialDTLS(ctx context.Context, n, addr string) (DTLSConn, error) {
+	cfg := &tls.Config{}
+	if d.TLSConfig != nil {
+		cfg = d.TLSConfig.Clone()
+	}
+	if cfg.ServerName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		cfg.ServerName = host
+	}
+	return d.DTLS.DialContext(ctx, n, addr, cfg)
+}
+
+// ListenAndServeDTLS listens for DTLS clients on addr with t and
+// serves their requests with h.
+func ListenAndServeDTLS(network, addr string, t DTLSTransport, config *tls.Config, h Handler) error {
+	l, err := t.Listen(network, addr, config)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	return ServeDTLS(l, h)
+}
+
+// ServeDTLS serves the requests of the clients accepted on l, a
+// listener of a DTLSTransport, with h.
+func ServeDTLS(l net.Listener, h Handler) error {
+	s := &Server{Handler: h}
+	return s.ServeDTLS(l)
+}
+
+// ServeDTLS serves the requests of the clients accepted on l, a
+// listener of a DTLSTransport, as Serve does those received on a UDP
+// socket, until l is closed, or the server is shut down or closed,
+// when it returns ErrServerClosed.  The client's verified identity is
+// available to handlers through Request.Identity; the listener they
+// get is nil.
+func (s *Server) ServeDTLS(l net.Listener) error {
+	if _, _, ok := s.track(l); !ok {
+		return ErrServerClosed
+	}
+	defer s.untrack(l)
+
+	if _, err := (BlockOption{Size: s.blockSize()}).szx(); err != nil {
+		return err
+	}
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return ErrServerClosed
+			}
+			return err
+		}
+		go s.serveDTLS(c)
+	}
+}
+
+// A dtlsSocket is a DTLS association a Server answers one client on.
+type dtlsSocket struct {
+	net.Conn
+	session *Session
+}
+
+// WriteTo sends b to the client, whatever a says.
+func (d *dtlsSocket) WriteTo(b []byte, a net.Addr) (int, error) {
+	return d.Write(b)
+}
+
+func (s *Server) serveDTLS(c net.Conn) {
+	defer c.Close()
+	d := &dtlsSocket{Conn: c, session: NewSession(c.LocalAddr(), c.RemoteAddr())}
+	if dc, ok := c.(DTLSConn); ok {
+		d.session.SetIdentity(peerIdentity(dc.ConnectionState()))
+	}
+	sem, done, ok := s.track(d)
+	if !ok {
+		return
+	}
+	defer s.untrack(d)
+
+	a, _ := c.RemoteAddr().(*net.UDPAddr)
+	// One byte more tells truncated datagrams apart.
+	buf := make([]byte, s.readBufferSize()+1)
+	for {
+		n, err := c.Read(buf)
+		if err != nil {
+			return
+		}
+		s.dispatch(d, sem, done, buf[:n], a, nil)
+	}
+}
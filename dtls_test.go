@@ -0,0 +1,163 @@
+package coap
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net"
+	"testing"
+)
+
+// pipeTransport stands in for a DTLS implementation, connecting
+// clients to its listener through pipes with the given handshake
+// states.
+type pipeTransport struct {
+	accepted       pipeListener
+	config         *tls.Config
+	client, server tls.ConnectionState
+}
+
+func (t *pipeTransport) DialContext(ctx context.Context, network, addr string, config *tls.Config) (DTLSConn, error) {
+	t.config = config
+	c, s := net.Pipe()
+	t.accepted <- dtlsPipe{s, t.server}
+	return dtlsPipe{c, t.client}, nil
+}
+
+func (t *pipeTransport) Listen(network, addr string, config *tls.Config) (net.Listener, error) {
+	return t.accepted, nil
+}
+
+type pipeListener chan net.Conn
+
+func (l pipeListener) Accept() (net.Conn, error) {
+	c, ok := <-l
+	if !ok {
+		return nil, net.ErrClosed
+	}
+	return c, nil
+}
+
+func (l pipeListener) Close() error   { close(l); return nil }
+func (l pipeListener) Addr() net.Addr { return nil }
+
+type dtlsPipe struct {
+	net.Conn
+	state tls.ConnectionState
+}
+
+func (c dtlsPipe) ConnectionState() tls.ConnectionState { return c.state }
+
+// verified returns the state of a handshake with a peer verified by
+// a certificate for name.
+func verified(name string) tls.ConnectionState {
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: name}}
+	return tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{cert},
+		VerifiedChains:   [][]*x509.Certificate{{cert}},
+	}
+}
+
+func TestDTLS(t *testing.T) {
+	mux := NewServeMux()
+	mux.Handle("/who", RequestFunc(func(r *Request) {
+		r.Respond(Message{Code: Content, Payload: []byte(r.Identity())})
+	}))
+	tr := &pipeTransport{
+		accepted: make(pipeListener, 1),
+		client:   verified("server"),
+		server:   verified("client"),
+	}
+	l, _ := tr.Listen("udp", ":5684", nil)
+	defer l.Close()
+	go ServeDTLS(l, mux)
+
+	d := Dialer{DTLS: tr}
+	c, err := d.Dial("udp", "example.com:5684")
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	defer c.Close()
+	if tr.config.ServerName != "example.com" {
+		t.Errorf("Expected the server name from the address, got %q", tr.config.ServerName)
+	}
+	if id := c.Session().Identity(); id != "CN=server" {
+		t.Errorf("Expected the server's identity, got %q", id)
+	}
+
+	req := Message{Type: Confirmable, Code: GET, MessageID: 1}
+	req.SetPathString("/who")
+	rv, err := c.Send(req)
+	if err != nil {
+		t.Fatalf("Error sending: %v", err)
+	}
+	if rv.Code != Content || string(rv.Payload) != "CN=client" {
+		t.Errorf("Expected the client's identity, got %v %q", rv.Code, rv.Payload)
+	}
+	if err := c.Ping(context.Background()); err != nil {
+		t.Errorf("Error pinging: %v", err)
+	}
+}
+
+func TestDTLSServerPipeline(t *testing.T) {
+	body := bytes.Repeat([]byte("x"), 3000)
+	mux := NewServeMux()
+	mux.Handle("/slow", RequestFunc(func(r *Request) {
+		if err := r.Ack(); err != nil {
+			t.Errorf("Error acknowledging: %v", err)
+		}
+		r.Respond(Message{Code: Content, Payload: body})
+	}))
+	tr := &pipeTransport{accepted: make(pipeListener, 1)}
+	l, _ := tr.Listen("udp", ":5684", nil)
+	s := &Server{Handler: mux}
+	served := make(chan error, 1)
+	go func() { served <- s.ServeDTLS(l) }()
+
+	c, err := (&Dialer{DTLS: tr}).Dial("udp", "example.com:5684")
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	defer c.Close()
+
+	req := Message{Type: Confirmable, Code: GET, MessageID: 1}
+	req.SetPathString("/slow")
+	rv, err := c.Send(req)
+	if err != nil {
+		t.Fatalf("Error sending: %v", err)
+	}
+	if rv.Code != Content || !bytes.Equal(rv.Payload, body) {
+		t.Errorf("Expected the whole body in a separate response, got %v with %v bytes",
+			rv.Code, len(rv.Payload))
+	}
+	if s.BlockwiseTransfers() != 0 {
+		t.Errorf("Expected the Block2 transfer done, got %v", s.BlockwiseTransfers())
+	}
+
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Errorf("Error shutting down: %v", err)
+	}
+	if err := <-served; err != ErrServerClosed {
+		t.Errorf("Expected ErrServerClosed, got %v", err)
+	}
+}
+
+func TestPeerIdentity(t *testing.T) {
+	unverified := verified("x")
+	unverified.VerifiedChains = nil
+	tests := []struct {
+		cs  tls.ConnectionState
+		exp string
+	}{
+		{verified("device-1"), "CN=device-1"},
+		{unverified, ""},
+		{tls.ConnectionState{}, ""},
+	}
+	for _, test := range tests {
+		if id := peerIdentity(test.cs); id != test.exp {
+			t.Errorf("Expected identity %q, got %q", test.exp, id)
+		}
+	}
+}
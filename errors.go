@@ -0,0 +1,105 @@
+package coap
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors reported by clients and the message parser.  Errors that
+// carry details are *ResetError, *BadOptionError or *TruncatedError
+// values, which errors.Is matches against ErrReset, ErrBadOption and
+// ErrTruncated.
+var (
+	// ErrTimeout is returned when no response arrived in time.  It
+	// is a net.Error reporting Timeout.
+	ErrTimeout error = timeoutError{}
+	// ErrReset is matched by every *ResetError.
+	ErrReset = errors.New("message was reset")
+	// ErrInvalidVersion is returned for messages of a CoAP
+	// version other than 1.
+	ErrInvalidVersion = errors.New("invalid version")
+	// ErrBadOption is matched by every *BadOptionError.
+	ErrBadOption = errors.New("bad option")
+	// ErrTruncated is matched by every *TruncatedError.
+	ErrTruncated = errors.New("truncated")
+	// ErrNoOption is returned by the GetOption methods for options
+	// the message doesn't have.
+	ErrNoOption = errors.New("option not present")
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// A BadOptionError reports an option that couldn't be parsed or
+// encoded.
+type BadOptionError struct {
+	ID OptionID
+	// Reason tells what's wrong with the option, if known.
+	Reason string
+}
+
+func (e *BadOptionError) Error() string {
+	if e.Reason == "" {
+		return fmt.Sprintf("bad option %v", e.ID)
+	}
+	return fmt.Sprintf("bad option %v: %s", e.ID, e.Reason)
+}
+
+// Is reports whether target is ErrBadOption.
+func (e *BadOptionError) Is(target error) bool {
+	return target == ErrBadOption
+}
+
+// A ResetError is returned when the peer rejected a message with a
+// Reset, as opposed to not answering it or answering it with an error
+// code.
+type ResetError struct {
+	// MessageID is the Message ID of the rejected message.
+	MessageID uint16
+}
+
+func (e *ResetError) Error() string {
+	return fmt.Sprintf("message %d was reset", e.MessageID)
+}
+
+// Is reports whether target is ErrReset.
+func (e *ResetError) Is(target error) bool {
+	return target == ErrReset
+}
+
+// A MessageSizeError reports an incoming message larger than the
+// receiver accepts, found before its body is read.
+type MessageSizeError struct {
+	// Size is the size the message claims.
+	Size uint64
+	// Max is the size of the largest message accepted.
+	Max int
+}
+
+func (e *MessageSizeError) Error() string {
+	return fmt.Sprintf("message of %d bytes larger than %d", e.Size, e.Max)
+}
+
+// Is reports whether target is ErrMessageTooLarge.
+func (e *MessageSizeError) Is(target error) bool {
+	return target == ErrMessageTooLarge
+}
+
+// A TruncatedError reports a message that ended in the middle of a
+// field.
+type TruncatedError struct {
+	// Offset is where the incomplete field starts.
+	Offset int
+}
+
+func (e *TruncatedError) Error() string {
+	return fmt.Sprintf("truncated at offset %d", e.Offset)
+}
+
+// Is reports whether target is ErrTruncated.
+func (e *TruncatedError) Is(target error) bool {
+	return target == ErrTruncated
+}
@@ -0,0 +1,101 @@
+package coap
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		data   []byte
+		is     error
+		offset int
+		id     OptionID
+	}{
+		{"short header", []byte{0x40, 0x01}, ErrTruncated, 0, 0},
+		{"bad version", []byte{0x80, 0x01, 0x00, 0x01}, ErrInvalidVersion, 0, 0},
+		{"short token", []byte{0x42, 0x01, 0x00, 0x01, 0xaa}, ErrTruncated, 4, 0},
+		{"short extended delta", []byte{0x40, 0x01, 0x00, 0x01, 0xd0}, ErrTruncated, 5, 0},
+		{"short value", []byte{0x40, 0x01, 0x00, 0x01, 0xb3, 'a'}, ErrTruncated, 5, 0},
+		{"length marker", []byte{0x40, 0x01, 0x00, 0x01, 0xbf}, ErrBadOption, 0, URIPath},
+		{"delta marker", []byte{0x40, 0x01, 0x00, 0x01, 0xf1}, ErrBadOption, 0, 0},
+	}
+
+	for _, test := range tests {
+		_, err := ParseMessage(test.data)
+		if !errors.Is(err, test.is) {
+			t.Errorf("%v: expected %v, got %v", test.name, test.is, err)
+			continue
+		}
+		var terr *TruncatedError
+		if errors.As(err, &terr) && terr.Offset != test.offset {
+			t.Errorf("%v: expected offset %v, got %v", test.name, test.offset, terr.Offset)
+		}
+		var berr *BadOptionError
+		if errors.As(err, &berr) && berr.ID != test.id {
+			t.Errorf("%v: expected option %v, got %v", test.name, test.id, berr.ID)
+		}
+	}
+}
+
+func TestSendErrors(t *testing.T) {
+	defer func(d time.Duration) { ackTimeout = d }(ackTimeout)
+	ackTimeout = time.Millisecond
+
+	for _, silent := range []bool{false, true} {
+		l, addr, _ := pingServer(t, silent)
+		defer l.Close()
+
+		c, err := Dial("udp", addr)
+		if err != nil {
+			t.Fatalf("Error dialing: %v", err)
+		}
+		defer c.Close()
+
+		_, err = c.Send(Message{Type: Confirmable, MessageID: 42})
+		switch {
+		case !silent && !errors.Is(err, ErrReset):
+			t.Errorf("Expected ErrReset, got %v", err)
+		case !silent:
+			if re, ok := err.(*ResetError); !ok || re.MessageID != 42 {
+				t.Errorf("Expected a *ResetError for message 42, got %#v", err)
+			}
+		case silent && err != ErrTimeout:
+			t.Errorf("Expected ErrTimeout, got %v", err)
+		}
+		if neterr, ok := err.(net.Error); silent && (!ok || !neterr.Timeout()) {
+			t.Errorf("Expected a timeout net.Error, got %v", err)
+		}
+	}
+}
+
+func TestMarshalErrors(t *testing.T) {
+	withOption := func(m Message, id OptionID, v interface{}) Message {
+		m.SetOption(id, v)
+		return m
+	}
+	get := Message{Type: Confirmable, Code: GET, MessageID: 1}
+
+	tests := []struct {
+		name string
+		m    Message
+		is   error
+	}{
+		{"long token", Message{Code: GET, Token: []byte("123456789")}, ErrInvalidTokenLen},
+		{"bad type", Message{Type: 4, Code: GET}, ErrInvalidType},
+		{"empty with token", Message{Type: Acknowledgement, Token: []byte("t")}, ErrNonEmpty},
+		{"float value", withOption(get, MaxAge, 1.5), ErrBadOption},
+		{"negative value", withOption(get, URIPort, -1), ErrBadOption},
+		{"value too long", withOption(get, URIPort, 1<<20), ErrBadOption},
+		{"empty host", withOption(get, URIHost, ""), ErrBadOption},
+	}
+
+	for _, test := range tests {
+		if _, err := test.m.MarshalBinary(); !errors.Is(err, test.is) {
+			t.Errorf("%v: expected %v, got %v", test.name, test.is, err)
+		}
+	}
+}
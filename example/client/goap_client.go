@@ -8,22 +8,20 @@ import (
 )
 
 func main() {
-
-	req := coap.Message{
-		Type:      coap.Confirmable,
-		Code:      coap.GET,
-		MessageID: 12345,
-		Payload:   []byte("hello, world!"),
-	}
-
 	path := "/some/path"
 	if len(os.Args) > 1 {
 		path = os.Args[1]
 	}
 
-	req.SetOption(coap.ETag, "weetag")
-	req.SetOption(coap.MaxAge, 3)
-	req.SetPathString(path)
+	req, err := coap.NewRequest(coap.GET, path).
+		MessageID(12345).
+		Option(coap.ETag, "weetag").
+		Option(coap.MaxAge, 3).
+		Payload(coap.TextPlain, []byte("hello, world!")).
+		Build()
+	if err != nil {
+		log.Fatalf("Error building request: %v", err)
+	}
 
 	c, err := coap.Dial("udp", "localhost:5683")
 	if err != nil {
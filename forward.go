@@ -0,0 +1,258 @@
+package coap
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+)
+
+// UnsafeOptionPolicy says what a proxy does with a request carrying
+// options it doesn't recognize and that are unsafe to forward (RFC
+// 7252 section 5.7.1).  Unrecognized options that are safe to
+// forward are always forwarded.
+type UnsafeOptionPolicy int
+
+const (
+	// RejectUnsafe answers such requests with 4.02 Bad Option.
+	RejectUnsafe UnsafeOptionPolicy = iota
+	// ForwardUnsafe forwards the unsafe options verbatim, for
+	// proxies that pass requests through unchanged.
+	ForwardUnsafe
+)
+
+// Forward applies p to req, a request a proxy received.  It returns
+// the request to send on, or, if p rejects it, the response to send
+// back instead.
+//
+// The Hop-Limit option, if present, is decremented; a request that
+// runs out of hops is answered with 5.08 Hop Limit Reached, breaking
+// proxy loops (RFC 8768).
+func (p UnsafeOptionPolicy) Forward(req Message) (fwd, reject *Message) {
+	for _, id := range req.UnrecognizedOptions() {
+		if id.UnSafe() && p == RejectUnsafe {
+			return nil, proxyError(req, BadOption, fmt.Sprintf("unrecognized option %d", id))
+		}
+	}
+	req.opts = append(options(nil), req.opts...)
+	if hops, ok := req.Option(HopLimit).(uint32); ok {
+		if hops <= 1 {
+			return nil, proxyError(req, HopLimitReached, "")
+		}
+		req.SetOption(HopLimit, hops-1)
+	}
+	return &req, nil
+}
+
+// proxyError makes the response with code to req, which the proxy
+// won't forward, explaining why in diag.
+func proxyError(req Message, code COAPCode, diag string) *Message {
+	rv := &Message{
+		Type:      NonConfirmable,
+		Code:      code,
+		MessageID: req.MessageID,
+		Token:     req.Token,
+		Payload:   []byte(diag),
+	}
+	if diag == "" {
+		rv.Payload = nil
+	}
+	if req.IsConfirmable() {
+		rv.Type = Acknowledgement
+	}
+	return rv
+}
+
+// DefaultProxySchemes are the schemes a ForwardProxy reaches targets
+// with when its Schemes aren't set.
+var DefaultProxySchemes = []string{"coap", "coap+tcp", "coaps+tcp"}
+
+// A ForwardProxy is a handler forwarding requests with a Proxy-Uri
+// or Proxy-Scheme option to their target, over UDP or TCP, and
+// relaying the responses back (RFC 7252 section 5.7.2).  It should
+// be served with SeparateResponses, as the target may take longer to
+// answer than the client waits for an ACK.
+type ForwardProxy struct {
+	// Disabled makes the proxy answer every proxy request with 5.05
+	// Proxying Not Supported.
+	Disabled bool
+	// Schemes are the schemes of the targets the proxy forwards
+	// to; requests for others are answered with 5.05 Proxying Not
+	// Supported.  Nil means DefaultProxySchemes.
+	Schemes []string
+	// Unsafe says what to do with requests carrying unrecognized
+	// options that are unsafe to forward.
+	Unsafe UnsafeOptionPolicy
+	// Dial connects to the endpoint of a target URL.  Nil means
+	// DialURL.
+	Dial func(rawurl string) (Client, error)
+	// Handler, if not nil, serves the requests that aren't for a
+	// proxy.  Otherwise they're answered with 4.04 Not Found.
+	Handler Handler
+
+	ids proxyIDs
+}
+
+// ServeCOAP forwards the proxy request m and returns the response.
+func (p *ForwardProxy) ServeCOAP(l *net.UDPConn, a *net.UDPAddr, m *Message) *Message {
+	if m.Option(ProxyURI) == nil && m.Option(ProxyScheme) == nil {
+		if p.Handler != nil {
+			return p.Handler.ServeCOAP(l, a, m)
+		}
+		return notFoundHandler(l, a, m)
+	}
+	if p.Disabled {
+		return proxyError(*m, ProxyingNotSupported, "")
+	}
+
+	target, rv := p.target(l, m)
+	if rv != nil {
+		return rv
+	}
+	dial := p.Dial
+	if dial == nil {
+		dial = DialURL
+	}
+	c, err := dial((&url.URL{Scheme: target.Scheme, Host: target.Host}).String())
+	if err != nil {
+		return proxyError(*m, BadGateway, err.Error())
+	}
+	defer c.Close()
+	rv, _ = p.ids.relay(c, m, target, p.Unsafe)
+	return rv
+}
+
+// proxyIDs provides the Message IDs and tokens of the requests a proxy
+// sends on.
+type proxyIDs struct {
+	once    sync.Once
+	session *Session
+}
+
+// relay sends the request m on to target over c, with its options
+// other than the URI ones, and returns the response to m.  The error
+// is that of sending, if any, when the response reports it.
+func (ids *proxyIDs) relay(c Client, m *Message, target *url.URL, unsafe UnsafeOptionPolicy) (*Message, error) {
+	fwd, reject := unsafe.Forward(*m)
+	if reject != nil {
+		return reject, nil
+	}
+	req, err := NewRequestFromURL(m.Code, target.String())
+	if err != nil {
+		return proxyError(*m, BadRequest, err.Error()), nil
+	}
+	for _, o := range fwd.opts {
+		switch o.ID {
+		case ProxyURI, ProxyScheme, URIHost, URIPort, URIPath, URIQuery:
+		default:
+			req.opts = append(req.opts, o)
+		}
+	}
+	ids.once.Do(func() { ids.session = NewSession(nil, nil) })
+	req.MessageID = ids.session.NextMessageID()
+	req.Token = ids.session.NextToken()
+	req.Payload = m.Payload
+
+	resp, err := c.Send(req)
+	switch {
+	case err == ErrTimeout || err == nil && resp == nil:
+		return proxyError(*m, GatewayTimeout, ""), err
+	case err != nil:
+		return proxyError(*m, BadGateway, err.Error()), err
+	}
+	rv := proxyError(*m, resp.Code, "")
+	rv.opts = append(options(nil), resp.opts...)
+	rv.Payload = resp.Payload
+	return rv, nil
+}
+
+// proxyBackend is a proxy's connection to its backend, dialed when
+// first needed and again after it fails.
+type proxyBackend struct {
+	ids    proxyIDs
+	mu     sync.Mutex
+	client Client
+}
+
+// forward relays the request m to target, the backend's URL for it,
+// and returns the response to m.  Nil dial means DialURL.
+func (b *proxyBackend) forward(dial func(string) (Client, error), m *Message, target *url.URL, unsafe UnsafeOptionPolicy) *Message {
+	c, err := b.conn(dial, target)
+	if err != nil {
+		return proxyError(*m, BadGateway, err.Error())
+	}
+	rv, err := b.ids.relay(c, m, target, unsafe)
+	if err != nil && err != ErrTimeout {
+		b.drop(c)
+	}
+	return rv
+}
+
+func (b *proxyBackend) conn(dial func(string) (Client, error), target *url.URL) (Client, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.client != nil {
+		return b.client, nil
+	}
+	if dial == nil {
+		dial = DialURL
+	}
+	c, err := dial((&url.URL{Scheme: target.Scheme, Host: target.Host}).String())
+	if err != nil {
+		return nil, err
+	}
+	b.client = c
+	return c, nil
+}
+
+// drop closes c, a connection that failed, so the next request dials
+// the backend again.
+func (b *proxyBackend) drop(c Client) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.client == c {
+		b.client = nil
+	}
+	c.Close()
+}
+
+func (b *proxyBackend) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.client == nil {
+		return nil
+	}
+	err := b.client.Close()
+	b.client = nil
+	return err
+}
+
+// target returns the URI the proxy request m is for, or the error
+// response to it.
+func (p *ForwardProxy) target(l *net.UDPConn, m *Message) (*url.URL, *Message) {
+	var u *url.URL
+	if v, ok := m.Option(ProxyURI).(string); ok {
+		var err error
+		if u, err = url.Parse(v); err != nil || !u.IsAbs() {
+			return nil, proxyError(*m, BadOption, fmt.Sprintf("invalid Proxy-Uri %q", v))
+		}
+	} else {
+		var local net.Addr
+		if l != nil {
+			local = l.LocalAddr()
+		}
+		u = m.URL(local)
+		u.Scheme, _ = m.Option(ProxyScheme).(string)
+	}
+
+	schemes := p.Schemes
+	if schemes == nil {
+		schemes = DefaultProxySchemes
+	}
+	for _, s := range schemes {
+		if u.Scheme == s {
+			return u, nil
+		}
+	}
+	return nil, proxyError(*m, ProxyingNotSupported, fmt.Sprintf("unsupported scheme %q", u.Scheme))
+}
@@ -0,0 +1,168 @@
+package coap
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestOptionIDProperties(t *testing.T) {
+	tests := []struct {
+		id                        OptionID
+		critical, unsafe, nocache bool
+	}{
+		{IfMatch, true, false, false},
+		{URIHost, true, true, false},
+		{ETag, false, false, false},
+		{MaxAge, false, true, false},
+		{Size1, false, false, true},
+		{Size2, false, false, true},
+	}
+
+	for _, test := range tests {
+		if test.id.Critical() != test.critical || test.id.UnSafe() != test.unsafe ||
+			test.id.NoCacheKey() != test.nocache {
+			t.Errorf("Unexpected properties for %v: critical=%v unsafe=%v nocachekey=%v",
+				test.id, test.id.Critical(), test.id.UnSafe(), test.id.NoCacheKey())
+		}
+	}
+}
+
+func TestForwardUnrecognizedOptions(t *testing.T) {
+	const safe, unsafe OptionID = 252, 250
+
+	req := Message{Type: Confirmable, Code: GET, MessageID: 7, Token: []byte("p")}
+	req.SetPathString("/x")
+	req.AddOption(unsafe, []byte{2})
+	req.AddOption(safe, []byte{1})
+	data, err := req.MarshalBinary()
+	if err != nil {
+		t.Fatalf("Error encoding: %v", err)
+	}
+	got, err := ParseMessage(data)
+	if err != nil {
+		t.Fatalf("Error parsing: %v", err)
+	}
+	if ids := got.UnrecognizedOptions(); !reflect.DeepEqual(ids, []OptionID{unsafe, safe}) {
+		t.Fatalf("Expected unrecognized options %v, got %v", []OptionID{unsafe, safe}, ids)
+	}
+
+	fwd, reject := RejectUnsafe.Forward(got)
+	if fwd != nil || reject == nil || reject.Code != BadOption ||
+		reject.Type != Acknowledgement || reject.MessageID != 7 {
+		t.Errorf("Expected a 4.02 ACK, got %v, %v", fwd, reject)
+	}
+
+	fwd, reject = ForwardUnsafe.Forward(got)
+	if reject != nil {
+		t.Fatalf("Unexpected rejection: %v", reject)
+	}
+	out, err := fwd.MarshalBinary()
+	if err != nil {
+		t.Fatalf("Error encoding forwarded request: %v", err)
+	}
+	if !bytes.Equal(out, data) {
+		t.Errorf("Expected the request forwarded verbatim\n%x, got\n%x", data, out)
+	}
+
+	req.RemoveOption(unsafe)
+	if fwd, reject := RejectUnsafe.Forward(req); fwd == nil || reject != nil {
+		t.Errorf("Expected safe options forwarded, got %v, %v", fwd, reject)
+	}
+}
+
+func TestForwardHopLimit(t *testing.T) {
+	tests := []struct {
+		hops   interface{}
+		expect interface{}
+		code   COAPCode
+	}{
+		{nil, nil, 0},
+		{uint32(16), uint32(15), 0},
+		{uint32(2), uint32(1), 0},
+		{uint32(1), nil, HopLimitReached},
+		{uint32(0), nil, HopLimitReached},
+	}
+
+	for _, test := range tests {
+		req := Message{Type: NonConfirmable, Code: GET, MessageID: 3}
+		if test.hops != nil {
+			req.SetOption(HopLimit, test.hops)
+		}
+		fwd, reject := RejectUnsafe.Forward(req)
+		if test.code != 0 {
+			if fwd != nil || reject == nil || reject.Code != test.code || reject.Type != NonConfirmable {
+				t.Errorf("Hop-Limit %v: expected %v, got %v, %v", test.hops, test.code, fwd, reject)
+			}
+			continue
+		}
+		if reject != nil || fwd.Option(HopLimit) != test.expect {
+			t.Errorf("Hop-Limit %v: expected %v forwarded, got %v, %v", test.hops, test.expect, fwd, reject)
+		}
+		if req.Option(HopLimit) != test.hops {
+			t.Errorf("Hop-Limit %v: the original request changed", test.hops)
+		}
+	}
+}
+
+func TestForwardProxy(t *testing.T) {
+	bl, baddr := startUDPLisenter(t)
+	defer bl.Close()
+	go Serve(bl, FuncHandler(func(l *net.UDPConn, a *net.UDPAddr, m *Message) *Message {
+		rv := &Message{
+			Type:      Acknowledgement,
+			Code:      Content,
+			MessageID: m.MessageID,
+			Token:     m.Token,
+			Payload:   []byte(m.URL(l.LocalAddr()).RequestURI() + " " + string(m.Payload)),
+		}
+		rv.SetOption(MaxAge, 30)
+		return rv
+	}))
+
+	pl, paddr := startUDPLisenter(t)
+	defer pl.Close()
+	go Serve(pl, &ForwardProxy{})
+
+	port := uint32(bl.LocalAddr().(*net.UDPAddr).Port)
+	tests := []struct {
+		name string
+		opts []Option
+		code COAPCode
+		exp  string
+	}{
+		{"Proxy-Uri", []Option{{ProxyURI, "coap://" + baddr + "/a/b?x=1"}},
+			Content, "/a/b?x=1 hi"},
+		{"Proxy-Scheme", []Option{{URIHost, "127.0.0.1"}, {URIPort, port},
+			{URIPath, "c"}, {ProxyScheme, "coap"}},
+			Content, "/c hi"},
+		{"scheme", []Option{{ProxyURI, "http://" + baddr + "/"}},
+			ProxyingNotSupported, `unsupported scheme "http"`},
+		{"relative", []Option{{ProxyURI, "/a"}},
+			BadOption, `invalid Proxy-Uri "/a"`},
+		{"not proxied", nil, NotFound, ""},
+	}
+	for i, test := range tests {
+		req := Message{Type: Confirmable, Code: POST, MessageID: uint16(i), Token: []byte{byte(i)}, Payload: []byte("hi")}
+		for _, o := range test.opts {
+			req.AddOption(o.ID, o.Value)
+		}
+		rv := dialAndSend(t, paddr, req)
+		if rv.Code != test.code || string(rv.Payload) != test.exp || !bytes.Equal(rv.Token, req.Token) {
+			t.Errorf("%v: expected %v %q, got %v", test.name, test.code, test.exp, rv)
+		}
+		if test.code == Content && rv.Option(MaxAge) != uint32(30) {
+			t.Errorf("%v: expected Max-Age relayed, got %v", test.name, rv)
+		}
+	}
+
+	dl, daddr := startUDPLisenter(t)
+	defer dl.Close()
+	go Serve(dl, &ForwardProxy{Disabled: true})
+	req := Message{Type: Confirmable, Code: GET, MessageID: 10}
+	req.SetOption(ProxyURI, "coap://"+baddr+"/")
+	if rv := dialAndSend(t, daddr, req); rv.Code != ProxyingNotSupported {
+		t.Errorf("Expected ProxyingNotSupported when disabled, got %v", rv)
+	}
+}
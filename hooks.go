@@ -0,0 +1,53 @@
+package coap
+
+import (
+	"net"
+	"time"
+)
+
+// Hooks are callbacks a Server or client connection makes as its
+// exchanges progress, for logging, metrics or tracing.  Any of them
+// may be nil.  They're called on the goroutines handling the
+// exchanges, so they should be quick, and safe for concurrent use.
+// A nil *Hooks calls nothing.
+type Hooks struct {
+	// OnRequest is called with each request a server received or
+	// a client sent, and the peer's address.
+	OnRequest func(m Message, peer net.Addr)
+	// OnResponse is called with each response a server sent or a
+	// client received, and the time since the request arrived or
+	// was first sent.
+	OnResponse func(m Message, peer net.Addr, elapsed time.Duration)
+	// OnRetransmit is called before each retransmission of a
+	// confirmable message, with its number, counting from 1, and
+	// the time since the message was first sent.
+	OnRetransmit func(m Message, peer net.Addr, attempt int, elapsed time.Duration)
+	// OnTimeout is called when a confirmable message, or a
+	// client's request, is given up on for lack of an answer, with
+	// the time since it was first sent.
+	OnTimeout func(m Message, peer net.Addr, elapsed time.Duration)
+}
+
+func (h *Hooks) request(m Message, peer net.Addr) {
+	if h != nil && h.OnRequest != nil {
+		h.OnRequest(m, peer)
+	}
+}
+
+func (h *Hooks) response(m Message, peer net.Addr, start time.Time) {
+	if h != nil && h.OnResponse != nil {
+		h.OnResponse(m, peer, time.Since(start))
+	}
+}
+
+func (h *Hooks) retransmit(m Message, peer net.Addr, attempt int, start time.Time) {
+	if h != nil && h.OnRetransmit != nil {
+		h.OnRetransmit(m, peer, attempt, time.Since(start))
+	}
+}
+
+func (h *Hooks) timeout(m Message, peer net.Addr, start time.Time) {
+	if h != nil && h.OnTimeout != nil {
+		h.OnTimeout(m, peer, time.Since(start))
+	}
+}
@@ -0,0 +1,103 @@
+package coap
+
+import (
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// hookLog records the calls of its hooks.
+type hookLog struct {
+	mu    sync.Mutex
+	calls []string
+}
+
+func (h *hookLog) add(s string) {
+	h.mu.Lock()
+	h.calls = append(h.calls, s)
+	h.mu.Unlock()
+}
+
+func (h *hookLog) get() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]string(nil), h.calls...)
+}
+
+func (h *hookLog) hooks() *Hooks {
+	return &Hooks{
+		OnRequest: func(m Message, peer net.Addr) {
+			h.add("request " + m.Code.String())
+		},
+		OnResponse: func(m Message, peer net.Addr, elapsed time.Duration) {
+			if elapsed < 0 {
+				h.add("negative elapsed time")
+			}
+			h.add("response " + m.Code.String())
+		},
+		OnRetransmit: func(m Message, peer net.Addr, attempt int, elapsed time.Duration) {
+			h.add("retransmit")
+		},
+		OnTimeout: func(m Message, peer net.Addr, elapsed time.Duration) {
+			h.add("timeout")
+		},
+	}
+}
+
+func TestHooks(t *testing.T) {
+	var server, client hookLog
+	l, addr := startUDPLisenter(t)
+	defer l.Close()
+	s := &Server{Handler: FuncHandler(contentHandler), Hooks: server.hooks()}
+	go s.Serve(l)
+
+	d := Dialer{Hooks: client.hooks()}
+	c, err := d.Dial("udp", addr)
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	defer c.Close()
+	if _, err := c.Send(Message{Type: Confirmable, Code: GET, MessageID: 1, Token: []byte("h")}); err != nil {
+		t.Fatalf("Error sending: %v", err)
+	}
+
+	exp := []string{"request GET", "response Content"}
+	for _, log := range []*hookLog{&server, &client} {
+		if got := log.get(); !reflect.DeepEqual(got, exp) {
+			t.Errorf("Expected %v, got %v", exp, got)
+		}
+	}
+
+	var lost hookLog
+	pl, paddr, _ := pingServer(t, true)
+	defer pl.Close()
+	d = Dialer{
+		Hooks:  lost.hooks(),
+		Params: TransmissionParams{Retry: ExponentialBackoff{Initial: time.Millisecond, MaxAttempts: 3}},
+	}
+	c, err = d.Dial("udp", paddr)
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	defer c.Close()
+	if _, err := c.Send(Message{Type: Confirmable, Code: GET, MessageID: 2, Token: []byte("l")}); err != ErrTimeout {
+		t.Fatalf("Expected ErrTimeout, got %v", err)
+	}
+	exp = []string{"request GET", "retransmit", "retransmit", "timeout"}
+	if got := lost.get(); !reflect.DeepEqual(got, exp) {
+		t.Errorf("Expected %v, got %v", exp, got)
+	}
+
+	var separate hookLog
+	a, _ := net.ResolveUDPAddr("udp", paddr)
+	m := Message{Type: Confirmable, Code: Content, MessageID: 3}
+	if _, err := transmitConfirmable(l, a, m, d.Params, telemetry{hooks: separate.hooks()}, nil); err != ErrRetransmitTimeout {
+		t.Fatalf("Expected ErrRetransmitTimeout, got %v", err)
+	}
+	exp = []string{"retransmit", "retransmit", "timeout"}
+	if got := separate.get(); !reflect.DeepEqual(got, exp) {
+		t.Errorf("Expected %v, got %v", exp, got)
+	}
+}
@@ -0,0 +1,147 @@
+package coap
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+// ErrBadLink is returned for link-format documents that don't parse.
+var ErrBadLink = errors.New("malformed link-format")
+
+// A Link is one link of an application/link-format document (RFC
+// 6690).
+type Link struct {
+	// Target is the URI reference between the angle brackets.
+	Target string
+	// Params are the link attributes.  Those without a value map
+	// to "".
+	Params map[string]string
+}
+
+// ParseLinks parses an application/link-format document, such as the
+// payload of a response from /.well-known/core.
+func ParseLinks(s string) ([]Link, error) {
+	var links []Link
+	s = strings.TrimSpace(s)
+	for s != "" {
+		if s[0] != '<' {
+			return nil, ErrBadLink
+		}
+		end := strings.IndexByte(s, '>')
+		if end < 0 {
+			return nil, ErrBadLink
+		}
+		l := Link{Target: s[1:end], Params: map[string]string{}}
+		s = strings.TrimSpace(s[end+1:])
+
+		for s != "" && s[0] == ';' {
+			s = strings.TrimSpace(s[1:])
+			i := strings.IndexAny(s, "=;,")
+			if i < 0 {
+				i = len(s)
+			}
+			name := strings.TrimSpace(s[:i])
+			if name == "" {
+				return nil, ErrBadLink
+			}
+			s = s[i:]
+			var value string
+			if s != "" && s[0] == '=' {
+				var err error
+				value, s, err = linkParamValue(strings.TrimSpace(s[1:]))
+				if err != nil {
+					return nil, err
+				}
+			}
+			l.Params[name] = value
+			s = strings.TrimSpace(s)
+		}
+		links = append(links, l)
+
+		if s != "" {
+			if s[0] != ',' {
+				return nil, ErrBadLink
+			}
+			s = strings.TrimSpace(s[1:])
+		}
+	}
+	return links, nil
+}
+
+// linkParamValue splits a token or quoted string off the beginning of
+// s.
+func linkParamValue(s string) (value, rest string, err error) {
+	if s == "" || s[0] != '"' {
+		i := strings.IndexAny(s, ";,")
+		if i < 0 {
+			i = len(s)
+		}
+		return strings.TrimSpace(s[:i]), s[i:], nil
+	}
+
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+			if i == len(s) {
+				return "", "", ErrBadLink
+			}
+			b.WriteByte(s[i])
+		case '"':
+			return b.String(), s[i+1:], nil
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return "", "", ErrBadLink
+}
+
+// linkQuoter escapes a link attribute value for a quoted string.
+var linkQuoter = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+// FormatLinks serializes links as an application/link-format
+// document.
+func FormatLinks(links []Link) string {
+	var b strings.Builder
+	for i, l := range links {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(l.String())
+	}
+	return b.String()
+}
+
+// String serializes the link, with its attributes sorted by name.
+// Values other than numbers are quoted, and attributes with an empty
+// value appear by name only.
+func (l Link) String() string {
+	var b strings.Builder
+	b.WriteString("<" + l.Target + ">")
+
+	names := make([]string, 0, len(l.Params))
+	for k := range l.Params {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		b.WriteString(";" + k)
+		v := l.Params[k]
+		switch {
+		case v == "":
+		case strings.Trim(v, "0123456789") == "":
+			b.WriteString("=" + v)
+		default:
+			b.WriteString(`="` + linkQuoter.Replace(v) + `"`)
+		}
+	}
+	return b.String()
+}
+
+// Values returns the space-separated values of the attribute name,
+// such as the resource types of "rt" or the interfaces of "if".
+func (l Link) Values(name string) []string {
+	return strings.Fields(l.Params[name])
+}
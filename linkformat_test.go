@@ -0,0 +1,72 @@
+package coap
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseLinks(t *testing.T) {
+	tests := []struct {
+		in  string
+		exp []Link
+	}{
+		{"", nil},
+		{`</sensors/temp>;rt="temperature-c";if=sensor;obs,</a,b>`,
+			[]Link{
+				{"/sensors/temp", map[string]string{"rt": "temperature-c", "if": "sensor", "obs": ""}},
+				{"/a,b", map[string]string{}},
+			}},
+		{`<coap://[2001:db8::1]>; ep="n\"1" ; d=, </x>`,
+			[]Link{
+				{"coap://[2001:db8::1]", map[string]string{"ep": `n"1`, "d": ""}},
+				{"/x", map[string]string{}},
+			}},
+	}
+
+	for _, test := range tests {
+		got, err := ParseLinks(test.in)
+		if err != nil {
+			t.Errorf("Error parsing %q: %v", test.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.exp) {
+			t.Errorf("Parsing %q: expected %v, got %v", test.in, test.exp, got)
+		}
+	}
+
+	for _, bad := range []string{"/x", "</x", `</x>;rt="open`, "</x>;=1", "</x> </y>"} {
+		if _, err := ParseLinks(bad); err != ErrBadLink {
+			t.Errorf("Parsing %q: expected ErrBadLink, got %v", bad, err)
+		}
+	}
+}
+
+func TestFormatLinks(t *testing.T) {
+	links := []Link{
+		{"/sensors/temp", map[string]string{"rt": "temperature-c core.s", "ct": "40", "obs": ""}},
+		{"coap://[2001:db8::1]/x", map[string]string{"title": `say "\hi"`}},
+		{"/empty", nil},
+	}
+	exp := `</sensors/temp>;ct=40;obs;rt="temperature-c core.s",` +
+		`<coap://[2001:db8::1]/x>;title="say \"\\hi\"",` +
+		`</empty>`
+	got := FormatLinks(links)
+	if got != exp {
+		t.Fatalf("Expected\n%s\ngot\n%s", exp, got)
+	}
+
+	parsed, err := ParseLinks(got)
+	if err != nil {
+		t.Fatalf("Error parsing %q: %v", got, err)
+	}
+	links[2].Params = map[string]string{}
+	if !reflect.DeepEqual(parsed, links) {
+		t.Errorf("Round trip: expected %v, got %v", links, parsed)
+	}
+	if v := parsed[0].Values("rt"); !reflect.DeepEqual(v, []string{"temperature-c", "core.s"}) {
+		t.Errorf("Unexpected rt values: %v", v)
+	}
+	if FormatLinks(nil) != "" {
+		t.Errorf("Expected an empty document for no links")
+	}
+}
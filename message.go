@@ -2,12 +2,15 @@ package coap
 
 import (
 	"bytes"
+	"encoding"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"reflect"
 	"sort"
 	"strings"
+	"unicode"
+	"unicode/utf8"
 )
 
 // COAPType represents the message type.
@@ -52,59 +55,94 @@ const (
 	POST   COAPCode = 2
 	PUT    COAPCode = 3
 	DELETE COAPCode = 4
+	FETCH  COAPCode = 5 // RFC 8132
+	PATCH  COAPCode = 6 // RFC 8132
+	IPATCH COAPCode = 7 // RFC 8132
 )
 
 // Response Codes
 const (
-	Created               COAPCode = 65
-	Deleted               COAPCode = 66
-	Valid                 COAPCode = 67
-	Changed               COAPCode = 68
-	Content               COAPCode = 69
-	BadRequest            COAPCode = 128
-	Unauthorized          COAPCode = 129
-	BadOption             COAPCode = 130
-	Forbidden             COAPCode = 131
-	NotFound              COAPCode = 132
-	MethodNotAllowed      COAPCode = 133
-	NotAcceptable         COAPCode = 134
-	PreconditionFailed    COAPCode = 140
-	RequestEntityTooLarge COAPCode = 141
-	UnsupportedMediaType  COAPCode = 143
-	InternalServerError   COAPCode = 160
-	NotImplemented        COAPCode = 161
-	BadGateway            COAPCode = 162
-	ServiceUnavailable    COAPCode = 163
-	GatewayTimeout        COAPCode = 164
-	ProxyingNotSupported  COAPCode = 165
+	Created                 COAPCode = 65
+	Deleted                 COAPCode = 66
+	Valid                   COAPCode = 67
+	Changed                 COAPCode = 68
+	Content                 COAPCode = 69
+	Continue                COAPCode = 95
+	BadRequest              COAPCode = 128
+	Unauthorized            COAPCode = 129
+	BadOption               COAPCode = 130
+	Forbidden               COAPCode = 131
+	NotFound                COAPCode = 132
+	MethodNotAllowed        COAPCode = 133
+	NotAcceptable           COAPCode = 134
+	RequestEntityIncomplete COAPCode = 136
+	Conflict                COAPCode = 137
+	PreconditionFailed      COAPCode = 140
+	RequestEntityTooLarge   COAPCode = 141
+	UnsupportedMediaType    COAPCode = 143
+	UnprocessableEntity     COAPCode = 150
+	InternalServerError     COAPCode = 160
+	NotImplemented          COAPCode = 161
+	BadGateway              COAPCode = 162
+	ServiceUnavailable      COAPCode = 163
+	GatewayTimeout          COAPCode = 164
+	ProxyingNotSupported    COAPCode = 165
+	HopLimitReached         COAPCode = 168
 )
 
+// Signaling Codes, used on reliable transports (RFC 8323 section 5).
+const (
+	CSM     COAPCode = 225
+	Ping    COAPCode = 226
+	Pong    COAPCode = 227
+	Release COAPCode = 228
+	Abort   COAPCode = 229
+)
+
+func isSignal(c COAPCode) bool {
+	return c>>5 == 7
+}
+
 var codeNames = [256]string{
-	GET:                   "GET",
-	POST:                  "POST",
-	PUT:                   "PUT",
-	DELETE:                "DELETE",
-	Created:               "Created",
-	Deleted:               "Deleted",
-	Valid:                 "Valid",
-	Changed:               "Changed",
-	Content:               "Content",
-	BadRequest:            "BadRequest",
-	Unauthorized:          "Unauthorized",
-	BadOption:             "BadOption",
-	Forbidden:             "Forbidden",
-	NotFound:              "NotFound",
-	MethodNotAllowed:      "MethodNotAllowed",
-	NotAcceptable:         "NotAcceptable",
-	PreconditionFailed:    "PreconditionFailed",
-	RequestEntityTooLarge: "RequestEntityTooLarge",
-	UnsupportedMediaType:  "UnsupportedMediaType",
-	InternalServerError:   "InternalServerError",
-	NotImplemented:        "NotImplemented",
-	BadGateway:            "BadGateway",
-	ServiceUnavailable:    "ServiceUnavailable",
-	GatewayTimeout:        "GatewayTimeout",
-	ProxyingNotSupported:  "ProxyingNotSupported",
+	0:                       "Empty",
+	GET:                     "GET",
+	POST:                    "POST",
+	PUT:                     "PUT",
+	DELETE:                  "DELETE",
+	FETCH:                   "FETCH",
+	PATCH:                   "PATCH",
+	IPATCH:                  "iPATCH",
+	Created:                 "Created",
+	Deleted:                 "Deleted",
+	Valid:                   "Valid",
+	Changed:                 "Changed",
+	Content:                 "Content",
+	Continue:                "Continue",
+	BadRequest:              "BadRequest",
+	Unauthorized:            "Unauthorized",
+	BadOption:               "BadOption",
+	Forbidden:               "Forbidden",
+	NotFound:                "NotFound",
+	MethodNotAllowed:        "MethodNotAllowed",
+	NotAcceptable:           "NotAcceptable",
+	RequestEntityIncomplete: "RequestEntityIncomplete",
+	Conflict:                "Conflict",
+	PreconditionFailed:      "PreconditionFailed",
+	RequestEntityTooLarge:   "RequestEntityTooLarge",
+	UnsupportedMediaType:    "UnsupportedMediaType",
+	UnprocessableEntity:     "UnprocessableEntity",
+	InternalServerError:     "InternalServerError",
+	NotImplemented:          "NotImplemented",
+	BadGateway:              "BadGateway",
+	ServiceUnavailable:      "ServiceUnavailable",
+	GatewayTimeout:          "GatewayTimeout",
+	ProxyingNotSupported:    "ProxyingNotSupported",
+	HopLimitReached:         "HopLimitReached",
+	CSM:                     "CSM",
+	Ping:                    "Ping",
+	Pong:                    "Pong",
+	Release:                 "Release",
+	Abort:                   "Abort",
 }
 
 func init() {
@@ -124,10 +162,30 @@ var (
 	ErrInvalidTokenLen   = errors.New("invalid token length")
 	ErrOptionTooLong     = errors.New("option is too long")
 	ErrOptionGapTooLarge = errors.New("option gap too large")
+	ErrInvalidType       = errors.New("invalid message type")
+	ErrNonEmpty          = errors.New("empty message with token, options or payload")
 )
 
 // OptionID identifies an option in a message.
-type OptionID uint8
+type OptionID uint16
+
+// Critical tells whether an endpoint that doesn't understand the
+// option must reject the message (RFC 7252 section 5.4.1).
+func (o OptionID) Critical() bool {
+	return o&1 != 0
+}
+
+// UnSafe tells whether a proxy that doesn't understand the option
+// must not forward it (RFC 7252 section 5.4.2).
+func (o OptionID) UnSafe() bool {
+	return o&2 != 0
+}
+
+// NoCacheKey tells whether the option is left out of the cache key
+// (RFC 7252 section 5.4.2).
+func (o OptionID) NoCacheKey() bool {
+	return o&0x1e == 0x1c
+}
 
 /*
    +-----+----+---+---+---+----------------+--------+--------+---------+
@@ -151,6 +209,20 @@ type OptionID uint8
    |  39 | x  | x | - |   | Proxy-Scheme   | string | 1-255  | (none)  |
    |  60 |    |   | x |   | Size1          | uint   | 0-4    | (none)  |
    +-----+----+---+---+---+----------------+--------+--------+---------+
+
+   Blockwise transfers (RFC 7959) add:
+
+   |  23 | x  | x | - | - | Block2         | uint   | 0-3    | (none)  |
+   |  27 | x  | x | - | - | Block1         | uint   | 0-3    | (none)  |
+   |  28 |    |   | x |   | Size2          | uint   | 0-4    | (none)  |
+
+   No-Response (RFC 7967) adds:
+
+   | 258 |    | x | - |   | No-Response    | uint   | 0-1    | 0       |
+
+   Hop-Limit (RFC 8768) adds:
+
+   |  16 |    |   |   |   | Hop-Limit      | uint   | 1      | 16      |
 */
 
 // Option IDs.
@@ -166,11 +238,16 @@ const (
 	ContentFormat OptionID = 12
 	MaxAge        OptionID = 14
 	URIQuery      OptionID = 15
+	HopLimit      OptionID = 16
 	Accept        OptionID = 17
 	LocationQuery OptionID = 20
+	Block2        OptionID = 23
+	Block1        OptionID = 27
+	Size2         OptionID = 28
 	ProxyURI      OptionID = 35
 	ProxyScheme   OptionID = 39
 	Size1         OptionID = 60
+	NoResponse    OptionID = 258
 )
 
 // Option value format (RFC7252 section 3.2)
@@ -184,29 +261,93 @@ const (
 	valueString
 )
 
+// An optionDef describes an option: its name, value format and
+// length, and whether it may be repeated (RFC 7252 section 5.4.5).
+// Whether it's critical, unsafe or part of the cache key follows from
+// its number.
 type optionDef struct {
+	name        string
 	valueFormat valueFormat
 	minLen      int
 	maxLen      int
+	repeatable  bool
+}
+
+var optionDefs = map[OptionID]optionDef{
+	IfMatch:       {name: "If-Match", valueFormat: valueOpaque, minLen: 0, maxLen: 8, repeatable: true},
+	URIHost:       {name: "Uri-Host", valueFormat: valueString, minLen: 1, maxLen: 255},
+	ETag:          {name: "ETag", valueFormat: valueOpaque, minLen: 1, maxLen: 8, repeatable: true},
+	IfNoneMatch:   {name: "If-None-Match", valueFormat: valueEmpty, minLen: 0, maxLen: 0},
+	Observe:       {name: "Observe", valueFormat: valueUint, minLen: 0, maxLen: 3},
+	URIPort:       {name: "Uri-Port", valueFormat: valueUint, minLen: 0, maxLen: 2},
+	LocationPath:  {name: "Location-Path", valueFormat: valueString, minLen: 0, maxLen: 255, repeatable: true},
+	URIPath:       {name: "Uri-Path", valueFormat: valueString, minLen: 0, maxLen: 255, repeatable: true},
+	ContentFormat: {name: "Content-Format", valueFormat: valueUint, minLen: 0, maxLen: 2},
+	MaxAge:        {name: "Max-Age", valueFormat: valueUint, minLen: 0, maxLen: 4},
+	URIQuery:      {name: "Uri-Query", valueFormat: valueString, minLen: 0, maxLen: 255, repeatable: true},
+	HopLimit:      {name: "Hop-Limit", valueFormat: valueUint, minLen: 1, maxLen: 1},
+	Accept:        {name: "Accept", valueFormat: valueUint, minLen: 0, maxLen: 2},
+	LocationQuery: {name: "Location-Query", valueFormat: valueString, minLen: 0, maxLen: 255, repeatable: true},
+	Block2:        {name: "Block2", valueFormat: valueUint, minLen: 0, maxLen: 3},
+	Block1:        {name: "Block1", valueFormat: valueUint, minLen: 0, maxLen: 3},
+	Size2:         {name: "Size2", valueFormat: valueUint, minLen: 0, maxLen: 4},
+	ProxyURI:      {name: "Proxy-Uri", valueFormat: valueString, minLen: 1, maxLen: 1034},
+	ProxyScheme:   {name: "Proxy-Scheme", valueFormat: valueString, minLen: 1, maxLen: 255},
+	Size1:         {name: "Size1", valueFormat: valueUint, minLen: 0, maxLen: 4},
+	NoResponse:    {name: "No-Response", valueFormat: valueUint, minLen: 0, maxLen: 1},
+}
+
+// lookupOptionDef returns the definition of the option id in a
+// message with the given code, whose zero value is for options this
+// package doesn't know.
+func lookupOptionDef(code COAPCode, id OptionID) optionDef {
+	if isSignal(code) {
+		return signalOptionDefs[code][id]
+	}
+	return optionDefs[id]
+}
+
+// No-Response option values, combined to suppress several classes of
+// responses (RFC 7967 section 2.1).
+const (
+	NoResponseSuccess     uint32 = 1 << 1 // 2.xx
+	NoResponseClientError uint32 = 1 << 3 // 4.xx
+	NoResponseServerError uint32 = 1 << 4 // 5.xx
+)
+
+// suppressed tells whether the No-Response option of the request m
+// asks not to be sent a response with code c.
+func (m Message) suppressed(c COAPCode) bool {
+	v, ok := m.Option(NoResponse).(uint32)
+	if !ok {
+		return false
+	}
+	return v&(1<<(c>>5-1)) != 0
 }
 
-var optionDefs = [256]optionDef{
-	IfMatch:       optionDef{valueFormat: valueOpaque, minLen: 0, maxLen: 8},
-	URIHost:       optionDef{valueFormat: valueString, minLen: 1, maxLen: 255},
-	ETag:          optionDef{valueFormat: valueOpaque, minLen: 1, maxLen: 8},
-	IfNoneMatch:   optionDef{valueFormat: valueEmpty, minLen: 0, maxLen: 0},
-	Observe:       optionDef{valueFormat: valueUint, minLen: 0, maxLen: 3},
-	URIPort:       optionDef{valueFormat: valueUint, minLen: 0, maxLen: 2},
-	LocationPath:  optionDef{valueFormat: valueString, minLen: 0, maxLen: 255},
-	URIPath:       optionDef{valueFormat: valueString, minLen: 0, maxLen: 255},
-	ContentFormat: optionDef{valueFormat: valueUint, minLen: 0, maxLen: 2},
-	MaxAge:        optionDef{valueFormat: valueUint, minLen: 0, maxLen: 4},
-	URIQuery:      optionDef{valueFormat: valueString, minLen: 0, maxLen: 255},
-	Accept:        optionDef{valueFormat: valueUint, minLen: 0, maxLen: 2},
-	LocationQuery: optionDef{valueFormat: valueString, minLen: 0, maxLen: 255},
-	ProxyURI:      optionDef{valueFormat: valueString, minLen: 1, maxLen: 1034},
-	ProxyScheme:   optionDef{valueFormat: valueString, minLen: 1, maxLen: 255},
-	Size1:         optionDef{valueFormat: valueUint, minLen: 0, maxLen: 4},
+// Signaling option IDs.  Their meaning depends on the signaling
+// code they're used with.
+const (
+	MaxMessageSize     OptionID = 2 // CSM
+	BlockWiseTransfer  OptionID = 4 // CSM
+	Custody            OptionID = 2 // Ping and Pong
+	AlternativeAddress OptionID = 2 // Release
+	HoldOff            OptionID = 4 // Release
+	BadCSMOption       OptionID = 2 // Abort
+)
+
+var signalOptionDefs = map[COAPCode]map[OptionID]optionDef{
+	CSM: {
+		MaxMessageSize:    {name: "Max-Message-Size", valueFormat: valueUint, minLen: 0, maxLen: 4},
+		BlockWiseTransfer: {name: "Block-Wise-Transfer", valueFormat: valueEmpty, minLen: 0, maxLen: 0},
+	},
+	Ping: {Custody: {name: "Custody", valueFormat: valueEmpty, minLen: 0, maxLen: 0}},
+	Pong: {Custody: {name: "Custody", valueFormat: valueEmpty, minLen: 0, maxLen: 0}},
+	Release: {
+		AlternativeAddress: {name: "Alternative-Address", valueFormat: valueString, minLen: 1, maxLen: 255, repeatable: true},
+		HoldOff:            {name: "Hold-Off", valueFormat: valueUint, minLen: 0, maxLen: 3},
+	},
+	Abort: {BadCSMOption: {name: "Bad-CSM-Option", valueFormat: valueUint, minLen: 0, maxLen: 2}},
 }
 
 // MediaType specifies the content type of a message.
@@ -220,6 +361,7 @@ const (
 	AppOctets     MediaType = 42 // application/octet-stream
 	AppExi        MediaType = 47 // application/exi
 	AppJSON       MediaType = 50 // application/json
+	AppCBOR       MediaType = 60 // application/cbor
 )
 
 type option struct {
@@ -254,57 +396,121 @@ func decodeInt(b []byte) uint32 {
 	return binary.BigEndian.Uint32(tmp)
 }
 
-func (o option) toBytes() []byte {
+func (o option) toBytes() ([]byte, error) {
 	var v uint32
 
 	switch i := o.Value.(type) {
 	case string:
-		return []byte(i)
+		return []byte(i), nil
 	case []byte:
-		return i
+		return i, nil
 	case MediaType:
 		v = uint32(i)
 	case int:
+		if i < 0 || int64(i) > 1<<32-1 {
+			return nil, o.invalid("value %d out of range", i)
+		}
 		v = uint32(i)
 	case int32:
+		if i < 0 {
+			return nil, o.invalid("value %d out of range", i)
+		}
 		v = uint32(i)
 	case uint:
+		if uint64(i) > 1<<32-1 {
+			return nil, o.invalid("value %d out of range", i)
+		}
 		v = uint32(i)
 	case uint32:
 		v = i
 	default:
-		panic(fmt.Errorf("invalid type for option %x: %T (%v)",
-			o.ID, o.Value, o.Value))
+		return nil, o.invalid("invalid value type %T", o.Value)
+	}
+
+	return encodeInt(v), nil
+}
+
+func (o option) invalid(format string, args ...interface{}) error {
+	return &BadOptionError{ID: o.ID, Reason: fmt.Sprintf(format, args...)}
+}
+
+// validate checks that the message can be encoded.
+func (m *Message) validate() error {
+	if m.Type > Reset {
+		return ErrInvalidType
 	}
+	if len(m.Token) > 8 {
+		return ErrInvalidTokenLen
+	}
+	if m.Code == 0 && (len(m.Token) > 0 || len(m.opts) > 0 || len(m.Payload) > 0) {
+		return ErrNonEmpty
+	}
+	return nil
+}
 
-	return encodeInt(v)
+// optionBytes encodes the value of o, checking it against the
+// option's definition.
+func (m *Message) optionBytes(o option) ([]byte, error) {
+	def := lookupOptionDef(m.Code, o.ID)
+	switch o.Value.(type) {
+	case string, []byte:
+		if def.valueFormat == valueUint {
+			return nil, o.invalid("%T value for a uint option", o.Value)
+		}
+	default:
+		if def.valueFormat == valueString || def.valueFormat == valueOpaque {
+			return nil, o.invalid("%T value for a string or opaque option", o.Value)
+		}
+	}
+	b, err := o.toBytes()
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > extoptWordAddend+0xffff {
+		return nil, ErrOptionTooLong
+	}
+	if def.valueFormat != valueUnknown && (len(b) < def.minLen || len(b) > def.maxLen) {
+		return nil, o.invalid("value length %d out of range %d-%d", len(b), def.minLen, def.maxLen)
+	}
+	return b, nil
 }
 
-func parseOptionValue(optionID OptionID, valueBuf []byte) interface{} {
-	def := optionDefs[optionID]
+// parseOptionValue decodes the value of the option id, which follows
+// the option prev.  A value of the wrong length, or a repetition of an
+// option that can't be repeated, is an error for a critical option;
+// an elective one is skipped with a nil value (RFC 7252 sections
+// 5.4.3 and 5.4.5).
+func parseOptionValue(code COAPCode, id, prev OptionID, valueBuf []byte) (interface{}, error) {
+	def := lookupOptionDef(code, id)
 	if def.valueFormat == valueUnknown {
-		// Skip unrecognized options (RFC7252 section 5.4.1)
-		return nil
+		// Keep unrecognized options as they are, to be rejected
+		// or forwarded (RFC7252 section 5.4.1 and 5.7.1).
+		return valueBuf, nil
 	}
-	if len(valueBuf) < def.minLen || len(valueBuf) > def.maxLen {
-		// Skip options with illegal value length (RFC7252 section 5.4.3)
-		return nil
+	var reason string
+	switch {
+	case len(valueBuf) < def.minLen || len(valueBuf) > def.maxLen:
+		reason = fmt.Sprintf("value length %d out of range %d-%d", len(valueBuf), def.minLen, def.maxLen)
+	case id == prev && !def.repeatable:
+		reason = "not repeatable"
+	}
+	if reason != "" {
+		if id.Critical() {
+			return nil, &BadOptionError{ID: id, Reason: reason}
+		}
+		return nil, nil
 	}
 	switch def.valueFormat {
 	case valueUint:
 		intValue := decodeInt(valueBuf)
-		if optionID == ContentFormat || optionID == Accept {
-			return MediaType(intValue)
-		} else {
-			return intValue
+		if id == ContentFormat || id == Accept {
+			return MediaType(intValue), nil
 		}
+		return intValue, nil
 	case valueString:
-		return string(valueBuf)
-	case valueOpaque, valueEmpty:
-		return valueBuf
+		return string(valueBuf), nil
 	}
-	// Skip unrecognized options (should never be reached)
-	return nil
+	return valueBuf, nil
 }
 
 type options []option
@@ -314,9 +520,6 @@ func (o options) Len() int {
 }
 
 func (o options) Less(i, j int) bool {
-	if o[i].ID == o[j].ID {
-		return i < j
-	}
 	return o[i].ID < o[j].ID
 }
 
@@ -345,6 +548,51 @@ type Message struct {
 	opts options
 }
 
+// COAPMessage is implemented by the messages of every transport
+// (*Message and *TcpMessage), so code dealing with requests and
+// responses can be shared between them.
+type COAPMessage interface {
+	MessageCode() COAPCode
+	SetMessageCode(c COAPCode)
+	MessageToken() []byte
+	SetMessageToken(t []byte)
+	MessagePayload() []byte
+	SetMessagePayload(p []byte)
+
+	Options(o OptionID) []interface{}
+	Option(o OptionID) interface{}
+	AddOption(opID OptionID, val interface{})
+	SetOption(opID OptionID, val interface{})
+	RemoveOption(opID OptionID)
+	PathString() string
+
+	encoding.BinaryMarshaler
+	encoding.BinaryUnmarshaler
+}
+
+var (
+	_ COAPMessage = (*Message)(nil)
+	_ COAPMessage = (*TcpMessage)(nil)
+)
+
+// MessageCode returns the message's code.
+func (m Message) MessageCode() COAPCode { return m.Code }
+
+// SetMessageCode sets the message's code.
+func (m *Message) SetMessageCode(c COAPCode) { m.Code = c }
+
+// MessageToken returns the message's token.
+func (m Message) MessageToken() []byte { return m.Token }
+
+// SetMessageToken sets the message's token.
+func (m *Message) SetMessageToken(t []byte) { m.Token = t }
+
+// MessagePayload returns the message's payload.
+func (m Message) MessagePayload() []byte { return m.Payload }
+
+// SetMessagePayload sets the message's payload.
+func (m *Message) SetMessagePayload(p []byte) { m.Payload = p }
+
 // IsConfirmable returns true if this message is confirmable.
 func (m Message) IsConfirmable() bool {
 	return m.Type == Confirmable
@@ -363,6 +611,45 @@ func (m Message) Options(o OptionID) []interface{} {
 	return rv
 }
 
+// UnrecognizedOptions returns the IDs of the options in the message
+// this package doesn't know, in order.
+func (m Message) UnrecognizedOptions() []OptionID {
+	var rv []OptionID
+	for _, o := range m.opts {
+		if lookupOptionDef(m.Code, o.ID).valueFormat == valueUnknown {
+			rv = append(rv, o.ID)
+		}
+	}
+	return rv
+}
+
+// An Option is an option of a message.
+type Option struct {
+	ID OptionID
+	// Value is the option's value: a uint32 (or MediaType) for
+	// uint options, a string for string options, and a []byte for
+	// empty and opaque options, and options this package doesn't
+	// know.
+	Value interface{}
+}
+
+// Bytes returns the option's value as it's encoded in a message.
+func (o Option) Bytes() ([]byte, error) {
+	return option(o).toBytes()
+}
+
+// AllOptions returns the message's options in the order they're
+// encoded in, for proxies and validators examining options they
+// don't know.
+func (m Message) AllOptions() []Option {
+	var rv []Option
+	for _, o := range m.opts {
+		rv = append(rv, Option(o))
+	}
+	sort.SliceStable(rv, func(i, j int) bool { return rv[i].ID < rv[j].ID })
+	return rv
+}
+
 // Option gets the first value for the given option ID.
 func (m Message) Option(o OptionID) interface{} {
 	for _, v := range m.opts {
@@ -373,6 +660,69 @@ func (m Message) Option(o OptionID) interface{} {
 	return nil
 }
 
+// option returns the first option with the given ID and its
+// definition, or ErrNoOption.
+func (m Message) option(id OptionID) (option, optionDef, error) {
+	def := lookupOptionDef(m.Code, id)
+	for _, o := range m.opts {
+		if o.ID == id {
+			return o, def, nil
+		}
+	}
+	return option{ID: id}, def, ErrNoOption
+}
+
+// GetOptionUint returns the first value of the given uint option,
+// whatever integer type it was set with.
+func (m Message) GetOptionUint(id OptionID) (uint32, error) {
+	o, def, err := m.option(id)
+	if err != nil {
+		return 0, err
+	}
+	if def.valueFormat != valueUnknown && def.valueFormat != valueUint {
+		return 0, o.invalid("not a uint option")
+	}
+	switch o.Value.(type) {
+	case string, []byte:
+		return 0, o.invalid("%T value isn't an integer", o.Value)
+	}
+	b, err := o.toBytes()
+	if err != nil {
+		return 0, err
+	}
+	return decodeInt(b), nil
+}
+
+// GetOptionString returns the first value of the given string
+// option.
+func (m Message) GetOptionString(id OptionID) (string, error) {
+	o, def, err := m.option(id)
+	if err != nil {
+		return "", err
+	}
+	if def.valueFormat != valueUnknown && def.valueFormat != valueString {
+		return "", o.invalid("not a string option")
+	}
+	switch v := o.Value.(type) {
+	case string:
+		return v, nil
+	case []byte:
+		return string(v), nil
+	}
+	return "", o.invalid("%T value isn't a string", o.Value)
+}
+
+// GetOptionBytes returns the first value of the given option as it's
+// encoded in the message, such as an ETag, or an option this package
+// doesn't know.
+func (m Message) GetOptionBytes(id OptionID) ([]byte, error) {
+	o, _, err := m.option(id)
+	if err != nil {
+		return nil, err
+	}
+	return o.toBytes()
+}
+
 func (m Message) optionStrings(o OptionID) []string {
 	var rv []string
 	for _, o := range m.Options(o) {
@@ -386,15 +736,20 @@ func (m Message) Path() []string {
 	return m.optionStrings(URIPath)
 }
 
-// PathString gets a path as a / separated string.
+// PathString gets a path as a / separated string, without a leading
+// slash.  It's "" for the root resource.
 func (m Message) PathString() string {
 	return strings.Join(m.Path(), "/")
 }
 
-// SetPathString sets a path by a / separated string.
+// SetPathString sets a path by a / separated string.  Leading
+// slashes are ignored, so "" and "/" both name the root resource,
+// which has no Uri-Path options (RFC 7252 section 6.4).
 func (m *Message) SetPathString(s string) {
-	for s[0] == '/' {
-		s = s[1:]
+	s = strings.TrimLeft(s, "/")
+	if s == "" {
+		m.RemoveOption(URIPath)
+		return
 	}
 	m.SetPath(strings.Split(s, "/"))
 }
@@ -436,8 +791,14 @@ const (
 	extoptError      = 15
 )
 
-// MarshalBinary produces the binary form of this Message.
+// MarshalBinary produces the binary form of this Message.  It
+// doesn't modify the message, so a message may be shared and encoded
+// by several goroutines at once.
 func (m *Message) MarshalBinary() ([]byte, error) {
+	if err := m.validate(); err != nil {
+		return nil, err
+	}
+
 	tmpbuf := []byte{0, 0}
 	binary.BigEndian.PutUint16(tmpbuf, m.MessageID)
 
@@ -526,12 +887,26 @@ func (m *Message) MarshalBinary() ([]byte, error) {
 		writeExt(l, lx)
 	}
 
-	sort.Stable(&m.opts)
+	opts := m.opts
+	if !sort.IsSorted(opts) {
+		// Sort a copy, leaving m as it is so that it may be
+		// encoded concurrently.
+		opts = append(options(nil), opts...)
+		sort.Stable(opts)
+	}
 
 	prev := 0
 
-	for _, o := range m.opts {
-		b := o.toBytes()
+	for _, o := range opts {
+		if int(o.ID) == prev {
+			if def := lookupOptionDef(m.Code, o.ID); def.valueFormat != valueUnknown && !def.repeatable {
+				return nil, o.invalid("not repeatable")
+			}
+		}
+		b, err := m.optionBytes(o)
+		if err != nil {
+			return nil, err
+		}
 		writeOptHeader(int(o.ID)-prev, len(b))
 		buf.Write(b)
 		prev = int(o.ID)
@@ -554,12 +929,28 @@ func ParseMessage(data []byte) (Message, error) {
 
 // UnmarshalBinary parses the given binary slice as a Message.
 func (m *Message) UnmarshalBinary(data []byte) error {
+	m.Token = nil
+	return m.decode(data)
+}
+
+// ParseMessageInto parses data into m like ParseMessage, reusing the
+// storage of m's token and options rather than allocating, for
+// servers that recycle their messages.  Like with ParseMessage, the
+// payload and opaque option values refer to data.
+func ParseMessageInto(m *Message, data []byte) error {
+	*m = Message{Token: m.Token[:0], opts: m.opts[:0]}
+	return m.decode(data)
+}
+
+// decode parses data into m, appending the token to m.Token[:0] and
+// the options to m.opts.
+func (m *Message) decode(data []byte) error {
 	if len(data) < 4 {
-		return errors.New("short packet")
+		return &TruncatedError{Offset: 0}
 	}
 
 	if data[0]>>6 != 1 {
-		return errors.New("invalid version")
+		return ErrInvalidVersion
 	}
 
 	m.Type = COAPType((data[0] >> 4) & 0x3)
@@ -571,27 +962,25 @@ func (m *Message) UnmarshalBinary(data []byte) error {
 	m.Code = COAPCode(data[1])
 	m.MessageID = binary.BigEndian.Uint16(data[2:4])
 
-	if tokenLen > 0 {
-		m.Token = make([]byte, tokenLen)
-	}
 	if len(data) < 4+tokenLen {
-		return errors.New("truncated")
+		return &TruncatedError{Offset: 4}
 	}
-	copy(m.Token, data[4:4+tokenLen])
+	m.Token = append(m.Token[:0], data[4:4+tokenLen]...)
 	b := data[4+tokenLen:]
 	prev := 0
+	offset := func() int { return len(data) - len(b) }
 
 	parseExtOpt := func(opt int) (int, error) {
 		switch opt {
 		case extoptByteCode:
 			if len(b) < 1 {
-				return -1, errors.New("truncated")
+				return -1, &TruncatedError{Offset: offset()}
 			}
 			opt = int(b[0]) + extoptByteAddend
 			b = b[1:]
 		case extoptWordCode:
 			if len(b) < 2 {
-				return -1, errors.New("truncated")
+				return -1, &TruncatedError{Offset: offset()}
 			}
 			opt = int(binary.BigEndian.Uint16(b[:2])) + extoptWordAddend
 			b = b[2:]
@@ -608,8 +997,10 @@ func (m *Message) UnmarshalBinary(data []byte) error {
 		delta := int(b[0] >> 4)
 		length := int(b[0] & 0x0f)
 
-		if delta == extoptError || length == extoptError {
-			return errors.New("unexpected extended option marker")
+		// A delta of 15 outside the payload marker leaves no
+		// option to blame.
+		if delta == extoptError {
+			return ErrBadOption
 		}
 
 		b = b[1:]
@@ -618,17 +1009,26 @@ func (m *Message) UnmarshalBinary(data []byte) error {
 		if err != nil {
 			return err
 		}
+		if prev+delta > 0xffff {
+			return ErrBadOption
+		}
+		oid := OptionID(prev + delta)
+		if length == extoptError {
+			return &BadOptionError{ID: oid}
+		}
 		length, err = parseExtOpt(length)
 		if err != nil {
 			return err
 		}
 
 		if len(b) < length {
-			return errors.New("truncated")
+			return &TruncatedError{Offset: offset()}
 		}
 
-		oid := OptionID(prev + delta)
-		opval := parseOptionValue(oid, b[:length])
+		opval, err := parseOptionValue(m.Code, oid, OptionID(prev), b[:length])
+		if err != nil {
+			return err
+		}
 		b = b[length:]
 		prev = int(oid)
 
@@ -639,3 +1039,62 @@ func (m *Message) UnmarshalBinary(data []byte) error {
 	m.Payload = b
 	return nil
 }
+
+// payloadPreview is how much of the payload String shows.
+const payloadPreview = 32
+
+// String describes the message for debugging: its type, code, Message
+// ID and token, its options by name, and the start of its payload.
+func (m Message) String() string {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "%v %v %d.%02d mid=%d token=%x",
+		m.Type, m.Code, m.Code>>5, m.Code&0x1f, m.MessageID, m.Token)
+	opts := append(options(nil), m.opts...)
+	sort.Stable(opts)
+	for _, o := range opts {
+		name := lookupOptionDef(m.Code, o.ID).name
+		if name == "" {
+			name = fmt.Sprintf("Option%d", o.ID)
+		}
+		switch v := o.Value.(type) {
+		case string:
+			fmt.Fprintf(buf, " %s=%q", name, v)
+		case []byte:
+			fmt.Fprintf(buf, " %s=%x", name, v)
+		default:
+			fmt.Fprintf(buf, " %s=%v", name, v)
+		}
+	}
+	if len(m.Payload) == 0 {
+		return buf.String()
+	}
+	p := m.Payload
+	if len(p) > payloadPreview {
+		p = p[:payloadPreview]
+	}
+	if printable(p) {
+		fmt.Fprintf(buf, " payload=%q", p)
+	} else {
+		fmt.Fprintf(buf, " payload=%x", p)
+	}
+	if len(p) < len(m.Payload) {
+		fmt.Fprintf(buf, "... (%d bytes)", len(m.Payload))
+	}
+	return buf.String()
+}
+
+// printable tells whether b is text, possibly cut in the middle of a
+// character.
+func printable(b []byte) bool {
+	for len(b) > 0 {
+		r, n := utf8.DecodeRune(b)
+		if r == utf8.RuneError && n == 1 {
+			return !utf8.FullRune(b)
+		}
+		if !unicode.IsPrint(r) && !unicode.IsSpace(r) {
+			return false
+		}
+		b = b[n:]
+	}
+	return true
+}
@@ -3,8 +3,13 @@ package coap
 import (
 	"bytes"
 	"encoding"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"reflect"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
 )
 
@@ -14,8 +19,13 @@ var (
 )
 
 // assertEqualMessages compares the e(xptected) message to the a(ctual) message
-// and reports any diffs with t.Errorf.
+// and reports any diffs with t.Errorf.  Options are compared in the
+// order they're encoded in.
 func assertEqualMessages(t *testing.T, e, a Message) {
+	for _, m := range []*Message{&e, &a} {
+		m.opts = append(options(nil), m.opts...)
+		sort.Stable(m.opts)
+	}
 	if e.Type != a.Type {
 		t.Errorf("Expected type %v, got %v", e.Type, a.Type)
 	}
@@ -86,10 +96,10 @@ func TestOptionToBytes(t *testing.T) {
 
 	for _, test := range tests {
 		op := option{Value: test.in}
-		got := op.toBytes()
-		if !bytes.Equal(test.exp, got) {
-			t.Errorf("Error on %T(%v), got %#v, wanted %#v",
-				test.in, test.in, got, test.exp)
+		got, err := op.toBytes()
+		if err != nil || !bytes.Equal(test.exp, got) {
+			t.Errorf("Error on %T(%v), got %#v, %v, wanted %#v",
+				test.in, test.in, got, err, test.exp)
 		}
 	}
 }
@@ -118,16 +128,13 @@ func TestMissingOption(t *testing.T) {
 	}
 }
 
-func TestOptionToBytesPanic(t *testing.T) {
-	defer func() {
-		err := recover()
-		if err == nil {
-			t.Error("Expected panic. Didn't")
-		} else {
-			t.Logf("Got expected error: %v", err)
+func TestOptionToBytesInvalid(t *testing.T) {
+	for _, v := range []interface{}{3.1415926535897, -1, int32(-1)} {
+		_, err := option{ID: MaxAge, Value: v}.toBytes()
+		if berr, ok := err.(*BadOptionError); !ok || berr.ID != MaxAge {
+			t.Errorf("Expected a BadOptionError for %T(%v), got %v", v, v, err)
 		}
-	}()
-	option{Value: 3.1415926535897}.toBytes()
+	}
 }
 
 func TestTypeString(t *testing.T) {
@@ -147,10 +154,12 @@ func TestTypeString(t *testing.T) {
 
 func TestCodeString(t *testing.T) {
 	tests := map[COAPCode]string{
-		0:             "Unknown (0x0)",
+		0:             "Empty",
 		GET:           "GET",
 		POST:          "POST",
 		NotAcceptable: "NotAcceptable",
+		IPATCH:        "iPATCH",
+		Conflict:      "Conflict",
 		255:           "Unknown (0xff)",
 	}
 
@@ -254,7 +263,16 @@ func TestInvalidMessageParsing(t *testing.T) {
 	}
 }
 
-func TestOptionsWithIllegalLengthAreIgnoredDuringParsing(t *testing.T) {
+func TestCriticalOptionsWithIllegalLengthFailParsing(t *testing.T) {
+	_, err := ParseMessage([]byte{0x40, 0x01, 0xab, 0xcd,
+		0x73, // URI-Port option (uint) with length 3 (valid lengths are 0-2)
+		0x11, 0x22, 0x33, 0xff})
+	if oe, ok := err.(*BadOptionError); !ok || oe.ID != URIPort {
+		t.Errorf("Expected a bad Uri-Port option, got %v", err)
+	}
+}
+
+func TestElectiveOptionsWithIllegalLengthAreIgnoredDuringParsing(t *testing.T) {
 	exp := Message{
 		Type:      Confirmable,
 		Code:      GET,
@@ -262,16 +280,6 @@ func TestOptionsWithIllegalLengthAreIgnoredDuringParsing(t *testing.T) {
 		Payload:   []byte{},
 	}
 	msg, err := ParseMessage([]byte{0x40, 0x01, 0xab, 0xcd,
-		0x73, // URI-Port option (uint) with length 3 (valid lengths are 0-2)
-		0x11, 0x22, 0x33, 0xff})
-	if err != nil {
-		t.Fatalf("Error parsing message: %v", err)
-	}
-	if fmt.Sprintf("%#v", exp) != fmt.Sprintf("%#v", msg) {
-		t.Errorf("Expected\n%#v\ngot\n%#v", exp, msg)
-	}
-
-	msg, err = ParseMessage([]byte{0x40, 0x01, 0xab, 0xcd,
 		0xd5, 0x01, // Max-Age option (uint) with length 5 (valid lengths are 0-4)
 		0x11, 0x22, 0x33, 0x44, 0x55, 0xff})
 	if err != nil {
@@ -806,3 +814,275 @@ func TestEncodeMessageWithAllOptions(t *testing.T) {
 	}
 	assertEqualMessages(t, req, parsedMsg)
 }
+
+func TestHighOptionNumbers(t *testing.T) {
+	m := Message{Type: Confirmable, Code: GET, MessageID: 1}
+	m.SetPathString("/x")
+	m.AddOption(OptionID(2049), []byte("ocf"))
+	m.AddOption(OptionID(65000), []byte{1})
+
+	data, err := m.MarshalBinary()
+	if err != nil {
+		t.Fatalf("Error encoding: %v", err)
+	}
+	got, err := ParseMessage(data)
+	if err != nil {
+		t.Fatalf("Error decoding: %v", err)
+	}
+	if v, _ := got.Option(OptionID(2049)).([]byte); string(v) != "ocf" {
+		t.Errorf("Expected option 2049, got %v", got.Option(OptionID(2049)))
+	}
+	if v, _ := got.Option(OptionID(65000)).([]byte); len(v) != 1 || v[0] != 1 {
+		t.Errorf("Expected option 65000, got %v", got.Option(OptionID(65000)))
+	}
+	if ids := got.UnrecognizedOptions(); !reflect.DeepEqual(ids, []OptionID{2049, 65000}) {
+		t.Errorf("Unexpected unrecognized options %v", ids)
+	}
+
+	// An option number beyond 65535.
+	data = append(data[:len(data):len(data)], 0xe0, 0xff, 0xff)
+	if _, err := ParseMessage(data); err != ErrBadOption {
+		t.Errorf("Expected ErrBadOption, got %v", err)
+	}
+}
+
+func TestGetOptionTyped(t *testing.T) {
+	local := Message{Type: Confirmable, Code: GET, MessageID: 1}
+	local.SetOption(ContentFormat, AppJSON)
+	local.SetOption(MaxAge, 30)
+	local.SetOption(ETag, []byte{1, 2})
+	local.SetOption(URIHost, "example.com")
+	local.AddOption(2049, []byte("x"))
+	data, err := local.MarshalBinary()
+	if err != nil {
+		t.Fatalf("Error encoding: %v", err)
+	}
+	parsed, err := ParseMessage(data)
+	if err != nil {
+		t.Fatalf("Error parsing: %v", err)
+	}
+
+	for _, m := range []Message{local, parsed} {
+		if v, err := m.GetOptionUint(ContentFormat); v != uint32(AppJSON) || err != nil {
+			t.Errorf("Expected Content-Format 50, got %v, %v", v, err)
+		}
+		if v, err := m.GetOptionUint(MaxAge); v != 30 || err != nil {
+			t.Errorf("Expected Max-Age 30, got %v, %v", v, err)
+		}
+		if v, err := m.GetOptionString(URIHost); v != "example.com" || err != nil {
+			t.Errorf("Expected Uri-Host example.com, got %q, %v", v, err)
+		}
+		if v, err := m.GetOptionBytes(ETag); !bytes.Equal(v, []byte{1, 2}) || err != nil {
+			t.Errorf("Expected ETag 0102, got %x, %v", v, err)
+		}
+		if v, err := m.GetOptionBytes(MaxAge); !bytes.Equal(v, []byte{30}) || err != nil {
+			t.Errorf("Expected Max-Age bytes 1e, got %x, %v", v, err)
+		}
+		if v, err := m.GetOptionString(2049); v != "x" || err != nil {
+			t.Errorf("Expected unknown option x, got %q, %v", v, err)
+		}
+		if _, err := m.GetOptionUint(Accept); err != ErrNoOption {
+			t.Errorf("Expected ErrNoOption for Accept, got %v", err)
+		}
+		if _, err := m.GetOptionUint(URIHost); !errors.Is(err, ErrBadOption) {
+			t.Errorf("Expected ErrBadOption for Uri-Host as uint, got %v", err)
+		}
+		if _, err := m.GetOptionString(MaxAge); !errors.Is(err, ErrBadOption) {
+			t.Errorf("Expected ErrBadOption for Max-Age as string, got %v", err)
+		}
+	}
+}
+
+func TestOptionValidation(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []option
+		exp  string
+	}{
+		{"repeated Uri-Host", []option{{URIHost, "a"}, {URIHost, "b"}},
+			"bad option 3: not repeatable"},
+		{"repeated Uri-Path", []option{{URIPath, "a"}, {URIPath, "b"}}, ""},
+		{"string Max-Age", []option{{MaxAge, "60"}},
+			"bad option 14: string value for a uint option"},
+		{"uint ETag", []option{{ETag, 1}},
+			"bad option 4: int value for a string or opaque option"},
+		{"long ETag", []option{{ETag, make([]byte, 9)}},
+			"bad option 4: value length 9 out of range 1-8"},
+		{"empty Uri-Host", []option{{URIHost, ""}},
+			"bad option 3: value length 0 out of range 1-255"},
+		{"repeated unknown", []option{{2049, []byte("a")}, {2049, []byte("b")}}, ""},
+	}
+	for _, test := range tests {
+		m := Message{Type: Confirmable, Code: GET, opts: test.opts}
+		_, err := m.MarshalBinary()
+		if got := fmt.Sprint(err); test.exp == "" && err != nil || test.exp != "" && got != test.exp {
+			t.Errorf("%v: expected %q, got %v", test.name, test.exp, err)
+		}
+	}
+
+	// A repeated critical option is an error; a repeated elective
+	// one is ignored past its first value.
+	_, err := ParseMessage([]byte{0x40, 0x01, 0x00, 0x01,
+		0x31, 'a', 0x01, 'b'})
+	if oe, ok := err.(*BadOptionError); !ok || oe.ID != URIHost || oe.Reason != "not repeatable" {
+		t.Errorf("Expected a repeated Uri-Host error, got %v", err)
+	}
+	m, err := ParseMessage([]byte{0x40, 0x01, 0x00, 0x01,
+		0xc1, 0x01, 0x01, 0x02})
+	if err != nil || !reflect.DeepEqual(m.Options(ContentFormat), []interface{}{MediaType(1)}) {
+		t.Errorf("Expected one Content-Format, got %v, %v", m.Options(ContentFormat), err)
+	}
+}
+
+func TestMessageString(t *testing.T) {
+	m := Message{Type: Confirmable, Code: GET, MessageID: 12, Token: []byte{0xab}}
+	m.SetPathString("/a/b")
+	m.SetOption(ContentFormat, AppJSON)
+	m.SetOption(ETag, []byte{1, 2})
+	m.AddOption(2049, []byte{3})
+
+	tests := []struct {
+		payload []byte
+		exp     string
+	}{
+		{nil, ""},
+		{[]byte("héllo\n"), ` payload="héllo\n"`},
+		{[]byte{0, 1, 0xff}, ` payload=0001ff`},
+		{[]byte(strings.Repeat("x", 40)), ` payload="` + strings.Repeat("x", 32) + `"... (40 bytes)`},
+		{append(bytes.Repeat([]byte("x"), 31), "é"...), ` payload="` + strings.Repeat("x", 31) + `\xc3"... (33 bytes)`},
+	}
+	for _, test := range tests {
+		m.Payload = test.payload
+		exp := `Confirmable GET 0.01 mid=12 token=ab ETag=0102 Uri-Path="a" Uri-Path="b" Content-Format=50 Option2049=03` + test.exp
+		if m.String() != exp {
+			t.Errorf("Expected\n%s\ngot\n%s", exp, m.String())
+		}
+	}
+}
+
+func FuzzParseMessage(f *testing.F) {
+	m := Message{Type: Confirmable, Code: GET, MessageID: 1, Token: []byte("t"), Payload: []byte("hi")}
+	m.SetPathString("/a/b")
+	m.SetOption(ContentFormat, AppJSON)
+	data, err := m.MarshalBinary()
+	if err != nil {
+		f.Fatalf("Error encoding: %v", err)
+	}
+	f.Add(data)
+	f.Add([]byte{0x40, 0x01, 0x00, 0x01, 0xd0})
+	f.Add([]byte{0x40, 0x01, 0x00, 0x01, 0xe0, 0x01})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		m, err := ParseMessage(data)
+		if err != nil {
+			return
+		}
+		_ = m.String()
+		if _, err := json.Marshal(m); err != nil {
+			t.Errorf("Error encoding parsed %x as JSON: %v", data, err)
+		}
+		if enc, err := m.MarshalBinary(); err == nil {
+			if _, err := ParseMessage(enc); err != nil {
+				t.Errorf("Error parsing %x re-encoded from %x: %v", enc, data, err)
+			}
+		}
+	})
+}
+
+func TestParseMessageInto(t *testing.T) {
+	m := Message{Type: Confirmable, Code: GET, MessageID: 1, Token: []byte("tok"), Payload: []byte("hi")}
+	m.SetOption(ETag, []byte{1, 2})
+	m.SetOption(ContentFormat, TextPlain)
+	data, err := m.MarshalBinary()
+	if err != nil {
+		t.Fatalf("Error encoding: %v", err)
+	}
+	other := Message{Type: NonConfirmable, Code: POST, MessageID: 2}
+	other.SetPathString("/a/b/c")
+	otherData, err := other.MarshalBinary()
+	if err != nil {
+		t.Fatalf("Error encoding: %v", err)
+	}
+
+	var got Message
+	for _, d := range [][]byte{otherData, data} {
+		if err := ParseMessageInto(&got, d); err != nil {
+			t.Fatalf("Error parsing: %v", err)
+		}
+	}
+	want, _ := ParseMessage(data)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+
+	// Opaque and string option values still take an allocation.
+	m.RemoveOption(ETag)
+	if data, err = m.MarshalBinary(); err != nil {
+		t.Fatalf("Error encoding: %v", err)
+	}
+	allocs := testing.AllocsPerRun(100, func() {
+		ParseMessageInto(&got, data)
+	})
+	if allocs != 0 {
+		t.Errorf("Expected no allocations, got %v", allocs)
+	}
+}
+
+func TestMarshalBinaryLeavesOptions(t *testing.T) {
+	m := Message{Type: Confirmable, Code: GET, MessageID: 1}
+	m.SetOption(MaxAge, 60)
+	m.SetPathString("/a/b")
+	m.SetOption(URIHost, "example.com")
+	before := fmt.Sprint(m.opts)
+
+	var wg sync.WaitGroup
+	results := make([][]byte, 4)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], _ = m.MarshalBinary()
+		}(i)
+	}
+	wg.Wait()
+
+	if after := fmt.Sprint(m.opts); after != before {
+		t.Errorf("Options changed from %v to %v", before, after)
+	}
+	parsed, err := ParseMessage(results[0])
+	if err != nil {
+		t.Fatalf("Error parsing: %v", err)
+	}
+	if parsed.PathString() != "a/b" || parsed.Option(URIHost) != "example.com" || parsed.Option(MaxAge) != uint32(60) {
+		t.Errorf("Unexpected options %v", parsed)
+	}
+	for _, r := range results[1:] {
+		if !bytes.Equal(r, results[0]) {
+			t.Errorf("Expected %x, got %x", results[0], r)
+		}
+	}
+}
+
+func TestAllOptions(t *testing.T) {
+	m := Message{Type: Confirmable, Code: GET, MessageID: 1}
+	m.SetOption(MaxAge, 300)
+	m.SetPathString("/a/b")
+	m.AddOption(2049, []byte{7})
+
+	exp := []Option{{URIPath, "a"}, {URIPath, "b"}, {MaxAge, 300}, {2049, []byte{7}}}
+	if got := m.AllOptions(); !reflect.DeepEqual(got, exp) {
+		t.Errorf("Expected %v, got %v", exp, got)
+	}
+
+	var raw [][]byte
+	for _, o := range m.AllOptions() {
+		b, err := o.Bytes()
+		if err != nil {
+			t.Fatalf("Error encoding %v: %v", o, err)
+		}
+		raw = append(raw, b)
+	}
+	if exp := [][]byte{[]byte("a"), []byte("b"), {1, 44}, {7}}; !reflect.DeepEqual(raw, exp) {
+		t.Errorf("Expected %v, got %v", exp, raw)
+	}
+}
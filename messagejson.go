@@ -0,0 +1,200 @@
+package coap
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// jsonMessage is the JSON form of a Message.
+type jsonMessage struct {
+	Type       string       `json:"type"`
+	Code       string       `json:"code"`
+	MessageID  uint16       `json:"mid"`
+	Token      string       `json:"token,omitempty"`
+	Options    []jsonOption `json:"options,omitempty"`
+	Payload    *string      `json:"payload,omitempty"`
+	PayloadHex string       `json:"payload_hex,omitempty"`
+}
+
+// jsonOption is the JSON form of an option: its name, or its number
+// if this package doesn't know it, and its value as a number for uint
+// options, a string for string options, and hex otherwise.
+type jsonOption struct {
+	Name  string          `json:"name,omitempty"`
+	ID    OptionID        `json:"id,omitempty"`
+	Value json.RawMessage `json:"value"`
+}
+
+// codeJSON names c, in the dotted form for codes without a name.
+func codeJSON(c COAPCode) string {
+	if strings.HasPrefix(codeNames[c], "Unknown") {
+		return fmt.Sprintf("%d.%02d", c>>5, c&0x1f)
+	}
+	return codeNames[c]
+}
+
+func parseCodeJSON(s string) (COAPCode, error) {
+	for i, name := range codeNames {
+		if name == s {
+			return COAPCode(i), nil
+		}
+	}
+	var class, detail uint8
+	if n, err := fmt.Sscanf(s, "%1d.%02d", &class, &detail); n == 2 && err == nil && class < 8 && detail < 32 {
+		return COAPCode(class<<5 | detail), nil
+	}
+	return 0, fmt.Errorf("invalid code %q", s)
+}
+
+// MarshalJSON encodes the message with readable names for its type,
+// code and options.  The payload is a string if it's valid UTF-8, and
+// hex otherwise.
+func (m Message) MarshalJSON() ([]byte, error) {
+	jm := jsonMessage{
+		Type:      m.Type.String(),
+		Code:      codeJSON(m.Code),
+		MessageID: m.MessageID,
+		Token:     hex.EncodeToString(m.Token),
+	}
+	for _, o := range m.opts {
+		def := lookupOptionDef(m.Code, o.ID)
+		jo := jsonOption{Name: def.name}
+		if def.name == "" {
+			jo.ID = o.ID
+		}
+		var v interface{}
+		switch def.valueFormat {
+		case valueUint:
+			b, err := o.toBytes()
+			if err != nil {
+				return nil, err
+			}
+			v = decodeInt(b)
+		case valueString:
+			v = o.Value
+		default:
+			b, err := o.toBytes()
+			if err != nil {
+				return nil, err
+			}
+			v = hex.EncodeToString(b)
+		}
+		var err error
+		if jo.Value, err = json.Marshal(v); err != nil {
+			return nil, err
+		}
+		jm.Options = append(jm.Options, jo)
+	}
+	if utf8.Valid(m.Payload) {
+		if len(m.Payload) > 0 {
+			p := string(m.Payload)
+			jm.Payload = &p
+		}
+	} else {
+		jm.PayloadHex = hex.EncodeToString(m.Payload)
+	}
+	return json.Marshal(jm)
+}
+
+// UnmarshalJSON decodes a message encoded by MarshalJSON.  Codes may
+// also be given in the dotted form, such as "2.05", and options by
+// number.
+func (m *Message) UnmarshalJSON(data []byte) error {
+	var jm jsonMessage
+	if err := json.Unmarshal(data, &jm); err != nil {
+		return err
+	}
+	rv := Message{MessageID: jm.MessageID}
+
+	typ := -1
+	for i, name := range typeNames {
+		if name == jm.Type {
+			typ = i
+		}
+	}
+	if typ < 0 {
+		return fmt.Errorf("invalid message type %q", jm.Type)
+	}
+	rv.Type = COAPType(typ)
+	var err error
+	if rv.Code, err = parseCodeJSON(jm.Code); err != nil {
+		return err
+	}
+	if rv.Token, err = hex.DecodeString(jm.Token); err != nil {
+		return err
+	}
+	if len(rv.Token) == 0 {
+		rv.Token = nil
+	}
+
+	for _, jo := range jm.Options {
+		o, err := rv.parseOptionJSON(jo)
+		if err != nil {
+			return err
+		}
+		rv.opts = append(rv.opts, o)
+	}
+
+	switch {
+	case jm.Payload != nil:
+		rv.Payload = []byte(*jm.Payload)
+	case jm.PayloadHex != "":
+		if rv.Payload, err = hex.DecodeString(jm.PayloadHex); err != nil {
+			return err
+		}
+	}
+	*m = rv
+	return nil
+}
+
+// parseOptionJSON decodes jo, an option of m.
+func (m *Message) parseOptionJSON(jo jsonOption) (option, error) {
+	o := option{ID: jo.ID}
+	if jo.Name != "" {
+		defs := optionDefs
+		if isSignal(m.Code) {
+			defs = signalOptionDefs[m.Code]
+		}
+		found := false
+		for id, def := range defs {
+			if def.name == jo.Name {
+				o.ID, found = id, true
+			}
+		}
+		if !found {
+			return o, fmt.Errorf("unknown option %q", jo.Name)
+		}
+	}
+
+	switch lookupOptionDef(m.Code, o.ID).valueFormat {
+	case valueUint:
+		var v uint32
+		if err := json.Unmarshal(jo.Value, &v); err != nil {
+			return o, o.invalid("%v", err)
+		}
+		o.Value = v
+		if o.ID == ContentFormat || o.ID == Accept {
+			o.Value = MediaType(v)
+		}
+	case valueString:
+		var v string
+		if err := json.Unmarshal(jo.Value, &v); err != nil {
+			return o, o.invalid("%v", err)
+		}
+		o.Value = v
+	default:
+		var v string
+		if err := json.Unmarshal(jo.Value, &v); err != nil {
+			return o, o.invalid("%v", err)
+		}
+		b, err := hex.DecodeString(v)
+		if err != nil {
+			return o, o.invalid("%v", err)
+		}
+		o.Value = b
+	}
+	return o, nil
+}
@@ -0,0 +1,70 @@
+package coap
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestMessageJSON(t *testing.T) {
+	m := Message{Type: Confirmable, Code: GET, MessageID: 12, Token: []byte{0xab}}
+	m.SetPathString("/a/b")
+	m.SetOption(ContentFormat, AppJSON)
+	m.SetOption(ETag, []byte{1, 2})
+	m.AddOption(2049, []byte{3})
+	m.Payload = []byte("hi")
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		t.Fatalf("Error encoding: %v", err)
+	}
+	exp := `{"type":"Confirmable","code":"GET","mid":12,"token":"ab","options":[` +
+		`{"name":"Uri-Path","value":"a"},{"name":"Uri-Path","value":"b"},` +
+		`{"name":"Content-Format","value":50},{"name":"ETag","value":"0102"},` +
+		`{"id":2049,"value":"03"}],"payload":"hi"}`
+	if string(data) != exp {
+		t.Errorf("Expected\n%s\ngot\n%s", exp, data)
+	}
+
+	var got Message
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("Error decoding: %v", err)
+	}
+	if !reflect.DeepEqual(got, m) {
+		t.Errorf("Expected %v, got %v", m, got)
+	}
+
+	tests := []struct {
+		data string
+		exp  Message
+		out  string
+	}{
+		{`{"type":"Acknowledgement","code":"2.05","mid":1,"payload_hex":"00ff"}`,
+			Message{Type: Acknowledgement, Code: Content, MessageID: 1, Payload: []byte{0, 0xff}},
+			`{"type":"Acknowledgement","code":"Content","mid":1,"payload_hex":"00ff"}`},
+		{`{"type":"NonConfirmable","code":"7.31","mid":2}`,
+			Message{Type: NonConfirmable, Code: 255, MessageID: 2},
+			`{"type":"NonConfirmable","code":"7.31","mid":2}`},
+	}
+	for _, test := range tests {
+		var got Message
+		if err := json.Unmarshal([]byte(test.data), &got); err != nil || !reflect.DeepEqual(got, test.exp) {
+			t.Errorf("%s: expected %v, got %v, %v", test.data, test.exp, got, err)
+		}
+		data, err := json.Marshal(got)
+		if err != nil || string(data) != test.out {
+			t.Errorf("Expected %s, got %s, %v", test.out, data, err)
+		}
+	}
+
+	for _, bad := range []string{
+		`{"type":"Sometimes","code":"GET"}`,
+		`{"type":"Confirmable","code":"9.99"}`,
+		`{"type":"Confirmable","code":"GET","options":[{"name":"Uri-Nope","value":"a"}]}`,
+		`{"type":"Confirmable","code":"GET","options":[{"name":"Max-Age","value":"a"}]}`,
+	} {
+		if err := json.Unmarshal([]byte(bad), &got); err == nil {
+			t.Errorf("%s: expected an error", bad)
+		}
+	}
+}
@@ -1,22 +1,56 @@
 package coap
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"io"
+	"sync"
 )
 
 // TcpMessage is a CoAP Message that can encode itself for TCP
-// transport.
+// transport (RFC 8323).
 type TcpMessage struct {
 	Message
+
+	// Body, if not nil, supplies the payload in place of Payload,
+	// so large payloads can be written out without being held in
+	// memory.  Exactly BodyLength bytes are read from it.
+	Body       io.Reader
+	BodyLength int
 }
 
-func (m *TcpMessage) MarshalBinary() ([]byte, error) {
-	bin, err := m.Message.MarshalBinary()
-	if err != nil {
-		return nil, err
+// Message lengths at which the TCP header's length nibble switches
+// to a longer extended length (RFC 8323 section 3.2).
+const (
+	tcpLen13Base = 13
+	tcpLen14Base = 269
+	tcpLen15Base = 65805
+)
+
+// tcpLength splits the length of the options and payload into the
+// header's length nibble and its extended length bytes.
+func tcpLength(n int) (uint8, []byte) {
+	switch {
+	case n < tcpLen13Base:
+		return uint8(n), nil
+	case n < tcpLen14Base:
+		return 13, []byte{byte(n - tcpLen13Base)}
+	case n < tcpLen15Base:
+		ext := make([]byte, 2)
+		binary.BigEndian.PutUint16(ext, uint16(n-tcpLen14Base))
+		return 14, ext
+	default:
+		ext := make([]byte, 4)
+		binary.BigEndian.PutUint32(ext, uint32(n-tcpLen15Base))
+		return 15, ext
 	}
+}
+
+// frame returns the header for a message with n bytes of options
+// and payload.
+func (m *TcpMessage) frame(n int) []byte {
 
 	/*
 		A CoAP TCP message looks like:
@@ -24,46 +58,238 @@ func (m *TcpMessage) MarshalBinary() ([]byte, error) {
 		     0                   1                   2                   3
 		    0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
 		   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
-		   |        Message Length         |Ver| T |  TKL  |      Code     |
+		   |  Len  |  TKL  | Extended Length (0-4 bytes) ...
 		   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
-		   |   Token (if any, TKL bytes) ...
+		   |      Code     | Token (if any, TKL bytes) ...
 		   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
 		   |   Options (if any) ...
 		   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
 		   |1 1 1 1 1 1 1 1|    Payload (if any) ...
 		   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+
+		Len covers the options and payload; there's no Type or
+		Message ID.
 	*/
 
-	l := []byte{0, 0}
-	binary.BigEndian.PutUint16(l, uint16(len(bin)))
+	ln, ext := tcpLength(n)
+	rv := make([]byte, 0, 2+len(ext)+len(m.Token))
+	rv = append(rv, ln<<4|uint8(len(m.Token)))
+	rv = append(rv, ext...)
+	rv = append(rv, byte(m.Code))
+	return append(rv, m.Token...)
+}
 
-	return append(l, bin...), nil
+func (m *TcpMessage) MarshalBinary() ([]byte, error) {
+	if m.Body != nil {
+		buf := bytes.Buffer{}
+		_, err := m.WriteTo(&buf)
+		return buf.Bytes(), err
+	}
+
+	bin, err := m.Message.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	body := bin[4+len(m.Token):]
+	return append(m.frame(len(body)), body...), nil
+}
+
+// WriteTo writes the encoded message to w, streaming the payload
+// from Body if it's set.
+func (m *TcpMessage) WriteTo(w io.Writer) (int64, error) {
+	if m.Body == nil {
+		data, err := m.MarshalBinary()
+		if err != nil {
+			return 0, err
+		}
+		n, err := w.Write(data)
+		return int64(n), err
+	}
+
+	hdr := m.Message
+	hdr.Payload = nil
+	bin, err := hdr.MarshalBinary()
+	if err != nil {
+		return 0, err
+	}
+	opts := bin[4+len(m.Token):]
+	n := len(opts)
+	if m.BodyLength > 0 {
+		n += 1 + m.BodyLength
+		opts = append(opts, 0xff)
+	}
+
+	written, err := w.Write(append(m.frame(n), opts...))
+	if err != nil {
+		return int64(written), err
+	}
+	copied, err := io.CopyN(w, m.Body, int64(m.BodyLength))
+	return int64(written) + copied, unexpectedEOF(err)
 }
 
 func (m *TcpMessage) UnmarshalBinary(data []byte) error {
-	if len(data) < 4 {
-		return errors.New("short packet")
+	return m.decode(bytes.NewReader(data), 0)
+}
+
+// MarshalWebSocket produces the form of this message carried in a
+// WebSocket frame (RFC 8323 section 4.2), which leaves the length to
+// the frame.  Body is not supported.
+func (m *TcpMessage) MarshalWebSocket() ([]byte, error) {
+	bin, err := m.Message.MarshalBinary()
+	if err != nil {
+		return nil, err
 	}
+	return append(m.frame(0), bin[4+len(m.Token):]...), nil
+}
 
-	return m.Message.UnmarshalBinary(data)
+// UnmarshalWebSocket parses a message from a WebSocket frame.
+func (m *TcpMessage) UnmarshalWebSocket(data []byte) error {
+	if len(data) < 2 {
+		return &TruncatedError{Offset: 0}
+	}
+	if data[0]>>4 != 0 {
+		return errors.New("length set in WebSocket message")
+	}
+	tkl := int(data[0] & 0xf)
+	if tkl > 8 {
+		return ErrInvalidTokenLen
+	}
+
+	packet := append([]byte{1<<6 | uint8(tkl), data[1], 0, 0}, data[2:]...)
+	err := m.Message.UnmarshalBinary(packet)
+	if terr, ok := err.(*TruncatedError); ok {
+		// Offsets in data, which lacks the Message ID.
+		terr.Offset -= 2
+	}
+	return err
+}
+
+// decode reads a message from r, failing with a *MessageSizeError
+// before reading the rest of one larger than limit bytes, if limit is
+// positive.
+func (m *TcpMessage) decode(r io.Reader, limit int) error {
+	hdr := []byte{0}
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return err
+	}
+	tkl := int(hdr[0] & 0xf)
+	if tkl > 8 {
+		return ErrInvalidTokenLen
+	}
+
+	var ext []byte
+	switch hdr[0] >> 4 {
+	case 13:
+		ext = make([]byte, 1)
+	case 14:
+		ext = make([]byte, 2)
+	case 15:
+		ext = make([]byte, 4)
+	}
+	if _, err := io.ReadFull(r, ext); err != nil {
+		return unexpectedEOF(err)
+	}
+
+	var n uint64
+	switch len(ext) {
+	case 0:
+		n = uint64(hdr[0] >> 4)
+	case 1:
+		n = uint64(ext[0]) + tcpLen13Base
+	case 2:
+		n = uint64(binary.BigEndian.Uint16(ext)) + tcpLen14Base
+	case 4:
+		n = uint64(binary.BigEndian.Uint32(ext)) + tcpLen15Base
+	}
+
+	if size := uint64(2+len(ext)+tkl) + n; limit > 0 && size > uint64(limit) {
+		return &MessageSizeError{Size: size, Max: limit}
+	}
+
+	// Rebuild the message as a datagram for the common parser.
+	packet := []byte{1<<6 | uint8(tkl), 0, 0, 0}
+	if _, err := io.ReadFull(r, packet[1:2]); err != nil {
+		return unexpectedEOF(err)
+	}
+	// The buffer grows with the bytes that arrive rather than the
+	// length claimed, which may be up to 4GB without a limit.
+	buf := bytes.NewBuffer(packet)
+	if _, err := io.CopyN(buf, r, int64(tkl)+int64(n)); err != nil {
+		return unexpectedEOF(err)
+	}
+
+	return m.Message.UnmarshalBinary(buf.Bytes())
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
 }
 
 // Decode reads a single message from its input.
 func Decode(r io.Reader) (*TcpMessage, error) {
-	var ln uint16
-	err := binary.Read(r, binary.BigEndian, &ln)
-	if err != nil {
+	m := TcpMessage{}
+	if err := m.decode(r, 0); err != nil {
 		return nil, err
 	}
+	return &m, nil
+}
 
-	packet := make([]byte, ln)
-	_, err = io.ReadFull(r, packet)
-	if err != nil {
+// A Decoder reads TcpMessages from a stream, buffering partial reads
+// until a whole message is available.
+type Decoder struct {
+	// MaxMessageSize, if positive, is the size of the largest
+	// message decoded.  Larger ones fail with a *MessageSizeError,
+	// before their body is read.
+	MaxMessageSize int
+
+	r *bufio.Reader
+}
+
+// NewDecoder returns a Decoder reading from r.
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: bufio.NewReader(r)}
+}
+
+// Decode reads the next message.
+func (d *Decoder) Decode() (*TcpMessage, error) {
+	m := TcpMessage{}
+	if err := m.decode(d.r, d.MaxMessageSize); err != nil {
 		return nil, err
 	}
+	return &m, nil
+}
 
-	m := TcpMessage{}
+// An Encoder writes TcpMessages to a stream.  It is safe for
+// concurrent use; each message is written in one piece.
+type Encoder struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewEncoder returns an Encoder writing to w.
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w}
+}
+
+// Encode writes m.
+func (e *Encoder) Encode(m *TcpMessage) error {
+	if m.Body != nil {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		_, err := m.WriteTo(e.w)
+		return err
+	}
+
+	data, err := m.MarshalBinary()
+	if err != nil {
+		return err
+	}
 
-	err = m.UnmarshalBinary(packet)
-	return &m, err
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, err = e.w.Write(data)
+	return err
 }
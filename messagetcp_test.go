@@ -2,35 +2,239 @@ package coap
 
 import (
 	"bytes"
-	"encoding/binary"
+	"io"
 	"testing"
 )
 
 func TestTCPDecodeMessageSmallWithPayload(t *testing.T) {
-	input := []byte{0, 0,
-		0x40, 0x1, 0x30, 0x39, 0x21, 0x3,
+	input := []byte{
+		0xc0, 0x1, 0x21, 0x3,
 		0x26, 0x77, 0x65, 0x65, 0x74, 0x61, 0x67,
 		0xff, 'h', 'i',
 	}
 
-	binary.BigEndian.PutUint16(input, uint16(len(input)-2))
-
 	msg, err := Decode(bytes.NewReader(input))
 	if err != nil {
 		t.Fatalf("Error parsing message: %v", err)
 	}
 
-	if msg.Type != Confirmable {
-		t.Errorf("Expected message type confirmable, got %v", msg.Type)
-	}
 	if msg.Code != GET {
 		t.Errorf("Expected message code GET, got %v", msg.Code)
 	}
-	if msg.MessageID != 12345 {
-		t.Errorf("Expected message ID 12345, got %v", msg.MessageID)
+	if etag, _ := msg.Option(ETag).([]byte); string(etag) != "weetag" {
+		t.Errorf("Expected ETag weetag, got %q", msg.Option(ETag))
 	}
 
 	if !bytes.Equal(msg.Payload, []byte("hi")) {
 		t.Errorf("Incorrect payload: %q", msg.Payload)
 	}
 }
+
+func TestTCPLengthRoundTrip(t *testing.T) {
+	tests := []struct {
+		payload int
+		nibble  byte
+		ext     int
+	}{
+		{0, 0, 0},
+		{11, 12, 0},
+		{12, 13, 1},
+		{267, 13, 1},
+		{268, 14, 2},
+		{65803, 14, 2},
+		{65804, 15, 4},
+		{70000, 15, 4},
+	}
+
+	for _, test := range tests {
+		m := TcpMessage{Message: Message{
+			Code:    Content,
+			Token:   []byte("tk"),
+			Payload: bytes.Repeat([]byte{'x'}, test.payload),
+		}}
+		data, err := m.MarshalBinary()
+		if err != nil {
+			t.Fatalf("Error encoding %v byte payload: %v", test.payload, err)
+		}
+		if data[0] != test.nibble<<4|2 {
+			t.Errorf("Expected length nibble %v for %v byte payload, got %v",
+				test.nibble, test.payload, data[0]>>4)
+		}
+		if data[1+test.ext] != byte(Content) {
+			t.Errorf("Expected %v extended length bytes for %v byte payload",
+				test.ext, test.payload)
+		}
+
+		got, err := Decode(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("Error decoding %v byte payload: %v", test.payload, err)
+		}
+		assertEqualMessages(t, m.Message, got.Message)
+	}
+}
+
+func TestTCPDecodeTruncated(t *testing.T) {
+	m := TcpMessage{Message: Message{Code: Content, Payload: []byte("hello")}}
+	data, err := m.MarshalBinary()
+	if err != nil {
+		t.Fatalf("Error encoding: %v", err)
+	}
+	for i := 1; i < len(data); i++ {
+		if _, err := Decode(bytes.NewReader(data[:i])); err != io.ErrUnexpectedEOF {
+			t.Errorf("Expected ErrUnexpectedEOF decoding %v bytes, got %v", i, err)
+		}
+	}
+
+	// A length near 4GB with nothing behind it.
+	huge := []byte{0xf0, 0xff, 0xff, 0xff, 0xff, 0x45}
+	if _, err := Decode(bytes.NewReader(huge)); err != io.ErrUnexpectedEOF {
+		t.Errorf("Expected ErrUnexpectedEOF decoding a huge length, got %v", err)
+	}
+}
+
+// oneByteReader hands out its input a byte at a time.
+type oneByteReader struct {
+	data []byte
+}
+
+func (r *oneByteReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	p[0] = r.data[0]
+	r.data = r.data[1:]
+	return 1, nil
+}
+
+func TestTCPEncoderDecoder(t *testing.T) {
+	msgs := []TcpMessage{
+		{Message: Message{Code: GET, Token: []byte("a")}},
+		{Message: Message{Code: Content, Token: []byte("a"), Payload: []byte("hello")}},
+	}
+
+	buf := &bytes.Buffer{}
+	enc := NewEncoder(buf)
+	for i := range msgs {
+		if err := enc.Encode(&msgs[i]); err != nil {
+			t.Fatalf("Error encoding %v: %v", msgs[i], err)
+		}
+	}
+
+	dec := NewDecoder(&oneByteReader{buf.Bytes()})
+	for _, exp := range msgs {
+		got, err := dec.Decode()
+		if err != nil {
+			t.Fatalf("Error decoding: %v", err)
+		}
+		assertEqualMessages(t, exp.Message, got.Message)
+	}
+	if _, err := dec.Decode(); err != io.EOF {
+		t.Errorf("Expected EOF after the last message, got %v", err)
+	}
+}
+
+func TestTCPStreamedBody(t *testing.T) {
+	payload := bytes.Repeat([]byte("firmware"), 10000)
+
+	m := TcpMessage{Message: Message{Code: Content, Token: []byte("fw")}}
+	m.SetOption(ContentFormat, AppOctets)
+	exp := m.Message
+	exp.Payload = payload
+
+	m.Body = bytes.NewReader(payload)
+	m.BodyLength = len(payload)
+	buf := &bytes.Buffer{}
+	if err := NewEncoder(buf).Encode(&m); err != nil {
+		t.Fatalf("Error encoding: %v", err)
+	}
+
+	want, err := (&TcpMessage{Message: exp}).MarshalBinary()
+	if err != nil {
+		t.Fatalf("Error encoding: %v", err)
+	}
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Errorf("Streamed encoding differs from buffered encoding")
+	}
+
+	m.Body = bytes.NewReader(payload[:10])
+	if _, err := m.WriteTo(&bytes.Buffer{}); err != io.ErrUnexpectedEOF {
+		t.Errorf("Expected ErrUnexpectedEOF for a short body, got %v", err)
+	}
+}
+
+func TestCOAPMessageAcrossTransports(t *testing.T) {
+	// A response builder written once against the interface.
+	respond := func(req, rv COAPMessage) {
+		rv.SetMessageCode(Content)
+		rv.SetMessageToken(req.MessageToken())
+		rv.SetOption(ContentFormat, TextPlain)
+		rv.SetMessagePayload([]byte("hello " + req.PathString()))
+	}
+
+	tests := []struct {
+		req, rv COAPMessage
+		parsed  COAPMessage
+	}{
+		{&Message{Code: GET, Token: []byte("u")}, &Message{}, &Message{}},
+		{&TcpMessage{Message: Message{Code: GET, Token: []byte("t")}},
+			&TcpMessage{}, &TcpMessage{}},
+	}
+
+	for _, test := range tests {
+		test.req.SetOption(URIPath, "world")
+		respond(test.req, test.rv)
+
+		data, err := test.rv.MarshalBinary()
+		if err != nil {
+			t.Fatalf("Error encoding %T: %v", test.rv, err)
+		}
+		if err := test.parsed.UnmarshalBinary(data); err != nil {
+			t.Fatalf("Error decoding %T: %v", test.parsed, err)
+		}
+		if test.parsed.MessageCode() != Content ||
+			!bytes.Equal(test.parsed.MessageToken(), test.req.MessageToken()) ||
+			string(test.parsed.MessagePayload()) != "hello world" {
+			t.Errorf("Unexpected %T response: %v", test.parsed, test.parsed)
+		}
+	}
+}
+
+func TestWebSocketRoundTrip(t *testing.T) {
+	m := TcpMessage{Message: Message{Code: GET, Token: []byte("ws"),
+		Payload: bytes.Repeat([]byte{'x'}, 300)}}
+	m.SetPathString("/a/b")
+
+	data, err := m.MarshalWebSocket()
+	if err != nil {
+		t.Fatalf("Error encoding: %v", err)
+	}
+	if data[0] != 2 || data[1] != byte(GET) {
+		t.Errorf("Expected no length and code right after, got %x", data[:2])
+	}
+
+	var got TcpMessage
+	if err := got.UnmarshalWebSocket(data); err != nil {
+		t.Fatalf("Error decoding: %v", err)
+	}
+	assertEqualMessages(t, m.Message, got.Message)
+}
+
+func FuzzTCPDecode(f *testing.F) {
+	m := TcpMessage{Message: Message{Code: GET, Token: []byte("t"), Payload: []byte("hi")}}
+	m.SetPathString("/a")
+	data, err := m.MarshalBinary()
+	if err != nil {
+		f.Fatalf("Error encoding: %v", err)
+	}
+	f.Add(data)
+	f.Add([]byte{0xf0, 0xff, 0xff, 0xff, 0xff, 0x01})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var m TcpMessage
+		m.UnmarshalBinary(data)
+		m.UnmarshalWebSocket(data)
+	})
+}
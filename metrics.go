@@ -0,0 +1,229 @@
+package coap
+
+import (
+	"encoding/json"
+	"net"
+	"sync"
+	"time"
+)
+
+// A MetricsRecorder is told about the messages and exchanges of a
+// Server or client connection, to count them.  Metrics implements
+// it; adapters for monitoring systems such as Prometheus can
+// implement it as well, or wrap a Metrics and export its Snapshot.
+// Its methods are called concurrently.
+type MetricsRecorder interface {
+	// MessageSent and MessageReceived are called with every
+	// message sent or received.
+	MessageSent(m Message)
+	MessageReceived(m Message)
+	// Retransmission is called with every confirmable message
+	// sent again, after MessageSent.
+	Retransmission(m Message)
+	// Timeout is called with every confirmable message, or
+	// client request, given up on for lack of an answer.
+	Timeout(m Message)
+	// ObserveRegistration is called with every Observe
+	// registration a server received or a client sent.
+	ObserveRegistration(m Message)
+	// DuplicateRequest is called with every duplicate of a
+	// request a server received before.
+	DuplicateRequest(m Message)
+	// Latency is called with every response a server sent or a
+	// client received, and the time since the request arrived or
+	// was first sent.
+	Latency(m Message, d time.Duration)
+}
+
+// MetricsSnapshot is the state of a Metrics at one point.
+type MetricsSnapshot struct {
+	// Sent and Received count the messages by code; empty
+	// messages count as code 0.
+	Sent, Received map[COAPCode]uint64
+	// Retransmissions counts the confirmable messages sent again.
+	Retransmissions uint64
+	// Timeouts counts the messages given up on.
+	Timeouts uint64
+	// ObserveRegistrations counts the Observe registrations.
+	ObserveRegistrations uint64
+	// Duplicates counts the duplicate requests received.
+	Duplicates uint64
+	// Latency percentiles of the recent exchanges.
+	P50, P90, P99 time.Duration
+	// Max is the highest latency seen.
+	Max time.Duration
+}
+
+// Metrics is a MetricsRecorder counting in memory.  It is an
+// expvar.Var, so it can be published with expvar.Publish.
+//
+// The zero value is ready to use.
+type Metrics struct {
+	mu              sync.Mutex
+	sent, received  map[COAPCode]uint64
+	retransmissions uint64
+	timeouts        uint64
+	observes        uint64
+	duplicates      uint64
+	latency         latencies
+}
+
+func (m *Metrics) count(counts *map[COAPCode]uint64, c COAPCode) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if *counts == nil {
+		*counts = map[COAPCode]uint64{}
+	}
+	(*counts)[c]++
+}
+
+func (m *Metrics) inc(n *uint64) {
+	m.mu.Lock()
+	*n++
+	m.mu.Unlock()
+}
+
+// MessageSent counts msg by its code.
+func (m *Metrics) MessageSent(msg Message) { m.count(&m.sent, msg.Code) }
+
+// MessageReceived counts msg by its code.
+func (m *Metrics) MessageReceived(msg Message) { m.count(&m.received, msg.Code) }
+
+// Retransmission counts a retransmission.
+func (m *Metrics) Retransmission(msg Message) { m.inc(&m.retransmissions) }
+
+// Timeout counts a timeout.
+func (m *Metrics) Timeout(msg Message) { m.inc(&m.timeouts) }
+
+// ObserveRegistration counts an Observe registration.
+func (m *Metrics) ObserveRegistration(msg Message) { m.inc(&m.observes) }
+
+// DuplicateRequest counts a duplicate request.
+func (m *Metrics) DuplicateRequest(msg Message) { m.inc(&m.duplicates) }
+
+// Latency records the latency d.
+func (m *Metrics) Latency(msg Message, d time.Duration) {
+	m.mu.Lock()
+	m.latency.add(d)
+	m.mu.Unlock()
+}
+
+// Snapshot returns the current counts and latencies.
+func (m *Metrics) Snapshot() MetricsSnapshot {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rv := MetricsSnapshot{
+		Sent:                 map[COAPCode]uint64{},
+		Received:             map[COAPCode]uint64{},
+		Retransmissions:      m.retransmissions,
+		Timeouts:             m.timeouts,
+		ObserveRegistrations: m.observes,
+		Duplicates:           m.duplicates,
+		Max:                  m.latency.max,
+	}
+	for c, n := range m.sent {
+		rv.Sent[c] = n
+	}
+	for c, n := range m.received {
+		rv.Received[c] = n
+	}
+	rv.P50, rv.P90, rv.P99 = m.latency.percentiles()
+	return rv
+}
+
+// String returns the snapshot as a JSON object, with codes by name
+// and latencies in milliseconds.
+func (m *Metrics) String() string {
+	s := m.Snapshot()
+	ms := func(d time.Duration) float64 {
+		return float64(d) / float64(time.Millisecond)
+	}
+	names := func(counts map[COAPCode]uint64) map[string]uint64 {
+		rv := map[string]uint64{}
+		for c, n := range counts {
+			rv[c.String()] = n
+		}
+		return rv
+	}
+	b, err := json.Marshal(struct {
+		Sent                 map[string]uint64 `json:"sent"`
+		Received             map[string]uint64 `json:"received"`
+		Retransmissions      uint64            `json:"retransmissions"`
+		Timeouts             uint64            `json:"timeouts"`
+		ObserveRegistrations uint64            `json:"observe_registrations"`
+		Duplicates           uint64            `json:"duplicates"`
+		P50                  float64           `json:"p50_ms"`
+		P90                  float64           `json:"p90_ms"`
+		P99                  float64           `json:"p99_ms"`
+		Max                  float64           `json:"max_ms"`
+	}{names(s.Sent), names(s.Received), s.Retransmissions, s.Timeouts,
+		s.ObserveRegistrations, s.Duplicates,
+		ms(s.P50), ms(s.P90), ms(s.P99), ms(s.Max)})
+	if err != nil {
+		return "{}"
+	}
+	return string(b)
+}
+
+// telemetry is where a server, hub or client reports what it does:
+// its Tracer, Hooks, MetricsRecorder and Capture, any of which may be
+// nil.
+type telemetry struct {
+	tracer  *Tracer
+	hooks   *Hooks
+	metrics MetricsRecorder
+	capture *Capture
+}
+
+func (t telemetry) sent(local, peer net.Addr, m Message, retransmission bool) {
+	t.tracer.record(true, retransmission, peer, m)
+	if t.capture != nil {
+		if data, err := m.MarshalBinary(); err == nil {
+			t.capture.datagram(true, local, peer, data)
+		}
+	}
+	if t.metrics != nil {
+		t.metrics.MessageSent(m)
+		if retransmission {
+			t.metrics.Retransmission(m)
+		}
+	}
+}
+
+func (t telemetry) received(peer net.Addr, m Message) {
+	t.tracer.record(false, false, peer, m)
+	if t.metrics != nil {
+		t.metrics.MessageReceived(m)
+	}
+}
+
+func (t telemetry) request(m Message, peer net.Addr) {
+	t.hooks.request(m, peer)
+	if v, ok := observeValue(m); t.metrics != nil && ok && v == 0 {
+		t.metrics.ObserveRegistration(m)
+	}
+}
+
+func (t telemetry) response(m Message, peer net.Addr, start time.Time) {
+	t.hooks.response(m, peer, start)
+	if t.metrics != nil {
+		t.metrics.Latency(m, time.Since(start))
+	}
+}
+
+func (t telemetry) retransmit(m Message, peer net.Addr, attempt int, start time.Time) {
+	t.hooks.retransmit(m, peer, attempt, start)
+}
+
+func (t telemetry) timeout(m Message, peer net.Addr, start time.Time) {
+	t.hooks.timeout(m, peer, start)
+	if t.metrics != nil {
+		t.metrics.Timeout(m)
+	}
+}
+
+func (t telemetry) duplicate(m Message) {
+	if t.metrics != nil {
+		t.metrics.DuplicateRequest(m)
+	}
+}
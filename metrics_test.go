@@ -0,0 +1,82 @@
+package coap
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	var sm, cm Metrics
+	l, addr := startUDPLisenter(t)
+	defer l.Close()
+	s := &Server{Handler: FuncHandler(contentHandler), Metrics: &sm}
+	go s.Serve(l)
+
+	d := Dialer{Metrics: &cm}
+	c, err := d.Dial("udp", addr)
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	defer c.Close()
+	req := Message{Type: Confirmable, Code: GET, MessageID: 1, Token: []byte("m")}
+	req.SetOption(Observe, uint32(0))
+	if _, err := c.Send(req); err != nil {
+		t.Fatalf("Error sending: %v", err)
+	}
+
+	// A duplicate, as if the ACK was lost.
+	raw, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	defer raw.Close()
+	dup := Message{Type: Confirmable, Code: GET, MessageID: 2}
+	data, _ := dup.MarshalBinary()
+	buf := make([]byte, 1500)
+	for i := 0; i < 2; i++ {
+		raw.Write(data)
+		raw.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := raw.Read(buf); err != nil {
+			t.Fatalf("Error reading response %v: %v", i, err)
+		}
+	}
+
+	ss := sm.Snapshot()
+	if ss.Received[GET] != 3 || ss.Sent[Content] != 3 || ss.Duplicates != 1 ||
+		ss.ObserveRegistrations != 1 || ss.Retransmissions != 1 || ss.Max <= 0 {
+		t.Errorf("Unexpected server metrics: %+v", ss)
+	}
+	cs := cm.Snapshot()
+	if cs.Sent[GET] != 1 || cs.Received[Content] != 1 || cs.ObserveRegistrations != 1 || cs.P50 <= 0 {
+		t.Errorf("Unexpected client metrics: %+v", cs)
+	}
+
+	var lost Metrics
+	pl, paddr, _ := pingServer(t, true)
+	defer pl.Close()
+	d = Dialer{
+		Metrics: &lost,
+		Params:  TransmissionParams{Retry: ExponentialBackoff{Initial: time.Millisecond, MaxAttempts: 3}},
+	}
+	c, err = d.Dial("udp", paddr)
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	defer c.Close()
+	if _, err := c.Send(Message{Type: Confirmable, Code: GET, MessageID: 3, Token: []byte("l")}); err != ErrTimeout {
+		t.Fatalf("Expected ErrTimeout, got %v", err)
+	}
+	if ls := lost.Snapshot(); ls.Sent[GET] != 3 || ls.Retransmissions != 2 || ls.Timeouts != 1 {
+		t.Errorf("Unexpected metrics of the lost request: %+v", ls)
+	}
+
+	var decoded map[string]interface{}
+	if err := json.Unmarshal([]byte(sm.String()), &decoded); err != nil {
+		t.Fatalf("Error decoding %s: %v", sm.String(), err)
+	}
+	if decoded["duplicates"] != 1.0 || decoded["received"].(map[string]interface{})["GET"] != 3.0 {
+		t.Errorf("Unexpected JSON: %v", decoded)
+	}
+}
@@ -0,0 +1,86 @@
+package coap
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrMessageIDsExhausted is returned when every Message ID was given
+// to a destination within the allocator's Lifetime.
+var ErrMessageIDsExhausted = errors.New("coap: all Message IDs in use")
+
+// A MessageIDAllocator hands out Message IDs, counting up from a
+// random one.  It's safe for concurrent use, so a Server and a Hub
+// sending on the same sockets can share one.  The zero value is ready
+// to use.
+type MessageIDAllocator struct {
+	// Lifetime, if positive, makes the allocator remember the IDs
+	// it gave for each destination, and not give one to the same
+	// destination again within this period, usually
+	// ExchangeLifetime (RFC 7252 section 4.4).  Zero means relying
+	// on the counter not wrapping around that fast.
+	Lifetime time.Duration
+
+	once sync.Once
+	next uint32
+
+	mu    sync.Mutex
+	used  map[string]map[uint16]bool
+	order []usedID
+}
+
+// A usedID is a Message ID given to a destination, remembered until
+// the allocator's Lifetime passes.
+type usedID struct {
+	dst string
+	id  uint16
+	at  time.Time
+}
+
+// Next returns the next Message ID for a message to dst, which may
+// be nil for messages to whoever.
+func (a *MessageIDAllocator) Next(dst net.Addr) (uint16, error) {
+	a.once.Do(func() {
+		atomic.CompareAndSwapUint32(&a.next, 0, uint32(rand.Int31()))
+	})
+	if a.Lifetime <= 0 || dst == nil {
+		return uint16(atomic.AddUint32(&a.next, 1)), nil
+	}
+
+	now := time.Now()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for len(a.order) > 0 && now.Sub(a.order[0].at) >= a.Lifetime {
+		u := a.order[0]
+		a.order = a.order[1:]
+		delete(a.used[u.dst], u.id)
+		if len(a.used[u.dst]) == 0 {
+			delete(a.used, u.dst)
+		}
+	}
+
+	key := dst.String()
+	used := a.used[key]
+	if used == nil {
+		if a.used == nil {
+			a.used = map[string]map[uint16]bool{}
+		}
+		used = map[uint16]bool{}
+		a.used[key] = used
+	}
+	if len(used) > 0xffff {
+		return 0, ErrMessageIDsExhausted
+	}
+	for {
+		id := uint16(atomic.AddUint32(&a.next, 1))
+		if !used[id] {
+			used[id] = true
+			a.order = append(a.order, usedID{key, id, now})
+			return id, nil
+		}
+	}
+}
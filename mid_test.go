@@ -0,0 +1,62 @@
+package coap
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMessageIDAllocator(t *testing.T) {
+	var a MessageIDAllocator
+	var mu sync.Mutex
+	seen := map[uint16]bool{}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				id, err := a.Next(nil)
+				mu.Lock()
+				if err != nil || seen[id] {
+					t.Errorf("Unexpected Message ID %v, %v", id, err)
+				}
+				seen[id] = true
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestMessageIDAllocatorLifetime(t *testing.T) {
+	a := MessageIDAllocator{Lifetime: time.Second}
+	x := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5683}
+	y := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 5683}
+
+	seen := map[uint16]bool{}
+	for i := 0; i < 1<<16; i++ {
+		id, err := a.Next(x)
+		if err != nil || seen[id] {
+			t.Fatalf("Unexpected Message ID %v for %v, %v", id, i, err)
+		}
+		seen[id] = true
+	}
+	if _, err := a.Next(x); err != ErrMessageIDsExhausted {
+		t.Errorf("Expected ErrMessageIDsExhausted, got %v", err)
+	}
+	if _, err := a.Next(y); err != nil {
+		t.Errorf("Expected IDs for another destination, got %v", err)
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+	if _, err := a.Next(x); err != nil {
+		t.Errorf("Expected IDs once the lifetime passed, got %v", err)
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.order) != 1 || len(a.used) != 1 {
+		t.Errorf("Expected only the last ID remembered, got %v in %v", len(a.order), len(a.used))
+	}
+}
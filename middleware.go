@@ -0,0 +1,27 @@
+package coap
+
+// Middleware wraps a handler in another, for concerns that cut across
+// resources, such as logging, authorization, rate limiting or
+// recovering from panics.  Hub.Handler is one.
+//
+// Middleware that lets requests through to the handler it wraps
+// should be built with RequestFunc and hand them on with
+// ServeRequest, so the wrapped handler can still answer through the
+// Request, e.g. with a separate response.
+type Middleware func(Handler) Handler
+
+// Chain wraps h in the middleware mw, the first outermost, so it sees
+// each request first.
+func Chain(h Handler, mw ...Middleware) Handler {
+	for i := len(mw) - 1; i >= 0; i-- {
+		h = mw[i](h)
+	}
+	return h
+}
+
+// ServeRequest has h serve the request r, through its ServeRequest
+// method if it's a RequestHandler, otherwise responding with what its
+// ServeCOAP returns.
+func ServeRequest(h Handler, r *Request) {
+	serveRequest(h, r)
+}
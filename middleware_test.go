@@ -0,0 +1,59 @@
+package coap
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestChain(t *testing.T) {
+	var mu sync.Mutex
+	var seen []string
+	record := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return RequestFunc(func(r *Request) {
+				mu.Lock()
+				seen = append(seen, name)
+				mu.Unlock()
+				ServeRequest(next, r)
+			})
+		}
+	}
+	auth := func(next Handler) Handler {
+		return RequestFunc(func(r *Request) {
+			if len(r.Msg.optionStrings(URIQuery)) == 0 {
+				r.Respond(Message{Code: Unauthorized})
+				return
+			}
+			ServeRequest(next, r)
+		})
+	}
+
+	mux := NewServeMux()
+	mux.Handle("/a", RequestFunc(func(r *Request) {
+		r.Respond(Message{Code: Content, Payload: []byte("a")})
+	}))
+	l, addr := startUDPLisenter(t)
+	defer l.Close()
+	go Serve(l, Chain(mux, record("log"), auth, record("inner")))
+
+	req := Message{Type: Confirmable, Code: GET, MessageID: 1}
+	req.SetPathString("/a")
+	if rv := dialAndSend(t, addr, req); rv.Code != Unauthorized {
+		t.Errorf("Expected Unauthorized, got %v", rv)
+	}
+	req.AddOption(URIQuery, "key=secret")
+	req.MessageID++
+	if rv := dialAndSend(t, addr, req); rv.Code != Content || string(rv.Payload) != "a" {
+		t.Errorf("Expected the resource, got %v", rv)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if exp := []string{"log", "log", "inner"}; !reflect.DeepEqual(seen, exp) {
+		t.Errorf("Expected %v, got %v", exp, seen)
+	}
+	if h := Chain(mux); h != Handler(mux) {
+		t.Errorf("Expected no middleware to leave the handler alone")
+	}
+}
@@ -0,0 +1,232 @@
+package coap
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// The "All CoAP Nodes" multicast addresses (RFC 7252 section 12.8).
+var (
+	AllNodesIPv4          = net.IPv4(224, 0, 1, 187)
+	AllNodesIPv6LinkLocal = net.ParseIP("ff02::fd")
+	AllNodesIPv6SiteLocal = net.ParseIP("ff05::fd")
+)
+
+// ErrNotMulticast is returned when joining an address that isn't a
+// multicast group.
+var ErrNotMulticast = errors.New("not a multicast address")
+
+// errNoGroups is returned where the platform can't join groups on an
+// existing socket or tell which group a packet was sent to.
+var errNoGroups = errors.New("coap: multicast groups not supported on this platform")
+
+type groupKey struct {
+	l     *net.UDPConn
+	group string
+}
+
+// JoinGroup makes the server's socket l a member of the multicast
+// group on the interface ifi (nil for the system's choice).
+// Requests sent to the group are served by h, or by the server's
+// Handler if h is nil, and carry the group in Request.Group.  A
+// socket may join several groups, each with its own handler, such as
+// the All CoAP Nodes groups of different scopes (RFC 7390).
+func (s *Server) JoinGroup(l *net.UDPConn, ifi *net.Interface, group net.IP, h Handler) error {
+	if !group.IsMulticast() {
+		return ErrNotMulticast
+	}
+	if err := joinGroup(l, ifi, group); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.groups == nil {
+		s.groups = map[groupKey]Handler{}
+	}
+	s.groups[groupKey{l, group.String()}] = h
+	return nil
+}
+
+// LeaveGroup ends the membership of l in group on ifi.
+func (s *Server) LeaveGroup(l *net.UDPConn, ifi *net.Interface, group net.IP) error {
+	s.mu.Lock()
+	delete(s.groups, groupKey{l, group.String()})
+	s.mu.Unlock()
+	return leaveGroup(l, ifi, group)
+}
+
+// joinAllNodes joins l to the All CoAP Nodes groups of the network
+// n on each of the server's MulticastInterfaces.  A group that can't
+// be joined is skipped, as long as some group is joined on every
+// interface, since a dual-stack socket may only manage one family.
+func (s *Server) joinAllNodes(l *net.UDPConn, n string) error {
+	groups := []net.IP{AllNodesIPv4, AllNodesIPv6LinkLocal, AllNodesIPv6SiteLocal}
+	switch n {
+	case "udp4":
+		groups = groups[:1]
+	case "udp6":
+		groups = groups[1:]
+	}
+	for _, ifi := range s.MulticastInterfaces {
+		var err error
+		joined := false
+		for _, g := range groups {
+			if e := s.JoinGroup(l, ifi, g, nil); e != nil {
+				err = e
+				continue
+			}
+			joined = true
+		}
+		if !joined {
+			return err
+		}
+	}
+	return nil
+}
+
+// respondToGroup sends rv, the response to a multicast request, as a
+// non-confirmable message at a random point within the leisure
+// period.
+func (s *Server) respondToGroup(r *Request, rv Message) error {
+	leisure := s.Leisure
+	if leisure <= 0 {
+		leisure = s.Params.withDefaults().DefaultLeisure
+	}
+	time.Sleep(time.Duration(rand.Int63n(int64(leisure))))
+
+	rv.Type = NonConfirmable
+	var err error
+	if rv.MessageID, err = s.nextMessageID(r.Addr); err != nil {
+		return err
+	}
+	rv.Token = r.Msg.Token
+	s.telemetry().response(rv, r.Addr, r.start)
+	return s.transmit(r.l, r.Addr, rv)
+}
+
+// handler returns the handler for requests that arrived on l sent
+// to dst.
+func (s *Server) handler(l *net.UDPConn, dst net.IP) Handler {
+	if dst == nil || !dst.IsMulticast() {
+		return s.Handler
+	}
+	s.mu.Lock()
+	h := s.groups[groupKey{l, dst.String()}]
+	s.mu.Unlock()
+	if h == nil {
+		return s.Handler
+	}
+	return h
+}
+
+// DefaultLeisure is how long responses to a multicast request are
+// collected, DEFAULT_LEISURE (RFC 7252 section 8.2).
+const DefaultLeisure = 5 * time.Second
+
+// A MulticastResponse is a response to a multicast request and the
+// address of the server that sent it.
+type MulticastResponse struct {
+	Addr *net.UDPAddr
+	Msg  Message
+}
+
+// MulticastConn sends requests to a multicast group, such as
+// AllNodesIPv4 on port 5683, and collects the unicast responses.  It
+// may be used by multiple goroutines, whose requests take turns.
+type MulticastConn struct {
+	// Leisure is how long Send collects responses.  Zero means
+	// DefaultLeisure.
+	Leisure time.Duration
+	// ReadBufferSize is the largest response read; longer ones are
+	// truncated, and so dropped as malformed.  Zero means
+	// DefaultReadBufferSize.
+	ReadBufferSize int
+
+	conn    *net.UDPConn
+	group   *net.UDPAddr
+	session *Session
+	mu      sync.Mutex
+}
+
+// DialMulticast creates a client for the multicast group at addr,
+// e.g. "224.0.1.187:5683" or "[ff02::fd%eth0]:5683".
+func DialMulticast(n, addr string) (*MulticastConn, error) {
+	group, err := net.ResolveUDPAddr(n, addr)
+	if err != nil {
+		return nil, err
+	}
+	if !group.IP.IsMulticast() {
+		return nil, ErrNotMulticast
+	}
+	l, err := net.ListenUDP(n, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &MulticastConn{
+		conn:    l,
+		group:   group,
+		session: NewSession(l.LocalAddr(), group),
+	}, nil
+}
+
+// Send sends req to the group as a non-confirmable request, filling
+// in its Message ID and, if it has none, a token.  It returns the
+// responses that arrived within the leisure period, in order of
+// arrival.
+func (c *MulticastConn) Send(req Message) ([]MulticastResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	req.Type = NonConfirmable
+	req.MessageID = c.session.NextMessageID()
+	if len(req.Token) == 0 {
+		req.Token = c.session.NextToken()
+	}
+	if err := Transmit(c.conn, c.group, req); err != nil {
+		return nil, err
+	}
+
+	leisure := c.Leisure
+	if leisure == 0 {
+		leisure = DefaultLeisure
+	}
+	c.conn.SetReadDeadline(time.Now().Add(leisure))
+	defer c.conn.SetReadDeadline(time.Time{})
+
+	var rv []MulticastResponse
+	size := c.ReadBufferSize
+	if size <= 0 {
+		size = DefaultReadBufferSize
+	}
+	buf := make([]byte, size+1)
+	for {
+		nr, addr, err := c.conn.ReadFromUDP(buf)
+		if err != nil {
+			if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
+				return rv, nil
+			}
+			return rv, err
+		}
+		if nr > size {
+			continue
+		}
+		m, err := ParseMessage(buf[:nr])
+		if err != nil || !bytes.Equal(m.Token, req.Token) {
+			continue
+		}
+		if m.IsConfirmable() {
+			Transmit(c.conn, addr, Message{Type: Acknowledgement, MessageID: m.MessageID})
+		}
+		rv = append(rv, MulticastResponse{Addr: addr, Msg: m})
+	}
+}
+
+// Close closes the client's socket.
+func (c *MulticastConn) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,83 @@
+//go:build linux
+
+package coap
+
+import (
+	"net"
+	"syscall"
+)
+
+func joinGroup(l *net.UDPConn, ifi *net.Interface, group net.IP) error {
+	return setMembership(l, ifi, group, true)
+}
+
+func leaveGroup(l *net.UDPConn, ifi *net.Interface, group net.IP) error {
+	return setMembership(l, ifi, group, false)
+}
+
+// setMembership joins or leaves group, also asking for the packet
+// info that tells destination addresses apart.
+func setMembership(l *net.UDPConn, ifi *net.Interface, group net.IP, join bool) error {
+	rc, err := l.SyscallConn()
+	if err != nil {
+		return err
+	}
+	index := 0
+	if ifi != nil {
+		index = ifi.Index
+	}
+
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		if ip4 := group.To4(); ip4 != nil {
+			mreq := &syscall.IPMreqn{Ifindex: int32(index)}
+			copy(mreq.Multiaddr[:], ip4)
+			opt := syscall.IP_ADD_MEMBERSHIP
+			if !join {
+				opt = syscall.IP_DROP_MEMBERSHIP
+			}
+			serr = syscall.SetsockoptIPMreqn(int(fd), syscall.IPPROTO_IP, opt, mreq)
+			if serr == nil && join {
+				serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_PKTINFO, 1)
+			}
+			return
+		}
+
+		mreq := &syscall.IPv6Mreq{Interface: uint32(index)}
+		copy(mreq.Multiaddr[:], group.To16())
+		opt := syscall.IPV6_JOIN_GROUP
+		if !join {
+			opt = syscall.IPV6_LEAVE_GROUP
+		}
+		serr = syscall.SetsockoptIPv6Mreq(int(fd), syscall.IPPROTO_IPV6, opt, mreq)
+		if serr == nil && join {
+			serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_RECVPKTINFO, 1)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+// destination extracts the address a packet was sent to from its
+// control messages, or returns nil.
+func destination(oob []byte) net.IP {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil
+	}
+	for _, m := range msgs {
+		switch {
+		case m.Header.Level == syscall.IPPROTO_IP && m.Header.Type == syscall.IP_PKTINFO &&
+			len(m.Data) >= syscall.SizeofInet4Pktinfo:
+			// struct in_pktinfo: ifindex, spec_dst, addr.
+			return net.IP(append([]byte(nil), m.Data[8:12]...))
+		case m.Header.Level == syscall.IPPROTO_IPV6 && m.Header.Type == syscall.IPV6_PKTINFO &&
+			len(m.Data) >= syscall.SizeofInet6Pktinfo:
+			// struct in6_pktinfo: addr, ifindex.
+			return net.IP(append([]byte(nil), m.Data[:16]...))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+
+package coap
+
+import "net"
+
+func joinGroup(l *net.UDPConn, ifi *net.Interface, group net.IP) error {
+	return errNoGroups
+}
+
+func leaveGroup(l *net.UDPConn, ifi *net.Interface, group net.IP) error {
+	return errNoGroups
+}
+
+func destination(oob []byte) net.IP {
+	return nil
+}
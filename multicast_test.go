@@ -0,0 +1,149 @@
+package coap
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestServerGroupHandlers(t *testing.T) {
+	l, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero})
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	defer l.Close()
+
+	got := make(chan string, 2)
+	reply := func(name string) Handler {
+		return RequestFunc(func(r *Request) {
+			got <- name + " " + r.Group.String()
+		})
+	}
+
+	s := &Server{Handler: reply("unicast")}
+	if err := s.JoinGroup(l, nil, net.IPv4(127, 0, 0, 1), nil); err != ErrNotMulticast {
+		t.Errorf("Expected ErrNotMulticast, got %v", err)
+	}
+	group := net.IPv4(239, 255, 0, 187)
+	if err := s.JoinGroup(l, nil, group, reply("group")); err != nil {
+		t.Skipf("Can't join %v: %v", group, err)
+	}
+	defer s.LeaveGroup(l, nil, group)
+	go s.Serve(l)
+
+	c, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	defer c.Close()
+
+	port := l.LocalAddr().(*net.UDPAddr).Port
+	req := Message{Type: NonConfirmable, Code: GET, MessageID: 1}
+	req.SetPathString("/x")
+
+	tests := []struct {
+		dst  net.IP
+		want string
+	}{
+		{net.IPv4(127, 0, 0, 1), "unicast <nil>"},
+		{group, "group " + group.String()},
+	}
+	for _, test := range tests {
+		if err := Transmit(c, &net.UDPAddr{IP: test.dst, Port: port}, req); err != nil {
+			t.Skipf("Can't send to %v: %v", test.dst, err)
+		}
+		select {
+		case s := <-got:
+			if s != test.want {
+				t.Errorf("Sent to %v: expected %q, got %q", test.dst, test.want, s)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Nothing received for %v", test.dst)
+		}
+	}
+}
+
+func TestMulticastConn(t *testing.T) {
+	group := net.IPv4(239, 255, 0, 188)
+	l, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero})
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	defer l.Close()
+	port := l.LocalAddr().(*net.UDPAddr).Port
+
+	s := &Server{Leisure: 50 * time.Millisecond, Handler: FuncHandler(func(l *net.UDPConn, a *net.UDPAddr, m *Message) *Message {
+		return &Message{
+			Type:      Acknowledgement,
+			Code:      Content,
+			MessageID: m.MessageID,
+			Token:     m.Token,
+			Payload:   []byte("here"),
+		}
+	})}
+	if err := s.JoinGroup(l, nil, group, nil); err != nil {
+		t.Skipf("Can't join %v: %v", group, err)
+	}
+	go s.Serve(l)
+
+	if _, err := DialMulticast("udp4", "127.0.0.1:5683"); err != ErrNotMulticast {
+		t.Errorf("Expected ErrNotMulticast, got %v", err)
+	}
+	c, err := DialMulticast("udp4", (&net.UDPAddr{IP: group, Port: port}).String())
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	defer c.Close()
+	c.Leisure = 200 * time.Millisecond
+
+	req := Message{Code: GET}
+	req.SetPathString("/.well-known/core")
+	start := time.Now()
+	rvs, err := c.Send(req)
+	if err != nil {
+		t.Fatalf("Error sending: %v", err)
+	}
+	if time.Since(start) < c.Leisure {
+		t.Errorf("Expected responses collected for the whole leisure period")
+	}
+	if len(rvs) != 1 || string(rvs[0].Msg.Payload) != "here" || rvs[0].Addr.Port != port {
+		t.Fatalf("Unexpected responses: %+v", rvs)
+	}
+	if rvs[0].Msg.Type != NonConfirmable {
+		t.Errorf("Expected a non-confirmable response, got %v", rvs[0].Msg.Type)
+	}
+}
+
+func TestServerJoinAllNodes(t *testing.T) {
+	ifis, err := net.Interfaces()
+	if err != nil {
+		t.Skipf("Can't list interfaces: %v", err)
+	}
+	s := &Server{Leisure: 50 * time.Millisecond}
+	for i := range ifis {
+		if ifis[i].Flags&net.FlagMulticast != 0 && ifis[i].Flags&net.FlagUp != 0 {
+			s.MulticastInterfaces = append(s.MulticastInterfaces, &ifis[i])
+		}
+	}
+	if len(s.MulticastInterfaces) == 0 {
+		t.Skip("No multicast interfaces")
+	}
+
+	l, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero})
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	defer l.Close()
+	if err := s.joinAllNodes(l, "udp4"); err != nil {
+		t.Skipf("Can't join the All CoAP Nodes group: %v", err)
+	}
+	if h := s.handler(l, AllNodesIPv4); h != nil {
+		t.Errorf("Expected the group to use the server's handler, got %v", h)
+	}
+	s.mu.Lock()
+	n := len(s.groups)
+	s.mu.Unlock()
+	if n != 1 {
+		t.Errorf("Expected one group joined, got %v", n)
+	}
+}
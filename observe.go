@@ -0,0 +1,248 @@
+package coap
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrNotObservable is returned by Observe when the server answered
+// without registering the observation.
+var ErrNotObservable = errors.New("resource is not observable")
+
+// Number of notifications an Observation holds before dropping more.
+const notificationQueueLen = 16
+
+// DefaultObserveGrace is how long past the Max-Age of its last
+// notification an observation waits for the next one before
+// registering again.
+const DefaultObserveGrace = 5 * time.Second
+
+// An Observation is the observation of a resource made with Observe.
+type Observation struct {
+	// C delivers the notifications for the resource, starting with
+	// the response to the registration.  Stale notifications that
+	// arrive out of order are dropped.  C is closed by
+	// CancelObserve.
+	//
+	// When no notification arrives within the Max-Age of the last
+	// one plus the connection's ObserveGrace, the observation is
+	// registered again, and the response delivered on C, as the
+	// server may have lost it, such as when it restarted.
+	C <-chan Message
+
+	c     *Conn
+	req   Message
+	token []byte
+
+	mu     sync.Mutex
+	ch     chan Message
+	closed bool
+	order  observeOrder
+	timer  *time.Timer
+	wait   time.Duration
+	onGap  func(error)
+}
+
+// OnGap sets f to be called whenever the observation went quiet and
+// was registered again, as notifications may have been missed.  The
+// error is that of registering, if it failed; it's tried again after
+// the same wait, unless the connection is closed.
+func (o *Observation) OnGap(f func(err error)) {
+	o.mu.Lock()
+	o.onGap = f
+	o.mu.Unlock()
+}
+
+// observeValue returns the Observe option of the GET or FETCH request
+// m, 0 to register and 1 to deregister, if it has one.
+func observeValue(m Message) (uint32, bool) {
+	v := m.Option(Observe)
+	if v == nil || (m.Code != GET && m.Code != FETCH) {
+		return 0, false
+	}
+	b, _ := option{Observe, v}.toBytes()
+	return decodeInt(b), true
+}
+
+// An observeOrder orders the notifications of an observation by
+// their Observe values, to drop stale ones that arrive out of order
+// (RFC 7641 section 3.4).
+type observeOrder struct {
+	seq  uint32
+	last time.Time
+}
+
+// fresh tells whether a notification with Observe value v, received
+// now, is newer than the last one.  The 24-bit values wrap around,
+// and after 128 seconds any value is newer.
+func (o *observeOrder) fresh(v uint32, now time.Time) bool {
+	if o.last.IsZero() {
+		return true
+	}
+	v1, v2 := o.seq, v
+	return (v1 < v2 && v2-v1 < 1<<23) ||
+		(v1 > v2 && v1-v2 > 1<<23) ||
+		now.After(o.last.Add(128*time.Second))
+}
+
+// accept tells whether the notification m, received now, is fresh,
+// and if so records it as the last one.  Messages without an Observe
+// option are always accepted.
+func (o *observeOrder) accept(m Message, now time.Time) bool {
+	v, ok := m.Option(Observe).(uint32)
+	if !ok {
+		return true
+	}
+	if !o.fresh(v, now) {
+		return false
+	}
+	o.seq, o.last = v, now
+	return true
+}
+
+func (o *Observation) notify(m Message) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.closed {
+		return
+	}
+
+	if !o.order.accept(m, time.Now()) {
+		return
+	}
+
+	o.wait = defaultMaxAge + o.c.observeGrace
+	if age, ok := m.Option(MaxAge).(uint32); ok {
+		o.wait = time.Duration(age)*time.Second + o.c.observeGrace
+	}
+	if o.timer == nil {
+		o.timer = time.AfterFunc(o.wait, o.reregister)
+	} else {
+		o.timer.Reset(o.wait)
+	}
+
+	select {
+	case o.ch <- m:
+	default:
+	}
+}
+
+// Observe registers interest in the resource at path using the
+// Observe option (RFC 7641).  Notifications are matched to the
+// observation by its token and delivered on its channel.
+func (c *Conn) Observe(path string) (*Observation, error) {
+	ch := make(chan Message, notificationQueueLen)
+	o := &Observation{
+		C:     ch,
+		c:     c,
+		token: c.session.NextToken(),
+		ch:    ch,
+	}
+	o.req = Message{
+		Type:  Confirmable,
+		Code:  GET,
+		Token: o.token,
+	}
+	o.req.SetOption(Observe, uint32(0))
+	o.req.SetPathString(path)
+
+	c.mu.Lock()
+	c.observations[string(o.token)] = o
+	c.mu.Unlock()
+
+	rv, err := o.register()
+	if err != nil {
+		c.forget(o)
+		return nil, err
+	}
+	o.notify(*rv)
+	return o, nil
+}
+
+// register sends the Observe registration and returns the response.
+func (o *Observation) register() (*Message, error) {
+	req := o.req
+	req.MessageID = o.c.nextMessageID()
+	rv, err := o.c.Send(req)
+	if err == nil && (rv.Code < Created || rv.Code >= BadRequest ||
+		rv.Option(Observe) == nil) {
+		err = ErrNotObservable
+	}
+	return rv, err
+}
+
+// reregister registers the observation again after it went quiet.
+// The server may have restarted and count its notifications anew, so
+// the response is taken as fresh.
+func (o *Observation) reregister() {
+	o.mu.Lock()
+	closed := o.closed
+	o.mu.Unlock()
+	if closed {
+		return
+	}
+
+	rv, err := o.register()
+
+	o.mu.Lock()
+	if o.closed {
+		o.mu.Unlock()
+		if err == nil {
+			// Cancelled while registering, which the server
+			// took all the same.
+			o.deregister()
+		}
+		return
+	}
+	switch {
+	case err == nil:
+		o.order = observeOrder{}
+	case o.c.err() == nil:
+		o.timer.Reset(o.wait)
+	}
+	onGap := o.onGap
+	o.mu.Unlock()
+
+	if err == nil {
+		o.notify(*rv)
+	}
+	if onGap != nil {
+		onGap(err)
+	}
+}
+
+func (c *Conn) forget(o *Observation) {
+	c.mu.Lock()
+	delete(c.observations, string(o.token))
+	c.mu.Unlock()
+	c.session.RemoveObservation(o.token)
+
+	o.mu.Lock()
+	if !o.closed {
+		o.closed = true
+		close(o.ch)
+		if o.timer != nil {
+			o.timer.Stop()
+		}
+	}
+	o.mu.Unlock()
+}
+
+// CancelObserve cancels the observation, telling the server with a
+// GET carrying Observe=1, and closes its channel.
+func (c *Conn) CancelObserve(o *Observation) error {
+	c.forget(o)
+	return o.deregister()
+}
+
+// deregister tells the server to cancel the observation with a GET
+// carrying Observe=1.
+func (o *Observation) deregister() error {
+	req := o.req
+	req.opts = append(options(nil), o.req.opts...)
+	req.MessageID = o.c.nextMessageID()
+	req.SetOption(Observe, uint32(1))
+	_, err := o.c.Send(req)
+	return err
+}
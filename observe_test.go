@@ -0,0 +1,264 @@
+package coap
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestObserve(t *testing.T) {
+	h := NewHub()
+	h.Start()
+	defer h.Stop()
+	l, c := startHub(t, h)
+	defer l.Close()
+	defer c.Close()
+
+	o, err := c.Observe("/temp")
+	if err != nil {
+		t.Fatalf("Error observing: %v", err)
+	}
+	if m := <-o.C; string(m.Payload) != "current" {
+		t.Errorf("Expected registration response first, got %v (%s)", m, m.Payload)
+	}
+
+	if n, err := h.Notify("temp", Message{Code: Content, Payload: []byte("21C")}); n != 1 || err != nil {
+		t.Fatalf("Expected 1 observer notified, got %v, %v", n, err)
+	}
+	select {
+	case m := <-o.C:
+		if string(m.Payload) != "21C" {
+			t.Errorf("Unexpected notification: %v (%s)", m, m.Payload)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Timed out waiting for notification")
+	}
+
+	if err := c.CancelObserve(o); err != nil {
+		t.Fatalf("Error cancelling: %v", err)
+	}
+	if _, ok := <-o.C; ok {
+		t.Errorf("Expected the channel to be closed")
+	}
+	if n, err := h.Notify("temp", Message{Code: Content}); n != 0 || err != ErrNoObservers {
+		t.Errorf("Expected no observers left, got %v, %v", n, err)
+	}
+}
+
+func TestObserveNotObservable(t *testing.T) {
+	l, addr := startUDPLisenter(t)
+	defer l.Close()
+	go Serve(l, FuncHandler(contentHandler))
+
+	c, err := Dial("udp", addr)
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	defer c.Close()
+
+	if _, err := c.Observe("/temp"); err != ErrNotObservable {
+		t.Errorf("Expected ErrNotObservable, got %v", err)
+	}
+	if len(c.observations) != 0 {
+		t.Errorf("Expected no observations left, got %v", c.observations)
+	}
+}
+
+func TestObservationFreshness(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		last, v uint32
+		since   time.Duration
+		fresh   bool
+	}{
+		{1, 2, 0, true},
+		{2, 1, 0, false},
+		{2, 2, 0, false},
+		{1<<24 - 1, 0, 0, true},
+		{0, 1<<24 - 1, 0, false},
+		{2, 1, 129 * time.Second, true},
+	}
+
+	for _, test := range tests {
+		o := &observeOrder{seq: test.last, last: now.Add(-test.since)}
+		if got := o.fresh(test.v, now); got != test.fresh {
+			t.Errorf("Expected %v after %v (%v ago) fresh=%v, got %v",
+				test.v, test.last, test.since, test.fresh, got)
+		}
+	}
+}
+
+func TestObserveReregister(t *testing.T) {
+	var mu sync.Mutex
+	registrations := 0
+	l, addr := startUDPLisenter(t)
+	defer l.Close()
+	go Serve(l, FuncHandler(func(l *net.UDPConn, a *net.UDPAddr, m *Message) *Message {
+		mu.Lock()
+		registrations++
+		n := registrations
+		mu.Unlock()
+		rv := &Message{
+			Type:      Acknowledgement,
+			Code:      Content,
+			MessageID: m.MessageID,
+			Token:     m.Token,
+			Payload:   []byte(strconv.Itoa(n)),
+		}
+		// A restarted server counts its notifications anew.
+		rv.SetOption(Observe, uint32(100/n))
+		rv.SetOption(MaxAge, uint32(0))
+		return rv
+	}))
+
+	d := Dialer{ObserveGrace: 50 * time.Millisecond}
+	c, err := d.Dial("udp", addr)
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	defer c.Close()
+
+	o, err := c.Observe("/temp")
+	if err != nil {
+		t.Fatalf("Error observing: %v", err)
+	}
+	gaps := make(chan error, 10)
+	o.OnGap(func(err error) { gaps <- err })
+
+	for _, exp := range []string{"1", "2"} {
+		select {
+		case m := <-o.C:
+			if string(m.Payload) != exp {
+				t.Errorf("Expected registration %v, got %v (%s)", exp, m, m.Payload)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out waiting for registration %v", exp)
+		}
+	}
+	select {
+	case err := <-gaps:
+		if err != nil {
+			t.Errorf("Unexpected error registering again: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Timed out waiting for the gap callback")
+	}
+
+	if err := c.CancelObserve(o); err != nil {
+		t.Fatalf("Error cancelling: %v", err)
+	}
+	mu.Lock()
+	n := registrations
+	mu.Unlock()
+	time.Sleep(150 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	if registrations != n {
+		t.Errorf("Expected no registrations after cancelling, got %v more", registrations-n)
+	}
+}
+
+func TestObserveCancelledWhileReregistering(t *testing.T) {
+	inFlight := make(chan struct{})
+	release := make(chan struct{})
+	cancels := make(chan struct{}, 10)
+	var mu sync.Mutex
+	registrations := 0
+	l, addr := startUDPLisenter(t)
+	defer l.Close()
+	go Serve(l, FuncHandler(func(l *net.UDPConn, a *net.UDPAddr, m *Message) *Message {
+		if m.Option(Observe) == uint32(1) {
+			cancels <- struct{}{}
+		} else {
+			mu.Lock()
+			registrations++
+			n := registrations
+			mu.Unlock()
+			if n == 2 {
+				close(inFlight)
+				<-release
+			}
+		}
+		rv := &Message{
+			Type:      Acknowledgement,
+			Code:      Content,
+			MessageID: m.MessageID,
+			Token:     m.Token,
+		}
+		rv.SetOption(Observe, uint32(2))
+		rv.SetOption(MaxAge, uint32(0))
+		return rv
+	}))
+
+	d := Dialer{ObserveGrace: 50 * time.Millisecond}
+	c, err := d.Dial("udp", addr)
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	defer c.Close()
+
+	o, err := c.Observe("/temp")
+	if err != nil {
+		t.Fatalf("Error observing: %v", err)
+	}
+	select {
+	case <-inFlight:
+	case <-time.After(time.Second):
+		t.Fatalf("Timed out waiting for the registration to be repeated")
+	}
+	c.forget(o)
+	close(release)
+
+	select {
+	case <-cancels:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the repeated registration cancelled")
+	}
+}
+
+func TestReceiveDropsStaleNotifications(t *testing.T) {
+	l, addr := startUDPLisenter(t)
+	defer l.Close()
+	go Serve(l, FuncHandler(func(l *net.UDPConn, a *net.UDPAddr, m *Message) *Message {
+		go func() {
+			// After Send is done with the token.
+			time.Sleep(50 * time.Millisecond)
+			for i, v := range []uint32{5, 3, 6, 6} {
+				note := Message{
+					Type:      NonConfirmable,
+					Code:      Content,
+					MessageID: uint16(i),
+					Token:     m.Token,
+					Payload:   []byte(strconv.Itoa(int(v))),
+				}
+				note.SetOption(Observe, v)
+				Transmit(l, a, note)
+			}
+			Transmit(l, a, Message{Type: NonConfirmable, Code: Content, MessageID: 9, Token: m.Token, Payload: []byte("end")})
+		}()
+		return &Message{Type: Acknowledgement, Code: Content, MessageID: m.MessageID, Token: m.Token}
+	}))
+
+	c, err := Dial("udp", addr)
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	defer c.Close()
+
+	req := Message{Type: Confirmable, Code: GET, MessageID: 1, Token: []byte("obs")}
+	req.SetOption(Observe, uint32(0))
+	if _, err := c.Send(req); err != nil {
+		t.Fatalf("Error registering: %v", err)
+	}
+	for _, exp := range []string{"5", "6", "end"} {
+		m, err := c.Receive()
+		if err != nil {
+			t.Fatalf("Error receiving %v: %v", exp, err)
+		}
+		if string(m.Payload) != exp {
+			t.Errorf("Expected %v, got %v (%s)", exp, m, m.Payload)
+		}
+	}
+}
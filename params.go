@@ -0,0 +1,137 @@
+package coap
+
+import (
+	"math/rand"
+	"time"
+)
+
+// TransmissionParams are the transmission parameters of RFC 7252
+// section 4.8, for a Dialer, Server or Hub.  Zero fields take the
+// defaults: ResponseTimeout, ResponseRandomFactor, MaxRetransmit,
+// DefaultNStart and DefaultLeisure, and no probing rate limit.
+type TransmissionParams struct {
+	// AckTimeout is ACK_TIMEOUT, the least time before a
+	// confirmable message is first retransmitted.
+	AckTimeout time.Duration
+	// AckRandomFactor is ACK_RANDOM_FACTOR: the first timeout is
+	// picked at random between AckTimeout and AckTimeout times
+	// this.
+	AckRandomFactor float64
+	// MaxRetransmit is MAX_RETRANSMIT, how often a confirmable
+	// message is retransmitted before giving up.
+	MaxRetransmit int
+	// NStart is NSTART, how many confirmable requests a client has
+	// outstanding at once.
+	NStart int
+	// DefaultLeisure is DEFAULT_LEISURE, the period in which a
+	// server answers a multicast request.
+	DefaultLeisure time.Duration
+	// ProbingRate is PROBING_RATE, the average rate in bytes per
+	// second a client sends non-confirmable messages at.
+	ProbingRate float64
+	// Retry, if not nil, decides when confirmable messages are
+	// retransmitted and when to give up, instead of AckTimeout,
+	// AckRandomFactor, MaxRetransmit and any CoCoA estimates.
+	Retry RetryPolicy
+}
+
+// A RetryPolicy decides how long a confirmable message waits for its
+// acknowledgement before it's transmitted again.
+type RetryPolicy interface {
+	// NextTimeout returns the timeout of transmission n of a
+	// message, counting from 0 for the first, given prev, the
+	// timeout of the transmission before.  False gives up instead
+	// of transmitting again.
+	NextTimeout(n int, prev time.Duration) (time.Duration, bool)
+}
+
+// ExponentialBackoff is a RetryPolicy multiplying the timeout by
+// Factor on every retransmission, as RFC 7252 section 4.2 does with a
+// factor of 2.  Short timeouts and many attempts suit networks with
+// low latency; long timeouts and few attempts constrained ones, such
+// as NB-IoT.
+type ExponentialBackoff struct {
+	// Initial is the timeout of the first transmission.  Zero
+	// means ResponseTimeout.
+	Initial time.Duration
+	// Jitter is the fraction of Initial the first timeout is
+	// randomly lengthened by, at most, so peers don't retransmit
+	// in step.
+	Jitter float64
+	// Factor is what each timeout is multiplied by for the next.
+	// Zero means 2.
+	Factor float64
+	// Max, if positive, caps the timeouts.
+	Max time.Duration
+	// MaxAttempts is how many times a message is transmitted, at
+	// most.  Zero means once more than MaxRetransmit.
+	MaxAttempts int
+}
+
+// NextTimeout returns the timeout of transmission n.
+func (b ExponentialBackoff) NextTimeout(n int, prev time.Duration) (time.Duration, bool) {
+	attempts := b.MaxAttempts
+	if attempts <= 0 {
+		attempts = MaxRetransmit + 1
+	}
+	if n >= attempts {
+		return 0, false
+	}
+
+	var d time.Duration
+	if n == 0 {
+		d = b.Initial
+		if d <= 0 {
+			d = ackTimeout
+		}
+		d += time.Duration(rand.Float64() * b.Jitter * float64(d))
+	} else {
+		factor := b.Factor
+		if factor <= 0 {
+			factor = 2
+		}
+		d = time.Duration(float64(prev) * factor)
+	}
+	if b.Max > 0 && d > b.Max {
+		d = b.Max
+	}
+	return d, true
+}
+
+// retryPolicy returns p's Retry, or else the policy of RFC 7252
+// section 4.2 with p's parameters.
+func (p TransmissionParams) retryPolicy() RetryPolicy {
+	if p.Retry != nil {
+		return p.Retry
+	}
+	return ExponentialBackoff{
+		Initial:     p.AckTimeout,
+		Jitter:      p.AckRandomFactor - 1,
+		MaxAttempts: p.MaxRetransmit + 1,
+	}
+}
+
+// withDefaults returns p with its zero fields set to the defaults.
+func (p TransmissionParams) withDefaults() TransmissionParams {
+	if p.AckTimeout <= 0 {
+		p.AckTimeout = ackTimeout
+	}
+	if p.AckRandomFactor < 1 {
+		p.AckRandomFactor = ResponseRandomFactor
+	}
+	if p.MaxRetransmit <= 0 {
+		p.MaxRetransmit = MaxRetransmit
+	}
+	if p.NStart <= 0 {
+		p.NStart = DefaultNStart
+	}
+	if p.DefaultLeisure <= 0 {
+		p.DefaultLeisure = DefaultLeisure
+	}
+	return p
+}
+
+// dither picks a timeout between d and d * AckRandomFactor.
+func (p TransmissionParams) dither(d time.Duration) time.Duration {
+	return d + time.Duration(rand.Float64()*(p.AckRandomFactor-1)*float64(d))
+}
@@ -0,0 +1,128 @@
+package coap
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTransmissionParamsDefaults(t *testing.T) {
+	got := TransmissionParams{MaxRetransmit: 2, ProbingRate: 1}.withDefaults()
+	exp := TransmissionParams{
+		AckTimeout:      ResponseTimeout,
+		AckRandomFactor: ResponseRandomFactor,
+		MaxRetransmit:   2,
+		NStart:          DefaultNStart,
+		DefaultLeisure:  DefaultLeisure,
+		ProbingRate:     1,
+	}
+	if got != exp {
+		t.Errorf("Expected %+v, got %+v", exp, got)
+	}
+	for i := 0; i < 10; i++ {
+		if d := got.dither(time.Second); d < time.Second || d > 1500*time.Millisecond {
+			t.Errorf("Expected a timeout from 1s to 1.5s, got %v", d)
+		}
+	}
+}
+
+func TestDialerParams(t *testing.T) {
+	l, addr, _ := pingServer(t, true)
+	defer l.Close()
+
+	tr := &Tracer{}
+	d := Dialer{
+		Tracer: tr,
+		Params: TransmissionParams{
+			AckTimeout:      5 * time.Millisecond,
+			AckRandomFactor: 1,
+			MaxRetransmit:   2,
+		},
+	}
+	c, err := d.Dial("udp", addr)
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	defer c.Close()
+
+	start := time.Now()
+	if _, err := c.Send(Message{Type: Confirmable, MessageID: 1}); err != ErrTimeout {
+		t.Fatalf("Expected ErrTimeout, got %v", err)
+	}
+	// 5ms, 10ms and 20ms.
+	if elapsed := time.Since(start); elapsed < 35*time.Millisecond || elapsed > time.Second {
+		t.Errorf("Expected to give up after 35ms, took %v", elapsed)
+	}
+	if n := len(tr.Events()); n != 3 {
+		t.Errorf("Expected 3 transmissions, got %v", n)
+	}
+}
+
+func TestExponentialBackoff(t *testing.T) {
+	tests := []struct {
+		name string
+		b    ExponentialBackoff
+		exp  []time.Duration
+	}{
+		{"defaults", ExponentialBackoff{Initial: time.Second},
+			[]time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second}},
+		{"lan", ExponentialBackoff{Initial: 100 * time.Millisecond, Factor: 1.5, MaxAttempts: 3},
+			[]time.Duration{100 * time.Millisecond, 150 * time.Millisecond, 225 * time.Millisecond}},
+		{"capped", ExponentialBackoff{Initial: 10 * time.Second, Max: 30 * time.Second, MaxAttempts: 4},
+			[]time.Duration{10 * time.Second, 20 * time.Second, 30 * time.Second, 30 * time.Second}},
+	}
+	for _, test := range tests {
+		var got []time.Duration
+		var d time.Duration
+		for n := 0; ; n++ {
+			var ok bool
+			if d, ok = test.b.NextTimeout(n, d); !ok {
+				break
+			}
+			got = append(got, d)
+		}
+		if !reflect.DeepEqual(got, test.exp) {
+			t.Errorf("%v: expected %v, got %v", test.name, test.exp, got)
+		}
+	}
+
+	b := ExponentialBackoff{Initial: time.Second, Jitter: 0.5}
+	for i := 0; i < 10; i++ {
+		if d, _ := b.NextTimeout(0, 0); d < time.Second || d > 1500*time.Millisecond {
+			t.Errorf("Expected a timeout from 1s to 1.5s, got %v", d)
+		}
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	retry := ExponentialBackoff{Initial: 5 * time.Millisecond, Factor: 1, MaxAttempts: 5}
+
+	l, addr, _ := pingServer(t, true)
+	defer l.Close()
+	tr := &Tracer{}
+	d := Dialer{Tracer: tr, Params: TransmissionParams{Retry: retry}}
+	c, err := d.Dial("udp", addr)
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	defer c.Close()
+	if _, err := c.Send(Message{Type: Confirmable, MessageID: 1}); err != ErrTimeout {
+		t.Fatalf("Expected ErrTimeout, got %v", err)
+	}
+	if n := len(tr.Events()); n != 5 {
+		t.Errorf("Expected 5 client transmissions, got %v", n)
+	}
+
+	sl, saddr := startUDPLisenter(t)
+	defer sl.Close()
+	a, _ := net.ResolveUDPAddr("udp", saddr)
+	str := &Tracer{}
+	m := Message{Type: Confirmable, Code: Content, MessageID: 5}
+	if _, err := transmitConfirmable(sl, a, m, TransmissionParams{Retry: retry}, telemetry{tracer: str}, nil); err != ErrRetransmitTimeout {
+		t.Fatalf("Expected ErrRetransmitTimeout, got %v", err)
+	}
+	if n := len(str.Events()); n != 5 {
+		t.Errorf("Expected 5 server transmissions, got %v", n)
+	}
+}
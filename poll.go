@@ -0,0 +1,140 @@
+package coap
+
+import (
+	"bytes"
+	"sync"
+	"time"
+)
+
+// minPollInterval keeps a Max-Age of zero from polling in a busy loop.
+const minPollInterval = time.Second
+
+// A Poller fetches a resource periodically, for servers that don't
+// support Observe.  It's made by Poll.
+type Poller struct {
+	// C delivers the first response and every one that differs
+	// from the previous.  It's closed by Stop.
+	C <-chan Message
+
+	c        *Conn
+	path     string
+	interval time.Duration
+	ch       chan Message
+	stop     chan struct{}
+	once     sync.Once
+
+	mu  sync.Mutex
+	err error
+}
+
+// Poll fetches the resource at path every interval, or, if interval
+// is zero, whenever the previous response's Max-Age runs out.  The
+// ETag of the last response is sent along, so an unchanged resource
+// is confirmed with 2.03 Valid instead of being transferred again.
+func (c *Conn) Poll(path string, interval time.Duration) *Poller {
+	ch := make(chan Message)
+	p := &Poller{
+		C:        ch,
+		c:        c,
+		path:     path,
+		interval: interval,
+		ch:       ch,
+		stop:     make(chan struct{}),
+	}
+	go p.run()
+	return p
+}
+
+// Err returns the error of the last poll that failed, if the one
+// after it didn't succeed yet.
+func (p *Poller) Err() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+// Stop ends the polling and closes C.
+func (p *Poller) Stop() {
+	p.once.Do(func() { close(p.stop) })
+}
+
+func (p *Poller) run() {
+	defer close(p.ch)
+
+	var last *Message
+	for {
+		rv, err := p.fetch(last)
+		p.mu.Lock()
+		p.err = err
+		p.mu.Unlock()
+
+		wait := p.interval
+		if err == nil {
+			if changed(last, *rv) {
+				last = rv
+				select {
+				case p.ch <- *rv:
+				case <-p.stop:
+					return
+				}
+			}
+			if wait == 0 {
+				wait = maxAge(*rv)
+			}
+		}
+		if wait < minPollInterval && p.interval == 0 {
+			wait = minPollInterval
+		}
+
+		t := time.NewTimer(wait)
+		select {
+		case <-t.C:
+		case <-p.stop:
+			t.Stop()
+			return
+		}
+	}
+}
+
+// fetch gets the resource, validating the representation in last.
+// A 2.03 Valid response comes back as last, with the new Max-Age.
+func (p *Poller) fetch(last *Message) (*Message, error) {
+	req := Message{
+		Type:      Confirmable,
+		Code:      GET,
+		MessageID: p.c.nextMessageID(),
+		Token:     p.c.session.NextToken(),
+	}
+	req.SetPathString(p.path)
+	if last != nil {
+		if etag := last.Option(ETag); etag != nil {
+			req.SetOption(ETag, etag)
+		}
+	}
+
+	rv, err := p.c.Send(req)
+	if err != nil {
+		return nil, err
+	}
+	if rv.Code == Valid && last != nil {
+		m := *last
+		m.RemoveOption(MaxAge)
+		if v := rv.Option(MaxAge); v != nil {
+			m.SetOption(MaxAge, v)
+		}
+		return &m, nil
+	}
+	return rv, nil
+}
+
+// changed tells whether rv is a different representation than last.
+func changed(last *Message, rv Message) bool {
+	if last == nil || last.Code != rv.Code {
+		return true
+	}
+	etag, ok := rv.Option(ETag).([]byte)
+	if old, ok2 := last.Option(ETag).([]byte); ok && ok2 {
+		return !bytes.Equal(etag, old)
+	}
+	return !bytes.Equal(rv.Payload, last.Payload)
+}
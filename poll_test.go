@@ -0,0 +1,78 @@
+package coap
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPoll(t *testing.T) {
+	var mu sync.Mutex
+	version := 0
+	etag := func() []byte {
+		return []byte{byte(version)}
+	}
+	var valid int
+
+	l, addr := startUDPLisenter(t)
+	defer l.Close()
+	go Serve(l, FuncHandler(func(l *net.UDPConn, a *net.UDPAddr, m *Message) *Message {
+		mu.Lock()
+		defer mu.Unlock()
+		rv := &Message{
+			Type:      Acknowledgement,
+			MessageID: m.MessageID,
+			Token:     m.Token,
+		}
+		rv.SetOption(ETag, etag())
+		if tag, _ := m.Option(ETag).([]byte); bytes.Equal(tag, etag()) {
+			valid++
+			rv.Code = Valid
+			return rv
+		}
+		rv.Code = Content
+		rv.Payload = []byte{'v', '0' + byte(version)}
+		return rv
+	}))
+
+	c, err := Dial("udp", addr)
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	defer c.Close()
+
+	p := c.Poll("/state", 10*time.Millisecond)
+	next := func() Message {
+		select {
+		case m := <-p.C:
+			return m
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out waiting for a change")
+		}
+		panic("unreachable")
+	}
+
+	if m := next(); string(m.Payload) != "v0" {
+		t.Errorf("Expected v0 first, got %v (%s)", m, m.Payload)
+	}
+	time.Sleep(50 * time.Millisecond)
+	mu.Lock()
+	version = 1
+	n := valid
+	mu.Unlock()
+	if n == 0 {
+		t.Errorf("Expected the unchanged resource to be validated")
+	}
+	if m := next(); string(m.Payload) != "v1" {
+		t.Errorf("Expected v1 after the change, got %v (%s)", m, m.Payload)
+	}
+
+	p.Stop()
+	for range p.C {
+	}
+	if err := p.Err(); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,227 @@
+package coap
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ProxyFromEnvironment picks the proxy for reaching the endpoint of a
+// stream URL from the environment: HTTPS_PROXY for coaps+ URLs,
+// HTTP_PROXY for the others, and ALL_PROXY for both, except for hosts
+// matched by NO_PROXY.  Lowercase versions of the variables are used
+// too.
+func ProxyFromEnvironment(u *url.URL) (*url.URL, error) {
+	req := &http.Request{URL: &url.URL{Scheme: "http", Host: u.Host}}
+	if strings.HasPrefix(u.Scheme, "coaps") {
+		req.URL.Scheme = "https"
+	}
+	pu, err := http.ProxyFromEnvironment(req)
+	if pu != nil || err != nil {
+		return pu, err
+	}
+
+	all := getenv("ALL_PROXY")
+	if all == "" || noProxy(u.Hostname()) {
+		return nil, nil
+	}
+	return url.Parse(all)
+}
+
+func getenv(name string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return os.Getenv(strings.ToLower(name))
+}
+
+// noProxy reports whether NO_PROXY exempts host from proxying.
+func noProxy(host string) bool {
+	for _, p := range strings.Split(getenv("NO_PROXY"), ",") {
+		p = strings.TrimPrefix(strings.TrimSpace(p), ".")
+		if p == "*" || p != "" &&
+			(host == p || strings.HasSuffix(host, "."+p)) {
+			return true
+		}
+	}
+	return false
+}
+
+// DialProxy connects to addr through the proxy at proxy, which may be
+// an HTTP proxy supporting CONNECT (http://) or a SOCKS5 proxy
+// (socks5:// resolving addr locally, socks5h:// letting the proxy do
+// it).  User information in the URL is used to authenticate.
+func DialProxy(proxy *url.URL, addr string) (net.Conn, error) {
+	var port int
+	switch proxy.Scheme {
+	case "http", "":
+		port = 80
+	case "socks5", "socks5h":
+		port = 1080
+	default:
+		return nil, fmt.Errorf("coap: unsupported proxy scheme %q", proxy.Scheme)
+	}
+
+	nc, err := net.Dial("tcp", HostPort(proxy, port))
+	if err != nil {
+		return nil, err
+	}
+	if port == 80 {
+		nc, err = httpConnect(nc, proxy.User, addr)
+	} else {
+		err = socks5Connect(nc, proxy.User, addr, proxy.Scheme == "socks5h")
+	}
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	return nc, nil
+}
+
+// httpConnect asks the HTTP proxy at the other end of nc for a tunnel
+// to addr, and returns the tunnel's connection.
+func httpConnect(nc net.Conn, user *url.Userinfo, addr string) (net.Conn, error) {
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if user != nil {
+		pw, _ := user.Password()
+		auth := user.Username() + ":" + pw
+		req.Header.Set("Proxy-Authorization",
+			"Basic "+base64.StdEncoding.EncodeToString([]byte(auth)))
+	}
+	if err := req.Write(nc); err != nil {
+		return nc, err
+	}
+
+	br := bufio.NewReader(nc)
+	res, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nc, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return nc, fmt.Errorf("coap: proxy refused tunnel: %v", res.Status)
+	}
+	if br.Buffered() > 0 {
+		// The tunnel starts right after the response, and the
+		// server may have sent in it already.
+		return &bufferedConn{nc, br}, nil
+	}
+	return nc, nil
+}
+
+// A bufferedConn is a net.Conn whose reads start with what was
+// buffered reading from it before.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+var errSOCKS = errors.New("coap: SOCKS5 proxy error")
+
+func socks5Connect(nc net.Conn, user *url.Userinfo, addr string, remoteDNS bool) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return err
+	}
+
+	// Method negotiation (RFC 1928 section 3).
+	methods := []byte{0x00}
+	if user != nil {
+		methods = []byte{0x02}
+	}
+	if _, err := nc.Write(append([]byte{5, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(nc, buf); err != nil {
+		return err
+	}
+	if buf[0] != 5 || buf[1] != methods[0] {
+		return errSOCKS
+	}
+
+	if user != nil {
+		// Username/password authentication (RFC 1929).
+		pw, _ := user.Password()
+		auth := []byte{1, byte(len(user.Username()))}
+		auth = append(auth, user.Username()...)
+		auth = append(auth, byte(len(pw)))
+		auth = append(auth, pw...)
+		if _, err := nc.Write(auth); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(nc, buf); err != nil {
+			return err
+		}
+		if buf[1] != 0 {
+			return errors.New("coap: SOCKS5 authentication failed")
+		}
+	}
+
+	req := []byte{5, 1, 0}
+	ip := net.ParseIP(host)
+	if ip == nil && !remoteDNS {
+		ips, err := net.LookupIP(host)
+		if err != nil {
+			return err
+		}
+		ip = ips[0]
+	}
+	switch {
+	case ip == nil:
+		req = append(append(req, 3, byte(len(host))), host...)
+	case ip.To4() != nil:
+		req = append(append(req, 1), ip.To4()...)
+	default:
+		req = append(append(req, 4), ip.To16()...)
+	}
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	if _, err := nc.Write(req); err != nil {
+		return err
+	}
+
+	rep := make([]byte, 4)
+	if _, err := io.ReadFull(nc, rep); err != nil {
+		return err
+	}
+	if rep[0] != 5 || rep[1] != 0 {
+		return fmt.Errorf("coap: SOCKS5 connect failed with code %d", rep[1])
+	}
+	var skip int
+	switch rep[3] {
+	case 1:
+		skip = 4
+	case 4:
+		skip = 16
+	case 3:
+		if _, err := io.ReadFull(nc, rep[:1]); err != nil {
+			return err
+		}
+		skip = int(rep[0])
+	default:
+		return errSOCKS
+	}
+	_, err = io.ReadFull(nc, make([]byte, skip+2))
+	return err
+}
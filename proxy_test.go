@@ -0,0 +1,147 @@
+package coap
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+// listen runs serve for every connection accepted on a local port.
+func listen(t *testing.T, serve func(net.Conn)) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serve(c)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func echoServer(c net.Conn) {
+	io.Copy(c, c)
+	c.Close()
+}
+
+func tunnel(down net.Conn, addr string) {
+	up, err := net.Dial("tcp", addr)
+	if err != nil {
+		down.Close()
+		return
+	}
+	go func() {
+		io.Copy(up, down)
+		up.Close()
+	}()
+	io.Copy(down, up)
+	down.Close()
+}
+
+// socksServer accepts user:pw and IPv4 connect requests.
+func socksServer(c net.Conn) {
+	buf := make([]byte, 512)
+	io.ReadFull(c, buf[:3]) // 5 1 2
+	c.Write([]byte{5, 2})
+	readString := func() string {
+		io.ReadFull(c, buf[:1])
+		io.ReadFull(c, buf[1:1+buf[0]])
+		return string(buf[1 : 1+buf[0]])
+	}
+	io.ReadFull(c, buf[:1]) // version
+	user, pw := readString(), readString()
+	if user != "user" || pw != "pw" {
+		c.Write([]byte{1, 1})
+		c.Close()
+		return
+	}
+	c.Write([]byte{1, 0})
+
+	io.ReadFull(c, buf[:10])
+	ip := net.IP(buf[4:8])
+	port := int(buf[8])<<8 | int(buf[9])
+	c.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	tunnel(c, (&net.TCPAddr{IP: ip, Port: port}).String())
+}
+
+func connectServer(c net.Conn) {
+	req, err := http.ReadRequest(bufio.NewReader(c))
+	if err != nil || req.Method != "CONNECT" {
+		c.Close()
+		return
+	}
+	io.WriteString(c, "HTTP/1.1 200 Connection established\r\n\r\n")
+	tunnel(c, req.Host)
+}
+
+func TestDialProxy(t *testing.T) {
+	target := listen(t, echoServer)
+	tests := []string{
+		"socks5://user:pw@" + listen(t, socksServer),
+		"http://" + listen(t, connectServer),
+	}
+
+	for _, test := range tests {
+		pu, _ := url.Parse(test)
+		c, err := DialProxy(pu, target)
+		if err != nil {
+			t.Fatalf("Error dialing through %v: %v", test, err)
+		}
+		c.Write([]byte("hi"))
+		buf := make([]byte, 2)
+		if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "hi" {
+			t.Errorf("Expected echo through %v, got %q, %v", test, buf, err)
+		}
+		c.Close()
+	}
+
+	pu, _ := url.Parse("socks5://user:wrong@" + listen(t, socksServer))
+	if _, err := DialProxy(pu, target); err == nil {
+		t.Errorf("Expected SOCKS5 authentication to fail")
+	}
+}
+
+func TestDialProxyEagerTunnel(t *testing.T) {
+	// The tunneled server speaks first, in the same segment as the
+	// proxy's response, like a CoAP over TCP server sending its CSM.
+	addr := listen(t, func(c net.Conn) {
+		http.ReadRequest(bufio.NewReader(c))
+		io.WriteString(c, "HTTP/1.1 200 Connection established\r\n\r\nhello")
+		c.Close()
+	})
+	pu, _ := url.Parse("http://" + addr)
+	c, err := DialProxy(pu, "example.com:5683")
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	defer c.Close()
+	b, err := io.ReadAll(c)
+	if err != nil || string(b) != "hello" {
+		t.Errorf("Expected what the server sent first, got %q, %v", b, err)
+	}
+}
+
+func TestNoProxy(t *testing.T) {
+	t.Setenv("NO_PROXY", "localhost, .example.com")
+	tests := map[string]bool{
+		"localhost":        true,
+		"a.example.com":    true,
+		"example.com":      true,
+		"badexample.com":   false,
+		"coap.example.org": false,
+	}
+	for host, exp := range tests {
+		if got := noProxy(host); got != exp {
+			t.Errorf("noProxy(%q) = %v, expected %v", host, got, exp)
+		}
+	}
+}
@@ -0,0 +1,297 @@
+package coap
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A LookupQuery selects and pages the results of a Resource Directory
+// lookup (RFC 9176 section 7).
+type LookupQuery struct {
+	// Filters restrict the results to those with matching
+	// attributes, such as "ep", "d" or "rt".  A value ending in
+	// "*" matches by prefix.
+	Filters map[string]string
+	// Count, if positive, asks for at most Count results, from
+	// page Page (counting from zero) of results Count long.  A
+	// page shorter than Count is the last one.
+	Page, Count int
+}
+
+// An RDEndpoint is a registration found by an endpoint lookup.
+type RDEndpoint struct {
+	// Target is the registration resource.
+	Target string
+	// Name and Sector are the endpoint's "ep" and "d".
+	Name, Sector string
+	// Base is the base URI of the endpoint's links.
+	Base string
+	// Lifetime is how long the registration lasts without an
+	// update, zero if the directory didn't say.
+	Lifetime time.Duration
+	// Params has all the link's attributes.
+	Params map[string]string
+}
+
+// An RDGroup is a group found by a group lookup.
+type RDGroup struct {
+	// Target is the group resource.
+	Target string
+	// Name and Sector are the group's "gp" and "d".
+	Name, Sector string
+	// Base is the group's multicast address, if it has one.
+	Base string
+	// Params has all the link's attributes.
+	Params map[string]string
+}
+
+// LookupEndpoints runs an endpoint lookup on the directory's lookup
+// resource at path, typically /rd-lookup/ep.
+func (c *Conn) LookupEndpoints(path string, q LookupQuery) ([]RDEndpoint, error) {
+	links, err := c.lookup(path, q)
+	if err != nil {
+		return nil, err
+	}
+	rv := make([]RDEndpoint, 0, len(links))
+	for _, l := range links {
+		e := RDEndpoint{
+			Target: l.Target,
+			Name:   l.Params["ep"],
+			Sector: l.Params["d"],
+			Base:   l.Params["base"],
+			Params: l.Params,
+		}
+		if lt, err := strconv.ParseUint(l.Params["lt"], 10, 32); err == nil {
+			e.Lifetime = time.Duration(lt) * time.Second
+		}
+		rv = append(rv, e)
+	}
+	return rv, nil
+}
+
+// LookupResources runs a resource lookup on the directory's lookup
+// resource at path, typically /rd-lookup/res.  The links are those
+// registered, with the registering endpoint in their "anchor".
+func (c *Conn) LookupResources(path string, q LookupQuery) ([]Link, error) {
+	return c.lookup(path, q)
+}
+
+// LookupGroups runs a group lookup on the directory's lookup resource
+// at path, typically /rd-lookup/gp.
+func (c *Conn) LookupGroups(path string, q LookupQuery) ([]RDGroup, error) {
+	links, err := c.lookup(path, q)
+	if err != nil {
+		return nil, err
+	}
+	rv := make([]RDGroup, 0, len(links))
+	for _, l := range links {
+		rv = append(rv, RDGroup{
+			Target: l.Target,
+			Name:   l.Params["gp"],
+			Sector: l.Params["d"],
+			Base:   l.Params["base"],
+			Params: l.Params,
+		})
+	}
+	return rv, nil
+}
+
+func (c *Conn) lookup(path string, q LookupQuery) ([]Link, error) {
+	req := Message{
+		Type:      Confirmable,
+		Code:      GET,
+		MessageID: c.nextMessageID(),
+		Token:     c.session.NextToken(),
+	}
+	req.SetPathString(path)
+	req.SetOption(Accept, AppLinkFormat)
+
+	names := make([]string, 0, len(q.Filters))
+	for k := range q.Filters {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		req.AddOption(URIQuery, k+"="+q.Filters[k])
+	}
+	if q.Count > 0 {
+		req.AddOption(URIQuery, "page="+strconv.Itoa(q.Page))
+		req.AddOption(URIQuery, "count="+strconv.Itoa(q.Count))
+	}
+
+	rv, err := c.Send(req)
+	if err != nil {
+		return nil, err
+	}
+	if rv.Code != Content {
+		return nil, fmt.Errorf("coap: lookup of %v: %v", path, rv.Code)
+	}
+	return ParseLinks(string(rv.Payload))
+}
+
+// DefaultRDLifetime is how long a Resource Directory keeps a
+// registration that doesn't state its lifetime (RFC 9176 section
+// 5.3).
+const DefaultRDLifetime = 90000 * time.Second
+
+// An RDRegistration is this node's registration with a Resource
+// Directory.  It's updated whenever three quarters of its lifetime
+// have passed, and registered again if the directory lost it, until
+// it's removed.  It's made by Register.
+type RDRegistration struct {
+	c     *Conn
+	path  string
+	ep    RDEndpoint
+	links []Link
+	stop  chan struct{}
+	done  chan struct{}
+	once  sync.Once
+
+	mu       sync.Mutex
+	location string
+	err      error
+}
+
+// Register registers links with the Resource Directory's
+// registration resource at path, typically /rd.  The endpoint's
+// Name, and its Sector, Base and Lifetime if set, are sent as the
+// "ep", "d", "base" and "lt" parameters, and Params as further ones.
+func (c *Conn) Register(path string, ep RDEndpoint, links []Link) (*RDRegistration, error) {
+	r := &RDRegistration{
+		c:     c,
+		path:  path,
+		ep:    ep,
+		links: links,
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	if err := r.register(); err != nil {
+		return nil, err
+	}
+	go r.run()
+	return r, nil
+}
+
+// Location returns the registration resource the directory created.
+func (r *RDRegistration) Location() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.location
+}
+
+// Err returns the error of the last update that failed, if the one
+// after it didn't succeed yet.
+func (r *RDRegistration) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
+}
+
+// Remove stops updating the registration and deletes it from the
+// directory.
+func (r *RDRegistration) Remove() error {
+	r.once.Do(func() { close(r.stop) })
+	<-r.done
+
+	rv, err := r.c.Send(r.request(DELETE, r.Location()))
+	if err != nil {
+		return err
+	}
+	if rv.Code != Deleted && rv.Code != NotFound {
+		return fmt.Errorf("coap: removal of %v: %v", r.Location(), rv.Code)
+	}
+	return nil
+}
+
+func (r *RDRegistration) run() {
+	defer close(r.done)
+
+	lifetime := r.ep.Lifetime
+	if lifetime == 0 {
+		lifetime = DefaultRDLifetime
+	}
+	for {
+		t := time.NewTimer(lifetime * 3 / 4)
+		select {
+		case <-t.C:
+		case <-r.stop:
+			t.Stop()
+			return
+		}
+
+		err := r.update()
+		r.mu.Lock()
+		r.err = err
+		r.mu.Unlock()
+	}
+}
+
+// register sends the registration, remembering its location.
+func (r *RDRegistration) register() error {
+	req := r.request(POST, r.path)
+	if r.ep.Name != "" {
+		req.AddOption(URIQuery, "ep="+r.ep.Name)
+	}
+	if r.ep.Sector != "" {
+		req.AddOption(URIQuery, "d="+r.ep.Sector)
+	}
+	if r.ep.Base != "" {
+		req.AddOption(URIQuery, "base="+r.ep.Base)
+	}
+	if r.ep.Lifetime > 0 {
+		req.AddOption(URIQuery, "lt="+strconv.Itoa(int(r.ep.Lifetime/time.Second)))
+	}
+	names := make([]string, 0, len(r.ep.Params))
+	for k := range r.ep.Params {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		req.AddOption(URIQuery, k+"="+r.ep.Params[k])
+	}
+	req.SetOption(ContentFormat, AppLinkFormat)
+	req.Payload = []byte(FormatLinks(r.links))
+
+	rv, err := r.c.Send(req)
+	if err != nil {
+		return err
+	}
+	if rv.Code != Created {
+		return fmt.Errorf("coap: registration with %v: %v", r.path, rv.Code)
+	}
+	r.mu.Lock()
+	r.location = "/" + strings.Join(rv.optionStrings(LocationPath), "/")
+	r.mu.Unlock()
+	return nil
+}
+
+// update renews the registration, registering again if the
+// directory doesn't know it anymore.
+func (r *RDRegistration) update() error {
+	rv, err := r.c.Send(r.request(POST, r.Location()))
+	if err != nil {
+		return err
+	}
+	switch rv.Code {
+	case Changed:
+		return nil
+	case NotFound:
+		return r.register()
+	}
+	return fmt.Errorf("coap: update of %v: %v", r.Location(), rv.Code)
+}
+
+func (r *RDRegistration) request(code COAPCode, path string) Message {
+	req := Message{
+		Type:      Confirmable,
+		Code:      code,
+		MessageID: r.c.nextMessageID(),
+		Token:     r.c.session.NextToken(),
+	}
+	req.SetPathString(path)
+	return req
+}
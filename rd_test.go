@@ -0,0 +1,143 @@
+package coap
+
+import (
+	"net"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestLookupEndpoints(t *testing.T) {
+	l, addr := startUDPLisenter(t)
+	defer l.Close()
+	queries := make(chan []string, 1)
+	go Serve(l, FuncHandler(func(l *net.UDPConn, a *net.UDPAddr, m *Message) *Message {
+		queries <- m.optionStrings(URIQuery)
+		rv := &Message{
+			Type:      Acknowledgement,
+			Code:      Content,
+			MessageID: m.MessageID,
+			Token:     m.Token,
+			Payload:   []byte(`</rd/4521>;ep=node1;d=floor2;base="coap://[2001:db8::1]";lt=600`),
+		}
+		if m.PathString() != "rd-lookup/ep" {
+			rv.Code = NotFound
+			rv.Payload = nil
+		}
+		return rv
+	}))
+
+	c, err := Dial("udp", addr)
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	defer c.Close()
+
+	eps, err := c.LookupEndpoints("/rd-lookup/ep", LookupQuery{
+		Filters: map[string]string{"d": "floor2", "ep": "node*"},
+		Page:    2,
+		Count:   10,
+	})
+	if err != nil {
+		t.Fatalf("Error looking up: %v", err)
+	}
+	if q, exp := <-queries, []string{"d=floor2", "ep=node*", "page=2", "count=10"}; !reflect.DeepEqual(q, exp) {
+		t.Errorf("Expected query %q, got %q", exp, q)
+	}
+	if len(eps) != 1 {
+		t.Fatalf("Expected one endpoint, got %v", eps)
+	}
+	e := eps[0]
+	if e.Target != "/rd/4521" || e.Name != "node1" || e.Sector != "floor2" ||
+		e.Base != "coap://[2001:db8::1]" || e.Lifetime != 10*time.Minute {
+		t.Errorf("Unexpected endpoint: %+v", e)
+	}
+
+	if _, err := c.LookupGroups("/rd-lookup/gp", LookupQuery{}); err == nil {
+		t.Errorf("Expected an error for a 4.04 response")
+	}
+	<-queries
+}
+
+func TestRegister(t *testing.T) {
+	l, addr := startUDPLisenter(t)
+	defer l.Close()
+	type call struct {
+		code    COAPCode
+		path    string
+		query   []string
+		payload string
+	}
+	calls := make(chan call, 10)
+	registrations := 0
+	go Serve(l, FuncHandler(func(l *net.UDPConn, a *net.UDPAddr, m *Message) *Message {
+		calls <- call{m.Code, m.PathString(), m.optionStrings(URIQuery), string(m.Payload)}
+		rv := &Message{
+			Type:      Acknowledgement,
+			MessageID: m.MessageID,
+			Token:     m.Token,
+		}
+		switch {
+		case m.Code == POST && m.PathString() == "rd":
+			registrations++
+			rv.Code = Created
+			rv.AddOption(LocationPath, "rd")
+			rv.AddOption(LocationPath, strconv.Itoa(4520+registrations))
+		case m.Code == POST && m.PathString() == "rd/4522":
+			rv.Code = Changed
+		case m.Code == DELETE:
+			rv.Code = Deleted
+		default:
+			// The directory forgot the first registration.
+			rv.Code = NotFound
+		}
+		return rv
+	}))
+
+	c, err := Dial("udp", addr)
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	defer c.Close()
+
+	reg, err := c.Register("/rd", RDEndpoint{
+		Name:     "node1",
+		Sector:   "floor2",
+		Lifetime: time.Second,
+		Params:   map[string]string{"et": "oic.d.sensor"},
+	}, []Link{{"/temp", map[string]string{"rt": "temperature-c"}}})
+	if err != nil {
+		t.Fatalf("Error registering: %v", err)
+	}
+	if reg.Location() != "/rd/4521" {
+		t.Errorf("Unexpected location %q", reg.Location())
+	}
+
+	exp := []call{
+		{POST, "rd", []string{"ep=node1", "d=floor2", "lt=1", "et=oic.d.sensor"}, `</temp>;rt="temperature-c"`},
+		{POST, "rd/4521", nil, ""},
+		{POST, "rd", []string{"ep=node1", "d=floor2", "lt=1", "et=oic.d.sensor"}, `</temp>;rt="temperature-c"`},
+		{POST, "rd/4522", nil, ""},
+	}
+	for i, e := range exp {
+		select {
+		case got := <-calls:
+			if !reflect.DeepEqual(got, e) {
+				t.Errorf("Request %v: expected %+v, got %+v", i, e, got)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Request %v never arrived", i)
+		}
+	}
+	if reg.Location() != "/rd/4522" || reg.Err() != nil {
+		t.Errorf("Unexpected state after updates: %q, %v", reg.Location(), reg.Err())
+	}
+
+	if err := reg.Remove(); err != nil {
+		t.Fatalf("Error removing: %v", err)
+	}
+	if got := <-calls; got.code != DELETE || got.path != "rd/4522" {
+		t.Errorf("Expected DELETE of rd/4522, got %+v", got)
+	}
+}
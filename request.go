@@ -0,0 +1,235 @@
+package coap
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A Request is a request being served, through which the handler
+// answers it, possibly after ServeRequest returned.
+//
+// By default the response is piggybacked on the ACK of a confirmable
+// request.  A handler that needs time to come up with the response
+// calls Ack first; Respond then sends the response separately as a
+// confirmable message, retransmitting it until the client
+// acknowledges it.
+type Request struct {
+	// Msg is the request message.
+	Msg *Message
+	// Addr is the client's address.
+	Addr *net.UDPAddr
+	// Group is the multicast group the request was sent to, or
+	// nil if it was sent to the server directly.
+	Group net.IP
+
+	l packetConn
+	s *Server
+	// session, if not nil, is the state shared with the client,
+	// for transports that keep one.
+	session *Session
+	// respond, if not nil, takes the response in place of the
+	// server, for requests served through ServeCOAP.
+	respond func(m Message) error
+	// start is when the request arrived.
+	start time.Time
+
+	// onResponse, if not nil, is called with the response code
+	// when the response is sent.
+	onResponse func(COAPCode)
+	// block1 is the last Block1 option of a request received
+	// blockwise, echoed in the response.
+	block1 *BlockOption
+	// params are the values of the named parameters of the
+	// ServeMux pattern that matched.
+	params map[string]string
+
+	mu        sync.Mutex
+	acked     bool
+	responded bool
+}
+
+// ErrResponded is returned by Request.Respond when a response was
+// sent already.
+var ErrResponded = errors.New("response already sent")
+
+// ErrNoTransport is returned by Request.Respond and Ack when there's
+// no connection to send on, such as for a request served through
+// ServeCOAP that's answered after the handler returned.
+var ErrNoTransport = errors.New("coap: no connection to respond on")
+
+// RequestHandler is implemented by handlers that respond through a
+// Request.  ServeMux and the handlers made by RequestFunc implement
+// it.
+type RequestHandler interface {
+	ServeRequest(r *Request)
+}
+
+// standaloneIDs provides the Message IDs of non-confirmable responses
+// to requests served outside a Server.
+var standaloneIDs MessageIDAllocator
+
+type requestFunc func(r *Request)
+
+func (f requestFunc) ServeRequest(r *Request) {
+	f(r)
+}
+
+// ServeCOAP returns the response f gives before returning, for the
+// caller to send on its own connection.
+func (f requestFunc) ServeCOAP(l *net.UDPConn, a *net.UDPAddr, m *Message) *Message {
+	var mu sync.Mutex
+	var rv *Message
+	returned := false
+	f(&Request{Msg: m, Addr: a, respond: func(m Message) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if returned {
+			return ErrNoTransport
+		}
+		rv = &m
+		return nil
+	}})
+	mu.Lock()
+	defer mu.Unlock()
+	returned = true
+	return rv
+}
+
+// RequestFunc builds a handler that responds through a Request from
+// a function.
+//
+// Served through ServeCOAP, by callers that don't know about
+// Requests, the function must respond before it returns: the response
+// is what ServeCOAP returns, and the caller sends it.  Later ones fail
+// with ErrNoTransport.
+func RequestFunc(f func(r *Request)) Handler {
+	return requestFunc(f)
+}
+
+// PathParam returns the value of the named parameter of the
+// ServeMux pattern the request's path matched, such as "id" for
+// "/devices/{id}/state", or "" if there's none.
+func (r *Request) PathParam(name string) string {
+	return r.params[name]
+}
+
+// Identity returns the client's authenticated identity, such as the
+// subject of the certificate it was verified by over DTLS, or "" if
+// it's not known.
+func (r *Request) Identity() string {
+	if r.session == nil {
+		return ""
+	}
+	return r.session.Identity()
+}
+
+// Ack acknowledges a confirmable request with an empty ACK, making
+// the response a separate one.  It does nothing for non-confirmable
+// requests, or once the request was acknowledged, whether by Ack or
+// by a piggybacked response.
+func (r *Request) Ack() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.Msg.IsConfirmable() || r.acked || r.responded {
+		return nil
+	}
+	if r.respond != nil {
+		// Whoever sends the response knows whether to
+		// piggyback it.
+		return nil
+	}
+	if r.s == nil || r.l == nil {
+		return ErrNoTransport
+	}
+	r.acked = true
+	// Shutdown waits for the separate response.
+	atomic.AddInt64(&r.s.active, 1)
+
+	// Sent under the lock, so a racing Respond can't piggyback
+	// on an ACK of its own.
+	return r.s.transmit(r.l, r.Addr, Message{
+		Type:      Acknowledgement,
+		MessageID: r.Msg.MessageID,
+	})
+}
+
+// Respond sends m as the response, filling in its type, Message ID
+// and token.  For a separate response it blocks until the client
+// acknowledged it, returning ErrRetransmitTimeout if it never did.
+//
+// Only the first call sends anything; later ones return
+// ErrResponded.
+func (r *Request) Respond(m Message) error {
+	m.Token = r.Msg.Token
+	switch {
+	case !r.Msg.IsConfirmable():
+		m.Type = NonConfirmable
+		var err error
+		if r.s != nil {
+			m.MessageID, err = r.s.nextMessageID(r.Addr)
+		} else {
+			m.MessageID, err = standaloneIDs.Next(nil)
+		}
+		if err != nil {
+			return err
+		}
+	default:
+		// Decided by send, which knows whether the request
+		// is acknowledged by then.
+		m.Type = Acknowledgement
+		m.MessageID = r.Msg.MessageID
+	}
+	return r.send(m)
+}
+
+// send transmits the response m as it is, unless the request was
+// acknowledged already and m needs to be sent separately, or a
+// non-confirmable request's No-Response option suppresses it.
+func (r *Request) send(m Message) error {
+	r.mu.Lock()
+	if r.responded {
+		r.mu.Unlock()
+		return ErrResponded
+	}
+	r.responded = true
+	if r.acked && r.s != nil {
+		defer atomic.AddInt64(&r.s.active, -1)
+	}
+	if r.onResponse != nil {
+		r.onResponse(m.Code)
+	}
+	if !r.Msg.IsConfirmable() && r.Msg.suppressed(m.Code) {
+		r.mu.Unlock()
+		return nil
+	}
+	if r.respond != nil {
+		r.mu.Unlock()
+		return r.respond(m)
+	}
+	if r.s == nil || r.l == nil {
+		r.mu.Unlock()
+		return ErrNoTransport
+	}
+	if r.block1 != nil {
+		m.SetBlock1(*r.block1)
+	}
+	if isRequest(r.Msg.Code) {
+		r.s.sendBlock2(r, &m)
+	}
+	if r.Group != nil {
+		r.mu.Unlock()
+		return r.s.respondToGroup(r, m)
+	}
+	if !r.acked {
+		// Hold the lock while the response goes out, so a
+		// racing Ack doesn't send an empty ACK as well.
+		defer r.mu.Unlock()
+		r.s.telemetry().response(m, r.Addr, r.start)
+		return r.s.transmit(r.l, r.Addr, m)
+	}
+	r.mu.Unlock()
+	return r.s.respondSeparately(r, m)
+}
@@ -0,0 +1,220 @@
+package coap
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRequestRespond(t *testing.T) {
+	errs := make(chan error, 2)
+	mux := NewServeMux()
+	mux.Handle("/fast", RequestFunc(func(r *Request) {
+		errs <- r.Respond(Message{Code: Content, Payload: []byte("fast")})
+	}))
+	mux.Handle("/slow", RequestFunc(func(r *Request) {
+		if err := r.Ack(); err != nil {
+			errs <- err
+			return
+		}
+		go func() {
+			errs <- r.Respond(Message{Code: Content, Payload: []byte("slow")})
+		}()
+	}))
+
+	l, addr := startUDPLisenter(t)
+	defer l.Close()
+	go Serve(l, mux)
+
+	tests := []struct {
+		path string
+		typ  COAPType
+		same bool
+	}{
+		{"/fast", Acknowledgement, true},
+		{"/slow", Confirmable, false},
+	}
+
+	for _, test := range tests {
+		req := Message{Type: Confirmable, Code: GET, MessageID: 321, Token: []byte("t")}
+		req.SetPathString(test.path)
+		m := dialAndSend(t, addr, req)
+		if m.Type != test.typ || (m.MessageID == req.MessageID) != test.same ||
+			string(m.Token) != "t" || "/"+string(m.Payload) != test.path {
+			t.Errorf("Unexpected response to %v: %v", test.path, m)
+		}
+		if err := <-errs; err != nil {
+			t.Errorf("Error responding to %v: %v", test.path, err)
+		}
+	}
+}
+
+func TestRequestRespondOnce(t *testing.T) {
+	var tr Tracer
+	done := make(chan []error, 1)
+	s := &Server{
+		Tracer: &tr,
+		Handler: RequestFunc(func(r *Request) {
+			var errs []error
+			errs = append(errs, r.Respond(Message{Code: Content}))
+			errs = append(errs, r.Ack())
+			errs = append(errs, r.Respond(Message{Code: Content}))
+			done <- errs
+		}),
+	}
+	l, addr := startUDPLisenter(t)
+	defer l.Close()
+	go s.Serve(l)
+
+	dialAndSend(t, addr, Message{Type: Confirmable, Code: GET, MessageID: 11})
+	errs := <-done
+	if errs[0] != nil || errs[1] != nil || errs[2] != ErrResponded {
+		t.Errorf("Expected nil, nil, ErrResponded; got %v", errs)
+	}
+
+	var sent int
+	for _, e := range tr.Events() {
+		if e.Sent {
+			sent++
+		}
+	}
+	if sent != 1 {
+		t.Errorf("Expected a single message sent, got %v", tr.Events())
+	}
+}
+
+func TestRequestNoResponse(t *testing.T) {
+	var tr Tracer
+	done := make(chan error, 1)
+	s := &Server{
+		Tracer: &tr,
+		Handler: RequestFunc(func(r *Request) {
+			code := Content
+			if r.Msg.PathString() == "missing" {
+				code = NotFound
+			}
+			done <- r.Respond(Message{Code: code})
+		}),
+	}
+	l, addr := startUDPLisenter(t)
+	defer l.Close()
+	go s.Serve(l)
+
+	c, err := Dial("udp", addr)
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	defer c.Close()
+
+	tests := []struct {
+		typ  COAPType
+		path string
+		sent bool
+	}{
+		{NonConfirmable, "/found", true},
+		{NonConfirmable, "/missing", false},
+		{Confirmable, "/missing", true},
+	}
+	for i, test := range tests {
+		req := Message{Type: test.typ, Code: GET, MessageID: uint16(i), Token: []byte{byte(i)}}
+		req.SetPathString(test.path)
+		req.SetOption(NoResponse, NoResponseClientError|NoResponseServerError)
+		before := len(tr.Events())
+		if _, err := c.Send(req); err != nil {
+			t.Fatalf("Error sending: %v", err)
+		}
+		if err := <-done; err != nil {
+			t.Errorf("Error responding: %v", err)
+		}
+		var sent bool
+		for _, e := range tr.Events()[before:] {
+			sent = sent || e.Sent
+		}
+		if sent != test.sent {
+			t.Errorf("%v %v: expected sent %v, got %v", test.typ, test.path, test.sent, sent)
+		}
+	}
+}
+
+func TestRequestFuncThroughServeCOAP(t *testing.T) {
+	late := make(chan error, 1)
+	h := RequestFunc(func(r *Request) {
+		if r.Msg.PathString() == "late" {
+			go func() { late <- r.Respond(Message{Code: Content}) }()
+			return
+		}
+		r.Ack()
+		r.Respond(Message{Code: Content, Payload: []byte("now")})
+	})
+
+	req := &Message{Type: Confirmable, Code: GET, MessageID: 5, Token: []byte("t")}
+	req.SetPathString("now")
+	rv := h.ServeCOAP(nil, nil, req)
+	if rv == nil || rv.Type != Acknowledgement || rv.MessageID != 5 ||
+		string(rv.Token) != "t" || string(rv.Payload) != "now" {
+		t.Errorf("Expected the response to be returned, got %v", rv)
+	}
+
+	req.SetPathString("late")
+	if rv := h.ServeCOAP(nil, nil, req); rv != nil {
+		t.Errorf("Expected no response yet, got %v", rv)
+	}
+	if err := <-late; err != ErrNoTransport {
+		t.Errorf("Expected ErrNoTransport responding late, got %v", err)
+	}
+
+	r := &Request{Msg: req}
+	if err := r.Ack(); err != ErrNoTransport {
+		t.Errorf("Expected ErrNoTransport acknowledging without a connection, got %v", err)
+	}
+}
+
+func TestRequestFuncUnderHubSeparate(t *testing.T) {
+	h := NewHub()
+	h.Start()
+	defer h.Stop()
+	s := &Server{
+		Handler: h.Handler(RequestFunc(func(r *Request) {
+			r.Respond(Message{Code: Content, Payload: []byte("x")})
+		})),
+		SeparateResponses: true,
+	}
+	l, addr := startUDPLisenter(t)
+	defer l.Close()
+	go s.Serve(l)
+
+	c, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	defer c.Close()
+	req := Message{Type: Confirmable, Code: GET, MessageID: 9, Token: []byte("t")}
+	req.SetPathString("/a")
+	b, _ := req.MarshalBinary()
+	c.Write(b)
+
+	var acks, responses int
+	buf := make([]byte, DefaultReadBufferSize)
+	for {
+		c.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		n, err := c.Read(buf)
+		if err != nil {
+			break
+		}
+		m, err := ParseMessage(buf[:n])
+		if err != nil {
+			t.Fatalf("Error parsing: %v", err)
+		}
+		switch {
+		case m.Type == Acknowledgement && m.MessageID == 9:
+			acks++
+		case m.Type == Confirmable && m.Code == Content:
+			responses++
+			ack, _ := (&Message{Type: Acknowledgement, MessageID: m.MessageID}).MarshalBinary()
+			c.Write(ack)
+		}
+	}
+	if acks != 1 || responses != 1 {
+		t.Errorf("Expected one ACK and one separate response, got %v and %v", acks, responses)
+	}
+}
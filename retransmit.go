@@ -0,0 +1,97 @@
+package coap
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrRetransmitTimeout is returned when a confirmable message wasn't
+// acknowledged after the last retransmission.
+var ErrRetransmitTimeout = errors.New("no acknowledgement")
+
+// ackTimeout is the default ACK_TIMEOUT (RFC 7252 section 4.8).
+var ackTimeout = ResponseTimeout
+
+type pendingKey struct {
+	l    packetConn
+	addr string
+	mid  uint16
+}
+
+// Confirmable messages sent by servers, waiting for their ACK or RST.
+var pending = struct {
+	sync.Mutex
+	m map[pendingKey]chan Message
+}{m: map[pendingKey]chan Message{}}
+
+// transmitConfirmable sends the confirmable message m to a on l and
+// waits for the matching ACK or Reset, retransmitting as p's
+// RetryPolicy says in the meantime, exponential backoff by default.
+// The transmissions are reported to t, and the timeouts picked by cc.
+func transmitConfirmable(l packetConn, a *net.UDPAddr, m Message, p TransmissionParams, t telemetry, cc *CoCoA) (Message, error) {
+	k := pendingKey{l, a.String(), m.MessageID}
+	ch := make(chan Message, 1)
+
+	pending.Lock()
+	pending.m[k] = ch
+	pending.Unlock()
+	defer func() {
+		pending.Lock()
+		delete(pending.m, k)
+		pending.Unlock()
+	}()
+
+	start := time.Now()
+	p = p.withDefaults()
+	policy := p.Retry
+	if policy == nil {
+		timeout, backoff := cc.timeouts(a, p)
+		policy = ExponentialBackoff{Initial: timeout, Factor: backoff, MaxAttempts: p.MaxRetransmit + 1}
+	}
+	var timeout time.Duration
+	for i := 0; ; i++ {
+		var ok bool
+		if timeout, ok = policy.NextTimeout(i, timeout); !ok {
+			t.timeout(m, a, start)
+			return Message{}, ErrRetransmitTimeout
+		}
+		if i > 0 {
+			t.retransmit(m, a, i, start)
+		}
+		if err := writeMessage(l, a, m); err != nil {
+			return Message{}, err
+		}
+		t.sent(l.LocalAddr(), a, m, i > 0)
+
+		timer := time.NewTimer(timeout)
+		select {
+		case rv := <-ch:
+			timer.Stop()
+			cc.measured(a, time.Since(start), i+1)
+			return rv, nil
+		case <-timer.C:
+		}
+	}
+}
+
+// ackReceived hands an ACK or Reset to the transmitConfirmable
+// waiting for it, reporting whether there was one.
+func ackReceived(l packetConn, a *net.UDPAddr, m Message) bool {
+	if m.Type != Acknowledgement && m.Type != Reset {
+		return false
+	}
+
+	pending.Lock()
+	ch, ok := pending.m[pendingKey{l, a.String(), m.MessageID}]
+	pending.Unlock()
+
+	if ok {
+		select {
+		case ch <- m:
+		default:
+		}
+	}
+	return ok
+}
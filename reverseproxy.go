@@ -0,0 +1,97 @@
+package coap
+
+import (
+	"net"
+	"net/url"
+	"strings"
+)
+
+// A ReverseProxy is a handler serving the resources under a path
+// prefix from a backend endpoint, like httputil.ReverseProxy.  It
+// replaces the prefix of the Uri-Path of each request with the path
+// of its Target, and maps the Location-Path of the responses back
+// under the prefix.
+//
+// Blockwise bodies pass through whole: the server reassembles the
+// Block1 transfers of a request before the proxy sends it on, the
+// backend connection sends it and fetches the response in blocks, and
+// the server cuts the response into the blocks the client asks for.
+type ReverseProxy struct {
+	// Target is the backend, such as coap://backend/api.  Its
+	// scheme and host say where the requests go, and its path
+	// replaces Prefix in theirs.
+	Target *url.URL
+	// Prefix is the path the proxy serves, such as "/devices/".
+	// Requests for paths outside it are answered with 4.04 Not
+	// Found.
+	Prefix string
+	// Unsafe says what to do with requests carrying unrecognized
+	// options that are unsafe to forward.
+	Unsafe UnsafeOptionPolicy
+	// Dial connects to the endpoint of the Target.  Nil means
+	// DialURL.
+	Dial func(rawurl string) (Client, error)
+
+	backend proxyBackend
+}
+
+// NewReverseProxy returns a ReverseProxy serving the resources under
+// prefix from target.
+func NewReverseProxy(prefix string, target *url.URL) *ReverseProxy {
+	return &ReverseProxy{Target: target, Prefix: prefix}
+}
+
+// splitPath returns the segments of the slash separated path p.
+func splitPath(p string) []string {
+	p = strings.Trim(p, "/")
+	if p == "" {
+		return nil
+	}
+	return strings.Split(p, "/")
+}
+
+func hasPathPrefix(path, prefix []string) bool {
+	if len(path) < len(prefix) {
+		return false
+	}
+	for i, seg := range prefix {
+		if path[i] != seg {
+			return false
+		}
+	}
+	return true
+}
+
+// ServeCOAP sends the request m on to the backend and returns its
+// response.
+func (p *ReverseProxy) ServeCOAP(l *net.UDPConn, a *net.UDPAddr, m *Message) *Message {
+	prefix := splitPath(p.Prefix)
+	path := m.Path()
+	if !hasPathPrefix(path, prefix) {
+		return notFoundHandler(l, a, m)
+	}
+
+	var base Message
+	if err := base.SetEscapedPath(p.Target.EscapedPath()); err != nil {
+		return proxyError(*m, InternalServerError, err.Error())
+	}
+	backend := base.Path()
+	var req Message
+	req.SetPath(append(backend, path[len(prefix):]...))
+	target := *p.Target
+	target.RawPath = req.EscapedPath()
+	target.Path, _ = url.PathUnescape(target.RawPath)
+	target.RawQuery = m.EscapedQuery()
+
+	rv := p.backend.forward(p.Dial, m, &target, p.Unsafe)
+
+	if loc := rv.optionStrings(LocationPath); len(loc) > 0 && hasPathPrefix(loc, backend) {
+		rv.SetOption(LocationPath, append(append([]string(nil), prefix...), loc[len(backend):]...))
+	}
+	return rv
+}
+
+// Close closes the connection to the backend.
+func (p *ReverseProxy) Close() error {
+	return p.backend.Close()
+}
@@ -0,0 +1,76 @@
+package coap
+
+import (
+	"bytes"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestReverseProxy(t *testing.T) {
+	body := bytes.Repeat([]byte("0123456789"), 300)
+
+	backend := NewServeMux()
+	backend.Handle("/api/", RequestFunc(func(r *Request) {
+		rv := Message{Code: Content, Payload: []byte(r.Msg.EscapedPath() + "?" + r.Msg.EscapedQuery())}
+		switch {
+		case r.Msg.Code == POST:
+			rv.Code = Created
+			rv.Payload = nil
+			if bytes.Equal(r.Msg.Payload, body) {
+				rv.AddOption(LocationPath, []string{"api", "items", "3"})
+			}
+		case r.Msg.PathString() == "api/big":
+			rv.Payload = body
+		}
+		r.Respond(rv)
+	}))
+	bl, baddr := startUDPLisenter(t)
+	defer bl.Close()
+	go Serve(bl, backend)
+
+	target, err := url.Parse("coap://" + baddr + "/api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := NewReverseProxy("/devices/", target)
+	defer proxy.Close()
+	mux := NewServeMux()
+	mux.Handle("/devices/", proxy)
+	pl, paddr := startUDPLisenter(t)
+	defer pl.Close()
+	go Serve(pl, mux)
+
+	c, err := Dial("udp", paddr)
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	defer c.Close()
+	send := func(code COAPCode, path, query string, payload []byte) *Message {
+		req := Message{Type: Confirmable, Code: code, MessageID: c.nextMessageID(), Token: []byte{byte(code)}, Payload: payload}
+		req.SetEscapedPath(path)
+		req.SetEscapedQuery(query)
+		rv, err := c.Send(req)
+		if err != nil {
+			t.Fatalf("Error sending %v %v: %v", code, path, err)
+		}
+		return rv
+	}
+
+	if rv := send(GET, "/devices/a%2Fb/c", "x=1", nil); rv.Code != Content || string(rv.Payload) != "/api/a%2Fb/c?x=1" {
+		t.Errorf("Expected the rewritten path, got %v", rv)
+	}
+	if rv := send(GET, "/devices/big", "", nil); rv.Code != Content || !bytes.Equal(rv.Payload, body) {
+		t.Errorf("Expected the whole blockwise body, got %v", rv)
+	}
+	rv := send(POST, "/devices/items", "", body)
+	if loc := rv.optionStrings(LocationPath); rv.Code != Created || !reflect.DeepEqual(loc, []string{"devices", "items", "3"}) {
+		t.Errorf("Expected Location-Path devices/items/3, got %v", rv)
+	}
+
+	req := &Message{Type: Confirmable, Code: GET}
+	req.SetPathString("/other")
+	if rv := proxy.ServeCOAP(nil, nil, req); rv.Code != NotFound {
+		t.Errorf("Expected NotFound outside the prefix, got %v", rv)
+	}
+}
@@ -2,12 +2,26 @@
 package coap
 
 import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
 	"log"
 	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
-const maxPktLen = 1500
+// DefaultReadBufferSize is the largest datagram servers and clients
+// read unless configured otherwise, enough for an Ethernet MTU.
+const DefaultReadBufferSize = 1500
+
+// ErrDatagramTooLarge is reported for datagrams larger than the read
+// buffer, which are dropped rather than handled truncated.
+var ErrDatagramTooLarge = errors.New("datagram larger than the read buffer")
 
 // Handler is a type that handles CoAP messages.
 type Handler interface {
@@ -26,19 +40,338 @@ func FuncHandler(f func(l *net.UDPConn, a *net.UDPAddr, m *Message) *Message) Ha
 	return funcHandler(f)
 }
 
-func handlePacket(l *net.UDPConn, data []byte, u *net.UDPAddr,
-	rh Handler) {
+// ErrServerClosed is returned by a Server's Serve and ListenAndServe
+// once it's shut down or closed.
+var ErrServerClosed = errors.New("coap: Server closed")
+
+// A Server serves CoAP requests over UDP.
+type Server struct {
+	// Addr is the address ListenAndServe listens on when it's not
+	// given one, ":5683" if empty.
+	Addr string
+	// Handler handles the requests.
+	Handler Handler
+	// ReadBufferSize is the largest datagram read; longer ones are
+	// truncated, and so dropped as malformed.  Zero means
+	// DefaultReadBufferSize.
+	ReadBufferSize int
+	// BlockSize is the size of the blocks that responses too large
+	// for one are cut in (RFC 7959 Block2), unless the client asked
+	// for smaller ones; a power of two from 16 to 1024.  Zero
+	// means 1024.
+	BlockSize int
+	// MaxConcurrentRequests, if positive, is how many packets are
+	// handled at once.  Reading more waits until one is done.
+	MaxConcurrentRequests int
+	// Malformed, if not nil, is called with every packet that
+	// can't be parsed, its source, and the parse error.  The data
+	// must not be retained.  Nil means logging the error.
+	Malformed func(data []byte, a *net.UDPAddr, err error)
+	// SilentReject makes the server drop malformed confirmable
+	// messages, and confirmable responses it has no request for,
+	// instead of rejecting them with a Reset (RFC 7252 section
+	// 4.2).  Requests with a malformed critical option are always
+	// answered 4.02 Bad Option.  ACKs, Resets and non-confirmable
+	// responses the server has no exchange for are never answered;
+	// they're passed to the Handler, which a Hub watches for
+	// Resets, and which ServeMux ignores.
+	SilentReject bool
+	// Tracer, if not nil, records the messages received and the
+	// responses sent.
+	Tracer *Tracer
+	// Hooks, if not nil, are called with the requests received,
+	// the responses sent, and the retransmissions and timeouts of
+	// separate responses.
+	Hooks *Hooks
+	// Metrics, if not nil, counts the messages, retransmissions,
+	// timeouts, Observe registrations and duplicate requests, and
+	// records how long requests take to answer.
+	Metrics MetricsRecorder
+	// Capture, if not nil, gets a copy of every datagram sent
+	// and received, including malformed ones.
+	Capture *Capture
+	// SeparateResponses makes the server acknowledge confirmable
+	// requests as soon as they arrive and send the responses
+	// separately (RFC 7252 section 5.2.2), for handlers that may
+	// take longer than the client's ACK_TIMEOUT.  Otherwise
+	// responses are piggybacked on the ACK.
+	SeparateResponses bool
+	// BlockwiseTimeout is how long the state of a blockwise
+	// transfer is kept after its last block.  A transfer that's
+	// abandoned for longer is forgotten, and its next block is
+	// answered with 4.08 Request Entity Incomplete.  Zero means
+	// DefaultBlockwiseTimeout.
+	BlockwiseTimeout time.Duration
+	// MaxBodySize bounds the request bodies received in blocks
+	// (RFC 7959 Block1).  A request announcing a larger one with
+	// Size1, or growing past it, is answered with 4.13 Request
+	// Entity Too Large.  Zero means DefaultMaxBodySize.
+	MaxBodySize int
+	// MaxBlockwiseTransfers and MaxBlockwiseTransfersPerPeer bound
+	// the blockwise transfers kept at once, in total and for each
+	// client.  Beyond either, a request body starting in blocks is
+	// answered with 5.03 Service Unavailable, and a large response
+	// isn't kept, so asking for its later blocks has the handler
+	// make it again.  Zero means DefaultMaxBlockwiseTransfers and
+	// DefaultMaxBlockwiseTransfersPerPeer.
+	MaxBlockwiseTransfers        int
+	MaxBlockwiseTransfersPerPeer int
+	// MulticastInterfaces, if not empty, makes ListenAndServe
+	// join the All CoAP Nodes groups of its address family on
+	// these interfaces.
+	MulticastInterfaces []*net.Interface
+	// Leisure is the period in which responses to multicast
+	// requests are sent, non-confirmable and at a random point, so
+	// the group's members don't all answer at once (RFC 7252
+	// section 8.2).  Zero means Params.DefaultLeisure.
+	Leisure time.Duration
+	// Params are the transmission parameters for separate
+	// responses and responses to multicast requests.
+	Params TransmissionParams
+	// MessageIDs, if not nil, allocates the Message IDs of the
+	// messages the server sends other than ACKs and Resets, so a
+	// Hub sending on the same sockets can share it.  Nil means an
+	// allocator of the server's own.
+	MessageIDs *MessageIDAllocator
+	// DuplicateLifetime is how long a request is remembered, so
+	// that retransmissions of it are answered without the handler
+	// seeing them again.  Zero means ExchangeLifetime; a negative
+	// value disables duplicate detection.
+	DuplicateLifetime time.Duration
+	// DuplicateCacheSize bounds the number of requests remembered,
+	// forgetting the oldest first.  Zero means
+	// DefaultDuplicateCacheSize.
+	DuplicateCacheSize int
+	// CoCoA, if not nil, adapts the retransmission timeouts of
+	// separate responses to the clients' round-trip times.
+	CoCoA *CoCoA
+	// ReuseRequests makes the server recycle the packets and
+	// messages of requests once they're handled, to spare the
+	// garbage collector on busy servers.  Handlers must then be
+	// done with the request when they return: they may not keep
+	// the message, its token or payload, or the Request, nor
+	// respond from another goroutine.
+	ReuseRequests bool
+
+	malformed uint64
+	ids       MessageIDAllocator
+
+	// active counts the packets being handled, and the requests
+	// that still owe a separate response.
+	active int64
+
+	mu        sync.Mutex
+	closed    bool
+	done      chan struct{}
+	listeners map[io.Closer]bool
+	sem       chan struct{}
+	groups    map[groupKey]Handler
+	transfers map[string]*transfer
+	// peerTransfers counts the transfers by client address.
+	peerTransfers map[string]int
+	dups          map[dupKey]*dupEntry
+	dupOrder      []*dupEntry
+}
+
+// MalformedCount returns the number of packets the server dropped
+// because they couldn't be parsed.
+func (s *Server) MalformedCount() uint64 {
+	return atomic.LoadUint64(&s.malformed)
+}
+
+// Pools of the packets and messages of requests, for servers that
+// reuse them.
+var (
+	packetPool  = sync.Pool{New: func() interface{} { return new([]byte) }}
+	messagePool = sync.Pool{New: func() interface{} { return new(Message) }}
+)
+
+func (s *Server) readBufferSize() int {
+	if s.ReadBufferSize > 0 {
+		return s.ReadBufferSize
+	}
+	return DefaultReadBufferSize
+}
+
+// packet returns a buffer for a packet of n bytes, from the pool if
+// the server reuses them.
+func (s *Server) packet(n int) *[]byte {
+	if !s.ReuseRequests {
+		b := make([]byte, n)
+		return &b
+	}
+	b := packetPool.Get().(*[]byte)
+	if cap(*b) < n {
+		*b = make([]byte, n, s.readBufferSize()+1)
+	}
+	*b = (*b)[:n]
+	return b
+}
+
+// handlePacket parses and handles the packet data, then recycles it
+// if the server reuses packets.
+func (s *Server) handlePacket(l packetConn, data *[]byte, u *net.UDPAddr, dst net.IP) {
+	if !s.ReuseRequests {
+		s.handle(l, *data, new(Message), u, dst)
+		return
+	}
+	msg := messagePool.Get().(*Message)
+	s.handle(l, *data, msg, u, dst)
+	msg.Payload = nil
+	messagePool.Put(msg)
+	packetPool.Put(data)
+}
 
-	msg, err := ParseMessage(data)
+func (s *Server) handle(l packetConn, data []byte, msg *Message, u *net.UDPAddr, dst net.IP) {
+	s.Capture.datagram(false, l.LocalAddr(), u, data)
+	err := ErrDatagramTooLarge
+	if len(data) <= s.readBufferSize() {
+		err = ParseMessageInto(msg, data)
+	}
 	if err != nil {
-		log.Printf("Error parsing %v", err)
+		atomic.AddUint64(&s.malformed, 1)
+		if s.Malformed != nil {
+			s.Malformed(data, u, err)
+		} else {
+			log.Printf("Error parsing %v", err)
+		}
+		// A confirmable request with a malformed critical option is
+		// answered 4.02 Bad Option (RFC 7252 section 5.4.3); other
+		// confirmable messages are rejected if the header is
+		// readable, since it has the Message ID to reject.
+		var berr *BadOptionError
+		if errors.As(err, &berr) && msg.IsConfirmable() && isRequest(msg.Code) {
+			s.transmit(l, u, Message{
+				Type:      Acknowledgement,
+				Code:      BadOption,
+				MessageID: msg.MessageID,
+				Token:     append([]byte(nil), msg.Token...),
+				Payload:   []byte(berr.Error()),
+			})
+		} else if len(data) >= 4 && data[0]>>6 == 1 && COAPType(data[0]>>4&0x3) == Confirmable {
+			s.reject(l, u, binary.BigEndian.Uint16(data[2:4]))
+		}
 		return
 	}
+	s.telemetry().received(u, *msg)
 
-	rv := rh.ServeCOAP(l, u, &msg)
-	if rv != nil {
-		Transmit(l, u, *rv)
+	if ackReceived(l, u, *msg) || s.duplicate(l, u, *msg) {
+		return
+	}
+	if msg.Code == 0 && msg.IsConfirmable() {
+		// A CoAP ping (RFC 7252 section 4.3).
+		s.transmit(l, u, Message{Type: Reset, MessageID: msg.MessageID})
+		return
+	}
+	if msg.IsConfirmable() && !isRequest(msg.Code) {
+		// A response the server didn't ask for.
+		s.reject(l, u, msg.MessageID)
+		return
+	}
+
+	r := &Request{Msg: msg, Addr: u, l: l, s: s, start: time.Now()}
+	if d, ok := l.(*dtlsSocket); ok {
+		r.session = d.session
+	}
+	if dst.IsMulticast() {
+		r.Group = dst
+	}
+	if isRequest(msg.Code) {
+		s.telemetry().request(*msg, u)
+		if rejectCritical(r) || !s.receiveBlock(r) {
+			return
+		}
+		if s.SeparateResponses {
+			r.Ack()
+		}
+	}
+	udp, _ := l.(*net.UDPConn)
+	serveRequest(s.handler(udp, dst), r)
+}
+
+// rejectCritical answers r with 4.02 Bad Option, listing them in the
+// diagnostic payload, if its request has critical options this
+// package doesn't know, and tells whether it did.  Non-confirmable
+// such requests are dropped without an answer; unknown elective
+// options are ignored (RFC 7252 section 5.4.1).
+func rejectCritical(r *Request) bool {
+	var bad []string
+	for _, id := range r.Msg.UnrecognizedOptions() {
+		if id.Critical() {
+			bad = append(bad, strconv.Itoa(int(id)))
+		}
+	}
+	if bad == nil {
+		return false
+	}
+	if r.Msg.IsConfirmable() {
+		r.Respond(Message{
+			Code:    BadOption,
+			Payload: []byte("unrecognized critical options " + strings.Join(bad, ", ")),
+		})
+	}
+	return true
+}
+
+// serveRequest has h serve r, through ServeRequest if it can.
+func serveRequest(h Handler, r *Request) {
+	if rh, ok := h.(RequestHandler); ok {
+		rh.ServeRequest(r)
+		return
+	}
+	udp, _ := r.l.(*net.UDPConn)
+	if rv := h.ServeCOAP(udp, r.Addr, r.Msg); rv != nil {
+		r.send(*rv)
+	}
+}
+
+// reject answers the confirmable message from u with Message ID mid
+// with a Reset, unless the server rejects messages silently.
+func (s *Server) reject(l packetConn, u *net.UDPAddr, mid uint16) {
+	if !s.SilentReject {
+		s.transmit(l, u, Message{Type: Reset, MessageID: mid})
+	}
+}
+
+func (s *Server) telemetry() telemetry {
+	return telemetry{s.Tracer, s.Hooks, s.Metrics, s.Capture}
+}
+
+func (s *Server) nextMessageID(dst net.Addr) (uint16, error) {
+	if s.MessageIDs != nil {
+		return s.MessageIDs.Next(dst)
+	}
+	return s.ids.Next(dst)
+}
+
+func (s *Server) transmit(l packetConn, u *net.UDPAddr, m Message) error {
+	err := writeMessage(l, u, m)
+	if err == nil {
+		s.telemetry().sent(l.LocalAddr(), u, m, false)
+		s.rememberResponse(l, u, m)
+	}
+	return err
+}
+
+// respondSeparately sends rv, the response to the already
+// acknowledged request r, in a message of its own.  Unless the handler
+// asked for a non-confirmable response, it's retransmitted until the
+// client acknowledges it.
+func (s *Server) respondSeparately(r *Request, rv Message) error {
+	var err error
+	if rv.MessageID, err = s.nextMessageID(r.Addr); err != nil {
+		return err
+	}
+	rv.Token = r.Msg.Token
+	if rv.Type != NonConfirmable {
+		rv.Type = Confirmable
 	}
+	s.telemetry().response(rv, r.Addr, r.start)
+	if rv.Type == NonConfirmable {
+		return s.transmit(r.l, r.Addr, rv)
+	}
+	_, err = transmitConfirmable(r.l, r.Addr, rv, s.Params, s.telemetry(), s.CoCoA)
+	return err
 }
 
 // Transmit a message.
@@ -56,6 +389,23 @@ func Transmit(l *net.UDPConn, a *net.UDPAddr, m Message) error {
 	return err
 }
 
+// A packetConn is what a Server receives messages on and answers
+// them on: a UDP socket, or a DTLS association with one client.
+type packetConn interface {
+	LocalAddr() net.Addr
+	WriteTo(b []byte, a net.Addr) (int, error)
+}
+
+// writeMessage sends m to a on l.
+func writeMessage(l packetConn, a *net.UDPAddr, m Message) error {
+	d, err := m.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	_, err = l.WriteTo(d, a)
+	return err
+}
+
 // Receive a message.
 func Receive(l *net.UDPConn, buf []byte) (Message, error) {
 	l.SetReadDeadline(time.Now().Add(ResponseTimeout))
@@ -69,6 +419,26 @@ func Receive(l *net.UDPConn, buf []byte) (Message, error) {
 
 // ListenAndServe binds to the given address and serve requests forever.
 func ListenAndServe(n, addr string, rh Handler) error {
+	s := &Server{Handler: rh}
+	return s.ListenAndServe(n, addr)
+}
+
+// ListenAndServe binds to the given address and serves requests
+// until the server is shut down or closed.  An empty network means
+// "udp", and an empty address the server's Addr.
+func (s *Server) ListenAndServe(n, addr string) error {
+	if s.isClosed() {
+		return ErrServerClosed
+	}
+	if n == "" {
+		n = "udp"
+	}
+	if addr == "" {
+		addr = s.Addr
+	}
+	if addr == "" {
+		addr = ":5683"
+	}
 	uaddr, err := net.ResolveUDPAddr(n, addr)
 	if err != nil {
 		return err
@@ -78,25 +448,184 @@ func ListenAndServe(n, addr string, rh Handler) error {
 	if err != nil {
 		return err
 	}
+	if len(s.MulticastInterfaces) > 0 {
+		if err := s.joinAllNodes(l, n); err != nil {
+			l.Close()
+			return err
+		}
+	}
 
-	return Serve(l, rh)
+	return s.Serve(l)
 }
 
 // Serve processes incoming UDP packets on the given listener, and processes
 // these requests forever (or until the listener is closed).
 func Serve(listener *net.UDPConn, rh Handler) error {
-	buf := make([]byte, maxPktLen)
+	s := &Server{Handler: rh}
+	return s.Serve(listener)
+}
+
+// Serve processes incoming UDP packets on the given listener until
+// it's closed, or the server is shut down or closed, when it returns
+// ErrServerClosed.
+func (s *Server) Serve(listener *net.UDPConn) error {
+	sem, done, ok := s.track(listener)
+	if !ok {
+		return ErrServerClosed
+	}
+	defer s.untrack(listener)
+
+	if _, err := (BlockOption{Size: s.blockSize()}).szx(); err != nil {
+		return err
+	}
+	// One byte more tells truncated datagrams apart.
+	buf := make([]byte, s.readBufferSize()+1)
+	oob := make([]byte, 128)
 	for {
-		nr, addr, err := listener.ReadFromUDP(buf)
+		nr, noob, _, addr, err := listener.ReadMsgUDP(buf, oob)
 		if err != nil {
+			if s.isClosed() {
+				return ErrServerClosed
+			}
 			if neterr, ok := err.(net.Error); ok && (neterr.Temporary() || neterr.Timeout()) {
 				time.Sleep(5 * time.Millisecond)
 				continue
 			}
 			return err
 		}
-		tmp := make([]byte, nr)
-		copy(tmp, buf)
-		go handlePacket(listener, tmp, addr, rh)
+		s.dispatch(listener, sem, done, buf[:nr], addr, destination(oob[:noob]))
+	}
+}
+
+// dispatch handles the packet data, received on l from u and sent to
+// dst, in a goroutine of its own once sem has room for it.  While the
+// server shuts down, as done tells, only the ACKs and Resets of its
+// separate responses are taken.
+func (s *Server) dispatch(l packetConn, sem, done chan struct{}, data []byte, u *net.UDPAddr, dst net.IP) {
+	select {
+	case <-done:
+		s.drain(l, data, u)
+		return
+	default:
+	}
+	tmp := s.packet(len(data))
+	copy(*tmp, data)
+	if sem != nil {
+		select {
+		case sem <- struct{}{}:
+		case <-done:
+			// Shutting down, so dropped like the requests
+			// after it.
+			if s.ReuseRequests {
+				packetPool.Put(tmp)
+			}
+			return
+		}
+	}
+	atomic.AddInt64(&s.active, 1)
+	go func() {
+		defer func() {
+			atomic.AddInt64(&s.active, -1)
+			if sem != nil {
+				<-sem
+			}
+		}()
+		s.handlePacket(l, tmp, u, dst)
+	}()
+}
+
+// track registers l, a listener or connection, as being served,
+// to be closed with the server, returning the semaphore bounding
+// the packets handled at once, if any, and the channel closed when
+// the server is, or false if it's closed already.
+func (s *Server) track(l io.Closer) (chan struct{}, chan struct{}, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil, nil, false
+	}
+	if s.done == nil {
+		s.done = make(chan struct{})
+	}
+	if s.listeners == nil {
+		s.listeners = map[io.Closer]bool{}
+	}
+	s.listeners[l] = true
+	if s.sem == nil && s.MaxConcurrentRequests > 0 {
+		s.sem = make(chan struct{}, s.MaxConcurrentRequests)
+	}
+	return s.sem, s.done, true
+}
+
+func (s *Server) untrack(l io.Closer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.listeners, l)
+}
+
+func (s *Server) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+// drain handles the packet data from u while the server shuts down:
+// only the ACKs and Resets of the separate responses still going out
+// are taken, and requests are dropped.
+func (s *Server) drain(l packetConn, data []byte, u *net.UDPAddr) {
+	m, err := ParseMessage(append([]byte(nil), data...))
+	if err == nil {
+		ackReceived(l, u, m)
+	}
+}
+
+// stop marks the server closed, so it takes no more requests, and
+// returns its listeners.
+func (s *Server) stop() []io.Closer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closed && s.done != nil {
+		close(s.done)
+	}
+	s.closed = true
+	var ls []io.Closer
+	for l := range s.listeners {
+		ls = append(ls, l)
+	}
+	return ls
+}
+
+func closeAll(ls []io.Closer) error {
+	var err error
+	for _, l := range ls {
+		if cerr := l.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// Close closes the server's listeners right away, without waiting
+// for the requests being handled.
+func (s *Server) Close() error {
+	return closeAll(s.stop())
+}
+
+// Shutdown stops taking requests, waits for those being handled to be
+// done, including their separate responses, and then closes the
+// server's listeners.  If ctx is done first, it closes them right
+// away and returns ctx's error.
+func (s *Server) Shutdown(ctx context.Context) error {
+	ls := s.stop()
+	t := time.NewTicker(10 * time.Millisecond)
+	defer t.Stop()
+	for atomic.LoadInt64(&s.active) > 0 {
+		select {
+		case <-ctx.Done():
+			closeAll(ls)
+			return ctx.Err()
+		case <-t.C:
+		}
 	}
+	return closeAll(ls)
 }
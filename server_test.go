@@ -1,8 +1,12 @@
 package coap
 
 import (
+	"bytes"
+	"context"
 	"net"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func startUDPLisenter(t *testing.T) (*net.UDPConn, string) {
@@ -35,6 +39,7 @@ func TestServeWithAckResponse(t *testing.T) {
 		Type:      Confirmable,
 		Code:      POST,
 		MessageID: 9876,
+		Token:     []byte("tok"),
 		Payload:   []byte("Content sent by client"),
 	}
 	req.SetOption(ContentFormat, TextPlain)
@@ -44,6 +49,7 @@ func TestServeWithAckResponse(t *testing.T) {
 		Type:      Acknowledgement,
 		Code:      Content,
 		MessageID: req.MessageID,
+		Token:     req.Token,
 		Payload:   []byte("Reply from CoAP server"),
 	}
 	res.SetOption(ContentFormat, TextPlain)
@@ -88,3 +94,495 @@ func TestServeWithoutAckResponse(t *testing.T) {
 		t.Fatalf("Received response packet, but expected none")
 	}
 }
+
+func TestServeReportsMalformed(t *testing.T) {
+	type report struct {
+		data []byte
+		addr *net.UDPAddr
+		err  error
+	}
+	reports := make(chan report, 1)
+	s := &Server{
+		Handler: FuncHandler(func(l *net.UDPConn, a *net.UDPAddr, m *Message) *Message {
+			t.Errorf("Unexpected message: %v", m)
+			return nil
+		}),
+		Malformed: func(data []byte, a *net.UDPAddr, err error) {
+			reports <- report{append([]byte(nil), data...), a, err}
+		},
+	}
+
+	udpListener, coapServerAddr := startUDPLisenter(t)
+	defer udpListener.Close()
+	go s.Serve(udpListener)
+
+	c, err := net.Dial("udp", coapServerAddr)
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	defer c.Close()
+	junk := []byte{0x49, 0x01, 0x00, 0x01} // token length 9
+	if _, err := c.Write(junk); err != nil {
+		t.Fatalf("Error writing: %v", err)
+	}
+
+	select {
+	case r := <-reports:
+		if !bytes.Equal(r.data, junk) || r.addr.String() != c.LocalAddr().String() ||
+			r.err != ErrInvalidTokenLen {
+			t.Errorf("Unexpected report: %x from %v: %v", r.data, r.addr, r.err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Timed out waiting for the malformed packet report")
+	}
+	if n := s.MalformedCount(); n != 1 {
+		t.Errorf("Expected 1 malformed packet counted, got %v", n)
+	}
+}
+
+func TestServeRejects(t *testing.T) {
+	resp, err := (&Message{Type: Confirmable, Code: Content, MessageID: 8, Token: []byte("t")}).MarshalBinary()
+	if err != nil {
+		t.Fatalf("Error encoding: %v", err)
+	}
+	nonResp := append([]byte(nil), resp...)
+	nonResp[0] = nonResp[0]&^0x30 | byte(NonConfirmable)<<4
+	tests := []struct {
+		name string
+		data []byte
+		mid  int // -1 for no Reset
+	}{
+		{"malformed CON", []byte{0x49, 0x01, 0x00, 0x07}, 7},
+		{"malformed NON", []byte{0x59, 0x01, 0x00, 0x07}, -1},
+		{"wrong version", []byte{0x89, 0x01, 0x00, 0x07}, -1},
+		{"short", []byte{0x40, 0x01}, -1},
+		{"CON response", resp, 8},
+		{"NON response", nonResp, -1},
+	}
+
+	for _, silent := range []bool{false, true} {
+		s := &Server{
+			Handler:      FuncHandler(func(l *net.UDPConn, a *net.UDPAddr, m *Message) *Message { return nil }),
+			Malformed:    func(data []byte, a *net.UDPAddr, err error) {},
+			SilentReject: silent,
+		}
+		l, addr := startUDPLisenter(t)
+		defer l.Close()
+		go s.Serve(l)
+
+		c, err := net.Dial("udp", addr)
+		if err != nil {
+			t.Fatalf("Error dialing: %v", err)
+		}
+		defer c.Close()
+		for _, test := range tests {
+			if _, err := c.Write(test.data); err != nil {
+				t.Fatalf("Error writing: %v", err)
+			}
+			c.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+			buf := make([]byte, DefaultReadBufferSize)
+			n, err := c.Read(buf)
+			switch {
+			case err == nil && (test.mid < 0 || silent):
+				t.Errorf("%v, silent=%v: unexpected answer %x", test.name, silent, buf[:n])
+			case err != nil && test.mid >= 0 && !silent:
+				t.Errorf("%v: expected a Reset, got %v", test.name, err)
+			case err == nil:
+				m, err := ParseMessage(buf[:n])
+				if err != nil || m.Type != Reset || m.Code != 0 || int(m.MessageID) != test.mid {
+					t.Errorf("%v: expected a Reset for %v, got %v, %v", test.name, test.mid, m, err)
+				}
+			}
+		}
+	}
+}
+
+func TestServeDatagramSizes(t *testing.T) {
+	s := &Server{
+		Handler: FuncHandler(func(l *net.UDPConn, a *net.UDPAddr, m *Message) *Message {
+			return &Message{Type: Acknowledgement, Code: Content, MessageID: m.MessageID,
+				Token: m.Token, Payload: m.Payload}
+		}),
+		ReadBufferSize: 4096,
+		BlockSize:      64,
+		ReuseRequests:  true,
+	}
+	l, addr := startUDPLisenter(t)
+	defer l.Close()
+	go s.Serve(l)
+
+	c, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	defer c.Close()
+	req := Message{Type: Confirmable, Code: POST, MessageID: 1, Token: []byte("t"),
+		Payload: bytes.Repeat([]byte("x"), 3000)}
+	rv, err := roundTrip(c, req)
+	if err != nil {
+		t.Fatalf("Error sending a 3000 byte request: %v", err)
+	}
+	if b, ok := rv.Block2(); !ok || b.Size != 64 || !b.More || len(rv.Payload) != 64 {
+		t.Errorf("Expected a first block of 64 bytes, got %v", rv)
+	}
+
+	req.MessageID, req.Payload = 2, []byte("short")
+	req.SetBlock2(BlockOption{Size: 1024})
+	if rv, err = roundTrip(c, req); err != nil {
+		t.Fatalf("Error sending: %v", err)
+	}
+	if b, ok := rv.Block2(); ok || string(rv.Payload) != "short" {
+		t.Errorf("Expected a short response without blocks, got %v, %v", rv, b)
+	}
+
+	if err := (&Server{BlockSize: 100}).Serve(l); err != ErrInvalidBlockSize {
+		t.Errorf("Expected ErrInvalidBlockSize, got %v", err)
+	}
+
+	reports := make(chan error, 1)
+	small := &Server{
+		Handler:        s.Handler,
+		ReadBufferSize: 64,
+		Malformed:      func(data []byte, a *net.UDPAddr, err error) { reports <- err },
+	}
+	sl, saddr := startUDPLisenter(t)
+	defer sl.Close()
+	go small.Serve(sl)
+	sc, err := net.Dial("udp", saddr)
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	defer sc.Close()
+	req.MessageID, req.Payload = 3, bytes.Repeat([]byte("x"), 100)
+	req.RemoveOption(Block2)
+	if rv, err = roundTrip(sc, req); err != nil || rv.Type != Reset || rv.MessageID != 3 {
+		t.Errorf("Expected a Reset for a datagram too large, got %v, %v", rv, err)
+	}
+	if err := <-reports; err != ErrDatagramTooLarge {
+		t.Errorf("Expected ErrDatagramTooLarge, got %v", err)
+	}
+}
+
+// roundTrip sends m on c and reads the response.
+func roundTrip(c net.Conn, m Message) (Message, error) {
+	b, err := m.MarshalBinary()
+	if err != nil {
+		return Message{}, err
+	}
+	if _, err := c.Write(b); err != nil {
+		return Message{}, err
+	}
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 8192)
+	n, err := c.Read(buf)
+	if err != nil {
+		return Message{}, err
+	}
+	return ParseMessage(buf[:n])
+}
+
+func TestServeSeparateResponses(t *testing.T) {
+	var tr Tracer
+	s := &Server{
+		Handler:           FuncHandler(contentHandler),
+		Tracer:            &tr,
+		SeparateResponses: true,
+	}
+	udpListener, coapServerAddr := startUDPLisenter(t)
+	defer udpListener.Close()
+	go s.Serve(udpListener)
+
+	req := Message{Type: Confirmable, Code: GET, MessageID: 1234, Token: []byte("sep")}
+	m := dialAndSend(t, coapServerAddr, req)
+	if m.Type != Confirmable || m.Code != Content || m.MessageID == req.MessageID ||
+		string(m.Token) != "sep" || string(m.Payload) != "current" {
+		t.Fatalf("Unexpected separate response: %v", m)
+	}
+
+	// Request, empty ACK, response, and the client's ACK.
+	exp := []COAPType{Confirmable, Acknowledgement, Confirmable, Acknowledgement}
+	for i := 0; len(tr.Events()) < len(exp) && i < 100; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	events := tr.Events()
+	if len(events) != len(exp) {
+		t.Fatalf("Expected %v events, got %v", len(exp), events)
+	}
+	for i, e := range events {
+		if e.Type != exp[i] {
+			t.Errorf("Expected %v at %v, got %v", exp[i], i, e)
+		}
+	}
+	if events[1].Code != 0 || events[1].MessageID != req.MessageID {
+		t.Errorf("Expected an empty ACK for the request, got %v", events[1])
+	}
+}
+
+func TestServerShutdown(t *testing.T) {
+	l, addr := startUDPLisenter(t)
+	started := make(chan uint16, 2)
+	release := make(chan struct{})
+	s := &Server{
+		MaxConcurrentRequests: 1,
+		Handler: RequestFunc(func(r *Request) {
+			started <- r.Msg.MessageID
+			<-release
+			r.Respond(Message{Code: Content})
+		}),
+	}
+	served := make(chan error, 1)
+	go func() { served <- s.Serve(l) }()
+
+	raddr, _ := net.ResolveUDPAddr("udp", addr)
+	c, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	defer c.Close()
+	for i := uint16(1); i <= 2; i++ {
+		Transmit(c, nil, Message{Type: NonConfirmable, Code: GET, MessageID: i, Token: []byte{byte(i)}})
+	}
+	<-started
+	select {
+	case id := <-started:
+		t.Fatalf("Expected one request handled at a time, got %v too", id)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- s.Shutdown(context.Background()) }()
+	select {
+	case err := <-shutdown:
+		t.Fatalf("Expected Shutdown to wait for the handler, got %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+	if err := <-shutdown; err != nil {
+		t.Errorf("Error shutting down: %v", err)
+	}
+	if err := <-served; err != ErrServerClosed {
+		t.Errorf("Expected Serve to return ErrServerClosed, got %v", err)
+	}
+
+	// The request being handled is answered; the one waiting its
+	// turn is dropped.
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, DefaultReadBufferSize)
+	n, err := c.Read(buf)
+	if err != nil {
+		t.Fatalf("Expected the response, got %v", err)
+	}
+	if m, err := ParseMessage(buf[:n]); err != nil || m.Code != Content || string(m.Token) != "\x01" {
+		t.Errorf("Expected the response to the first request, got %v, %v", m, err)
+	}
+	select {
+	case id := <-started:
+		t.Errorf("Expected no request handled after Shutdown, got %v", id)
+	default:
+	}
+
+	if err := s.Serve(l); err != ErrServerClosed {
+		t.Errorf("Expected ErrServerClosed serving after Shutdown, got %v", err)
+	}
+	if err := s.ListenAndServe("", ""); err != ErrServerClosed {
+		t.Errorf("Expected ErrServerClosed listening after Shutdown, got %v", err)
+	}
+}
+
+func TestServerShutdownDeadline(t *testing.T) {
+	l, _ := startUDPLisenter(t)
+	s := &Server{Handler: FuncHandler(contentHandler)}
+	served := make(chan error, 1)
+	go func() { served <- s.Serve(l) }()
+
+	// A request that's never answered.
+	atomic.AddInt64(&s.active, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected the request to outlast the deadline, got %v", err)
+	}
+	if err := <-served; err != ErrServerClosed {
+		t.Errorf("Expected Serve to return ErrServerClosed, got %v", err)
+	}
+}
+
+func TestServerShutdownSeparate(t *testing.T) {
+	l, addr := startUDPLisenter(t)
+	s := &Server{Handler: RequestFunc(func(r *Request) {
+		r.Ack()
+		go func() {
+			time.Sleep(200 * time.Millisecond)
+			r.Respond(Message{Code: Content})
+		}()
+	})}
+	go s.Serve(l)
+
+	c, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	defer c.Close()
+	req, _ := (&Message{Type: Confirmable, Code: GET, MessageID: 3, Token: []byte("t")}).MarshalBinary()
+	c.Write(req)
+	buf := make([]byte, DefaultReadBufferSize)
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	if n, err := c.Read(buf); err != nil {
+		t.Fatalf("Expected an ACK, got %v", err)
+	} else if m, _ := ParseMessage(buf[:n]); m.Type != Acknowledgement || m.Code != 0 {
+		t.Fatalf("Expected an empty ACK, got %v", m)
+	}
+
+	start := time.Now()
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- s.Shutdown(context.Background()) }()
+
+	n, err := c.Read(buf)
+	if err != nil {
+		t.Fatalf("Expected the separate response, got %v", err)
+	}
+	m, err := ParseMessage(buf[:n])
+	if err != nil || m.Type != Confirmable || m.Code != Content {
+		t.Fatalf("Expected a confirmable response, got %v, %v", m, err)
+	}
+	ack, _ := (&Message{Type: Acknowledgement, MessageID: m.MessageID}).MarshalBinary()
+	c.Write(ack)
+	if err := <-shutdown; err != nil {
+		t.Errorf("Error shutting down: %v", err)
+	}
+	if d := time.Since(start); d < 150*time.Millisecond || d > time.Second {
+		t.Errorf("Expected Shutdown to wait for the acknowledged response, took %v", d)
+	}
+}
+
+func TestServerClose(t *testing.T) {
+	s := &Server{Addr: "127.0.0.1:0", Handler: FuncHandler(contentHandler)}
+	served := make(chan error, 1)
+	go func() { served <- s.ListenAndServe("udp", "") }()
+	for i := 0; i < 100; i++ {
+		s.mu.Lock()
+		n := len(s.listeners)
+		s.mu.Unlock()
+		if n > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := s.Close(); err != nil {
+		t.Errorf("Error closing: %v", err)
+	}
+	select {
+	case err := <-served:
+		if err != ErrServerClosed {
+			t.Errorf("Expected ErrServerClosed, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("ListenAndServe didn't return")
+	}
+}
+
+func TestServeRejectsCriticalOptions(t *testing.T) {
+	l, addr := startUDPLisenter(t)
+	defer l.Close()
+	var served int32
+	go Serve(l, FuncHandler(func(l *net.UDPConn, a *net.UDPAddr, m *Message) *Message {
+		atomic.AddInt32(&served, 1)
+		return &Message{Type: Acknowledgement, Code: Content, MessageID: m.MessageID, Token: m.Token}
+	}))
+
+	tests := []struct {
+		opts []OptionID
+		code COAPCode
+		diag string
+	}{
+		{nil, Content, ""},
+		{[]OptionID{2050}, Content, ""},
+		{[]OptionID{2049, 2050, 2051}, BadOption, "unrecognized critical options 2049, 2051"},
+	}
+	for i, test := range tests {
+		req := Message{Type: Confirmable, Code: GET, MessageID: uint16(i), Token: []byte{byte(i)}}
+		for _, o := range test.opts {
+			req.AddOption(o, []byte("x"))
+		}
+		rv := dialAndSend(t, addr, req)
+		if rv.Code != test.code || string(rv.Payload) != test.diag {
+			t.Errorf("%v: expected %v %q, got %v %q", test.opts, test.code, test.diag, rv.Code, rv.Payload)
+		}
+	}
+	if n := atomic.LoadInt32(&served); n != 2 {
+		t.Errorf("Expected 2 requests served, got %v", n)
+	}
+}
+
+func TestServeRejectsMalformedCriticalOptions(t *testing.T) {
+	l, addr := startUDPLisenter(t)
+	defer l.Close()
+	s := &Server{
+		Handler:   FuncHandler(func(l *net.UDPConn, a *net.UDPAddr, m *Message) *Message { return nil }),
+		Malformed: func(data []byte, a *net.UDPAddr, err error) {},
+	}
+	go s.Serve(l)
+
+	c, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	defer c.Close()
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		// Uri-Port with length 3 (valid lengths are 0-2).
+		{"wrong length", []byte{0x41, 0x01, 0x00, 0x07, 't', 0x73, 0x11, 0x22, 0x33}},
+		// Uri-Host twice.
+		{"repeated", []byte{0x41, 0x01, 0x00, 0x07, 't', 0x31, 'a', 0x01, 'b'}},
+	}
+	for _, test := range tests {
+		if _, err := c.Write(test.data); err != nil {
+			t.Fatalf("Error writing: %v", err)
+		}
+		c.SetReadDeadline(time.Now().Add(time.Second))
+		buf := make([]byte, DefaultReadBufferSize)
+		n, err := c.Read(buf)
+		if err != nil {
+			t.Fatalf("%v: error reading: %v", test.name, err)
+		}
+		m, err := ParseMessage(buf[:n])
+		if err != nil || m.Type != Acknowledgement || m.Code != BadOption ||
+			m.MessageID != 7 || string(m.Token) != "t" || len(m.Payload) == 0 {
+			t.Errorf("%v: expected a piggybacked 4.02 with a diagnostic, got %v, %v", test.name, m, err)
+		}
+	}
+}
+
+func TestServeReuseRequests(t *testing.T) {
+	l, addr := startUDPLisenter(t)
+	defer l.Close()
+	s := &Server{ReuseRequests: true, Handler: FuncHandler(func(l *net.UDPConn, a *net.UDPAddr, m *Message) *Message {
+		return &Message{
+			Type:      Acknowledgement,
+			Code:      Content,
+			MessageID: m.MessageID,
+			Token:     m.Token,
+			Payload:   append([]byte(m.PathString()+":"), m.Payload...),
+		}
+	})}
+	go s.Serve(l)
+
+	c, err := Dial("udp", addr)
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	defer c.Close()
+	for i, path := range []string{"/a/long/path", "/b", "/c/d"} {
+		req := Message{Type: Confirmable, Code: POST, MessageID: uint16(i), Payload: []byte{byte('0' + i)}}
+		req.SetPathString(path)
+		rv, err := c.Send(req)
+		if err != nil {
+			t.Fatalf("Error sending: %v", err)
+		}
+		if exp := path[1:] + ":" + string(req.Payload); string(rv.Payload) != exp {
+			t.Errorf("Expected %q, got %q", exp, rv.Payload)
+		}
+	}
+}
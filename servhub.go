@@ -0,0 +1,1025 @@
+package coap
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Notification delivery errors.
+var (
+	ErrNoObservers   = errors.New("no observers")
+	ErrObserverQueue = errors.New("observer queue full")
+	ErrHubStopped    = errors.New("hub is not running")
+
+	ErrTooManyObservers = errors.New("too many observers")
+	ErrNoCodec          = errors.New("no codec for content format")
+)
+
+// Number of notifications of one priority queued per observer address
+// before dropping, unless configured otherwise.
+const observerQueueLen = 8
+
+// Priority orders the notifications waiting to be sent to the same
+// address.
+type Priority int
+
+// Notification priorities.
+const (
+	PriorityLow    Priority = -1 // e.g. bulk telemetry
+	PriorityNormal Priority = 0
+	PriorityHigh   Priority = 1 // e.g. alarms
+
+	numPriorities = 3
+)
+
+func (p Priority) index() int {
+	switch {
+	case p < PriorityNormal:
+		return 0
+	case p > PriorityNormal:
+		return 2
+	}
+	return 1
+}
+
+// Backpressure decides what happens to a notification when the
+// queue it belongs in is full.
+type Backpressure int
+
+// Backpressure policies.
+const (
+	// DropNewest refuses the new notification.
+	DropNewest Backpressure = iota
+	// DropOldest discards the oldest notification still queued
+	// for the same observation to make room.
+	DropOldest
+	// Coalesce replaces a notification still queued for the same
+	// observation, so only the latest state is sent.  This
+	// applies even before the queue is full.
+	Coalesce
+	// Block makes Notify wait until there is room.
+	Block
+)
+
+// Eviction decides what happens to a registration that would exceed
+// a resource's observer limit.
+type Eviction int
+
+// Eviction policies.
+const (
+	// RejectNew refuses the registration with 5.03 Service
+	// Unavailable.
+	RejectNew Eviction = iota
+	// EvictLeastRecentlyAcked makes room by dropping the observer
+	// that was least recently heard from.
+	EvictLeastRecentlyAcked
+)
+
+// ResourceConfig configures how notifications for a resource are
+// delivered.
+type ResourceConfig struct {
+	// Priority of the resource's notifications when several are
+	// waiting for the same address.
+	Priority Priority
+	// Backpressure applied when the queue for an observer is full.
+	Backpressure Backpressure
+	// MaxObservers limits the number of observers of the
+	// resource; zero means no limit.
+	MaxObservers int
+	// Eviction applies once MaxObservers is reached.
+	Eviction Eviction
+	// Snapshot, if not nil, provides the current representation
+	// of the resource, which is sent in response to registrations
+	// instead of consulting the wrapped handler.
+	Snapshot func() Message
+	// MaxAge, if positive, is stamped as the Max-Age option on
+	// every notification and registration response, telling
+	// observers and caches how long each stays fresh (RFC 7641
+	// section 3.3).  It's rounded to seconds.
+	MaxAge time.Duration
+}
+
+// Hub keeps track of the observers of resources (RFC 7641) and
+// delivers notifications to them.
+//
+// Observers may register at any time, but notifications are only
+// delivered between Start and Stop.
+type Hub struct {
+	// RetainLimit, when positive, makes notifications confirmable
+	// and enables store-and-forward: once an observer fails to
+	// acknowledge one, it and any later notifications are kept
+	// (at most RetainLimit of them, dropping the oldest) and sent
+	// when the observer is next heard from.
+	RetainLimit int
+	// Store keeps notifications for unreachable observers.  Nil
+	// means keeping them in memory.
+	Store NotificationStore
+	// Params are the transmission parameters for confirmable
+	// notifications.
+	Params TransmissionParams
+	// Tracer, if not nil, records the notifications sent.
+	Tracer *Tracer
+	// CoCoA, if not nil, adapts the retransmission timeouts of
+	// confirmable notifications to the observers' round-trip
+	// times.
+	CoCoA *CoCoA
+	// MessageIDs, if not nil, allocates the Message IDs of
+	// notifications.  Sharing the Server's keeps them apart from
+	// its separate responses.  Nil means an allocator of the hub's
+	// own.
+	MessageIDs *MessageIDAllocator
+
+	ids MessageIDAllocator
+
+	mu        sync.Mutex
+	running   bool
+	wg        sync.WaitGroup
+	observers map[string]map[string]*observer
+	peers     map[string]*peer
+	// unreachable indexes the observers with retained
+	// notifications by address.
+	unreachable map[string]map[*observer]bool
+	resources   map[string]ResourceConfig
+	last        map[string]Message
+	queueLimits [numPriorities]int
+	codecs      map[codecKey]Codec
+	sessions    SessionTable
+}
+
+// A Codec converts a payload from one content format to another.
+type Codec func(payload []byte) ([]byte, error)
+
+type codecKey struct {
+	from, to MediaType
+}
+
+type observer struct {
+	l           *net.UDPConn
+	addr        *net.UDPAddr
+	path        string
+	token       []byte
+	seq         uint32
+	peer        *peer
+	unreachable bool
+	// lastMID is the Message ID of the latest notification, which
+	// a Reset may refer to.
+	lastMID uint16
+	// group observers are multicast addresses, which only get
+	// non-confirmable notifications.
+	group bool
+	// lastAck is when the observer was last heard from.
+	lastAck time.Time
+	// accept is the content format asked for at registration,
+	// if any.
+	accept interface{}
+	// sent is when the latest notification was sent, and fresh
+	// until when its Max-Age says it's fresh.
+	sent, fresh time.Time
+}
+
+// ObserverState describes an observer and the freshness of what it
+// was last sent.
+type ObserverState struct {
+	// Path is the observed resource.
+	Path  string
+	Addr  *net.UDPAddr
+	Token []byte
+	// Seq is the Observe value of the latest notification.
+	Seq uint32
+	// Sent is when the latest notification was sent, or zero if
+	// none was yet.
+	Sent time.Time
+	// FreshUntil is when the latest notification's Max-Age runs
+	// out.
+	FreshUntil time.Time
+}
+
+// Fresh tells whether the observer's latest notification is still
+// fresh at t.
+func (s ObserverState) Fresh(t time.Time) bool {
+	return t.Before(s.FreshUntil)
+}
+
+// defaultMaxAge applies to notifications without Max-Age (RFC 7252
+// section 5.10.5).
+const defaultMaxAge = 60 * time.Second
+
+// stampMaxAge sets the Max-Age option of m from d, if positive.
+func stampMaxAge(m *Message, d time.Duration) {
+	if d > 0 {
+		m.SetOption(MaxAge, uint32((d+time.Second/2)/time.Second))
+	}
+}
+
+// maxAge returns how long m stays fresh.
+func maxAge(m Message) time.Duration {
+	v, ok := m.Option(MaxAge).(uint32)
+	if !ok {
+		return defaultMaxAge
+	}
+	return time.Duration(v) * time.Second
+}
+
+type notification struct {
+	o *observer
+	m Message
+}
+
+// peer holds the notifications waiting for one address, sent one at
+// a time by a transmitter goroutine, most urgent first.
+type peer struct {
+	queues    [numPriorities][]notification
+	cond      *sync.Cond // signaled when notifications are queued
+	space     *sync.Cond // signaled when notifications are taken
+	observers int
+	closed    bool
+}
+
+func (p *peer) next() (notification, bool) {
+	for i := numPriorities - 1; i >= 0; i-- {
+		if q := p.queues[i]; len(q) > 0 {
+			n := q[0]
+			p.queues[i] = q[1:]
+			return n, true
+		}
+	}
+	return notification{}, false
+}
+
+// observerKey identifies an observation of a resource by the
+// observer's address and the token it registered with.
+func observerKey(a *net.UDPAddr, token []byte) string {
+	return fmt.Sprintf("%v %x", a, token)
+}
+
+func (o *observer) key() string {
+	return o.path + " " + observerKey(o.addr, o.token)
+}
+
+// NotificationStore retains notifications for observers that can't
+// currently be reached.  Keys identify one observation of one
+// resource.
+type NotificationStore interface {
+	// Retain keeps m under key, discarding the oldest
+	// notifications beyond limit.
+	Retain(key string, m Message, limit int)
+	// Release removes and returns everything kept under key,
+	// oldest first.
+	Release(key string) []Message
+}
+
+type memStore struct {
+	mu sync.Mutex
+	m  map[string][]Message
+}
+
+func (s *memStore) Retain(key string, m Message, limit int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.m == nil {
+		s.m = map[string][]Message{}
+	}
+	q := append(s.m[key], m)
+	if len(q) > limit {
+		q = q[len(q)-limit:]
+	}
+	s.m[key] = q
+}
+
+func (s *memStore) Release(key string) []Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	q := s.m[key]
+	delete(s.m, key)
+	return q
+}
+
+// ObserverError describes a notification that couldn't be handed to
+// one observer.
+type ObserverError struct {
+	Addr  *net.UDPAddr
+	Token []byte
+	Err   error
+}
+
+func (e ObserverError) Error() string {
+	return fmt.Sprintf("%v (token %x): %v", e.Addr, e.Token, e.Err)
+}
+
+// NotifyError summarizes a notification that didn't reach all
+// observers.
+type NotifyError struct {
+	Queued int
+	Failed []ObserverError
+}
+
+func (e *NotifyError) Error() string {
+	var errs []string
+	for _, f := range e.Failed {
+		errs = append(errs, f.Error())
+	}
+	return fmt.Sprintf("notified %d of %d observers: %s", e.Queued,
+		e.Queued+len(e.Failed), strings.Join(errs, "; "))
+}
+
+// NewHub creates a stopped Hub without any observers.
+func NewHub() *Hub {
+	h := &Hub{
+		Store:       &memStore{},
+		observers:   map[string]map[string]*observer{},
+		peers:       map[string]*peer{},
+		unreachable: map[string]map[*observer]bool{},
+		resources:   map[string]ResourceConfig{},
+		last:        map[string]Message{},
+		codecs:      map[codecKey]Codec{},
+	}
+	for i := range h.queueLimits {
+		h.queueLimits[i] = observerQueueLen
+	}
+	return h
+}
+
+// Configure sets how notifications for the resource at path are
+// delivered.
+func (h *Hub) Configure(path string, c ResourceConfig) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.resources[path] = c
+}
+
+// SetQueueLimit sets how many notifications of priority p may wait
+// for one address before further ones are dropped.
+func (h *Hub) SetQueueLimit(p Priority, n int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.queueLimits[p.index()] = n
+}
+
+// enqueue queues m for o, applying the resource's backpressure
+// policy; only Notify may block.  Must be called with h.mu held.
+func (h *Hub) enqueue(o *observer, m Message, mayBlock bool) error {
+	rc := h.resources[o.path]
+	i := rc.Priority.index()
+	p := o.peer
+
+	queued := func() int {
+		for j, n := range p.queues[i] {
+			if n.o == o {
+				return j
+			}
+		}
+		return -1
+	}
+
+	switch rc.Backpressure {
+	case Coalesce:
+		if j := queued(); j >= 0 {
+			p.queues[i][j].m = m
+			return nil
+		}
+	case DropOldest:
+		if len(p.queues[i]) >= h.queueLimits[i] {
+			if j := queued(); j >= 0 {
+				p.queues[i] = append(p.queues[i][:j], p.queues[i][j+1:]...)
+			}
+		}
+	case Block:
+		for mayBlock && len(p.queues[i]) >= h.queueLimits[i] && h.queueLimits[i] > 0 {
+			p.space.Wait()
+			if !h.running {
+				return ErrHubStopped
+			}
+			if h.observers[o.path][observerKey(o.addr, o.token)] != o {
+				return ErrNoObservers
+			}
+		}
+	}
+
+	if len(p.queues[i]) >= h.queueLimits[i] {
+		return ErrObserverQueue
+	}
+	p.queues[i] = append(p.queues[i], notification{o, m})
+	p.cond.Signal()
+	return nil
+}
+
+func (h *Hub) nextMessageID(dst net.Addr) (uint16, error) {
+	if h.MessageIDs != nil {
+		return h.MessageIDs.Next(dst)
+	}
+	return h.ids.Next(dst)
+}
+
+// Handler wraps h so GET requests carrying Observe=0 register the
+// sender as an observer of the request path, and Observe=1 cancels
+// that again.
+//
+// Registrations are answered with the current state of the
+// resource: the configured Snapshot if there is one, otherwise the
+// response from h, falling back to the latest notification if h
+// doesn't respond.  Either way the Observe option is added.
+func (h *Hub) Handler(next Handler) Handler {
+	return FuncHandler(func(l *net.UDPConn, a *net.UDPAddr, m *Message) *Message {
+		h.seen(a)
+		if m.Type == Reset {
+			h.rejected(a, m.MessageID)
+			return nil
+		}
+		if m.Code != GET || m.Option(Observe) == nil {
+			return next.ServeCOAP(l, a, m)
+		}
+
+		path := m.PathString()
+		switch m.Option(Observe) {
+		case uint32(0):
+			o, err := h.register(l, a, m.Token, path)
+			if err != nil {
+				rv := &Message{
+					Type:      NonConfirmable,
+					Code:      ServiceUnavailable,
+					MessageID: m.MessageID,
+					Token:     m.Token,
+				}
+				if m.IsConfirmable() {
+					rv.Type = Acknowledgement
+				}
+				return rv
+			}
+			h.mu.Lock()
+			o.accept = m.Option(Accept)
+			h.mu.Unlock()
+			rv := h.snapshot(path, m)
+			if rv == nil {
+				rv = next.ServeCOAP(l, a, m)
+			}
+			if rv == nil {
+				rv = h.latest(path, m)
+			}
+			if rv == nil || rv.Code < Created || rv.Code >= BadRequest {
+				h.remove(o)
+				return rv
+			}
+			rv.SetOption(Observe, o.seq)
+			h.mu.Lock()
+			stampMaxAge(rv, h.resources[path].MaxAge)
+			h.sent(o, *rv)
+			h.mu.Unlock()
+			return rv
+		case uint32(1):
+			h.deregister(path, observerKey(a, m.Token))
+		}
+		return next.ServeCOAP(l, a, m)
+	})
+}
+
+// snapshot asks the resource at path for its state, if it can tell.
+func (h *Hub) snapshot(path string, req *Message) *Message {
+	h.mu.Lock()
+	f := h.resources[path].Snapshot
+	h.mu.Unlock()
+
+	if f == nil {
+		return nil
+	}
+	return registrationResponse(f(), req)
+}
+
+// latest returns the most recent notification for path, if any.
+func (h *Hub) latest(path string, req *Message) *Message {
+	h.mu.Lock()
+	m, ok := h.last[path]
+	h.mu.Unlock()
+
+	if !ok {
+		return nil
+	}
+	return registrationResponse(m, req)
+}
+
+// registrationResponse makes the representation m the response to
+// the registration req.
+func registrationResponse(m Message, req *Message) *Message {
+	m.opts = append(options(nil), m.opts...)
+	m.Type = NonConfirmable
+	if req.IsConfirmable() {
+		m.Type = Acknowledgement
+	}
+	m.MessageID = req.MessageID
+	m.Token = req.Token
+	return &m
+}
+
+func (h *Hub) register(l *net.UDPConn, a *net.UDPAddr, token []byte, path string) (*observer, error) {
+	o := &observer{
+		l:       l,
+		addr:    a,
+		path:    path,
+		token:   append([]byte(nil), token...),
+		seq:     2,
+		lastAck: time.Now(),
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	obs := h.observers[path]
+	k := observerKey(a, token)
+	if rc := h.resources[path]; obs[k] == nil &&
+		rc.MaxObservers > 0 && len(obs) >= rc.MaxObservers {
+		if rc.Eviction != EvictLeastRecentlyAcked {
+			return nil, ErrTooManyObservers
+		}
+		var oldest *observer
+		for _, o := range obs {
+			if oldest == nil || o.lastAck.Before(oldest.lastAck) {
+				oldest = o
+			}
+		}
+		h.deregisterLocked(path, observerKey(oldest.addr, oldest.token))
+	}
+
+	obs = h.observers[path]
+	if obs == nil {
+		obs = map[string]*observer{}
+		h.observers[path] = obs
+	}
+	if prev := obs[k]; prev != nil {
+		o.peer = prev.peer
+		h.forget(prev)
+	} else {
+		o.peer = h.peers[a.String()]
+		if o.peer == nil {
+			o.peer = &peer{
+				cond:  sync.NewCond(&h.mu),
+				space: sync.NewCond(&h.mu),
+			}
+			h.peers[a.String()] = o.peer
+			if h.running {
+				h.startPeer(o.peer)
+			}
+		}
+		o.peer.observers++
+	}
+	obs[k] = o
+	h.sessions.Get(localAddr(l), a).SetObservation(token, path)
+	return o, nil
+}
+
+func localAddr(l *net.UDPConn) net.Addr {
+	if l == nil {
+		return nil
+	}
+	return l.LocalAddr()
+}
+
+// Session returns the state shared with the peer at a, as seen from
+// l.  It records the peer's observations.
+func (h *Hub) Session(l *net.UDPConn, a *net.UDPAddr) *Session {
+	return h.sessions.Get(localAddr(l), a)
+}
+
+// Observers returns the state of the observers of path.
+func (h *Hub) Observers(path string) []ObserverState {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var rv []ObserverState
+	for _, o := range h.observers[path] {
+		rv = append(rv, o.state())
+	}
+	return rv
+}
+
+// Registrations returns the state of the observers of all resources,
+// ordered by path.  Handlers may consult it, e.g. to skip work no one
+// is observing.
+func (h *Hub) Registrations() []ObserverState {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var rv []ObserverState
+	for _, obs := range h.observers {
+		for _, o := range obs {
+			rv = append(rv, o.state())
+		}
+	}
+	sort.Slice(rv, func(i, j int) bool {
+		if rv[i].Path != rv[j].Path {
+			return rv[i].Path < rv[j].Path
+		}
+		return observerKey(rv[i].Addr, rv[i].Token) < observerKey(rv[j].Addr, rv[j].Token)
+	})
+	return rv
+}
+
+// Deregister removes the observer at a that registered for path with
+// token, telling whether there was one.  It won't get further
+// notifications.
+func (h *Hub) Deregister(path string, a *net.UDPAddr, token []byte) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	k := observerKey(a, token)
+	if h.observers[path][k] == nil {
+		return false
+	}
+	h.deregisterLocked(path, k)
+	return true
+}
+
+// state describes o.  h.mu must be held.
+func (o *observer) state() ObserverState {
+	return ObserverState{
+		Path:       o.path,
+		Addr:       o.addr,
+		Token:      append([]byte(nil), o.token...),
+		Seq:        o.seq,
+		Sent:       o.sent,
+		FreshUntil: o.fresh,
+	}
+}
+
+// AddGroup registers the multicast address group as an observer of
+// path, so every notification for it is also sent (non-confirmable,
+// carrying token) to the group from l.
+func (h *Hub) AddGroup(path string, l *net.UDPConn, group *net.UDPAddr, token []byte) error {
+	o, err := h.register(l, group, token, path)
+	if err != nil {
+		return err
+	}
+	h.mu.Lock()
+	o.group = true
+	h.mu.Unlock()
+	return nil
+}
+
+// RemoveGroup stops notifying group about path.
+func (h *Hub) RemoveGroup(path string, group *net.UDPAddr) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for k, o := range h.observers[path] {
+		if o.group && o.addr.String() == group.String() {
+			h.deregisterLocked(path, k)
+		}
+	}
+}
+
+func (h *Hub) deregister(path, key string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.deregisterLocked(path, key)
+}
+
+// remove deregisters o, unless it has been replaced already.
+func (h *Hub) remove(o *observer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	k := observerKey(o.addr, o.token)
+	if h.observers[o.path][k] == o {
+		h.deregisterLocked(o.path, k)
+	}
+}
+
+func (h *Hub) deregisterLocked(path, key string) {
+	obs := h.observers[path]
+	if o := obs[key]; o != nil {
+		delete(obs, key)
+		h.forget(o)
+		s := h.sessions.Get(localAddr(o.l), o.addr)
+		s.RemoveObservation(o.token)
+		if s.ObservationCount() == 0 {
+			h.sessions.Remove(localAddr(o.l), o.addr)
+		}
+		o.peer.observers--
+		if o.peer.observers == 0 {
+			o.peer.closed = true
+			o.peer.cond.Signal()
+			delete(h.peers, o.addr.String())
+		}
+	}
+	if len(obs) == 0 {
+		delete(h.observers, path)
+	}
+}
+
+// forget discards the notifications retained for o.  h.mu must be
+// held.
+func (h *Hub) forget(o *observer) {
+	if !o.unreachable {
+		return
+	}
+	o.unreachable = false
+	a := o.addr.String()
+	delete(h.unreachable[a], o)
+	if len(h.unreachable[a]) == 0 {
+		delete(h.unreachable, a)
+	}
+	h.Store.Release(o.key())
+}
+
+// retain keeps m for o until it's heard from again, unless it has
+// been deregistered meanwhile.  h.mu must be held.
+func (h *Hub) retain(o *observer, m Message) {
+	if h.observers[o.path][observerKey(o.addr, o.token)] != o {
+		return
+	}
+	if !o.unreachable {
+		o.unreachable = true
+		a := o.addr.String()
+		if h.unreachable[a] == nil {
+			h.unreachable[a] = map[*observer]bool{}
+		}
+		h.unreachable[a][o] = true
+	}
+	h.Store.Retain(o.key(), m, h.RetainLimit)
+}
+
+// rejected deregisters the observer at a whose latest
+// non-confirmable notification was answered with a Reset.
+func (h *Hub) rejected(a *net.UDPAddr, mid uint16) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for path, obs := range h.observers {
+		for k, o := range obs {
+			if o.lastMID == mid && o.addr.String() == a.String() {
+				h.deregisterLocked(path, k)
+			}
+		}
+	}
+}
+
+func (h *Hub) startPeer(p *peer) {
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+		for {
+			h.mu.Lock()
+			for h.running && !p.closed && p.empty() {
+				p.cond.Wait()
+			}
+			n, ok := p.next()
+			p.space.Broadcast()
+			h.mu.Unlock()
+
+			if !ok {
+				return
+			}
+			h.deliver(n.o, n.m)
+		}
+	}()
+}
+
+func (p *peer) empty() bool {
+	for _, q := range p.queues {
+		if len(q) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// sent records that m was sent to o.  h.mu must be held.
+func (h *Hub) sent(o *observer, m Message) {
+	o.sent = time.Now()
+	o.fresh = o.sent.Add(maxAge(m))
+}
+
+func (h *Hub) deliver(o *observer, m Message) {
+	if m.Type != Confirmable {
+		h.mu.Lock()
+		o.lastMID = m.MessageID
+		h.mu.Unlock()
+		if Transmit(o.l, o.addr, m) == nil {
+			telemetry{tracer: h.Tracer}.sent(o.l.LocalAddr(), o.addr, m, false)
+			h.mu.Lock()
+			h.sent(o, m)
+			h.mu.Unlock()
+		}
+		return
+	}
+
+	h.mu.Lock()
+	if o.unreachable {
+		h.retain(o, m)
+		h.mu.Unlock()
+		return
+	}
+	h.mu.Unlock()
+
+	rv, err := transmitConfirmable(o.l, o.addr, m, h.Params, telemetry{tracer: h.Tracer}, h.CoCoA)
+	if err == nil {
+		h.mu.Lock()
+		o.lastAck = time.Now()
+		h.sent(o, m)
+		h.mu.Unlock()
+	}
+	switch {
+	case err == ErrRetransmitTimeout:
+		h.mu.Lock()
+		h.retain(o, m)
+		h.mu.Unlock()
+	case err == nil && rv.Type == Reset:
+		h.remove(o)
+	}
+}
+
+// seen forwards notifications retained for observers at a, now that
+// it has shown up again.
+func (h *Hub) seen(a *net.UDPAddr) {
+	if h.RetainLimit <= 0 {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if !h.running {
+		return
+	}
+	obs := h.unreachable[a.String()]
+	delete(h.unreachable, a.String())
+	for o := range obs {
+		o.unreachable = false
+		for _, m := range h.Store.Release(o.key()) {
+			var err error
+			if m.MessageID, err = h.nextMessageID(o.addr); err != nil {
+				h.retain(o, m)
+				continue
+			}
+			h.enqueue(o, m, false)
+		}
+	}
+}
+
+// Start begins delivering notifications.
+func (h *Hub) Start() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.running {
+		return
+	}
+	h.running = true
+	for _, p := range h.peers {
+		h.startPeer(p)
+	}
+}
+
+// Stop stops accepting notifications and waits until the ones
+// already queued have been sent.  Observers stay registered, so the
+// Hub can be started again.
+func (h *Hub) Stop() {
+	h.mu.Lock()
+	if !h.running {
+		h.mu.Unlock()
+		return
+	}
+	h.running = false
+	for _, p := range h.peers {
+		p.cond.Broadcast()
+		p.space.Broadcast()
+	}
+	h.mu.Unlock()
+
+	h.wg.Wait()
+}
+
+// RegisterCodec makes Notify convert payloads from one content
+// format to another for observers that registered with an Accept
+// option asking for it.
+func (h *Hub) RegisterCodec(from, to MediaType, c Codec) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.codecs[codecKey{from, to}] = c
+}
+
+// transcode converts the notification n into the accept content
+// format, if one was asked for, reusing conversions already made for
+// this notification.  Must be called with h.mu held.
+func (h *Hub) transcode(n *Message, accept interface{}, done map[MediaType][]byte) error {
+	to, ok := accept.(MediaType)
+	if !ok {
+		return nil
+	}
+	from, _ := n.Option(ContentFormat).(MediaType)
+	if from == to {
+		return nil
+	}
+
+	p, ok := done[to]
+	if !ok {
+		c := h.codecs[codecKey{from, to}]
+		if c == nil {
+			return ErrNoCodec
+		}
+		var err error
+		if p, err = c(n.Payload); err != nil {
+			return err
+		}
+		done[to] = p
+	}
+	n.Payload = p
+	n.SetOption(ContentFormat, to)
+	return nil
+}
+
+// Notify sends m to every observer of path, returning the number of
+// observers targeted.  The error is ErrHubStopped if the Hub isn't
+// running, ErrNoObservers if there were no observers, or a
+// *NotifyError if the notification couldn't be queued for some of
+// them.
+//
+// Observers that registered with an Accept option get m converted to
+// that content format by the registered codecs.
+//
+// A notification with an error code, such as 4.04 Not Found once the
+// resource is deleted, is the last one: it's sent without the Observe
+// option and the observers are removed (RFC 7641 section 4.2).
+func (h *Hub) Notify(path string, m Message) (int, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if !h.running {
+		return 0, ErrHubStopped
+	}
+	final := m.Code >= BadRequest
+	if final {
+		delete(h.last, path)
+	} else {
+		h.last[path] = m
+	}
+
+	// Blocking releases the lock, so work on a snapshot.
+	var obs []*observer
+	for _, o := range h.observers[path] {
+		obs = append(obs, o)
+	}
+	if len(obs) == 0 {
+		return 0, ErrNoObservers
+	}
+
+	nerr := &NotifyError{}
+	payloads := map[MediaType][]byte{}
+	for _, o := range obs {
+		n := m
+		n.opts = append(options(nil), m.opts...)
+		if err := h.transcode(&n, o.accept, payloads); err != nil {
+			nerr.Failed = append(nerr.Failed, ObserverError{
+				Addr:  o.addr,
+				Token: o.token,
+				Err:   err,
+			})
+			continue
+		}
+		n.Type = NonConfirmable
+		if h.RetainLimit > 0 && !o.group {
+			n.Type = Confirmable
+		}
+		var err error
+		if n.MessageID, err = h.nextMessageID(o.addr); err != nil {
+			nerr.Failed = append(nerr.Failed, ObserverError{
+				Addr:  o.addr,
+				Token: o.token,
+				Err:   err,
+			})
+			continue
+		}
+		n.Token = o.token
+		if !final {
+			o.seq = (o.seq + 1) & 0xffffff
+			n.SetOption(Observe, o.seq)
+			stampMaxAge(&n, h.resources[path].MaxAge)
+		}
+
+		if err := h.enqueue(o, n, true); err != nil {
+			nerr.Failed = append(nerr.Failed, ObserverError{
+				Addr:  o.addr,
+				Token: o.token,
+				Err:   err,
+			})
+		} else {
+			nerr.Queued++
+		}
+	}
+
+	if final {
+		// Queued notifications are still sent after this.
+		for _, o := range obs {
+			if h.observers[path][observerKey(o.addr, o.token)] == o {
+				h.deregisterLocked(path, observerKey(o.addr, o.token))
+			}
+		}
+	}
+
+	if len(nerr.Failed) > 0 {
+		return len(obs), nerr
+	}
+	return len(obs), nil
+}
@@ -0,0 +1,722 @@
+package coap
+
+import (
+	"net"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// observeMID numbers the requests made by observeRequest, which the
+// server would take for duplicates if they shared a Message ID.
+var observeMID uint32 = 4320
+
+func observeRequest(path string, token string) Message {
+	req := Message{
+		Type:      Confirmable,
+		Code:      GET,
+		MessageID: uint16(atomic.AddUint32(&observeMID, 1)),
+		Token:     []byte(token),
+	}
+	req.SetOption(Observe, 0)
+	req.SetPathString(path)
+	return req
+}
+
+func contentHandler(l *net.UDPConn, a *net.UDPAddr, m *Message) *Message {
+	if !m.IsConfirmable() {
+		return nil
+	}
+	return &Message{
+		Type:      Acknowledgement,
+		Code:      Content,
+		MessageID: m.MessageID,
+		Token:     m.Token,
+		Payload:   []byte("current"),
+	}
+}
+
+// startHub serves h in front of contentHandler and returns a client
+// connected to it.
+func startHub(t *testing.T, h *Hub) (*net.UDPConn, *Conn) {
+	l, addr := startUDPLisenter(t)
+	go Serve(l, h.Handler(FuncHandler(contentHandler)))
+
+	c, err := Dial("udp", addr)
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	return l, c
+}
+
+func TestHubNotify(t *testing.T) {
+	h := NewHub()
+	h.Start()
+	defer h.Stop()
+	l, c := startHub(t, h)
+	defer l.Close()
+	defer c.Close()
+
+	rv, err := c.Send(observeRequest("/temp", "tok"))
+	if err != nil {
+		t.Fatalf("Error registering: %v", err)
+	}
+	if rv.Option(Observe) == nil {
+		t.Errorf("Expected Observe option in registration response")
+	}
+
+	n, err := h.Notify("temp", Message{Code: Content, Payload: []byte("21C")})
+	if n != 1 || err != nil {
+		t.Fatalf("Expected 1 observer notified, got %v, %v", n, err)
+	}
+
+	note, err := c.Receive()
+	if err != nil {
+		t.Fatalf("Error receiving notification: %v", err)
+	}
+	if string(note.Token) != "tok" || string(note.Payload) != "21C" {
+		t.Errorf("Unexpected notification: %v (%s)", note, note.Payload)
+	}
+	if seq, _ := note.Option(Observe).(uint32); seq <= rv.Option(Observe).(uint32) {
+		t.Errorf("Expected increasing Observe sequence, got %v after %v",
+			seq, rv.Option(Observe))
+	}
+}
+
+func TestHubNotifyNoObservers(t *testing.T) {
+	h := NewHub()
+	h.Start()
+	defer h.Stop()
+	n, err := h.Notify("nothing", Message{Code: Content})
+	if n != 0 || err != ErrNoObservers {
+		t.Errorf("Expected 0, ErrNoObservers; got %v, %v", n, err)
+	}
+}
+
+func TestHubNotifyQueueFull(t *testing.T) {
+	h := NewHub()
+	h.SetQueueLimit(PriorityNormal, 0)
+	a := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5683}
+	h.register(nil, a, []byte("t"), "full")
+	h.running = true // without transmitters, so notifications pile up
+
+	n, err := h.Notify("full", Message{Code: Content})
+	nerr, ok := err.(*NotifyError)
+	if n != 1 || !ok {
+		t.Fatalf("Expected 1, *NotifyError; got %v, %v", n, err)
+	}
+	if nerr.Queued != 0 || len(nerr.Failed) != 1 ||
+		nerr.Failed[0].Err != ErrObserverQueue {
+		t.Errorf("Unexpected delivery summary: %v", nerr)
+	}
+}
+
+func TestHubCancelObserve(t *testing.T) {
+	h := NewHub()
+	h.Start()
+	defer h.Stop()
+	l, c := startHub(t, h)
+	defer l.Close()
+	defer c.Close()
+
+	if _, err := c.Send(observeRequest("/temp", "tok")); err != nil {
+		t.Fatalf("Error registering: %v", err)
+	}
+	cancel := observeRequest("/temp", "tok")
+	cancel.SetOption(Observe, 1)
+	if _, err := c.Send(cancel); err != nil {
+		t.Fatalf("Error deregistering: %v", err)
+	}
+
+	if n, err := h.Notify("temp", Message{Code: Content}); n != 0 || err != ErrNoObservers {
+		t.Errorf("Expected no observers left, got %v, %v", n, err)
+	}
+}
+
+func TestHubStartStop(t *testing.T) {
+	h := NewHub()
+	l, c := startHub(t, h)
+	defer l.Close()
+	defer c.Close()
+
+	if _, err := c.Send(observeRequest("/temp", "tok")); err != nil {
+		t.Fatalf("Error registering: %v", err)
+	}
+	if _, err := h.Notify("temp", Message{Code: Content}); err != ErrHubStopped {
+		t.Errorf("Expected ErrHubStopped before Start, got %v", err)
+	}
+
+	h.Start()
+	for i := 0; i < 3; i++ {
+		if _, err := h.Notify("temp", Message{Code: Content}); err != nil {
+			t.Fatalf("Error notifying: %v", err)
+		}
+	}
+	h.Stop()
+
+	// Everything queued before Stop is still delivered.
+	for i := 0; i < 3; i++ {
+		if _, err := c.Receive(); err != nil {
+			t.Fatalf("Error receiving notification %v: %v", i, err)
+		}
+	}
+	if _, err := h.Notify("temp", Message{Code: Content}); err != ErrHubStopped {
+		t.Errorf("Expected ErrHubStopped after Stop, got %v", err)
+	}
+
+	// And it can be restarted with the observer still registered.
+	h.Start()
+	defer h.Stop()
+	if n, err := h.Notify("temp", Message{Code: Content}); n != 1 || err != nil {
+		t.Errorf("Expected 1 observer after restart, got %v, %v", n, err)
+	}
+}
+
+func TestHubStoreAndForward(t *testing.T) {
+	defer func(d time.Duration) { ackTimeout = d }(ackTimeout)
+	ackTimeout = time.Millisecond
+
+	h := NewHub()
+	h.RetainLimit = 2
+	h.Start()
+	defer h.Stop()
+
+	l, addr := startUDPLisenter(t)
+	defer l.Close()
+	go Serve(l, h.Handler(FuncHandler(contentHandler)))
+
+	tmp, _ := startUDPLisenter(t)
+	d := Dialer{LocalAddr: tmp.LocalAddr().(*net.UDPAddr)}
+	tmp.Close()
+
+	c, err := d.Dial("udp", addr)
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	if _, err := c.Send(observeRequest("/temp", "tok")); err != nil {
+		t.Fatalf("Error registering: %v", err)
+	}
+	// The device goes to sleep.
+	c.Close()
+
+	for _, p := range []string{"1", "2", "3"} {
+		if _, err := h.Notify("temp", Message{Code: Content, Payload: []byte(p)}); err != nil {
+			t.Fatalf("Error notifying: %v", err)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// It wakes up and says hello on the same address.
+	c, err = d.Dial("udp", addr)
+	if err != nil {
+		t.Fatalf("Error redialing: %v", err)
+	}
+	defer c.Close()
+	if _, err := c.Send(Message{Type: NonConfirmable, Code: GET}); err != nil {
+		t.Fatalf("Error sending: %v", err)
+	}
+
+	for _, exp := range []string{"2", "3"} {
+		note, err := c.Receive()
+		if err != nil {
+			t.Fatalf("Error receiving retained notification: %v", err)
+		}
+		if note.Type != Confirmable || string(note.Payload) != exp {
+			t.Errorf("Expected confirmable notification %q, got %v (%s)",
+				exp, note, note.Payload)
+		}
+		c.Send(Message{Type: Acknowledgement, MessageID: note.MessageID})
+	}
+}
+
+func TestHubPriorities(t *testing.T) {
+	h := NewHub()
+	h.Configure("alarm", ResourceConfig{Priority: PriorityHigh})
+	h.Configure("telemetry", ResourceConfig{Priority: PriorityLow})
+	h.SetQueueLimit(PriorityLow, 1)
+
+	a := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5683}
+	for _, path := range []string{"alarm", "telemetry", "state"} {
+		h.register(nil, a, []byte(path), path)
+	}
+	h.running = true // without transmitters, so notifications pile up
+
+	notify := func(path string) error {
+		_, err := h.Notify(path, Message{Code: Content, Payload: []byte(path)})
+		return err
+	}
+	for _, path := range []string{"telemetry", "state", "alarm"} {
+		if err := notify(path); err != nil {
+			t.Fatalf("Error notifying %v: %v", path, err)
+		}
+	}
+	if err := notify("telemetry"); err == nil {
+		t.Errorf("Expected the low priority queue to be full")
+	}
+
+	p := h.peers[a.String()]
+	for _, exp := range []string{"alarm", "state", "telemetry"} {
+		n, ok := p.next()
+		if !ok || string(n.m.Payload) != exp {
+			t.Errorf("Expected %v next, got %s (%v)", exp, n.m.Payload, ok)
+		}
+	}
+	if _, ok := p.next(); ok {
+		t.Errorf("Expected the queues to be drained")
+	}
+}
+
+func TestHubGroupObserver(t *testing.T) {
+	h := NewHub()
+	h.RetainLimit = 1
+	h.Start()
+	defer h.Stop()
+
+	l, _ := startUDPLisenter(t)
+	defer l.Close()
+
+	// A plain socket stands in for the multicast group.
+	group, _ := startUDPLisenter(t)
+	defer group.Close()
+
+	if err := h.AddGroup("scene", l, group.LocalAddr().(*net.UDPAddr), []byte("g")); err != nil {
+		t.Fatalf("Error adding group: %v", err)
+	}
+	if n, err := h.Notify("scene", Message{Code: Content, Payload: []byte("on")}); n != 1 || err != nil {
+		t.Fatalf("Expected 1 observer notified, got %v, %v", n, err)
+	}
+
+	group.SetReadDeadline(time.Now().Add(time.Second))
+	note, err := Receive(group, make([]byte, DefaultReadBufferSize))
+	if err != nil {
+		t.Fatalf("Error receiving group notification: %v", err)
+	}
+	if note.Type != NonConfirmable || string(note.Token) != "g" ||
+		string(note.Payload) != "on" {
+		t.Errorf("Unexpected group notification: %v (%s)", note, note.Payload)
+	}
+
+	h.RemoveGroup("scene", group.LocalAddr().(*net.UDPAddr))
+	if _, err := h.Notify("scene", Message{Code: Content}); err != ErrNoObservers {
+		t.Errorf("Expected ErrNoObservers after RemoveGroup, got %v", err)
+	}
+}
+
+func TestHubObserversKeyedByToken(t *testing.T) {
+	h := NewHub()
+	h.Start()
+	defer h.Stop()
+	l, c := startHub(t, h)
+	defer l.Close()
+	defer c.Close()
+
+	// One client, two observations of one resource, and one of another.
+	for _, r := range []struct{ path, token string }{
+		{"/temp", "t1"}, {"/temp", "t2"}, {"/humidity", "h1"},
+	} {
+		if _, err := c.Send(observeRequest(r.path, r.token)); err != nil {
+			t.Fatalf("Error registering %v: %v", r, err)
+		}
+	}
+	observations := func(path string) int {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		return len(h.observers[path])
+	}
+	if n := observations("temp"); n != 2 {
+		t.Errorf("Expected 2 observations of temp, got %v", n)
+	}
+	if n := observations("humidity"); n != 1 {
+		t.Errorf("Expected 1 observation of humidity, got %v", n)
+	}
+
+	// Re-registering with the same token doesn't add another.
+	if _, err := c.Send(observeRequest("/temp", "t1")); err != nil {
+		t.Fatalf("Error re-registering: %v", err)
+	}
+	if n := observations("temp"); n != 2 {
+		t.Errorf("Expected 2 observations of temp after re-registering, got %v", n)
+	}
+
+	// Cancelling one leaves the other.
+	cancel := observeRequest("/temp", "t2")
+	cancel.SetOption(Observe, 1)
+	if _, err := c.Send(cancel); err != nil {
+		t.Fatalf("Error deregistering: %v", err)
+	}
+	if n, _ := h.Notify("temp", Message{Code: Content}); n != 1 {
+		t.Errorf("Expected 1 observation of temp after cancelling, got %v", n)
+	}
+}
+
+func TestHubResetDeregistersObserver(t *testing.T) {
+	h := NewHub()
+	h.Start()
+	defer h.Stop()
+	l, c := startHub(t, h)
+	defer l.Close()
+	defer c.Close()
+
+	for _, tok := range []string{"t1", "t2"} {
+		if _, err := c.Send(observeRequest("/temp", tok)); err != nil {
+			t.Fatalf("Error registering: %v", err)
+		}
+	}
+	if _, err := h.Notify("temp", Message{Code: Content}); err != nil {
+		t.Fatalf("Error notifying: %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		note, err := c.Receive()
+		if err != nil {
+			t.Fatalf("Error receiving: %v", err)
+		}
+		if string(note.Token) == "t1" {
+			c.Send(Message{Type: Reset, MessageID: note.MessageID})
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	if n, _ := h.Notify("temp", Message{Code: Content}); n != 1 {
+		t.Errorf("Expected only the unrejected observation left, got %v", n)
+	}
+}
+
+func TestHubBackpressure(t *testing.T) {
+	tests := []struct {
+		policy Backpressure
+		exp    []string
+		errs   int
+	}{
+		{DropNewest, []string{"1", "2"}, 1},
+		{DropOldest, []string{"2", "3"}, 0},
+		{Coalesce, []string{"3"}, 0},
+	}
+
+	for _, test := range tests {
+		h := NewHub()
+		h.Configure("r", ResourceConfig{Backpressure: test.policy})
+		h.SetQueueLimit(PriorityNormal, 2)
+		a := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5683}
+		h.register(nil, a, []byte("t"), "r")
+		h.running = true // without transmitters, so notifications pile up
+
+		errs := 0
+		for _, p := range []string{"1", "2", "3"} {
+			if _, err := h.Notify("r", Message{Code: Content, Payload: []byte(p)}); err != nil {
+				errs++
+			}
+		}
+		if errs != test.errs {
+			t.Errorf("%v: expected %v failed notifications, got %v",
+				test.policy, test.errs, errs)
+		}
+
+		var got []string
+		for n, ok := h.peers[a.String()].next(); ok; n, ok = h.peers[a.String()].next() {
+			got = append(got, string(n.m.Payload))
+		}
+		if !reflect.DeepEqual(got, test.exp) {
+			t.Errorf("%v: expected %v queued, got %v", test.policy, test.exp, got)
+		}
+	}
+}
+
+func TestHubBackpressureBlock(t *testing.T) {
+	h := NewHub()
+	h.Configure("r", ResourceConfig{Backpressure: Block})
+	h.SetQueueLimit(PriorityNormal, 1)
+	a := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5683}
+	h.register(nil, a, []byte("t"), "r")
+	h.running = true // without transmitters, so notifications pile up
+
+	if _, err := h.Notify("r", Message{Code: Content}); err != nil {
+		t.Fatalf("Error notifying: %v", err)
+	}
+
+	done := make(chan error)
+	go func() {
+		_, err := h.Notify("r", Message{Code: Content})
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		t.Fatalf("Expected Notify to block, got %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	// Play transmitter.
+	h.mu.Lock()
+	p := h.peers[a.String()]
+	p.next()
+	p.space.Broadcast()
+	h.mu.Unlock()
+
+	if err := <-done; err != nil {
+		t.Errorf("Error from blocked Notify: %v", err)
+	}
+}
+
+func TestHubRegistrationSnapshot(t *testing.T) {
+	h := NewHub()
+	h.Start()
+	defer h.Stop()
+	h.Configure("temp", ResourceConfig{Snapshot: func() Message {
+		return Message{Code: Content, Payload: []byte("19C")}
+	}})
+
+	l, addr := startUDPLisenter(t)
+	defer l.Close()
+	go Serve(l, h.Handler(FuncHandler(func(l *net.UDPConn, a *net.UDPAddr, m *Message) *Message {
+		return nil
+	})))
+
+	c, err := Dial("udp", addr)
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	defer c.Close()
+
+	rv, err := c.Send(observeRequest("/temp", "tok"))
+	if err != nil {
+		t.Fatalf("Error registering: %v", err)
+	}
+	if rv.Type != Acknowledgement || string(rv.Token) != "tok" ||
+		string(rv.Payload) != "19C" || rv.Option(Observe) == nil {
+		t.Errorf("Expected snapshot in the registration response, got %v (%s)",
+			rv, rv.Payload)
+	}
+
+	// Without a snapshot, the latest notification is used.
+	if _, err := h.Notify("humidity", Message{Code: Content, Payload: []byte("40%")}); err != ErrNoObservers {
+		t.Fatalf("Expected ErrNoObservers, got %v", err)
+	}
+	rv, err = c.Send(observeRequest("/humidity", "tok2"))
+	if err != nil {
+		t.Fatalf("Error registering: %v", err)
+	}
+	if string(rv.Payload) != "40%" || rv.Option(Observe) == nil {
+		t.Errorf("Expected latest state in the registration response, got %v (%s)",
+			rv, rv.Payload)
+	}
+}
+
+func TestHubObserverLimit(t *testing.T) {
+	for _, eviction := range []Eviction{RejectNew, EvictLeastRecentlyAcked} {
+		h := NewHub()
+		h.Configure("temp", ResourceConfig{MaxObservers: 2, Eviction: eviction})
+		l, c := startHub(t, h)
+
+		for _, tok := range []string{"t1", "t2"} {
+			if _, err := c.Send(observeRequest("/temp", tok)); err != nil {
+				t.Fatalf("Error registering: %v", err)
+			}
+		}
+		rv, err := c.Send(observeRequest("/temp", "t3"))
+		if err != nil {
+			t.Fatalf("Error registering: %v", err)
+		}
+
+		h.mu.Lock()
+		_, first := h.observers["temp"][observerKey(c.conn.LocalAddr().(*net.UDPAddr), []byte("t1"))]
+		n := len(h.observers["temp"])
+		h.mu.Unlock()
+
+		switch eviction {
+		case RejectNew:
+			if rv.Code != ServiceUnavailable || !first {
+				t.Errorf("Expected 5.03 and the first observer kept, got %v, %v",
+					rv.Code, first)
+			}
+		case EvictLeastRecentlyAcked:
+			if rv.Code != Content || first {
+				t.Errorf("Expected registration and the first observer evicted, got %v, %v",
+					rv.Code, first)
+			}
+		}
+		if n != 2 {
+			t.Errorf("Expected 2 observers, got %v", n)
+		}
+
+		c.Close()
+		l.Close()
+	}
+}
+
+func TestHubNotifyTranscodes(t *testing.T) {
+	h := NewHub()
+	h.RegisterCodec(AppJSON, AppCBOR, func(p []byte) ([]byte, error) {
+		return []byte("cbor:" + string(p)), nil
+	})
+	h.Start()
+	defer h.Stop()
+	l, c := startHub(t, h)
+	defer l.Close()
+	defer c.Close()
+
+	req := observeRequest("/temp", "cbor")
+	req.SetOption(Accept, AppCBOR)
+	for _, r := range []Message{observeRequest("/temp", "json"), req} {
+		if _, err := c.Send(r); err != nil {
+			t.Fatalf("Error registering: %v", err)
+		}
+	}
+
+	m := Message{Code: Content, Payload: []byte(`{"t":21}`)}
+	m.SetOption(ContentFormat, AppJSON)
+	if n, err := h.Notify("temp", m); n != 2 || err != nil {
+		t.Fatalf("Expected 2 observers notified, got %v, %v", n, err)
+	}
+
+	exp := map[string]string{
+		"json": `{"t":21}`,
+		"cbor": `cbor:{"t":21}`,
+	}
+	for range exp {
+		note, err := c.Receive()
+		if err != nil {
+			t.Fatalf("Error receiving notification: %v", err)
+		}
+		if string(note.Payload) != exp[string(note.Token)] {
+			t.Errorf("Expected %q for %s, got %q", exp[string(note.Token)],
+				note.Token, note.Payload)
+		}
+	}
+}
+
+func TestHubMaxAge(t *testing.T) {
+	h := NewHub()
+	h.Configure("temp", ResourceConfig{MaxAge: 30 * time.Second})
+	h.Start()
+	defer h.Stop()
+	l, c := startHub(t, h)
+	defer l.Close()
+	defer c.Close()
+
+	before := time.Now()
+	rv, err := c.Send(observeRequest("/temp", "tok"))
+	if err != nil {
+		t.Fatalf("Error registering: %v", err)
+	}
+	if rv.Option(MaxAge) != uint32(30) {
+		t.Errorf("Expected Max-Age 30 on registration response, got %v", rv.Option(MaxAge))
+	}
+
+	if _, err := h.Notify("temp", Message{Code: Content}); err != nil {
+		t.Fatalf("Error notifying: %v", err)
+	}
+	note, err := c.Receive()
+	if err != nil {
+		t.Fatalf("Error receiving notification: %v", err)
+	}
+	if note.Option(MaxAge) != uint32(30) {
+		t.Errorf("Expected Max-Age 30 on notification, got %v", note.Option(MaxAge))
+	}
+
+	obs := h.Observers("temp")
+	if len(obs) != 1 {
+		t.Fatalf("Expected 1 observer, got %v", obs)
+	}
+	s := obs[0]
+	if string(s.Token) != "tok" || s.Seq != note.Option(Observe) || s.Sent.Before(before) ||
+		s.FreshUntil.Sub(s.Sent) != 30*time.Second {
+		t.Errorf("Unexpected observer state: %+v", s)
+	}
+	if !s.Fresh(time.Now()) || s.Fresh(s.Sent.Add(31*time.Second)) {
+		t.Errorf("Unexpected freshness for %+v", s)
+	}
+}
+
+func TestHubRegistrations(t *testing.T) {
+	h := NewHub()
+	h.Start()
+	defer h.Stop()
+	l, c := startHub(t, h)
+	defer l.Close()
+	defer c.Close()
+
+	for _, r := range []Message{
+		observeRequest("/temp", "t1"),
+		observeRequest("/humidity", "h1"),
+		observeRequest("/temp", "t2"),
+	} {
+		if _, err := c.Send(r); err != nil {
+			t.Fatalf("Error registering: %v", err)
+		}
+	}
+
+	var got []string
+	for _, s := range h.Registrations() {
+		got = append(got, s.Path+" "+string(s.Token))
+	}
+	if exp := []string{"humidity h1", "temp t1", "temp t2"}; !reflect.DeepEqual(got, exp) {
+		t.Errorf("Expected registrations %q, got %q", exp, got)
+	}
+
+	caddr := c.socket().LocalAddr().(*net.UDPAddr)
+	if !h.Deregister("humidity", caddr, []byte("h1")) || h.Deregister("humidity", caddr, []byte("h1")) {
+		t.Errorf("Expected Deregister to succeed once")
+	}
+
+	// Deleting the resource ends its observations.
+	if n, err := h.Notify("temp", Message{Code: NotFound}); n != 2 || err != nil {
+		t.Fatalf("Expected 2 observers notified, got %v, %v", n, err)
+	}
+	for i := 0; i < 2; i++ {
+		note, err := c.Receive()
+		if err != nil {
+			t.Fatalf("Error receiving notification: %v", err)
+		}
+		if note.Code != NotFound || note.Option(Observe) != nil {
+			t.Errorf("Expected a final 4.04 without Observe, got %v", note)
+		}
+	}
+	if rs := h.Registrations(); len(rs) != 0 {
+		t.Errorf("Expected no registrations left, got %+v", rs)
+	}
+}
+
+func TestHubDeregisterReleasesRetained(t *testing.T) {
+	defer func(d time.Duration) { ackTimeout = d }(ackTimeout)
+	ackTimeout = time.Millisecond
+
+	h := NewHub()
+	h.RetainLimit = 2
+	h.Start()
+	defer h.Stop()
+	l, c := startHub(t, h)
+	defer l.Close()
+
+	if _, err := c.Send(observeRequest("/temp", "tok")); err != nil {
+		t.Fatalf("Error registering: %v", err)
+	}
+	c.Close()
+	if _, err := h.Notify("temp", Message{Code: Content}); err != nil {
+		t.Fatalf("Error notifying: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	store := h.Store.(*memStore)
+	store.mu.Lock()
+	n := len(store.m)
+	store.mu.Unlock()
+	if n != 1 {
+		t.Fatalf("Expected the notification retained, got %v observers' worth", n)
+	}
+
+	o := h.Registrations()[0]
+	if !h.Deregister(o.Path, o.Addr, o.Token) {
+		t.Fatalf("Expected the observer deregistered")
+	}
+	store.mu.Lock()
+	n = len(store.m)
+	store.mu.Unlock()
+	h.mu.Lock()
+	u := len(h.unreachable)
+	h.mu.Unlock()
+	if n != 0 || u != 0 {
+		t.Errorf("Expected nothing retained after deregistering, got %v, %v", n, u)
+	}
+}
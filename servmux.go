@@ -2,17 +2,50 @@ package coap
 
 import (
 	"net"
+	"strings"
+	"sync"
 )
 
 // ServeMux provides mappings from a common endpoint to handlers by
-// request path.
+// request path.  Patterns may be registered and removed while it
+// serves requests.
 type ServeMux struct {
-	m map[string]muxEntry
+	// Stats, if not nil, collects statistics of the requests
+	// served by each route.
+	Stats *Stats
+	// NotFoundHandler, if not nil, handles the requests no pattern
+	// matches.  Otherwise confirmable ones are answered with 4.04
+	// Not Found, and non-confirmable ones ignored.
+	NotFoundHandler Handler
+
+	mu  sync.RWMutex
+	m   map[string]muxEntry
+	seq int
 }
 
 type muxEntry struct {
 	h       Handler
 	pattern string
+	attrs   map[string]string
+	// wild is set for patterns with wildcard segments, and weight
+	// ranks them against the others.  Ties go to the longer
+	// literal prefix, then to the pattern registered first, seq
+	// counting registrations.
+	wild   bool
+	weight int
+	prefix int
+	seq    int
+}
+
+// outranks reports whether e is preferred to o when both match.
+func (e muxEntry) outranks(o muxEntry) bool {
+	if e.weight != o.weight {
+		return e.weight > o.weight
+	}
+	if e.prefix != o.prefix {
+		return e.prefix > o.prefix
+	}
+	return e.seq < o.seq
 }
 
 // NewServeMux creates a new ServeMux.
@@ -31,60 +64,225 @@ func pathMatch(pattern, path string) bool {
 	return len(path) >= n && path[0:n] == pattern
 }
 
-// Find a handler on a handler map given a path string
-// Most-specific (longest) pattern wins
-func (mux *ServeMux) match(path string) (h Handler, pattern string) {
-	var n = 0
+// isWildcard reports whether the pattern segment seg matches any
+// segment: "*", or a named parameter such as "{id}".
+func isWildcard(seg string) bool {
+	return seg == "*" || len(seg) > 2 && seg[0] == '{' && seg[len(seg)-1] == '}'
+}
+
+// patternWeight ranks pattern by its length, wildcard segments
+// counting for less than any literal one.
+func patternWeight(pattern string) (int, bool) {
+	n, wild := 0, false
+	for _, seg := range strings.SplitAfter(pattern, "/") {
+		if isWildcard(strings.TrimSuffix(seg, "/")) {
+			wild = true
+			n += 1 + 2*(len(seg)-len(strings.TrimSuffix(seg, "/")))
+			continue
+		}
+		n += 2 * len(seg)
+	}
+	return n, wild
+}
+
+// literalPrefix returns the length of pattern before its first
+// wildcard segment.
+func literalPrefix(pattern string) int {
+	n := 0
+	for _, seg := range strings.SplitAfter(pattern, "/") {
+		if isWildcard(strings.TrimSuffix(seg, "/")) {
+			break
+		}
+		n += len(seg)
+	}
+	return n
+}
+
+// wildMatch matches path against a pattern with wildcard segments,
+// returning the values of its named parameters.
+func wildMatch(pattern, path string) (map[string]string, bool) {
+	prefix := strings.HasSuffix(pattern, "/")
+	segs := strings.Split(strings.TrimSuffix(pattern, "/"), "/")
+	parts := strings.Split(path, "/")
+	if len(parts) < len(segs) || !prefix && len(parts) > len(segs) ||
+		prefix && len(parts) == len(segs) {
+		return nil, false
+	}
+	var params map[string]string
+	for i, seg := range segs {
+		switch {
+		case !isWildcard(seg):
+			if seg != parts[i] {
+				return nil, false
+			}
+		case parts[i] == "":
+			return nil, false
+		case seg != "*":
+			if params == nil {
+				params = map[string]string{}
+			}
+			params[seg[1:len(seg)-1]] = parts[i]
+		}
+	}
+	return params, true
+}
+
+// Find a handler on a handler map given a path string, and the
+// values of the pattern's parameters.  Most-specific (longest)
+// pattern wins, a wildcard counting for less than any literal
+// segment; between equally specific ones, the one with the longer
+// literal prefix, then the one registered first.
+func (mux *ServeMux) match(path string) (h Handler, pattern string, params map[string]string) {
+	mux.mu.RLock()
+	defer mux.mu.RUnlock()
+	if path == "" {
+		// Only the root pattern matches the root resource.
+		e := mux.m[""]
+		return e.h, e.pattern, nil
+	}
+	var best muxEntry
 	for k, v := range mux.m {
-		if !pathMatch(k, path) {
+		var p map[string]string
+		if v.wild {
+			var ok bool
+			if p, ok = wildMatch(k, path); !ok {
+				continue
+			}
+		} else if !pathMatch(k, path) {
 			continue
 		}
-		if h == nil || len(k) > n {
-			n = len(k)
+		if h == nil || v.outranks(best) {
+			best = v
 			h = v.h
 			pattern = v.pattern
+			params = p
 		}
 	}
+	if h == nil && path == wellKnownCore {
+		return discoveryHandler{mux}, wellKnownCore, nil
+	}
 	return
 }
 
+// PathParams returns the values of the named parameters of the
+// pattern m's path matches, such as "id" for "/devices/{id}/state",
+// for handlers that don't get a Request.
+func (mux *ServeMux) PathParams(m *Message) map[string]string {
+	_, _, params := mux.match(m.PathString())
+	return params
+}
+
 func notFoundHandler(l *net.UDPConn, a *net.UDPAddr, m *Message) *Message {
 	if m.IsConfirmable() {
 		return &Message{
-			Type: Acknowledgement,
-			Code: NotFound,
+			Type:      Acknowledgement,
+			Code:      NotFound,
+			MessageID: m.MessageID,
+			Token:     m.Token,
 		}
 	}
 	return nil
 }
 
+// notFound returns the handler of requests no pattern matches.
+func (mux *ServeMux) notFound() Handler {
+	if mux.NotFoundHandler != nil {
+		return mux.NotFoundHandler
+	}
+	return funcHandler(notFoundHandler)
+}
+
 var _ = Handler(&ServeMux{})
 
 // ServeCOAP handles a single COAP message.  The message arrives from
 // the given listener having originated from the given UDPAddr.
+// Messages other than requests, such as stray ACKs and Resets, are
+// ignored.
 func (mux *ServeMux) ServeCOAP(l *net.UDPConn, a *net.UDPAddr, m *Message) *Message {
-	h, _ := mux.match(m.PathString())
+	if !isRequest(m.Code) {
+		return nil
+	}
+	h, pattern, _ := mux.match(m.PathString())
 	if h == nil {
-		h, _ = funcHandler(notFoundHandler), ""
+		h = mux.notFound()
+	} else if mux.Stats != nil {
+		done := mux.Stats.request("/" + pattern)
+		rv := h.ServeCOAP(l, a, m)
+		if rv != nil {
+			done(rv.Code)
+		}
+		return rv
 	}
 	// TODO:  Rewrite path?
 	return h.ServeCOAP(l, a, m)
 }
 
-// Handle configures a handler for the given path.
-func (mux *ServeMux) Handle(pattern string, handler Handler) {
-	for pattern != "" && pattern[0] == '/' {
-		pattern = pattern[1:]
+// ServeRequest hands the request to the handler for its path,
+// letting it respond through r.  Messages other than requests are
+// ignored.
+func (mux *ServeMux) ServeRequest(r *Request) {
+	if !isRequest(r.Msg.Code) {
+		return
 	}
-
-	if pattern == "" {
-		panic("http: invalid pattern " + pattern)
+	h, pattern, params := mux.match(r.Msg.PathString())
+	if h == nil {
+		h = mux.notFound()
+	} else if mux.Stats != nil {
+		r.onResponse = mux.Stats.request("/" + pattern)
 	}
+	r.params = params
+	serveRequest(h, r)
+}
+
+// Handle configures a handler for the given path.  The pattern "/"
+// (or "") names the root resource only; patterns ending in a slash
+// match every path below them.  A segment "*" matches any one
+// segment, and a segment such as "{id}" does too, capturing it as a
+// parameter read with Request.PathParam or ServeMux.PathParams.  Of
+// equally specific patterns matching a path, the one with the longer
+// literal prefix wins, then the one handled first.
+//
+// Handling a pattern again replaces its handler, and its link
+// attributes if it was registered with HandleResource; requests
+// already being served finish with the old handler.
+func (mux *ServeMux) Handle(pattern string, handler Handler) {
+	mux.handle(pattern, handler, nil)
+}
+
+// HandleResource configures a handler for the given path like
+// Handle, listing it in /.well-known/core with the link attributes
+// attrs, such as "rt", "if" and "ct".
+func (mux *ServeMux) HandleResource(pattern string, handler Handler, attrs map[string]string) {
+	mux.handle(pattern, handler, attrs)
+}
+
+func (mux *ServeMux) handle(pattern string, handler Handler, attrs map[string]string) {
+	pattern = strings.TrimLeft(pattern, "/")
+
 	if handler == nil {
 		panic("http: nil handler")
 	}
 
-	mux.m[pattern] = muxEntry{h: handler, pattern: pattern}
+	weight, wild := patternWeight(pattern)
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+	// A pattern handled again keeps its place in the registration
+	// order.
+	e, ok := mux.m[pattern]
+	if !ok {
+		mux.seq++
+		e.seq = mux.seq
+	}
+	mux.m[pattern] = muxEntry{h: handler, pattern: pattern, attrs: attrs, wild: wild,
+		weight: weight, prefix: literalPrefix(pattern), seq: e.seq}
+}
+
+// Unhandle removes the handler for the given pattern, if any, so
+// requests are served by the next most specific one, or not found.
+func (mux *ServeMux) Unhandle(pattern string) {
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+	delete(mux.m, strings.TrimLeft(pattern, "/"))
 }
 
 // HandleFunc configures a handler for the given path.
@@ -1,7 +1,10 @@
 package coap
 
 import (
+	"encoding/json"
 	"net"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -19,7 +22,7 @@ func TestPathMatching(t *testing.T) {
 		return nil
 	})
 
-	msg := &Message{}
+	msg := &Message{Code: GET}
 	msg.SetPathString("/a")
 	m.ServeCOAP(nil, nil, msg)
 	msg.SetPathString("/a")
@@ -40,6 +43,29 @@ func TestPathMatching(t *testing.T) {
 	}
 }
 
+func TestServeMuxIgnoresNonRequests(t *testing.T) {
+	m := NewServeMux()
+	hits := 0
+	m.HandleFunc("/", func(l *net.UDPConn, a *net.UDPAddr, m *Message) *Message {
+		hits++
+		return nil
+	})
+
+	for _, msg := range []Message{
+		{Type: Acknowledgement, MessageID: 1},
+		{Type: Reset, MessageID: 2},
+		{Type: NonConfirmable, Code: Content, MessageID: 3},
+	} {
+		if rv := m.ServeCOAP(nil, nil, &msg); rv != nil {
+			t.Errorf("Expected no answer to %v, got %v", msg, rv)
+		}
+		m.ServeRequest(&Request{Msg: &msg})
+	}
+	if hits != 0 {
+		t.Errorf("Expected no messages handled, got %v", hits)
+	}
+}
+
 func TestPathMatch(t *testing.T) {
 	tests := []struct {
 		pattern, path string
@@ -60,3 +86,260 @@ func TestPathMatch(t *testing.T) {
 		}
 	}
 }
+
+func TestRootPath(t *testing.T) {
+	m := NewServeMux()
+	var hits []string
+	for _, p := range []string{"/", "/a/"} {
+		p := p
+		m.HandleFunc(p, func(l *net.UDPConn, a *net.UDPAddr, m *Message) *Message {
+			hits = append(hits, p)
+			return nil
+		})
+	}
+
+	for _, path := range []string{"", "/", "//", "/a/b", "/c"} {
+		msg := &Message{Type: NonConfirmable, Code: GET}
+		msg.SetPathString("/x")
+		msg.SetPathString(path)
+		if msg.PathString() != strings.TrimLeft(path, "/") {
+			t.Errorf("Expected path %q for %q, got %q", strings.TrimLeft(path, "/"), path, msg.PathString())
+		}
+		m.ServeCOAP(nil, nil, msg)
+	}
+
+	exp := []string{"/", "/", "/", "/a/"}
+	if !reflect.DeepEqual(hits, exp) {
+		t.Errorf("Expected handlers %v, got %v", exp, hits)
+	}
+}
+
+func TestServeMuxStats(t *testing.T) {
+	m := NewServeMux()
+	m.Stats = &Stats{}
+	m.HandleFunc("/a", func(l *net.UDPConn, a *net.UDPAddr, m *Message) *Message {
+		if m.Type == NonConfirmable {
+			return nil
+		}
+		return &Message{Type: Acknowledgement, Code: Content, MessageID: m.MessageID, Token: m.Token}
+	})
+	m.Handle("/b/", RequestFunc(func(r *Request) {
+		r.Respond(Message{Code: Changed})
+	}))
+
+	l, addr := startUDPLisenter(t)
+	defer l.Close()
+	go Serve(l, m)
+
+	for _, req := range []struct {
+		path string
+		typ  COAPType
+	}{
+		{"/a", Confirmable}, {"/a", Confirmable}, {"/a", NonConfirmable},
+		{"/b/x", Confirmable}, {"/c", Confirmable},
+	} {
+		msg := Message{Type: req.typ, Code: GET, MessageID: 1}
+		msg.SetPathString(req.path)
+		dialAndSend(t, addr, msg)
+	}
+
+	routes := m.Stats.Routes()
+	if len(routes) != 2 || routes[0].Route != "/a" || routes[1].Route != "/b/" {
+		t.Fatalf("Unexpected routes: %+v", routes)
+	}
+	a, b := routes[0], routes[1]
+	if a.Requests != 3 || !reflect.DeepEqual(a.Codes, map[COAPCode]uint64{Content: 2}) {
+		t.Errorf("Unexpected stats for /a: %+v", a)
+	}
+	if b.Requests != 1 || !reflect.DeepEqual(b.Codes, map[COAPCode]uint64{Changed: 1}) {
+		t.Errorf("Unexpected stats for /b/: %+v", b)
+	}
+	if a.P50 > a.P99 || a.P99 > a.Max || a.Max <= 0 {
+		t.Errorf("Unexpected latencies for /a: %+v", a)
+	}
+	if rs, ok := m.Stats.Route("/b/"); !ok || rs.Requests != 1 {
+		t.Errorf("Unexpected stats for /b/: %+v, %v", rs, ok)
+	}
+
+	var decoded map[string]map[string]interface{}
+	if err := json.Unmarshal([]byte(m.Stats.String()), &decoded); err != nil {
+		t.Fatalf("Error decoding %s: %v", m.Stats.String(), err)
+	}
+	if decoded["/a"]["requests"] != 3.0 {
+		t.Errorf("Unexpected JSON: %v", decoded)
+	}
+}
+
+func TestServeMuxFetchPatch(t *testing.T) {
+	mux := NewServeMux()
+	mux.HandleFunc("/doc", func(l *net.UDPConn, a *net.UDPAddr, m *Message) *Message {
+		return &Message{
+			Type:      Acknowledgement,
+			Code:      Changed,
+			MessageID: m.MessageID,
+			Token:     m.Token,
+			Payload:   []byte(m.Code.String()),
+		}
+	})
+	l, addr := startUDPLisenter(t)
+	defer l.Close()
+	go Serve(l, mux)
+
+	for i, code := range []COAPCode{FETCH, PATCH, IPATCH} {
+		req := Message{
+			Type:      Confirmable,
+			Code:      code,
+			MessageID: uint16(i),
+			Token:     []byte{byte(i)},
+		}
+		req.SetPathString("/doc")
+		rv := dialAndSend(t, addr, req)
+		if rv.Code != Changed || string(rv.Payload) != code.String() {
+			t.Errorf("%v: unexpected response %v (%s)", code, rv, rv.Payload)
+		}
+	}
+}
+
+func TestWildcardPatterns(t *testing.T) {
+	m := NewServeMux()
+	var hits []string
+	for _, p := range []string{"/devices/{id}/state", "/devices/42/state",
+		"/devices/{id}/", "/devices/*/config", "/devices/"} {
+		p := p
+		m.Handle(p, RequestFunc(func(r *Request) {
+			hits = append(hits, p+" "+r.PathParam("id"))
+		}))
+	}
+
+	tests := []struct {
+		path, exp string
+	}{
+		{"/devices/7/state", "/devices/{id}/state 7"},
+		{"/devices/42/state", "/devices/42/state "},
+		{"/devices/7/state/x", "/devices/{id}/ 7"},
+		{"/devices/7/config", "/devices/*/config "},
+		{"/devices/7", "/devices/ "},
+		{"/devices//state", "/devices/ "},
+	}
+	for _, test := range tests {
+		hits = nil
+		msg := &Message{Type: NonConfirmable, Code: GET}
+		msg.SetPathString(test.path)
+		m.ServeRequest(&Request{Msg: msg})
+		if len(hits) != 1 || hits[0] != test.exp {
+			t.Errorf("%v: expected %q, got %q", test.path, test.exp, hits)
+		}
+	}
+
+	msg := &Message{}
+	msg.SetPathString("/devices/7/state")
+	if params := m.PathParams(msg); !reflect.DeepEqual(params, map[string]string{"id": "7"}) {
+		t.Errorf("Expected id 7, got %v", params)
+	}
+}
+
+func TestWildcardTies(t *testing.T) {
+	tests := []struct {
+		patterns  []string
+		path, exp string
+	}{
+		{[]string{"/*/b/c", "/a/*/c"}, "/a/b/c", "/a/*/c"},
+		{[]string{"/a/*/c", "/*/b/c"}, "/a/b/c", "/a/*/c"},
+		{[]string{"/{x}/b", "/*/b"}, "/a/b", "/{x}/b"},
+		{[]string{"/*/b", "/{x}/b"}, "/a/b", "/*/b"},
+	}
+	for _, test := range tests {
+		m := NewServeMux()
+		var hit string
+		for _, p := range test.patterns {
+			p := p
+			m.Handle(p, RequestFunc(func(r *Request) { hit = p }))
+		}
+		// Map iteration order varies, so try a few times.
+		for i := 0; i < 20; i++ {
+			msg := &Message{Type: NonConfirmable, Code: GET}
+			msg.SetPathString(test.path)
+			m.ServeRequest(&Request{Msg: msg})
+			if hit != test.exp {
+				t.Fatalf("%v with %v: expected %q, got %q", test.path, test.patterns, test.exp, hit)
+			}
+		}
+	}
+}
+
+func TestNotFound(t *testing.T) {
+	m := NewServeMux()
+	m.HandleFunc("/a", func(l *net.UDPConn, a *net.UDPAddr, m *Message) *Message {
+		return nil
+	})
+
+	req := &Message{Type: Confirmable, Code: GET, MessageID: 7, Token: []byte("t")}
+	req.SetPathString("/b")
+	rv := m.ServeCOAP(nil, nil, req)
+	if rv == nil || rv.Code != NotFound || rv.MessageID != 7 || string(rv.Token) != "t" {
+		t.Errorf("Expected 4.04 for a confirmable request, got %v", rv)
+	}
+	req.Type = NonConfirmable
+	if rv := m.ServeCOAP(nil, nil, req); rv != nil {
+		t.Errorf("Expected no response for a non-confirmable request, got %v", rv)
+	}
+
+	m.NotFoundHandler = FuncHandler(func(l *net.UDPConn, a *net.UDPAddr, m *Message) *Message {
+		return &Message{Type: NonConfirmable, Code: Forbidden}
+	})
+	if rv := m.ServeCOAP(nil, nil, req); rv == nil || rv.Code != Forbidden {
+		t.Errorf("Expected the NotFoundHandler's response, got %v", rv)
+	}
+}
+
+func TestUnhandle(t *testing.T) {
+	m := NewServeMux()
+	handler := func(code COAPCode) Handler {
+		return FuncHandler(func(l *net.UDPConn, a *net.UDPAddr, m *Message) *Message {
+			return &Message{Type: Acknowledgement, Code: code}
+		})
+	}
+	m.Handle("/a/", handler(Content))
+	m.Handle("/a/b", handler(Valid))
+
+	serve := func() COAPCode {
+		msg := &Message{Type: Confirmable, Code: GET}
+		msg.SetPathString("/a/b")
+		return m.ServeCOAP(nil, nil, msg).Code
+	}
+	if c := serve(); c != Valid {
+		t.Errorf("Expected Valid, got %v", c)
+	}
+	m.Handle("/a/b", handler(Changed))
+	if c := serve(); c != Changed {
+		t.Errorf("Expected the replaced handler's Changed, got %v", c)
+	}
+	m.Unhandle("/a/b")
+	if c := serve(); c != Content {
+		t.Errorf("Expected the prefix handler's Content, got %v", c)
+	}
+	m.Unhandle("a/")
+	if c := serve(); c != NotFound {
+		t.Errorf("Expected NotFound, got %v", c)
+	}
+}
+
+func TestServeMuxConcurrent(t *testing.T) {
+	m := NewServeMux()
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			m.HandleResource("/dev/x", FuncHandler(notFoundHandler), map[string]string{"rt": "x"})
+			m.Unhandle("/dev/x")
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		msg := &Message{Type: Confirmable, Code: GET}
+		msg.SetPathString("/dev/x")
+		m.ServeCOAP(nil, nil, msg)
+		msg.SetPathString(wellKnownCore)
+		m.ServeCOAP(nil, nil, msg)
+	}
+	<-done
+}
@@ -0,0 +1,211 @@
+package coap
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// A Session is the state shared with one peer, whatever the
+// transport: its addresses and security identity, the Message ID and
+// token spaces, and the observations in progress.  Clients have one
+// per connection; a Hub keeps its observers' in a SessionTable.
+type Session struct {
+	local, remote net.Addr
+
+	ids      MessageIDAllocator
+	tokenSeq uint64
+	tokenKey uint64
+
+	mu           sync.Mutex
+	identity     string
+	observations map[string]interface{}
+}
+
+// NewSession creates the session between the local and remote
+// addresses.
+func NewSession(local, remote net.Addr) *Session {
+	s := &Session{
+		local:        local,
+		remote:       remote,
+		observations: map[string]interface{}{},
+	}
+	var b [8]byte
+	rand.Read(b[:])
+	s.tokenKey = binary.BigEndian.Uint64(b[:])
+	return s
+}
+
+// LocalAddr returns the local address of the session.
+func (s *Session) LocalAddr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.local
+}
+
+// RemoteAddr returns the peer's address.
+func (s *Session) RemoteAddr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.remote
+}
+
+// moved records that the peer is now reached between other
+// addresses.
+func (s *Session) moved(local, remote net.Addr) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.local, s.remote = local, remote
+}
+
+// Identity returns the peer's authenticated identity, such as a PSK
+// identity or certificate subject, or "" if it's not known.
+func (s *Session) Identity() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.identity
+}
+
+// SetIdentity records the peer's authenticated identity.
+func (s *Session) SetIdentity(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.identity = id
+}
+
+// NextMessageID returns a Message ID not recently used in this
+// session.
+func (s *Session) NextMessageID() uint16 {
+	id, _ := s.ids.Next(nil)
+	return id
+}
+
+// NextToken returns an 8 byte token that won't repeat in this
+// session and is hard for off-path attackers to guess (RFC 7252
+// section 5.3.1).
+func (s *Session) NextToken() []byte {
+	tok := make([]byte, 8)
+	binary.BigEndian.PutUint64(tok, atomic.AddUint64(&s.tokenSeq, 1)^s.tokenKey)
+	return tok
+}
+
+// DefaultTokenLength is the length of the tokens clients give
+// requests sent without one, unless configured otherwise.
+const DefaultTokenLength = 8
+
+// NewToken returns a token of n random bytes, n from 1 to 8, which
+// off-path attackers can't guess (RFC 7252 section 5.3.1).
+func NewToken(n int) ([]byte, error) {
+	if n < 1 || n > 8 {
+		return nil, ErrInvalidTokenLen
+	}
+	tok := make([]byte, n)
+	if _, err := rand.Read(tok); err != nil {
+		return nil, err
+	}
+	return tok, nil
+}
+
+// assignToken gives req a token of n random bytes if it's a request
+// without one, unless n isn't positive.
+func assignToken(req *Message, n int) error {
+	if n <= 0 || len(req.Token) > 0 || !isRequest(req.Code) {
+		return nil
+	}
+	var err error
+	req.Token, err = NewToken(n)
+	return err
+}
+
+// SetObservation records the state of the observation using token.
+func (s *Session) SetObservation(token []byte, v interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.observations[string(token)] = v
+}
+
+// Observation returns the state of the observation using token, or
+// nil.
+func (s *Session) Observation(token []byte) interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.observations[string(token)]
+}
+
+// RemoveObservation forgets the observation using token.
+func (s *Session) RemoveObservation(token []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.observations, string(token))
+}
+
+// ObservationTokens returns the tokens of the observations in
+// progress.
+func (s *Session) ObservationTokens() [][]byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var rv [][]byte
+	for tok := range s.observations {
+		rv = append(rv, []byte(tok))
+	}
+	return rv
+}
+
+// ObservationCount returns the number of observations in progress.
+func (s *Session) ObservationCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.observations)
+}
+
+// A SessionTable holds sessions, one per pair of local
+// and remote addresses.  The zero value is an empty table.
+type SessionTable struct {
+	mu       sync.Mutex
+	sessions map[sessionKey]*Session
+}
+
+type sessionKey struct {
+	local, remote string
+}
+
+func keyFor(local, remote net.Addr) sessionKey {
+	k := sessionKey{remote: remote.String()}
+	if local != nil {
+		k.local = local.String()
+	}
+	return k
+}
+
+// Get returns the session between local and remote, creating it if
+// needed.
+func (t *SessionTable) Get(local, remote net.Addr) *Session {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.sessions == nil {
+		t.sessions = map[sessionKey]*Session{}
+	}
+	k := keyFor(local, remote)
+	s := t.sessions[k]
+	if s == nil {
+		s = NewSession(local, remote)
+		t.sessions[k] = s
+	}
+	return s
+}
+
+// Remove forgets the session between local and remote.
+func (t *SessionTable) Remove(local, remote net.Addr) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.sessions, keyFor(local, remote))
+}
+
+// Len returns the number of sessions in the table.
+func (t *SessionTable) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.sessions)
+}
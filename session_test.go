@@ -0,0 +1,75 @@
+package coap
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestSessionTokens(t *testing.T) {
+	s := NewSession(nil, nil)
+	seen := map[string]bool{}
+	for i := 0; i < 1000; i++ {
+		tok := s.NextToken()
+		if len(tok) != 8 || seen[string(tok)] {
+			t.Fatalf("Expected a fresh 8 byte token, got %x", tok)
+		}
+		seen[string(tok)] = true
+	}
+	if bytes.Equal(s.NextToken(), NewSession(nil, nil).NextToken()) {
+		t.Errorf("Expected different sessions to use different tokens")
+	}
+}
+
+func TestNewToken(t *testing.T) {
+	for _, n := range []int{1, 4, 8} {
+		a, err := NewToken(n)
+		if err != nil || len(a) != n {
+			t.Errorf("NewToken(%v) = %x, %v", n, a, err)
+		}
+	}
+	a, _ := NewToken(8)
+	b, _ := NewToken(8)
+	if bytes.Equal(a, b) {
+		t.Errorf("Expected different tokens, got %x twice", a)
+	}
+	for _, n := range []int{-1, 0, 9} {
+		if tok, err := NewToken(n); err != ErrInvalidTokenLen {
+			t.Errorf("NewToken(%v) = %x, %v, expected ErrInvalidTokenLen", n, tok, err)
+		}
+	}
+}
+
+func TestSessionTable(t *testing.T) {
+	var st SessionTable
+	local := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5683}
+	a := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 40000}
+	b := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 3), Port: 40000}
+
+	s := st.Get(local, a)
+	if st.Get(local, a) != s || st.Get(local, b) == s {
+		t.Errorf("Expected one session per peer")
+	}
+	if s.RemoteAddr() != a {
+		t.Errorf("Expected remote address %v, got %v", a, s.RemoteAddr())
+	}
+	st.Remove(local, a)
+	if st.Len() != 1 {
+		t.Errorf("Expected one session left, got %v", st.Len())
+	}
+}
+
+func TestHubSessionObservations(t *testing.T) {
+	h := NewHub()
+	a := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5683}
+	h.register(nil, a, []byte("t"), "temp")
+
+	if got := h.Session(nil, a).Observation([]byte("t")); got != "temp" {
+		t.Errorf("Expected the observation of temp in the session, got %v", got)
+	}
+
+	h.deregister("temp", observerKey(a, []byte("t")))
+	if h.sessions.Len() != 0 {
+		t.Errorf("Expected the session dropped with its last observation")
+	}
+}
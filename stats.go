@@ -0,0 +1,180 @@
+package coap
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Number of latency samples kept per route.
+const statsSamples = 1024
+
+// RouteStats summarizes the requests served by one route.
+type RouteStats struct {
+	// Route is the pattern the handler was registered with.
+	Route string
+	// Requests is the number of requests routed here.  Those
+	// not answered (yet) are the ones missing from Codes.
+	Requests uint64
+	// Codes counts the responses by code.
+	Codes map[COAPCode]uint64
+	// Latency percentiles of the recent responses, from the
+	// request being routed to its response being sent.
+	P50, P90, P99 time.Duration
+	// Max is the highest latency seen.
+	Max time.Duration
+}
+
+type routeStats struct {
+	requests uint64
+	codes    map[COAPCode]uint64
+	latency  latencies
+}
+
+// latencies keeps the latest statsSamples latencies, and the highest.
+type latencies struct {
+	samples []time.Duration // ring of the latest statsSamples
+	next    int
+	max     time.Duration
+}
+
+func (l *latencies) add(d time.Duration) {
+	if len(l.samples) < statsSamples {
+		l.samples = append(l.samples, d)
+	} else {
+		l.samples[l.next] = d
+		l.next = (l.next + 1) % statsSamples
+	}
+	if d > l.max {
+		l.max = d
+	}
+}
+
+// percentiles returns the 50th, 90th and 99th percentiles of the
+// samples.
+func (l *latencies) percentiles() (p50, p90, p99 time.Duration) {
+	sorted := append([]time.Duration(nil), l.samples...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	percentile := func(p int) time.Duration {
+		if len(sorted) == 0 {
+			return 0
+		}
+		return sorted[(len(sorted)-1)*p/100]
+	}
+	return percentile(50), percentile(90), percentile(99)
+}
+
+// Stats collects per route request statistics for a ServeMux.  It
+// is an expvar.Var, so it can be published with expvar.Publish.
+//
+// The zero value is ready to use.
+type Stats struct {
+	mu     sync.Mutex
+	routes map[string]*routeStats
+}
+
+func (s *Stats) route(route string) *routeStats {
+	if s.routes == nil {
+		s.routes = map[string]*routeStats{}
+	}
+	rs := s.routes[route]
+	if rs == nil {
+		rs = &routeStats{codes: map[COAPCode]uint64{}}
+		s.routes[route] = rs
+	}
+	return rs
+}
+
+// request counts a request for route and returns the function to
+// call with its response, if any.
+func (s *Stats) request(route string) func(code COAPCode) {
+	start := time.Now()
+	s.mu.Lock()
+	s.route(route).requests++
+	s.mu.Unlock()
+
+	return func(code COAPCode) {
+		d := time.Since(start)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		rs := s.route(route)
+		rs.codes[code]++
+		rs.latency.add(d)
+	}
+}
+
+// Route returns the statistics of route, the pattern as registered
+// with the ServeMux.
+func (s *Stats) Route(route string) (RouteStats, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rs, ok := s.routes[route]
+	if !ok {
+		return RouteStats{}, false
+	}
+	return rs.summary(route), true
+}
+
+// Routes returns the statistics of all routes, sorted by route.
+func (s *Stats) Routes() []RouteStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var rv []RouteStats
+	for route, rs := range s.routes {
+		rv = append(rv, rs.summary(route))
+	}
+	sort.Slice(rv, func(i, j int) bool { return rv[i].Route < rv[j].Route })
+	return rv
+}
+
+func (rs *routeStats) summary(route string) RouteStats {
+	rv := RouteStats{
+		Route:    route,
+		Requests: rs.requests,
+		Codes:    map[COAPCode]uint64{},
+		Max:      rs.latency.max,
+	}
+	for c, n := range rs.codes {
+		rv.Codes[c] = n
+	}
+	rv.P50, rv.P90, rv.P99 = rs.latency.percentiles()
+	return rv
+}
+
+// String returns the statistics as a JSON object keyed by route,
+// with latencies in milliseconds.
+func (s *Stats) String() string {
+	type route struct {
+		Requests uint64            `json:"requests"`
+		Codes    map[string]uint64 `json:"codes"`
+		P50      float64           `json:"p50_ms"`
+		P90      float64           `json:"p90_ms"`
+		P99      float64           `json:"p99_ms"`
+		Max      float64           `json:"max_ms"`
+	}
+	ms := func(d time.Duration) float64 {
+		return float64(d) / float64(time.Millisecond)
+	}
+
+	out := map[string]route{}
+	for _, rs := range s.Routes() {
+		r := route{
+			Requests: rs.Requests,
+			Codes:    map[string]uint64{},
+			P50:      ms(rs.P50),
+			P90:      ms(rs.P90),
+			P99:      ms(rs.P99),
+			Max:      ms(rs.Max),
+		}
+		for c, n := range rs.Codes {
+			r.Codes[c.String()] = n
+		}
+		out[rs.Route] = r
+	}
+	b, err := json.Marshal(out)
+	if err != nil {
+		return "{}"
+	}
+	return string(b)
+}
@@ -0,0 +1,418 @@
+package coap
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrReleased is returned for requests on a stream connection that
+// was released (7.04) by either side.
+var ErrReleased = errors.New("connection released")
+
+// ErrMessageTooLarge is returned by StreamConn.Send for messages
+// larger than the peer's Max-Message-Size, and matched by every
+// *MessageSizeError.
+var ErrMessageTooLarge = errors.New("message larger than the peer accepts")
+
+// DefaultMaxMessageSize is the size of the largest message a peer is
+// assumed to accept until its CSM tells otherwise (RFC 8323 section
+// 5.3.1).  Having nothing else to announce, a StreamConn accepts no
+// larger ones either.
+const DefaultMaxMessageSize = 1152
+
+// AbortError is returned to requests pending on a stream connection
+// when the peer aborts it with 7.05 Abort.
+type AbortError struct {
+	// Diagnostic is the peer's explanation, if any.
+	Diagnostic string
+	// BadCSMOption is the capability option the peer couldn't
+	// handle, if that's why it aborted.
+	BadCSMOption interface{}
+}
+
+func (e *AbortError) Error() string {
+	if e.Diagnostic == "" {
+		return "connection aborted"
+	}
+	return fmt.Sprintf("connection aborted: %s", e.Diagnostic)
+}
+
+// StreamConn is a CoAP connection over a reliable transport such as
+// TCP or TLS (RFC 8323).
+//
+// Like Conn, a goroutine reads everything arriving on the connection,
+// routing responses to the Send waiting for them by token and leaving
+// anything else to Receive.  The signaling messages are handled
+// automatically: the connection opens with a CSM, the peer's
+// Max-Message-Size is honored, and pings are answered.  A Release or
+// Abort from the peer shows in Released, Done and Err.
+type StreamConn struct {
+	t       MessageTransport
+	session *Session
+
+	incoming chan TcpMessage
+	done     chan struct{}
+	csmSent  chan struct{}
+	inflight sync.WaitGroup
+
+	mu           sync.Mutex
+	waiters      map[string]chan TcpMessage
+	released     bool
+	peerReleased chan struct{}
+	altAddr      string
+	peerMaxSize  uint32
+	err          error
+	tokenLen     int
+}
+
+// MessageTransport carries whole messages for a StreamConn, such as
+// over a TCP connection or a WebSocket.
+type MessageTransport interface {
+	ReadMessage() (*TcpMessage, error)
+	WriteMessage(m *TcpMessage) error
+	Close() error
+}
+
+// streamTransport frames messages on a byte stream.
+type streamTransport struct {
+	conn net.Conn
+	dec  *Decoder
+	enc  *Encoder
+}
+
+func (t *streamTransport) ReadMessage() (*TcpMessage, error) { return t.dec.Decode() }
+func (t *streamTransport) WriteMessage(m *TcpMessage) error  { return t.enc.Encode(m) }
+func (t *streamTransport) Close() error                      { return t.conn.Close() }
+func (t *streamTransport) LocalAddr() net.Addr               { return t.conn.LocalAddr() }
+func (t *streamTransport) RemoteAddr() net.Addr              { return t.conn.RemoteAddr() }
+
+// DialStream connects a CoAP client over a stream network such as
+// "tcp".
+func DialStream(n, addr string) (*StreamConn, error) {
+	conn, err := net.Dial(n, addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewStreamConn(conn), nil
+}
+
+// NewStreamConn speaks CoAP over an established connection, such as
+// a *tls.Conn.
+func NewStreamConn(conn net.Conn) *StreamConn {
+	dec := NewDecoder(conn)
+	dec.MaxMessageSize = DefaultMaxMessageSize
+	return NewTransportConn(&streamTransport{
+		conn: conn,
+		dec:  dec,
+		enc:  NewEncoder(conn),
+	})
+}
+
+// NewTransportConn speaks CoAP over t.  If t has LocalAddr and
+// RemoteAddr methods like a net.Conn, they give the session's
+// addresses.
+func NewTransportConn(t MessageTransport) *StreamConn {
+	var local, remote net.Addr
+	if a, ok := t.(interface {
+		LocalAddr() net.Addr
+		RemoteAddr() net.Addr
+	}); ok {
+		local, remote = a.LocalAddr(), a.RemoteAddr()
+	}
+
+	c := &StreamConn{
+		t:            t,
+		session:      NewSession(local, remote),
+		tokenLen:     DefaultTokenLength,
+		incoming:     make(chan TcpMessage, incomingQueueLen),
+		done:         make(chan struct{}),
+		csmSent:      make(chan struct{}),
+		waiters:      map[string]chan TcpMessage{},
+		peerReleased: make(chan struct{}),
+		peerMaxSize:  DefaultMaxMessageSize,
+	}
+	go func() {
+		// Each side starts with its capabilities (RFC 8323
+		// section 5.3); there's nothing to announce beyond the
+		// defaults.  Other messages wait for it.
+		defer close(c.csmSent)
+		csm := TcpMessage{Message: Message{Code: CSM}}
+		if err := t.WriteMessage(&csm); err != nil {
+			c.fail(err)
+		}
+	}()
+	go c.readLoop()
+	return c
+}
+
+// write sends m once the CSM is out.
+func (c *StreamConn) write(m *TcpMessage) error {
+	<-c.csmSent
+	return c.t.WriteMessage(m)
+}
+
+// Session returns the state shared with the peer.
+func (c *StreamConn) Session() *Session {
+	return c.session
+}
+
+// fail records why the connection is unusable, unless that's
+// already known.
+func (c *StreamConn) fail(err error) {
+	c.mu.Lock()
+	if c.err == nil {
+		c.err = err
+	}
+	c.mu.Unlock()
+}
+
+func (c *StreamConn) failure() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+func (c *StreamConn) readLoop() {
+	defer close(c.done)
+	for {
+		m, err := c.t.ReadMessage()
+		if err != nil {
+			var serr *MessageSizeError
+			if errors.As(err, &serr) {
+				// Not read, so the stream can't go on
+				// (RFC 8323 section 5.6).
+				abort := TcpMessage{Message: Message{Code: Abort, Payload: []byte(serr.Error())}}
+				c.write(&abort)
+				c.t.Close()
+			}
+			c.fail(err)
+			return
+		}
+
+		switch m.Code {
+		case Ping:
+			pong := TcpMessage{Message: Message{Code: Pong, Token: m.Token}}
+			go c.write(&pong)
+		case Release:
+			// Requests already sent will still be answered.
+			c.mu.Lock()
+			c.released = true
+			c.altAddr, _ = m.Option(AlternativeAddress).(string)
+			select {
+			case <-c.peerReleased:
+			default:
+				close(c.peerReleased)
+			}
+			c.mu.Unlock()
+		case Abort:
+			c.fail(&AbortError{
+				Diagnostic:   string(m.Payload),
+				BadCSMOption: m.Option(BadCSMOption),
+			})
+			c.t.Close()
+			return
+		case CSM:
+			if v, ok := m.Option(MaxMessageSize).(uint32); ok {
+				c.mu.Lock()
+				c.peerMaxSize = v
+				c.mu.Unlock()
+			}
+		case Pong:
+		default:
+			c.dispatch(*m)
+		}
+	}
+}
+
+func (c *StreamConn) dispatch(m TcpMessage) {
+	c.mu.Lock()
+	ch, ok := c.waiters[string(m.Token)]
+	c.mu.Unlock()
+
+	if ok {
+		select {
+		case ch <- m:
+		default:
+		}
+		return
+	}
+
+	select {
+	case c.incoming <- m:
+	default:
+	}
+}
+
+// Send a request and wait for its response.  A request without a
+// token gets a random one of DefaultTokenLength bytes, or as many as
+// the StreamDialer's TokenLength says.
+//
+// After either side released the connection, Send fails with
+// ErrReleased; requests pending when the peer aborts it fail with an
+// *AbortError.  Requests larger than the peer's Max-Message-Size fail
+// with ErrMessageTooLarge.
+func (c *StreamConn) Send(req TcpMessage) (*TcpMessage, error) {
+	if err := assignToken(&req.Message, c.tokenLen); err != nil {
+		return nil, err
+	}
+	if req.Body == nil {
+		b, err := req.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		if len(b) > int(c.PeerMaxMessageSize()) {
+			return nil, ErrMessageTooLarge
+		}
+	}
+
+	ch := make(chan TcpMessage, 1)
+	tok := string(req.Token)
+
+	c.mu.Lock()
+	switch {
+	case c.err != nil:
+		c.mu.Unlock()
+		return nil, c.err
+	case c.released:
+		c.mu.Unlock()
+		return nil, ErrReleased
+	}
+	c.waiters[tok] = ch
+	c.inflight.Add(1)
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		if c.waiters[tok] == ch {
+			delete(c.waiters, tok)
+		}
+		c.mu.Unlock()
+		c.inflight.Done()
+	}()
+
+	if err := c.write(&req); err != nil {
+		return nil, err
+	}
+
+	t := time.NewTimer(ResponseTimeout)
+	defer t.Stop()
+	select {
+	case rv := <-ch:
+		return &rv, nil
+	case <-c.done:
+		return nil, c.failure()
+	case <-t.C:
+		return nil, ErrTimeout
+	}
+}
+
+// Receive a message that isn't the response to a Send, such as an
+// Observe notification.
+func (c *StreamConn) Receive() (*TcpMessage, error) {
+	t := time.NewTimer(ResponseTimeout)
+	defer t.Stop()
+	select {
+	case rv := <-c.incoming:
+		return &rv, nil
+	case <-c.done:
+		select {
+		case rv := <-c.incoming:
+			return &rv, nil
+		default:
+		}
+		return nil, c.failure()
+	case <-t.C:
+		return nil, ErrTimeout
+	}
+}
+
+// PeerMaxMessageSize returns the size of the largest message the peer
+// accepts, as announced in its CSM.
+func (c *StreamConn) PeerMaxMessageSize() uint32 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.peerMaxSize
+}
+
+// Released returns a channel that's closed when the peer releases
+// the connection with 7.04 Release.  AlternativeAddress then tells
+// where it suggested reconnecting.
+func (c *StreamConn) Released() <-chan struct{} {
+	return c.peerReleased
+}
+
+// Done returns a channel that's closed when the connection is gone,
+// whether closed, aborted by either side, or broken.  Err tells why.
+func (c *StreamConn) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns why the connection is unusable, such as an *AbortError
+// when the peer aborted it, or nil while it's open.
+func (c *StreamConn) Err() error {
+	return c.failure()
+}
+
+// AlternativeAddress returns where the peer suggested reconnecting
+// when it released the connection, if it did.
+func (c *StreamConn) AlternativeAddress() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.altAddr
+}
+
+// Release closes the connection in an orderly way: it tells the peer
+// with 7.04 Release (suggesting altAddr, if not empty, as where to
+// reconnect), waits up to ResponseTimeout for requests in flight to
+// be answered, and then closes it.
+func (c *StreamConn) Release(altAddr string) error {
+	c.mu.Lock()
+	c.released = true
+	closed := c.err != nil
+	c.mu.Unlock()
+	if closed {
+		return c.t.Close()
+	}
+
+	m := TcpMessage{Message: Message{Code: Release}}
+	if altAddr != "" {
+		m.SetOption(AlternativeAddress, altAddr)
+	}
+	if err := c.write(&m); err != nil {
+		c.fail(err)
+		c.t.Close()
+		return err
+	}
+
+	idle := make(chan struct{})
+	go func() {
+		c.inflight.Wait()
+		close(idle)
+	}()
+	t := time.NewTimer(ResponseTimeout)
+	defer t.Stop()
+	select {
+	case <-idle:
+	case <-c.done:
+	case <-t.C:
+	}
+
+	c.fail(ErrReleased)
+	return c.t.Close()
+}
+
+// Abort closes the connection immediately, telling the peer why with
+// 7.05 Abort.
+func (c *StreamConn) Abort(diagnostic string) error {
+	c.fail(&AbortError{Diagnostic: diagnostic})
+	m := TcpMessage{Message: Message{Code: Abort, Payload: []byte(diagnostic)}}
+	c.write(&m)
+	return c.t.Close()
+}
+
+// Close releases the connection.
+func (c *StreamConn) Close() error {
+	return c.Release("")
+}
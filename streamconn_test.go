@@ -0,0 +1,205 @@
+package coap
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+)
+
+// streamPipe connects a StreamConn to a peer, which has received the
+// connection's CSM.
+func streamPipe() (*StreamConn, *Decoder, *Encoder) {
+	a, b := net.Pipe()
+	c, dec := NewStreamConn(a), NewDecoder(b)
+	dec.Decode()
+	return c, dec, NewEncoder(b)
+}
+
+func TestStreamConnSend(t *testing.T) {
+	c, dec, enc := streamPipe()
+	defer c.Close()
+
+	pong := make(chan bool, 1)
+	go func() {
+		ping := TcpMessage{Message: Message{Code: Ping, Token: []byte("p")}}
+		enc.Encode(&ping)
+		// net.Pipe doesn't buffer, so read both the pong and the
+		// request before answering.
+		var req *TcpMessage
+		for i := 0; i < 2; i++ {
+			m, err := dec.Decode()
+			if err != nil {
+				return
+			}
+			if m.Code == Pong {
+				pong <- true
+			} else {
+				req = m
+			}
+		}
+		rv := TcpMessage{Message: Message{Code: Content, Token: req.Token,
+			Payload: []byte("hi")}}
+		enc.Encode(&rv)
+		for {
+			if _, err := dec.Decode(); err != nil {
+				return
+			}
+		}
+	}()
+
+	rv, err := c.Send(TcpMessage{Message: Message{Code: GET, Token: []byte("t")}})
+	if err != nil {
+		t.Fatalf("Error sending: %v", err)
+	}
+	if rv.Code != Content || string(rv.Payload) != "hi" {
+		t.Errorf("Unexpected response: %v", rv)
+	}
+	select {
+	case <-pong:
+	default:
+		t.Errorf("Expected the ping answered")
+	}
+}
+
+func TestStreamConnRelease(t *testing.T) {
+	c, dec, enc := streamPipe()
+
+	got := make(chan *TcpMessage, 2)
+	go func() {
+		req, _ := dec.Decode()
+		got <- req
+		rel, _ := dec.Decode()
+		got <- rel
+		// Answer the request that was in flight when the client
+		// released the connection.
+		rv := TcpMessage{Message: Message{Code: Content, Token: req.Token}}
+		enc.Encode(&rv)
+	}()
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := c.Send(TcpMessage{Message: Message{Code: GET, Token: []byte("t")}})
+		errc <- err
+	}()
+	<-got
+
+	if err := c.Release("coap+tcp://[2001:db8::1]"); err != nil {
+		t.Fatalf("Error releasing: %v", err)
+	}
+	if err := <-errc; err != nil {
+		t.Errorf("Expected the in-flight request answered, got %v", err)
+	}
+	rel := <-got
+	if rel.Code != Release || rel.Option(AlternativeAddress) != "coap+tcp://[2001:db8::1]" {
+		t.Errorf("Expected Release with alternative address, got %v", rel)
+	}
+
+	if _, err := c.Send(TcpMessage{Message: Message{Code: GET}}); err != ErrReleased {
+		t.Errorf("Expected ErrReleased after releasing, got %v", err)
+	}
+}
+
+func TestStreamConnAbort(t *testing.T) {
+	c, dec, enc := streamPipe()
+	defer c.Close()
+
+	go func() {
+		dec.Decode()
+		abort := TcpMessage{Message: Message{Code: Abort, Payload: []byte("bye")}}
+		abort.SetOption(BadCSMOption, uint32(MaxMessageSize))
+		enc.Encode(&abort)
+	}()
+
+	_, err := c.Send(TcpMessage{Message: Message{Code: GET, Token: []byte("t")}})
+	var aerr *AbortError
+	if !errors.As(err, &aerr) {
+		t.Fatalf("Expected an AbortError, got %v", err)
+	}
+	if aerr.Diagnostic != "bye" || aerr.BadCSMOption != uint32(MaxMessageSize) {
+		t.Errorf("Unexpected abort: %+v", aerr)
+	}
+}
+
+func TestStreamConnMessageTooLarge(t *testing.T) {
+	a, b := net.Pipe()
+	c := NewStreamConn(a)
+	dec := NewDecoder(b)
+	defer c.Close()
+
+	// A frame claiming a 1MB body, which is never sent.
+	go b.Write([]byte{0xf0, 0, 0x0f, 0xfe, 0xf3, byte(POST)})
+
+	if m, err := dec.Decode(); err != nil || m.Code != CSM {
+		t.Fatalf("Expected a CSM first, got %v, %v", m, err)
+	}
+	m, err := dec.Decode()
+	if err != nil || m.Code != Abort || len(m.Payload) == 0 {
+		t.Fatalf("Expected an Abort with a diagnostic, got %v, %v", m, err)
+	}
+	<-c.Done()
+	var serr *MessageSizeError
+	if err := c.Err(); !errors.As(err, &serr) || serr.Max != DefaultMaxMessageSize || !errors.Is(err, ErrMessageTooLarge) {
+		t.Errorf("Expected a MessageSizeError, got %v", err)
+	}
+}
+
+func TestStreamConnSignaling(t *testing.T) {
+	a, b := net.Pipe()
+	c := NewStreamConn(a)
+	dec, enc := NewDecoder(b), NewEncoder(b)
+	defer c.Close()
+
+	if m, err := dec.Decode(); err != nil || m.Code != CSM {
+		t.Fatalf("Expected a CSM first, got %v, %v", m, err)
+	}
+	csm := TcpMessage{Message: Message{Code: CSM}}
+	csm.SetOption(MaxMessageSize, uint32(64))
+	enc.Encode(&csm)
+	ping := TcpMessage{Message: Message{Code: Ping}}
+	enc.Encode(&ping)
+	if m, err := dec.Decode(); err != nil || m.Code != Pong {
+		t.Fatalf("Expected a Pong, got %v, %v", m, err)
+	}
+
+	if n := c.PeerMaxMessageSize(); n != 64 {
+		t.Errorf("Expected Max-Message-Size 64, got %v", n)
+	}
+	big := TcpMessage{Message: Message{Code: POST, Token: []byte("t"), Payload: make([]byte, 100)}}
+	if _, err := c.Send(big); err != ErrMessageTooLarge {
+		t.Errorf("Expected ErrMessageTooLarge, got %v", err)
+	}
+
+	rel := TcpMessage{Message: Message{Code: Release}}
+	rel.SetOption(AlternativeAddress, "coap+tcp://[2001:db8::2]")
+	enc.Encode(&rel)
+	<-c.Released()
+	if a := c.AlternativeAddress(); a != "coap+tcp://[2001:db8::2]" {
+		t.Errorf("Unexpected alternative address %q", a)
+	}
+
+	abort := TcpMessage{Message: Message{Code: Abort, Payload: []byte("bye")}}
+	enc.Encode(&abort)
+	<-c.Done()
+	var ae *AbortError
+	if err := c.Err(); !errors.As(err, &ae) || ae.Diagnostic != "bye" {
+		t.Errorf("Expected the abort, got %v", err)
+	}
+}
+
+func TestStreamDialerTLSConfig(t *testing.T) {
+	var d StreamDialer
+	cfg := d.tlsConfig("example.com")
+	if cfg.ServerName != "example.com" || !reflect.DeepEqual(cfg.NextProtos, []string{"coap"}) {
+		t.Errorf("Expected the host name and the coap ALPN protocol, got %q, %q",
+			cfg.ServerName, cfg.NextProtos)
+	}
+
+	d.TLSConfig = &tls.Config{ServerName: "other", NextProtos: []string{"x"}}
+	cfg = d.tlsConfig("example.com")
+	if cfg.ServerName != "other" || !reflect.DeepEqual(cfg.NextProtos, []string{"x"}) {
+		t.Errorf("Expected the dialer's configuration kept, got %q, %q",
+			cfg.ServerName, cfg.NextProtos)
+	}
+}
@@ -0,0 +1,147 @@
+package coap
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// DefaultTraceLimit is the number of events a Tracer keeps when its
+// Limit isn't set.
+const DefaultTraceLimit = 1000
+
+// A TraceEvent is a message sent or received, as recorded by a
+// Tracer.
+type TraceEvent struct {
+	Time time.Time
+	// Sent is set for messages sent, and clear for messages
+	// received.
+	Sent bool
+	// Retransmission is set when a confirmable message is sent
+	// again for lack of an acknowledgement.
+	Retransmission bool
+	// Peer is the address of the other end.
+	Peer      string
+	Type      COAPType
+	Code      COAPCode
+	MessageID uint16
+	Token     []byte
+}
+
+func (e TraceEvent) String() string {
+	dir := "<-"
+	if e.Sent {
+		dir = "->"
+	}
+	if e.Retransmission {
+		dir = "=>"
+	}
+	return fmt.Sprintf("%v %v %v %v %v mid=%d token=%x",
+		e.Time.Format(time.RFC3339Nano), dir, e.Peer, e.Type, e.Code,
+		e.MessageID, e.Token)
+}
+
+// MarshalJSON encodes the event with readable names and a hex
+// token.
+func (e TraceEvent) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Time           time.Time `json:"time"`
+		Sent           bool      `json:"sent"`
+		Retransmission bool      `json:"retransmission,omitempty"`
+		Peer           string    `json:"peer"`
+		Type           string    `json:"type"`
+		Code           string    `json:"code"`
+		MessageID      uint16    `json:"mid"`
+		Token          string    `json:"token,omitempty"`
+	}{e.Time, e.Sent, e.Retransmission, e.Peer, e.Type.String(),
+		e.Code.String(), e.MessageID, hex.EncodeToString(e.Token)})
+}
+
+// A Tracer records the messages of the clients, servers and hubs it's
+// given to, for finding out why an exchange went wrong.  It can be
+// published with expvar, or served over HTTP.
+//
+// The zero value is ready to use.  A nil Tracer records nothing.
+type Tracer struct {
+	// Limit is the number of events kept; older ones are
+	// dropped.  Zero means DefaultTraceLimit.
+	Limit int
+
+	mu     sync.Mutex
+	events []TraceEvent
+}
+
+func (t *Tracer) record(sent, retransmission bool, peer net.Addr, m Message) {
+	if t == nil {
+		return
+	}
+	e := TraceEvent{
+		Time:           time.Now(),
+		Sent:           sent,
+		Retransmission: retransmission,
+		Type:           m.Type,
+		Code:           m.Code,
+		MessageID:      m.MessageID,
+		Token:          append([]byte(nil), m.Token...),
+	}
+	if peer != nil {
+		e.Peer = peer.String()
+	}
+
+	limit := t.Limit
+	if limit <= 0 {
+		limit = DefaultTraceLimit
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.events = append(t.events, e)
+	if len(t.events) > limit {
+		t.events = append(t.events[:0], t.events[len(t.events)-limit:]...)
+	}
+}
+
+// Events returns the recorded events, oldest first.
+func (t *Tracer) Events() []TraceEvent {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]TraceEvent(nil), t.events...)
+}
+
+// Exchange returns the events of the exchange with the Message ID
+// mid or the token: the request, its retransmissions, and the ACK,
+// Reset or responses that came back.
+func (t *Tracer) Exchange(mid uint16, token []byte) []TraceEvent {
+	var rv []TraceEvent
+	for _, e := range t.Events() {
+		if e.MessageID == mid || (len(token) > 0 && bytes.Equal(e.Token, token)) {
+			rv = append(rv, e)
+		}
+	}
+	return rv
+}
+
+// String returns the events as a JSON array, so a Tracer is an
+// expvar.Var.
+func (t *Tracer) String() string {
+	events := t.Events()
+	if events == nil {
+		events = []TraceEvent{}
+	}
+	b, err := json.Marshal(events)
+	if err != nil {
+		return "[]"
+	}
+	return string(b)
+}
+
+// ServeHTTP writes the events as a JSON array.
+func (t *Tracer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintln(w, t.String())
+}
@@ -0,0 +1,76 @@
+package coap
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTracerExchange(t *testing.T) {
+	var ctr, str Tracer
+	s := &Server{Handler: FuncHandler(contentHandler), Tracer: &str}
+	l, addr := startUDPLisenter(t)
+	defer l.Close()
+	go s.Serve(l)
+
+	d := Dialer{Tracer: &ctr}
+	c, err := d.Dial("udp", addr)
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	defer c.Close()
+
+	req := Message{Type: Confirmable, Code: GET, MessageID: 77, Token: []byte("tok")}
+	if _, err := c.Send(req); err != nil {
+		t.Fatalf("Error sending: %v", err)
+	}
+	time.Sleep(10 * time.Millisecond) // let the server record its response
+
+	for _, tr := range []*Tracer{&ctr, &str} {
+		events := tr.Exchange(77, []byte("tok"))
+		if len(events) != 2 {
+			t.Fatalf("Expected request and response, got %v", events)
+		}
+		if events[0].Type != Confirmable || events[1].Type != Acknowledgement ||
+			events[1].Code != Content || events[0].Sent == events[1].Sent {
+			t.Errorf("Unexpected exchange: %v", events)
+		}
+	}
+	if ctr.Events()[0].Peer != addr {
+		t.Errorf("Expected peer %v, got %v", addr, ctr.Events()[0].Peer)
+	}
+
+	var decoded []map[string]interface{}
+	if err := json.Unmarshal([]byte(ctr.String()), &decoded); err != nil {
+		t.Fatalf("Error decoding %s: %v", ctr.String(), err)
+	}
+	if len(decoded) != 2 || decoded[0]["token"] != "746f6b" || decoded[1]["code"] != "Content" {
+		t.Errorf("Unexpected JSON: %v", decoded)
+	}
+}
+
+func TestTracerRetransmissions(t *testing.T) {
+	defer func(d time.Duration) { ackTimeout = d }(ackTimeout)
+	ackTimeout = time.Millisecond
+
+	l, addr := startUDPLisenter(t)
+	defer l.Close()
+	a, _ := net.ResolveUDPAddr("udp", addr)
+
+	tr := Tracer{Limit: 3}
+	m := Message{Type: Confirmable, Code: Content, MessageID: 5}
+	if _, err := transmitConfirmable(l, a, m, TransmissionParams{}, telemetry{tracer: &tr}, nil); err != ErrRetransmitTimeout {
+		t.Fatalf("Expected ErrRetransmitTimeout, got %v", err)
+	}
+
+	events := tr.Events()
+	if len(events) != 3 {
+		t.Fatalf("Expected the last 3 events, got %v", events)
+	}
+	for _, e := range events {
+		if !e.Sent || !e.Retransmission {
+			t.Errorf("Expected a retransmission, got %v", e)
+		}
+	}
+}
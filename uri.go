@@ -0,0 +1,187 @@
+package coap
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// URL reconstructs the URI a request was made for from its Uri-Host,
+// Uri-Port, Uri-Path and Uri-Query options (RFC 7252 section 6.5).
+// local is the address the request was received on; it supplies the
+// host and port the options leave out, and picks coap+tcp for
+// requests that came over TCP.
+func (m Message) URL(local net.Addr) *url.URL {
+	u := &url.URL{Scheme: "coap"}
+
+	var ip net.IP
+	port := DefaultPort
+	switch a := local.(type) {
+	case *net.UDPAddr:
+		ip, port = a.IP, a.Port
+	case *net.TCPAddr:
+		u.Scheme = "coap+tcp"
+		ip, port = a.IP, a.Port
+	}
+
+	host := ""
+	if ip != nil {
+		host = ip.String()
+	}
+	if h, ok := m.Option(URIHost).(string); ok {
+		host = h
+	}
+	if v := m.Option(URIPort); v != nil {
+		b, _ := option{URIPort, v}.toBytes()
+		port = int(decodeInt(b))
+	}
+
+	if port != DefaultPort {
+		u.Host = net.JoinHostPort(host, strconv.Itoa(port))
+	} else if strings.Contains(host, ":") {
+		u.Host = "[" + host + "]"
+	} else {
+		u.Host = host
+	}
+
+	u.Path = "/" + strings.Join(m.Path(), "/")
+	u.RawPath = m.EscapedPath()
+	u.RawQuery = m.EscapedQuery()
+
+	return u
+}
+
+// NewRequestFromURL makes a confirmable request with the given method
+// for the coap, coaps, coap+tcp or coaps+tcp URL rawurl, setting the
+// Uri-Host, Uri-Port, Uri-Path and Uri-Query options (RFC 7252
+// section 6.4).  Uri-Host is left out for IP literals, and Uri-Port
+// for the scheme's default port, since the request's destination
+// gives them.
+func NewRequestFromURL(method COAPCode, rawurl string) (Message, error) {
+	if !isRequest(method) {
+		return Message{}, fmt.Errorf("coap: %v is not a request method", method)
+	}
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return Message{}, err
+	}
+	port := DefaultPort
+	switch u.Scheme {
+	case "coap", "coap+tcp":
+	case "coaps", "coaps+tcp":
+		port = DefaultSecurePort
+	default:
+		return Message{}, fmt.Errorf("coap: unsupported URL scheme %q", u.Scheme)
+	}
+	if u.Fragment != "" || u.Host == "" {
+		return Message{}, fmt.Errorf("coap: invalid request URL %q", rawurl)
+	}
+
+	m := Message{Type: Confirmable, Code: method}
+	host := u.Hostname()
+	if net.ParseIP(strings.SplitN(host, "%", 2)[0]) == nil {
+		m.SetOption(URIHost, strings.ToLower(host))
+	}
+	if p := u.Port(); p != "" {
+		n, err := strconv.ParseUint(p, 10, 16)
+		if err != nil {
+			return Message{}, fmt.Errorf("coap: invalid port in %q", rawurl)
+		}
+		if int(n) != port {
+			m.SetOption(URIPort, uint32(n))
+		}
+	}
+	if err := m.SetEscapedPath(u.EscapedPath()); err != nil {
+		return Message{}, err
+	}
+	if err := m.SetEscapedQuery(u.RawQuery); err != nil {
+		return Message{}, err
+	}
+	return m, nil
+}
+
+// EscapedPath returns the Uri-Path options as the path of a URI,
+// percent-encoding each segment (RFC 7252 section 6.5).  Unlike
+// PathString, it keeps segments containing "/" apart.
+func (m Message) EscapedPath() string {
+	path := m.Path()
+	raw := make([]string, len(path))
+	for i, seg := range path {
+		raw[i] = escapeURI(seg, "/?")
+	}
+	return "/" + strings.Join(raw, "/")
+}
+
+// SetEscapedPath replaces the Uri-Path options with the segments of
+// the percent-encoded path p (RFC 7252 section 6.4).
+func (m *Message) SetEscapedPath(p string) error {
+	var segs []string
+	if p != "" && p != "/" {
+		for _, seg := range strings.Split(strings.TrimPrefix(p, "/"), "/") {
+			s, err := url.PathUnescape(seg)
+			if err != nil {
+				return err
+			}
+			segs = append(segs, s)
+		}
+	}
+	m.SetPath(segs)
+	return nil
+}
+
+// EscapedQuery returns the Uri-Query options as the query of a URI,
+// percent-encoded and joined by "&".
+func (m Message) EscapedQuery() string {
+	var query []string
+	for _, q := range m.optionStrings(URIQuery) {
+		query = append(query, escapeURI(q, "&"))
+	}
+	return strings.Join(query, "&")
+}
+
+// SetEscapedQuery replaces the Uri-Query options with the arguments
+// of the percent-encoded query q.
+func (m *Message) SetEscapedQuery(q string) error {
+	var args []string
+	if q != "" {
+		for _, arg := range strings.Split(q, "&") {
+			s, err := url.PathUnescape(arg)
+			if err != nil {
+				return err
+			}
+			args = append(args, s)
+		}
+	}
+	m.SetOption(URIQuery, args)
+	return nil
+}
+
+// escapeURI percent-encodes s for use as a path segment or query
+// parameter, also encoding the characters in reserved.
+func escapeURI(s, reserved string) string {
+	const hex = "0123456789ABCDEF"
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if shouldEscape(c) || strings.IndexByte(reserved, c) >= 0 {
+			b.WriteByte('%')
+			b.WriteByte(hex[c>>4])
+			b.WriteByte(hex[c&0xf])
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+// shouldEscape reports whether c isn't allowed unencoded in a path
+// segment or query (RFC 3986 section 3.3 and 3.4).
+func shouldEscape(c byte) bool {
+	switch {
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		return false
+	}
+	return strings.IndexByte("-._~!$&'()*+,;=:@/?", c) < 0
+}
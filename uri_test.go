@@ -0,0 +1,136 @@
+package coap
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestMessageURL(t *testing.T) {
+	udp := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5683}
+	udp6 := &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 61616}
+	tcp := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5683}
+
+	tests := []struct {
+		local net.Addr
+		opts  []option
+		exp   string
+	}{
+		{udp, nil, "coap://192.0.2.1/"},
+		{udp6, nil, "coap://[2001:db8::1]:61616/"},
+		{tcp, nil, "coap+tcp://192.0.2.1/"},
+		{nil, []option{{URIHost, "example.net"}}, "coap://example.net/"},
+		{udp, []option{
+			{URIHost, "example.net"},
+			{URIPort, uint32(8000)},
+			{URIPath, ".well-known"},
+			{URIPath, "core"},
+		}, "coap://example.net:8000/.well-known/core"},
+		{udp, []option{
+			{URIPath, "a b"},
+			{URIPath, "c/d"},
+			{URIQuery, "rt=temp"},
+			{URIQuery, "x&y"},
+		}, "coap://192.0.2.1/a%20b/c%2Fd?rt=temp&x%26y"},
+		{udp6, []option{{URIPort, 5683}}, "coap://[2001:db8::1]/"},
+	}
+
+	for _, test := range tests {
+		m := Message{Code: GET}
+		for _, o := range test.opts {
+			m.AddOption(o.ID, o.Value)
+		}
+		if got := m.URL(test.local).String(); got != test.exp {
+			t.Errorf("Expected %v, got %v", test.exp, got)
+		}
+	}
+}
+
+func TestEscapedPathAndQuery(t *testing.T) {
+	tests := []struct {
+		path, query string
+		segs, args  []string
+	}{
+		{"/", "", nil, nil},
+		{"/a/b", "x=1", []string{"a", "b"}, []string{"x=1"}},
+		{"/a%2Fb/%C3%A9t%C3%A9", "q=a%26b&r", []string{"a/b", "été"}, []string{"q=a&b", "r"}},
+		{"/sp%20ace/", "", []string{"sp ace", ""}, nil},
+	}
+
+	for _, test := range tests {
+		var m Message
+		if err := m.SetEscapedPath(test.path); err != nil {
+			t.Errorf("Error setting path %q: %v", test.path, err)
+			continue
+		}
+		if err := m.SetEscapedQuery(test.query); err != nil {
+			t.Errorf("Error setting query %q: %v", test.query, err)
+			continue
+		}
+		if !reflect.DeepEqual(m.Path(), test.segs) ||
+			!reflect.DeepEqual(m.optionStrings(URIQuery), test.args) {
+			t.Errorf("Expected %q and %q for %q?%q, got %q and %q", test.segs, test.args,
+				test.path, test.query, m.Path(), m.optionStrings(URIQuery))
+		}
+		if p, q := m.EscapedPath(), m.EscapedQuery(); p != test.path || q != test.query {
+			t.Errorf("Expected %q?%q back, got %q?%q", test.path, test.query, p, q)
+		}
+	}
+
+	var m Message
+	if err := m.SetEscapedPath("/bad%zz"); err == nil {
+		t.Errorf("Expected an error for an invalid escape")
+	}
+}
+
+func TestNewRequestFromURL(t *testing.T) {
+	tests := []struct {
+		url  string
+		opts []Option
+		// dst is the address the request is sent to, which the
+		// URL takes IP literals from.
+		dst string
+		exp string
+	}{
+		{"coap://192.0.2.1/", nil, "192.0.2.1", "coap://192.0.2.1/"},
+		{"coap://Example.NET:61616/a%20b/c%2Fd?rt=temp&x%26y", []Option{
+			{URIHost, "example.net"},
+			{URIPort, uint32(61616)},
+			{URIPath, "a b"},
+			{URIPath, "c/d"},
+			{URIQuery, "rt=temp"},
+			{URIQuery, "x&y"},
+		}, "192.0.2.1", "coap://example.net:61616/a%20b/c%2Fd?rt=temp&x%26y"},
+		{"coap://example.net:5683/.well-known/core", []Option{
+			{URIHost, "example.net"},
+			{URIPath, ".well-known"},
+			{URIPath, "core"},
+		}, "192.0.2.1", "coap://example.net/.well-known/core"},
+		{"coaps://[2001:db8::1]:5683/", []Option{{URIPort, uint32(5683)}},
+			"2001:db8::1", "coap://[2001:db8::1]/"},
+	}
+	for _, test := range tests {
+		m, err := NewRequestFromURL(PUT, test.url)
+		if err != nil {
+			t.Errorf("%v: %v", test.url, err)
+			continue
+		}
+		if m.Code != PUT || m.Type != Confirmable || !reflect.DeepEqual(m.AllOptions(), test.opts) {
+			t.Errorf("%v: expected options %v, got %v", test.url, test.opts, m)
+		}
+		dst := &net.UDPAddr{IP: net.ParseIP(test.dst), Port: DefaultPort}
+		if got := m.URL(dst).String(); got != test.exp {
+			t.Errorf("%v: expected URL %v, got %v", test.url, test.exp, got)
+		}
+	}
+
+	for _, bad := range []string{"http://example.net/", "coap://example.net/#frag",
+		"coap:/path", "coap://example.net/%zz"} {
+		if _, err := NewRequestFromURL(GET, bad); err == nil {
+			t.Errorf("%v: expected an error", bad)
+		}
+	}
+	if _, err := NewRequestFromURL(Content, "coap://example.net/"); err == nil {
+		t.Errorf("Expected an error for a response code")
+	}
+}
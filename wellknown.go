@@ -0,0 +1,98 @@
+package coap
+
+import (
+	"net"
+	"sort"
+	"strings"
+)
+
+// wellKnownCore is the path of the resource discovery resource (RFC
+// 6690 section 4).
+const wellKnownCore = ".well-known/core"
+
+// discoveryHandler serves /.well-known/core for a ServeMux that
+// doesn't have a handler of its own for it, listing the mux's
+// resources in link-format.  A query such as ?rt=temperature only
+// lists the resources with a matching attribute, "href" matching the
+// path, and a value ending in "*" matches by prefix.
+type discoveryHandler struct {
+	mux *ServeMux
+}
+
+func (d discoveryHandler) ServeCOAP(l *net.UDPConn, a *net.UDPAddr, m *Message) *Message {
+	rv, _ := d.respond(m)
+	rv.Type = NonConfirmable
+	if m.IsConfirmable() {
+		rv.Type = Acknowledgement
+	}
+	rv.MessageID = m.MessageID
+	rv.Token = m.Token
+	return &rv
+}
+
+// ServeRequest stays quiet when a filtered multicast request matches
+// nothing, as RFC 6690 section 4.1 requires.
+func (d discoveryHandler) ServeRequest(r *Request) {
+	rv, n := d.respond(r.Msg)
+	if n == 0 && r.Group != nil && len(r.Msg.Options(URIQuery)) > 0 {
+		return
+	}
+	r.Respond(rv)
+}
+
+// respond returns the response to m and the number of links listed.
+func (d discoveryHandler) respond(m *Message) (Message, int) {
+	if m.Code != GET {
+		return Message{Code: MethodNotAllowed}, 0
+	}
+
+	var links []Link
+	d.mux.mu.RLock()
+	for _, e := range d.mux.m {
+		l := Link{Target: "/" + e.pattern, Params: e.attrs}
+		if e.pattern != wellKnownCore && !e.wild && linkMatches(l, m.optionStrings(URIQuery)) {
+			links = append(links, l)
+		}
+	}
+	d.mux.mu.RUnlock()
+	sort.Slice(links, func(i, j int) bool { return links[i].Target < links[j].Target })
+
+	rv := Message{Code: Content, Payload: []byte(FormatLinks(links))}
+	rv.SetOption(ContentFormat, AppLinkFormat)
+	return rv, len(links)
+}
+
+// linkMatches reports whether l satisfies every name=value filter of
+// a discovery query.  Attributes holding space-separated lists, such
+// as "rt", match if any of their values does.
+func linkMatches(l Link, filters []string) bool {
+	for _, f := range filters {
+		i := strings.IndexByte(f, '=')
+		if i < 0 {
+			if _, ok := l.Params[f]; !ok {
+				return false
+			}
+			continue
+		}
+		name, want := f[:i], f[i+1:]
+		values := l.Values(name)
+		if name == "href" {
+			values = []string{l.Target}
+		}
+		matched := false
+		for _, v := range values {
+			if strings.HasSuffix(want, "*") {
+				matched = strings.HasPrefix(v, want[:len(want)-1])
+			} else {
+				matched = v == want
+			}
+			if matched {
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,74 @@
+package coap
+
+import (
+	"net"
+	"testing"
+)
+
+func TestWellKnownCore(t *testing.T) {
+	nop := FuncHandler(func(l *net.UDPConn, a *net.UDPAddr, m *Message) *Message {
+		return nil
+	})
+	mux := NewServeMux()
+	mux.HandleResource("/sensors/temp", nop, map[string]string{
+		"rt": "temperature-c", "if": "sensor", "ct": "0",
+	})
+	mux.HandleResource("/sensors/light", nop, map[string]string{
+		"rt": "light-lux core.s", "title": `Light "lux"`, "obs": "",
+	})
+	mux.Handle("/firmware", nop)
+
+	l, addr := startUDPLisenter(t)
+	defer l.Close()
+	go Serve(l, mux)
+
+	tests := []struct {
+		query []string
+		exp   string
+	}{
+		{nil, `</firmware>,` +
+			`</sensors/light>;obs;rt="light-lux core.s";title="Light \"lux\"",` +
+			`</sensors/temp>;ct=0;if="sensor";rt="temperature-c"`},
+		{[]string{"rt=temperature-c"}, `</sensors/temp>;ct=0;if="sensor";rt="temperature-c"`},
+		{[]string{"rt=core.s"}, `</sensors/light>;obs;rt="light-lux core.s";title="Light \"lux\""`},
+		{[]string{"rt=light*"}, `</sensors/light>;obs;rt="light-lux core.s";title="Light \"lux\""`},
+		{[]string{"href=/sensors/*", "if=sensor"}, `</sensors/temp>;ct=0;if="sensor";rt="temperature-c"`},
+		{[]string{"obs"}, `</sensors/light>;obs;rt="light-lux core.s";title="Light \"lux\""`},
+		{[]string{"rt=humidity"}, ``},
+	}
+	for i, test := range tests {
+		req := Message{Type: Confirmable, Code: GET, MessageID: uint16(i)}
+		req.SetPathString("/.well-known/core")
+		for _, q := range test.query {
+			req.AddOption(URIQuery, q)
+		}
+		rv := dialAndSend(t, addr, req)
+		if rv.Code != Content || rv.Option(ContentFormat) != AppLinkFormat {
+			t.Errorf("%v: unexpected response %v", test.query, rv)
+		}
+		if string(rv.Payload) != test.exp {
+			t.Errorf("%v: expected\n%s\ngot\n%s", test.query, test.exp, rv.Payload)
+		}
+		if test.query == nil {
+			links, err := ParseLinks(string(rv.Payload))
+			if err != nil || len(links) != 3 || links[1].Params["title"] != `Light "lux"` {
+				t.Errorf("Error parsing %s: %v, %v", rv.Payload, links, err)
+			}
+		}
+	}
+
+	req := Message{Type: Confirmable, Code: POST, MessageID: 99}
+	req.SetPathString("/.well-known/core")
+	if rv := dialAndSend(t, addr, req); rv.Code != MethodNotAllowed {
+		t.Errorf("Expected MethodNotAllowed for POST, got %v", rv.Code)
+	}
+
+	own := NewServeMux()
+	own.HandleFunc("/.well-known/core", func(l *net.UDPConn, a *net.UDPAddr, m *Message) *Message {
+		return &Message{Type: Acknowledgement, Code: Content, Payload: []byte("mine")}
+	})
+	req.Code = GET
+	if rv := own.ServeCOAP(nil, nil, &req); rv == nil || string(rv.Payload) != "mine" {
+		t.Errorf("Expected the registered handler to be used, got %v", rv)
+	}
+}